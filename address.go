@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+// unix socket的地址为unix:///path，其他地址按tcp的host:port处理
+const unixScheme = "unix://"
+
+func unixPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// dialSocket 按地址连接tcp或unix socket
+func dialSocket(addr string, timeout time.Duration) (net.Conn, error) {
+	if path, ok := unixPath(addr); ok {
+		return net.DialTimeout("unix", path, timeout)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// socket proxy的地址，配置了address时优先使用
+func proxyAddress(pxyCfg *config.ProxyCfg) string {
+	if pxyCfg.Address != "" {
+		return pxyCfg.Address
+	}
+	return net.JoinHostPort(pxyCfg.Host, strconv.Itoa(pxyCfg.Port))
+}
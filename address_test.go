@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hostctl_proxy/internal/config"
+)
+
+// 留下socket文件的监听，模拟没有清理就退出的app
+func leaveSocket(t *testing.T, path string) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+}
+
+func TestAllocateUnixCleanup(t *testing.T) {
+	m := NewPortsManager()
+	path := filepath.Join(t.TempDir(), "app.sock")
+	cfg := &config.AppCfg{Address: unixScheme + path}
+
+	// 上次遗留的socket文件在分配时删除，app才能监听
+	leaveSocket(t, path)
+	alloc, err := m.Allocate("a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Mode != PortModeUnix || alloc.Path != path || alloc.Url() != unixScheme+path {
+		t.Errorf("alloc = %+v", alloc)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale socket was not removed: %v", err)
+	}
+	if _, err := m.Allocate("b", cfg); !errors.Is(err, ErrPortUnavailable) {
+		t.Errorf("path of another app: %v, want ErrPortUnavailable", err)
+	}
+
+	// app退出后没有删除的socket文件在释放时删除
+	leaveSocket(t, path)
+	m.Deregister("a")
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket was not removed on Deregister: %v", err)
+	}
+
+	// 不是socket的文件不能删除
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Allocate("a", cfg); !errors.Is(err, ErrPortUnavailable) {
+		t.Errorf("regular file: %v, want ErrPortUnavailable", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
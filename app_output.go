@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	defaultOutputLines = 1000
+	// 每个watcher最多收集的输出
+	maxWatchBuffer = 1 << 20
+	// 没有换行的输出超过这个长度时作为一行保存
+	maxOutputLine = 4 << 10
+)
+
+// AppOutput 保存app最近的输出，按行存储
+// 作为app的Stdout/Stderr使用
+type AppOutput struct {
+	mu       sync.Mutex
+	lines    []string
+	max      int
+	partial  []byte
+	watchers map[*OutputWatcher]bool
+}
+
+// OutputWatcher 收集Watch之后app的原始输出
+type OutputWatcher struct {
+	mu     sync.Mutex
+	buf    []byte
+	notify chan struct{}
+}
+
+func (w *OutputWatcher) write(p []byte) {
+	w.mu.Lock()
+	if n := maxWatchBuffer - len(w.buf); n > 0 {
+		if len(p) > n {
+			p = p[:n]
+		}
+		w.buf = append(w.buf, p...)
+	}
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Bytes 返回目前收集到的输出
+func (w *OutputWatcher) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.buf...)
+}
+
+// Notify 有新的输出时收到通知
+func (w *OutputWatcher) Notify() <-chan struct{} {
+	return w.notify
+}
+
+func NewAppOutput(max int) *AppOutput {
+	return &AppOutput{
+		lines: make([]string, 0, max),
+		max:   max,
+	}
+}
+
+func (o *AppOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for w := range o.watchers {
+		w.write(p)
+	}
+	data := append(o.partial, p...)
+	for {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 && i <= maxOutputLine {
+			o.append(string(bytes.TrimRight(data[:i], "\r")))
+			data = data[i+1:]
+			continue
+		}
+		if len(data) < maxOutputLine {
+			break
+		}
+		// 进度条和二进制输出可能一直没有换行，不在utf8字符中间截断
+		n := maxOutputLine
+		for k := 0; k < utf8.UTFMax-1 && !utf8.RuneStart(data[n]); k++ {
+			n--
+		}
+		o.append(string(data[:n]))
+		data = data[n:]
+	}
+	o.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (o *AppOutput) append(line string) {
+	if len(o.lines) >= o.max {
+		copy(o.lines, o.lines[1:])
+		o.lines = o.lines[:len(o.lines)-1]
+	}
+	o.lines = append(o.lines, line)
+}
+
+// Watch 开始收集app的输出，用完后需要Unwatch
+func (o *AppOutput) Watch() *OutputWatcher {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w := &OutputWatcher{notify: make(chan struct{}, 1)}
+	if o.watchers == nil {
+		o.watchers = make(map[*OutputWatcher]bool)
+	}
+	o.watchers[w] = true
+	return w
+}
+
+func (o *AppOutput) Unwatch(w *OutputWatcher) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.watchers, w)
+}
+
+// Tail 返回最后n行，n<=0时返回全部
+func (o *AppOutput) Tail(n int) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n <= 0 || n > len(o.lines) {
+		n = len(o.lines)
+	}
+	tail := make([]string, n)
+	copy(tail, o.lines[len(o.lines)-n:])
+	return tail
+}
+
+type OutputManager struct {
+	rl      sync.RWMutex
+	outputs map[string]*AppOutput
+}
+
+func NewOutputManager() *OutputManager {
+	return &OutputManager{
+		outputs: make(map[string]*AppOutput),
+	}
+}
+
+// Get 获取app的输出，不存在时新建
+func (m *OutputManager) Get(name string) *AppOutput {
+	m.rl.RLock()
+	o, ok := m.outputs[name]
+	m.rl.RUnlock()
+	if ok {
+		return o
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if o, ok = m.outputs[name]; !ok {
+		o = NewAppOutput(defaultOutputLines)
+		m.outputs[name] = o
+	}
+	return o
+}
+
+func (m *OutputManager) Exists(name string) bool {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	_, ok := m.outputs[name]
+	return ok
+}
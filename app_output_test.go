@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAppOutputLines(t *testing.T) {
+	o := NewAppOutput(3)
+	for _, chunk := range []string{"a\r\nb", "c\n", "\n", "d\ne\n", "partial"} {
+		o.Write([]byte(chunk))
+	}
+	if got := strings.Join(o.Tail(0), "|"); got != "|d|e" {
+		t.Errorf("Tail(0) = %q", got)
+	}
+	if got := strings.Join(o.Tail(1), "|"); got != "e" {
+		t.Errorf("Tail(1) = %q", got)
+	}
+	o.Write([]byte("\n"))
+	if got := strings.Join(o.Tail(1), "|"); got != "partial" {
+		t.Errorf("Tail(1) = %q", got)
+	}
+}
+
+// 没有换行的输出按maxOutputLine分成多行
+func TestAppOutputLongLine(t *testing.T) {
+	o := NewAppOutput(10)
+	for i := 0; i < 10; i++ {
+		o.Write([]byte(strings.Repeat("x", 1000)))
+	}
+	if lines := o.Tail(0); len(lines) != 2 || len(lines[0]) != maxOutputLine || len(lines[1]) != maxOutputLine {
+		t.Fatalf("got %d lines", len(lines))
+	}
+	if n := len(o.partial); n != 10000-2*maxOutputLine {
+		t.Errorf("partial has %d bytes", n)
+	}
+	o.Write([]byte("\n" + strings.Repeat("y", 2*maxOutputLine+1) + "\n"))
+	lines := o.Tail(0)
+	if len(lines) != 6 || len(lines[2]) != 10000-2*maxOutputLine || len(lines[5]) != 1 {
+		t.Errorf("got %d lines", len(lines))
+	}
+
+	// 截断的位置不能在多字节字符中间
+	o = NewAppOutput(10)
+	o.Write([]byte("a" + strings.Repeat("中", maxOutputLine/3+1)))
+	for _, line := range o.Tail(0) {
+		if !strings.HasSuffix(line, "中") {
+			t.Errorf("line of %d bytes ends in the middle of a character", len(line))
+		}
+	}
+}
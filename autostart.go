@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+)
+
+const (
+	AutostartPending  = "pending"
+	AutostartStarting = "starting"
+	AutostartStarted  = "started"
+	AutostartFailed   = "failed"
+	AutostartCanceled = "canceled"
+)
+
+type AutostartResult struct {
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// AutostartManager 在服务启动时启动autostart的app，并记录启动结果
+// 启动失败只记录，不影响服务运行
+type AutostartManager struct {
+	rl      sync.RWMutex
+	results map[string]*AutostartResult
+	stopC   chan struct{}
+	once    sync.Once
+}
+
+func NewAutostartManager() *AutostartManager {
+	return &AutostartManager{
+		results: make(map[string]*AutostartResult),
+		stopC:   make(chan struct{}),
+	}
+}
+
+func (m *AutostartManager) set(name, state string, err error) {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	res := &AutostartResult{State: state, Time: time.Now()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	m.results[name] = res
+}
+
+// Results 返回每个autostart app的启动结果
+func (m *AutostartManager) Results() map[string]AutostartResult {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	results := make(map[string]AutostartResult, len(m.results))
+	for name, res := range m.results {
+		results[name] = *res
+	}
+	return results
+}
+
+// 按autostart_order从小到大排序，相同时按名称排序
+func autostartApps() []string {
+	var (
+		names  []string
+		orders = make(map[string]int)
+	)
+	for name, cfg := range serverConfig.List("app") {
+		appCfg := cfg.(*config.AppCfg)
+		if appCfg.Autostart {
+			names = append(names, name)
+			orders[name] = appCfg.AutostartOrder
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if orders[names[i]] != orders[names[j]] {
+			return orders[names[i]] < orders[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// Run 依次启动autostart的app，启动前等待autostart_delay
+// app的依赖由appManager.Start负责启动
+func (m *AutostartManager) Run() {
+	names := autostartApps()
+	for _, name := range names {
+		m.set(name, AutostartPending, nil)
+	}
+
+	for i, name := range names {
+		appCfg, ok := serverConfig.GetConfig("app", name).(*config.AppCfg)
+		if !ok {
+			m.set(name, AutostartFailed, cmdctrl.ErrMsg("ANF", name))
+			continue
+		}
+		if appCfg.AutostartDelay > 0 {
+			select {
+			case <-m.stopC:
+				for _, n := range names[i:] {
+					m.set(n, AutostartCanceled, nil)
+				}
+				return
+			case <-time.After(time.Duration(appCfg.AutostartDelay) * time.Second):
+			}
+		}
+		select {
+		case <-m.stopC:
+			for _, n := range names[i:] {
+				m.set(n, AutostartCanceled, nil)
+			}
+			return
+		default:
+		}
+
+		m.set(name, AutostartStarting, nil)
+		logger.AppLog("info", "autostarting", name, fmt.Sprintf("%s is starting", name))
+		err := appManager.Start(name)
+		// 作为其他app的依赖时可能已经启动了
+		if err != nil && !errors.Is(err, cmdctrl.ErrRunning) {
+			logger.AppLog("error", "autostarting", name, err.Error())
+			m.set(name, AutostartFailed, err)
+			continue
+		}
+		logger.AppLog("info", "autostarting", name, fmt.Sprintf("%s is started", name))
+		m.set(name, AutostartStarted, nil)
+	}
+}
+
+// Stop 取消还没开始的autostart，服务停止时使用
+func (m *AutostartManager) Stop() {
+	m.once.Do(func() {
+		close(m.stopC)
+	})
+}
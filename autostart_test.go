@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 用新的serverConfig和appManager运行autostart，apps为app名称到配置的json
+// 只有在commands中的app会加入appManager，启动时按顺序记录到started
+func newAutostartApps(t *testing.T, apps map[string]string, commands ...string) *[]string {
+	t.Helper()
+	savedConfig, savedManager := serverConfig, appManager
+	t.Cleanup(func() {
+		serverConfig, appManager = savedConfig, savedManager
+	})
+	serverConfig = config.New()
+	appManager = cmdctrl.New(len(commands))
+	for name, data := range apps {
+		if err := serverConfig.Add("app", name, []byte(data)); err != nil {
+			t.Fatalf("add %s: %v", name, err)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		started []string
+	)
+	logs := logrus.New()
+	logs.SetOutput(io.Discard)
+	for _, name := range commands {
+		name := name
+		// 进程退出都算作重试，很快用完重试次数，Start不用等到超时
+		err := appManager.Add(name, cmdctrl.CommandInfo{
+			Args:            []string{"true"},
+			RecoverDuration: time.Hour,
+			NextLaunchWait:  time.Millisecond,
+			OnStart: func(*cmdctrl.CommandInfo) error {
+				mu.Lock()
+				defer mu.Unlock()
+				started = append(started, name)
+				return nil
+			},
+			Logentry: logrus.NewEntry(logs),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &started
+}
+
+func autostartStates(m *AutostartManager) map[string]string {
+	states := make(map[string]string)
+	for name, res := range m.Results() {
+		states[name] = res.State
+	}
+	return states
+}
+
+// 按autostart_order和名称启动，启动失败不影响后面的app
+func TestAutostartOrder(t *testing.T) {
+	started := newAutostartApps(t, map[string]string{
+		"late":    `{"autostart": true, "autostart_order": 2}`,
+		"b-first": `{"autostart": true, "autostart_order": 1}`,
+		"a-first": `{"autostart": true, "autostart_order": 1}`,
+		"missing": `{"autostart": true}`,
+		"manual":  `{}`,
+	}, "late", "b-first", "a-first", "manual")
+
+	if got, want := autostartApps(), []string{"missing", "a-first", "b-first", "late"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("autostartApps() = %v, want %v", got, want)
+	}
+	m := NewAutostartManager()
+	m.Run()
+	if want := []string{"a-first", "b-first", "late"}; !reflect.DeepEqual(*started, want) {
+		t.Errorf("started %v, want %v", *started, want)
+	}
+	want := map[string]string{
+		"missing": AutostartFailed,
+		"a-first": AutostartStarted,
+		"b-first": AutostartStarted,
+		"late":    AutostartStarted,
+	}
+	if got := autostartStates(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("results %v, want %v", got, want)
+	}
+	if res := m.Results()["missing"]; res.Error == "" {
+		t.Error("missing app has no error")
+	}
+}
+
+// 停止时正在等待autostart_delay的app和之后的app都取消
+func TestAutostartStop(t *testing.T) {
+	started := newAutostartApps(t, map[string]string{
+		"now":     `{"autostart": true, "autostart_order": 1}`,
+		"delayed": `{"autostart": true, "autostart_order": 2, "autostart_delay": 60}`,
+		"after":   `{"autostart": true, "autostart_order": 3}`,
+	}, "now", "delayed", "after")
+
+	m := NewAutostartManager()
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+	waitFor(t, "first app started", func() bool {
+		return autostartStates(m)["now"] == AutostartStarted
+	})
+	m.Stop()
+	<-done
+	// 重复Stop不会panic
+	m.Stop()
+
+	if want := []string{"now"}; !reflect.DeepEqual(*started, want) {
+		t.Errorf("started %v, want %v", *started, want)
+	}
+	want := map[string]string{
+		"now":     AutostartStarted,
+		"delayed": AutostartCanceled,
+		"after":   AutostartCanceled,
+	}
+	if got := autostartStates(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("results %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,1136 @@
+// Package client 是hostctl_proxy http api的go客户端
+// 接口与openapi.json保持一致
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ExecRequest struct {
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+}
+
+type ArgsRequest struct {
+	Args []string `json:"args"`
+}
+
+type CommandRequest struct {
+	Args   []string               `json:"args,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+type ProxyRequest struct {
+	Host     string `json:"host"`
+	Port     int    `json:"Port"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// APIError 对应服务端的错误响应
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id"`
+	// 被限流或排队已满时服务端建议的重试等待时间
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d %s, request %s)", e.Message, e.Status, e.Code, e.RequestId)
+}
+
+type envelope struct {
+	Code  int             `json:"code"`
+	Data  json.RawMessage `json:"data"`
+	Error *APIError       `json:"error"`
+}
+
+type Client struct {
+	BaseURL    string
+	Token      string // 服务端配置了sys.token时需要
+	HTTPClient *http.Client
+	// 访问配置了lock的app、串口和命令时携带的租约token，见Lock
+	LeaseTokens []string
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 15 * time.Minute},
+	}
+}
+
+// Do 发送请求并解析统一格式的响应，返回data字段
+// body为[]byte时原样发送，其他类型序列化成json
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body interface{}) (json.RawMessage, error) {
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("unexpected response %d: %s", resp.StatusCode, data)
+	}
+	if env.Error != nil {
+		env.Error.Status = resp.StatusCode
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			env.Error.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, env.Error
+	}
+	if resp.StatusCode >= http.StatusBadRequest || env.Code != 0 {
+		return nil, &APIError{Status: resp.StatusCode, Message: string(env.Data), RequestId: resp.Header.Get("X-Request-Id")}
+	}
+	return env.Data, nil
+}
+
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+		contentType = "application/octet-stream"
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header = c.header(req.Header)
+	return c.HTTPClient.Do(req)
+}
+
+func (c *Client) header(h http.Header) http.Header {
+	if h == nil {
+		h = http.Header{}
+	}
+	if c.Token != "" {
+		h.Set("Authorization", "Bearer "+c.Token)
+	}
+	if len(c.LeaseTokens) > 0 {
+		h.Set("X-Lease-Token", strings.Join(c.LeaseTokens, ","))
+	}
+	return h
+}
+
+// Output 从data中取出输出
+// 服务端会把能解析成json的输出直接放在data里，其他的放在data.output里
+func Output(data json.RawMessage) json.RawMessage {
+	var wrapped map[string]json.RawMessage
+	if err := json.Unmarshal(data, &wrapped); err == nil && len(wrapped) == 1 {
+		if out, ok := wrapped["output"]; ok {
+			return out
+		}
+	}
+	return data
+}
+
+// OutputString 把输出转成字符串，json字符串会去掉引号
+func OutputString(data json.RawMessage) string {
+	out := Output(data)
+	var s string
+	if err := json.Unmarshal(out, &s); err == nil {
+		return s
+	}
+	return string(out)
+}
+
+// Payload 取出link和proxy的响应内容，base64编码的响应会被解码
+func Payload(data json.RawMessage) ([]byte, error) {
+	var encoded struct {
+		Output   string `json:"output"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(data, &encoded); err == nil && encoded.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(encoded.Output)
+	}
+	return []byte(OutputString(data)), nil
+}
+
+func (c *Client) doString(ctx context.Context, method, path string, query url.Values, body interface{}) (string, error) {
+	data, err := c.Do(ctx, method, path, query, body)
+	if err != nil {
+		return "", err
+	}
+	return OutputString(data), nil
+}
+
+func appQuery(name string) url.Values {
+	return url.Values{"name": {name}}
+}
+
+func (c *Client) Ping(ctx context.Context) (string, error) {
+	return c.doString(ctx, http.MethodGet, "/", nil, nil)
+}
+
+// OpenAPI 获取服务端的openapi文档
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/openapi.json", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &APIError{Status: resp.StatusCode, Message: resp.Status}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// List 列出配置，components为app、command，其他值返回全部
+func (c *Client) List(ctx context.Context, components string) (map[string]json.RawMessage, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/list/"+url.PathEscape(components), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(Output(data), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func configPath(field, name string) string {
+	return "/configure/" + url.PathEscape(field) + "/" + url.PathEscape(name)
+}
+
+// DumpConfig 让服务端把当前配置写回config.json
+func (c *Client) DumpConfig(ctx context.Context) error {
+	_, err := c.Do(ctx, http.MethodPut, "/configure", nil, nil)
+	return err
+}
+
+// GetConfig 获取配置，结果解析到out中
+func (c *Client) GetConfig(ctx context.Context, field, name string, out interface{}) error {
+	data, err := c.Do(ctx, http.MethodGet, configPath(field, name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(Output(data), out)
+}
+
+func (c *Client) AddConfig(ctx context.Context, field, name string, cfg interface{}) error {
+	_, err := c.Do(ctx, http.MethodPost, configPath(field, name), nil, cfg)
+	return err
+}
+
+func (c *Client) ModifyConfig(ctx context.Context, field, name string, cfg interface{}) error {
+	_, err := c.Do(ctx, http.MethodPut, configPath(field, name), nil, cfg)
+	return err
+}
+
+func (c *Client) DeleteConfig(ctx context.Context, field, name string) error {
+	_, err := c.Do(ctx, http.MethodDelete, configPath(field, name), nil, nil)
+	return err
+}
+
+// Exec 在服务端执行shell命令
+func (c *Client) Exec(ctx context.Context, cmd string, args ...string) (string, error) {
+	return c.doString(ctx, http.MethodPost, "/exec", nil, ExecRequest{Cmd: cmd, Args: args})
+}
+
+// RunCommand 执行配置好的命令，args为空时使用default_args
+func (c *Client) RunCommand(ctx context.Context, name string, args ...string) (string, error) {
+	return c.doString(ctx, http.MethodPost, "/command/"+url.PathEscape(name), nil, ArgsRequest{Args: args})
+}
+
+// RunCommandParams 执行带参数模板的命令，没有传的参数使用默认值
+func (c *Client) RunCommandParams(ctx context.Context, name string, params map[string]interface{}) (string, error) {
+	return c.doString(ctx, http.MethodPost, "/command/"+url.PathEscape(name), nil, CommandRequest{Params: params})
+}
+
+// CommandConfig 通过AddConfig(ctx, "command", name, cfg)添加
+// 配置了Template时不经过shell运行，调用时使用Params
+type CommandConfig struct {
+	Cmd         string                  `json:"cmd"`
+	DefaultArgs []string                `json:"default_args,omitempty"`
+	Template    string                  `json:"template,omitempty"`
+	Params      map[string]*ParamConfig `json:"params,omitempty"`
+}
+
+// ParamConfig 命令参数，Default为nil时必须传
+type ParamConfig struct {
+	Type        string      `json:"type,omitempty"` // string、int、float、bool或enum
+	Default     interface{} `json:"default,omitempty"`
+	Enum        []string    `json:"enum,omitempty"`
+	Pattern     string      `json:"pattern,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Description string      `json:"description,omitempty"`
+	AllowDash   bool        `json:"allow_dash,omitempty"`
+}
+
+func (c *Client) AppStatus(ctx context.Context, name string) (string, error) {
+	return c.doString(ctx, http.MethodGet, "/app/status", appQuery(name), nil)
+}
+
+type AutostartResult struct {
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+type HubClient struct {
+	Id       int64     `json:"id"`
+	Remote   string    `json:"remote"`
+	Mode     string    `json:"mode"`
+	Observer bool      `json:"observer"`
+	Since    time.Time `json:"since"`
+}
+
+type HubStatus struct {
+	App        string      `json:"app"`
+	Url        string      `json:"url"`
+	Framing    bool        `json:"framing"`
+	WriteMode  string      `json:"write_mode"`
+	Controller int64       `json:"controller,omitempty"`
+	Created    time.Time   `json:"created"`
+	Clients    []HubClient `json:"clients"`
+}
+
+// AppClients 获取连接到app的websocket客户端
+func (c *Client) AppClients(ctx context.Context, name string) (*HubStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/app/clients", appQuery(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	var status HubStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// TtyMessage pty app终端的控制消息，type为input或resize
+type TtyMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+type TtyStatus struct {
+	App     string      `json:"app"`
+	Cols    int         `json:"cols"`
+	Rows    int         `json:"rows"`
+	Writer  int64       `json:"writer,omitempty"`
+	Created time.Time   `json:"created"`
+	Clients []HubClient `json:"clients"`
+}
+
+// TtyStatus 获取pty app终端的大小和连接的客户端
+func (c *Client) TtyStatus(ctx context.Context, name string) (*TtyStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/app/tty/"+url.PathEscape(name)+"/status", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var status TtyStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// PortAlloc socket app当前使用的端口
+type PortAlloc struct {
+	App   string    `json:"app"`
+	Port  int       `json:"port"`
+	Path  string    `json:"path,omitempty"` // unix socket的路径
+	Mode  string    `json:"mode"`
+	Since time.Time `json:"since"`
+}
+
+// Ports 获取所有socket app当前使用的端口
+func (c *Client) Ports(ctx context.Context) ([]PortAlloc, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/ports", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ports []PortAlloc
+	if err := json.Unmarshal(Output(data), &ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// Autostart 获取autostart的启动结果，key为app名称
+func (c *Client) Autostart(ctx context.Context) (map[string]AutostartResult, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/app/autostart", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]AutostartResult)
+	if err := json.Unmarshal(Output(data), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AppLogs 获取app最后lines行输出，lines<=0时返回全部
+func (c *Client) AppLogs(ctx context.Context, name string, lines int) ([]string, error) {
+	query := appQuery(name)
+	if lines > 0 {
+		query.Set("lines", strconv.Itoa(lines))
+	}
+	data, err := c.Do(ctx, http.MethodGet, "/app/logs", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var logs []string
+	if err := json.Unmarshal(Output(data), &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// StartApp 启动app，args为空时使用default_args
+func (c *Client) StartApp(ctx context.Context, name string, args ...string) error {
+	_, err := c.Do(ctx, http.MethodPost, "/app/control", appQuery(name), ArgsRequest{Args: args})
+	return err
+}
+
+func (c *Client) StopApp(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, http.MethodDelete, "/app/control", appQuery(name), nil)
+	return err
+}
+
+// GroupMember 是group状态中的一项，按启动顺序排列
+type GroupMember struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Member  bool   `json:"member"` // false表示只是group成员的依赖
+}
+
+func (c *Client) GroupStatus(ctx context.Context, group string) ([]GroupMember, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/group/"+url.PathEscape(group), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var members []GroupMember
+	if err := json.Unmarshal(Output(data), &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// StartGroup 按依赖顺序启动group
+func (c *Client) StartGroup(ctx context.Context, group string) error {
+	_, err := c.Do(ctx, http.MethodPost, "/group/"+url.PathEscape(group)+"/start", nil, nil)
+	return err
+}
+
+// StopGroup 按依赖逆序停止group
+func (c *Client) StopGroup(ctx context.Context, group string) error {
+	_, err := c.Do(ctx, http.MethodPost, "/group/"+url.PathEscape(group)+"/stop", nil, nil)
+	return err
+}
+
+// Link 向app的socket发送数据并返回回复
+func (c *Client) Link(ctx context.Context, name string, data []byte) (string, error) {
+	return c.LinkTimeout(ctx, name, data, 0)
+}
+
+// LinkTimeout 同Link，timeout为0时使用app的link_timeout
+func (c *Client) LinkTimeout(ctx context.Context, name string, data []byte, timeout time.Duration) (string, error) {
+	var query url.Values
+	if timeout > 0 {
+		query = url.Values{"timeout": {timeout.String()}}
+	}
+	resp, err := c.Do(ctx, http.MethodPut, "/app/link/"+url.PathEscape(name), query, data)
+	if err != nil {
+		return "", err
+	}
+	out, err := Payload(resp)
+	return string(out), err
+}
+
+// LinkBinary 以base64编码发送二进制数据，返回解码后的响应
+func (c *Client) LinkBinary(ctx context.Context, name string, data []byte, timeout time.Duration) ([]byte, error) {
+	query := url.Values{"encoding": {"base64"}}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	resp, err := c.Do(ctx, http.MethodPut, "/app/link/"+url.PathEscape(name), query, []byte(base64.StdEncoding.EncodeToString(data)))
+	if err != nil {
+		return nil, err
+	}
+	return Payload(resp)
+}
+
+// LinkOptions websocket桥接的选项
+type LinkOptions struct {
+	Mode    string // auto、text或binary，服务端发送消息使用的frame类型
+	Framing bool   // 按app的分帧收发消息
+	Observe bool   // 只读加入，输入会被丢弃
+}
+
+// ForwardStatus 端口转发的状态，没有运行时只有Name和Running
+type ForwardStatus struct {
+	Name     string    `json:"name"`
+	Running  bool      `json:"running"`
+	Protocol string    `json:"protocol,omitempty"`
+	Listen   string    `json:"listen,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Active   int64     `json:"active"`
+	Total    int64     `json:"total"`
+	Rejected int64     `json:"rejected"`
+	Failed   int64     `json:"failed"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// Forwards 获取所有端口转发的状态，key为proxy名称
+func (c *Client) Forwards(ctx context.Context) (map[string]ForwardStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/forward", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]ForwardStatus)
+	if err := json.Unmarshal(Output(data), &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (c *Client) forwardStatus(ctx context.Context, method, path string) (*ForwardStatus, error) {
+	data, err := c.Do(ctx, method, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var status ForwardStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *Client) ForwardStatus(ctx context.Context, name string) (*ForwardStatus, error) {
+	return c.forwardStatus(ctx, http.MethodGet, "/forward/"+url.PathEscape(name))
+}
+
+func (c *Client) StartForward(ctx context.Context, name string) (*ForwardStatus, error) {
+	return c.forwardStatus(ctx, http.MethodPost, "/forward/"+url.PathEscape(name)+"/start")
+}
+
+func (c *Client) StopForward(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, http.MethodPost, "/forward/"+url.PathEscape(name)+"/stop", nil, nil)
+	return err
+}
+
+// ExpectStep 先发送Send，再等待收到的数据匹配Expect正则
+type ExpectStep struct {
+	Send    string `json:"send,omitempty"`
+	Expect  string `json:"expect,omitempty"`
+	Fail    string `json:"fail,omitempty"`
+	Timeout int    `json:"timeout,omitempty"` // 毫秒
+}
+
+// ExpectRequest App和Proxy二选一，Send中的${name}替换为变量
+type ExpectRequest struct {
+	App     string            `json:"app,omitempty"`
+	Proxy   string            `json:"proxy,omitempty"`
+	Steps   []ExpectStep      `json:"steps"`
+	Vars    map[string]string `json:"vars,omitempty"`
+	Timeout int               `json:"timeout,omitempty"` // 毫秒
+}
+
+type ExpectStepResult struct {
+	Step    int               `json:"step"`
+	Send    string            `json:"send"`
+	Expect  string            `json:"expect"`
+	Output  string            `json:"output"`
+	Match   string            `json:"match"`
+	Groups  []string          `json:"groups"`
+	Capture map[string]string `json:"capture"`
+	Elapsed int64             `json:"elapsed"`
+	Error   string            `json:"error"`
+}
+
+type ExpectResult struct {
+	Ok         bool               `json:"ok"`
+	Vars       map[string]string  `json:"vars"`
+	Transcript []ExpectStepResult `json:"transcript"`
+	FailedStep int                `json:"failed_step"`
+	Error      string             `json:"error"`
+}
+
+// Expect 执行send/expect脚本，脚本失败时不返回error，见ExpectResult.Ok
+func (c *Client) Expect(ctx context.Context, req ExpectRequest) (*ExpectResult, error) {
+	data, err := c.Do(ctx, http.MethodPost, "/expect", nil, req)
+	if err != nil {
+		return nil, err
+	}
+	var res ExpectResult
+	if err := json.Unmarshal(Output(data), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// StdinRequest 写入app stdin的数据，data在前，lines每行追加\n
+// 配置Expect或Timeout时收集写入后的输出
+type StdinRequest struct {
+	Data     string   `json:"data,omitempty"`
+	Lines    []string `json:"lines,omitempty"`
+	Encoding string   `json:"encoding,omitempty"` // text或base64，同时用于data和output
+	Expect   string   `json:"expect,omitempty"`
+	Timeout  int      `json:"timeout,omitempty"` // 毫秒
+}
+
+type StdinResult struct {
+	Written int               `json:"written"`
+	Output  string            `json:"output"`
+	Matched bool              `json:"matched"`
+	Match   string            `json:"match"`
+	Groups  map[string]string `json:"groups"`
+}
+
+// WriteStdin 向运行中的app的stdin写入数据，pty app写入终端
+func (c *Client) WriteStdin(ctx context.Context, name string, req StdinRequest) (*StdinResult, error) {
+	data, err := c.Do(ctx, http.MethodPost, "/app/stdin", appQuery(name), req)
+	if err != nil {
+		return nil, err
+	}
+	var res StdinResult
+	if err := json.Unmarshal(Output(data), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ScheduleConfig 定时任务的配置，Cron和Interval二选一
+type ScheduleConfig struct {
+	Cron     string   `json:"cron,omitempty"`
+	Interval int      `json:"interval,omitempty"` // 秒
+	Action   string   `json:"action"`             // command、start、stop或restart
+	Target   string   `json:"target"`
+	Args     []string `json:"args,omitempty"`
+	Timeout  int      `json:"timeout,omitempty"` // 秒
+	Disabled bool     `json:"disabled,omitempty"`
+	// 带参数模板的命令使用的参数
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+type ScheduleRun struct {
+	Trigger  string    `json:"trigger"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // 秒
+	Ok       bool      `json:"ok"`
+	Output   string    `json:"output"`
+	Error    string    `json:"error"`
+}
+
+type ScheduleStatus struct {
+	Name    string         `json:"name"`
+	Config  ScheduleConfig `json:"config"`
+	Running bool           `json:"running"`
+	Next    *time.Time     `json:"next"`
+	Runs    int            `json:"runs"`
+	Skipped int            `json:"skipped"`
+	Last    *ScheduleRun   `json:"last"`
+	History []ScheduleRun  `json:"history"`
+}
+
+// Schedules 获取所有定时任务的状态，不包含运行记录
+func (c *Client) Schedules(ctx context.Context) ([]ScheduleStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/schedule", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []ScheduleStatus
+	if err := json.Unmarshal(Output(data), &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (c *Client) scheduleStatus(ctx context.Context, method, name string, body interface{}) (*ScheduleStatus, error) {
+	data, err := c.Do(ctx, method, "/schedule/"+url.PathEscape(name), nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var status ScheduleStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ScheduleStatus 获取定时任务的状态和最近的运行记录
+func (c *Client) ScheduleStatus(ctx context.Context, name string) (*ScheduleStatus, error) {
+	return c.scheduleStatus(ctx, http.MethodGet, name, nil)
+}
+
+// AddSchedule 新建定时任务，需要DumpConfig保存到配置文件
+func (c *Client) AddSchedule(ctx context.Context, name string, cfg ScheduleConfig) (*ScheduleStatus, error) {
+	return c.scheduleStatus(ctx, http.MethodPost, name, cfg)
+}
+
+func (c *Client) DeleteSchedule(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, http.MethodDelete, "/schedule/"+url.PathEscape(name), nil, nil)
+	return err
+}
+
+// RunSchedule 立即运行一次定时任务，运行失败时不返回error，见ScheduleRun.Ok
+func (c *Client) RunSchedule(ctx context.Context, name string) (*ScheduleRun, error) {
+	data, err := c.Do(ctx, http.MethodPost, "/schedule/"+url.PathEscape(name)+"/run", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var res ScheduleRun
+	if err := json.Unmarshal(Output(data), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// WorkflowStep 工作流的一步，type为command、app、send或wait
+type WorkflowStep struct {
+	Name            string   `json:"name,omitempty"`
+	Type            string   `json:"type"`
+	Command         string   `json:"command,omitempty"`
+	App             string   `json:"app,omitempty"`
+	Action          string   `json:"action,omitempty"` // start、stop或restart
+	Proxy           string   `json:"proxy,omitempty"`
+	Args            []string `json:"args,omitempty"`
+	Data            string   `json:"data,omitempty"`
+	Expect          string   `json:"expect,omitempty"`
+	Fail            string   `json:"fail,omitempty"`
+	Duration        int      `json:"duration,omitempty"` // 毫秒
+	Timeout         int      `json:"timeout,omitempty"`  // 毫秒
+	Retries         int      `json:"retries,omitempty"`
+	RetryDelay      int      `json:"retry_delay,omitempty"` // 毫秒
+	ContinueOnError bool     `json:"continue_on_error,omitempty"`
+	When            string   `json:"when,omitempty"` // success、failure或always
+	// 带参数模板的命令使用的参数，字符串中可以使用${var}
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// WorkflowConfig 通过AddConfig(ctx, "workflow", name, cfg)添加
+type WorkflowConfig struct {
+	Description string            `json:"description,omitempty"`
+	Vars        map[string]string `json:"vars,omitempty"`
+	Steps       []WorkflowStep    `json:"steps"`
+}
+
+type WorkflowStepResult struct {
+	Step     int        `json:"step"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	State    string     `json:"state"` // pending、running、ok、failed或skipped
+	Attempts int        `json:"attempts"`
+	Start    *time.Time `json:"start"`
+	Duration float64    `json:"duration"` // 秒
+	Output   string     `json:"output"`
+	Error    string     `json:"error"`
+}
+
+type WorkflowJob struct {
+	Id       string               `json:"id"`
+	Workflow string               `json:"workflow"`
+	State    string               `json:"state"` // running、succeeded、failed或canceled
+	Started  time.Time            `json:"started"`
+	Finished *time.Time           `json:"finished"`
+	Vars     map[string]string    `json:"vars"`
+	Steps    []WorkflowStepResult `json:"steps"`
+	Error    string               `json:"error"`
+}
+
+// Done job是否已经结束
+func (j *WorkflowJob) Done() bool {
+	return j.State != "running"
+}
+
+func decodeJob(data json.RawMessage) (*WorkflowJob, error) {
+	var job WorkflowJob
+	if err := json.Unmarshal(Output(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RunWorkflow 在后台运行工作流，vars覆盖默认值，返回刚创建的job
+func (c *Client) RunWorkflow(ctx context.Context, name string, vars map[string]string) (*WorkflowJob, error) {
+	body := map[string]interface{}{"vars": vars}
+	data, err := c.Do(ctx, http.MethodPost, "/workflow/"+url.PathEscape(name)+"/run", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(data)
+}
+
+func (c *Client) Job(ctx context.Context, id string) (*WorkflowJob, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(data)
+}
+
+// Jobs 获取最近的job，最近的在前，workflow为空时返回所有工作流的
+func (c *Client) Jobs(ctx context.Context, workflow string) ([]WorkflowJob, error) {
+	var query url.Values
+	if workflow != "" {
+		query = url.Values{"workflow": {workflow}}
+	}
+	data, err := c.Do(ctx, http.MethodGet, "/jobs", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []WorkflowJob
+	if err := json.Unmarshal(Output(data), &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	_, err := c.Do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+// WaitJob 每隔interval查询一次，直到job结束或ctx取消
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*WorkflowJob, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.Job(ctx, id)
+		if err != nil || job.Done() {
+			return job, err
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type RecordingInfo struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	App   string    `json:"app"`
+	Kind  string    `json:"kind"`
+	Url   string    `json:"url"`
+	Start time.Time `json:"start"`
+}
+
+// Recordings 列出link记录，app为空时返回全部
+func (c *Client) Recordings(ctx context.Context, app string) ([]RecordingInfo, error) {
+	var query url.Values
+	if app != "" {
+		query = url.Values{"app": {app}}
+	}
+	data, err := c.Do(ctx, http.MethodGet, "/recordings", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var infos []RecordingInfo
+	if err := json.Unmarshal(Output(data), &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// DownloadRecording 把记录文件写入w
+func (c *Client) DownloadRecording(ctx context.Context, name string, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/recordings/"+url.PathEscape(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		var env envelope
+		if json.Unmarshal(body, &env) == nil && env.Error != nil {
+			env.Error.Status = resp.StatusCode
+			return env.Error
+		}
+		return &APIError{Status: resp.StatusCode, Message: resp.Status}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *Client) DeleteRecording(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, http.MethodDelete, "/recordings/"+url.PathEscape(name), nil, nil)
+	return err
+}
+
+// HTTPProxy 通过http proxy转发请求，返回目标的原始响应，调用方负责关闭Body
+// path为目标上的路径，可以带query
+func (c *Client) HTTPProxy(ctx context.Context, name, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+"/proxy/"+url.PathEscape(name)+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header = c.header(req.Header)
+	return c.HTTPClient.Do(req)
+}
+
+// DialLink 建立到app socket的websocket桥接
+func (c *Client) DialLink(ctx context.Context, name string) (*websocket.Conn, error) {
+	return c.DialLinkWith(ctx, name, LinkOptions{})
+}
+
+func (c *Client) DialLinkWith(ctx context.Context, name string, opts LinkOptions) (*websocket.Conn, error) {
+	query := url.Values{}
+	if opts.Mode != "" {
+		query.Set("mode", opts.Mode)
+	}
+	if opts.Framing {
+		query.Set("framing", "true")
+	}
+	if opts.Observe {
+		query.Set("observe", "true")
+	}
+	return c.dialWebsocket(ctx, "/app/link/"+url.PathEscape(name), query)
+}
+
+// DialTty 连接pty app的终端，输出为binary frame
+// write为true时成为唯一的writer，输入用binary frame或TtyMessage发送
+func (c *Client) DialTty(ctx context.Context, name string, write bool) (*websocket.Conn, error) {
+	query := url.Values{}
+	if write {
+		query.Set("write", "true")
+	}
+	return c.dialWebsocket(ctx, "/app/tty/"+url.PathEscape(name), query)
+}
+
+// TtyResize 修改终端大小，只有writer可以修改
+func TtyResize(conn *websocket.Conn, cols, rows int) error {
+	return conn.WriteJSON(TtyMessage{Type: "resize", Cols: cols, Rows: rows})
+}
+
+func (c *Client) dialWebsocket(ctx context.Context, path string, query url.Values) (*websocket.Conn, error) {
+	u, err := url.Parse(c.BaseURL + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), c.header(nil))
+	if err != nil && resp != nil {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var env envelope
+		if json.Unmarshal(body, &env) == nil && env.Error != nil {
+			env.Error.Status = resp.StatusCode
+			return nil, env.Error
+		}
+	}
+	return conn, err
+}
+
+// Proxy 通过代理发送数据，name未配置时使用req中的host和port
+func (c *Client) Proxy(ctx context.Context, name string, req ProxyRequest) (string, error) {
+	data, err := c.Do(ctx, http.MethodPut, "/proxy/"+url.PathEscape(name), nil, req)
+	if err != nil {
+		return "", err
+	}
+	out, err := Payload(data)
+	return string(out), err
+}
+
+// LockRequest 申请租约，Wait大于0时被占用会排队等待
+type LockRequest struct {
+	Owner string `json:"owner"`
+	TTL   int    `json:"ttl,omitempty"`  // 秒，默认60
+	Wait  int    `json:"wait,omitempty"` // 秒
+}
+
+// Lease 资源的租约，Token只在申请时返回
+type Lease struct {
+	Resource string    `json:"resource"`
+	Owner    string    `json:"owner"`
+	Token    string    `json:"token,omitempty"`
+	TTL      int       `json:"ttl"` // 秒
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+type LockWaiter struct {
+	Owner string    `json:"owner"`
+	Since time.Time `json:"since"`
+}
+
+type LockStatus struct {
+	Resource string       `json:"resource"`
+	Holder   *Lease       `json:"holder,omitempty"`
+	Waiters  []LockWaiter `json:"waiters,omitempty"`
+}
+
+func (c *Client) lease(ctx context.Context, method, resource string, body interface{}) (*Lease, error) {
+	data, err := c.Do(ctx, method, "/locks/"+url.PathEscape(resource), nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var lease Lease
+	if err := json.Unmarshal(Output(data), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Lock 申请资源的租约，把返回的Token加到LeaseTokens后才能访问需要租约的接口
+func (c *Client) Lock(ctx context.Context, resource string, req LockRequest) (*Lease, error) {
+	return c.lease(ctx, http.MethodPost, resource, req)
+}
+
+// RenewLock 续约，ttl为0时沿用申请时的ttl
+func (c *Client) RenewLock(ctx context.Context, resource, token string, ttl int) (*Lease, error) {
+	return c.lease(ctx, http.MethodPut, resource, map[string]interface{}{"token": token, "ttl": ttl})
+}
+
+// Unlock 释放租约，force为true时不检查token
+func (c *Client) Unlock(ctx context.Context, resource, token string, force bool) error {
+	query := url.Values{}
+	if token != "" {
+		query.Set("token", token)
+	}
+	if force {
+		query.Set("force", "true")
+	}
+	_, err := c.Do(ctx, http.MethodDelete, "/locks/"+url.PathEscape(resource), query, nil)
+	return err
+}
+
+// Locks 列出被占用的资源
+func (c *Client) Locks(ctx context.Context) ([]LockStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/locks", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []LockStatus
+	if err := json.Unmarshal(Output(data), &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// LockStatus 获取资源的持有者和排队情况
+func (c *Client) LockStatus(ctx context.Context, resource string) (*LockStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/locks/"+url.PathEscape(resource), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var status LockStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// LimiterStatus 一个并发限制的状态，Limit为0表示不限制，Queue为-1表示不限制排队数
+type LimiterStatus struct {
+	Name     string `json:"name"`
+	Limit    int    `json:"limit"`
+	Queue    int    `json:"queue"`
+	Running  int    `json:"running"`
+	Waiting  int    `json:"waiting"`
+	Total    int64  `json:"total"`
+	Queued   int64  `json:"queued"`
+	Rejected int64  `json:"rejected"`
+	Timeouts int64  `json:"timeouts"`
+}
+
+type LimitStatus struct {
+	Commands     LimiterStatus     `json:"commands"`
+	PerCommand   []LimiterStatus   `json:"per_command"`
+	Links        []LimiterStatus   `json:"links"`
+	QueueTimeout int               `json:"queue_timeout"` // 毫秒
+	RateLimits   []RateLimitStatus `json:"rate_limits"`
+}
+
+// RateLimitStatus sys.rate_limits中一条规则的计数
+type RateLimitStatus struct {
+	Route   string   `json:"route"`
+	Methods []string `json:"methods,omitempty"`
+	By      string   `json:"by"`
+	Rate    float64  `json:"rate"`
+	Burst   int      `json:"burst"`
+	Clients int      `json:"clients"`
+	Allowed int64    `json:"allowed"`
+	Limited int64    `json:"limited"`
+}
+
+// Limits 获取命令和link的并发限制和排队情况
+func (c *Client) Limits(ctx context.Context) (*LimitStatus, error) {
+	data, err := c.Do(ctx, http.MethodGet, "/limits", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var status LimitStatus
+	if err := json.Unmarshal(Output(data), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Metrics 获取Prometheus文本格式的并发限制和限流计数
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/metrics", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var env envelope
+		if json.Unmarshal(body, &env) == nil && env.Error != nil {
+			env.Error.Status = resp.StatusCode
+			return "", env.Error
+		}
+		return "", &APIError{Status: resp.StatusCode, Message: resp.Status}
+	}
+	return string(body), nil
+}
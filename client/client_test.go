@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 收到的请求
+type captured struct {
+	method, path, query string
+	header              http.Header
+	body                string
+}
+
+// 记录每个请求并按respond返回响应
+func newServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*Client, *captured) {
+	t.Helper()
+	got := &captured{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*got = captured{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: string(body)}
+		respond(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL + "/"), got
+}
+
+func reply(status int, body string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	c, got := newServer(t, reply(http.StatusOK, `{"code": 0, "data": {"output": "done"}}`))
+	c.Token = "secret"
+	c.LeaseTokens = []string{"t1", "t2"}
+	out, err := c.RunCommandParams(context.Background(), "power on", map[string]interface{}{"port": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "done" {
+		t.Errorf("output = %q", out)
+	}
+	if got.method != http.MethodPost || got.path != "/command/power on" {
+		t.Errorf("request = %s %s", got.method, got.path)
+	}
+	if ct := got.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var body CommandRequest
+	if err := json.Unmarshal([]byte(got.body), &body); err != nil || body.Params["port"] != 3.0 || body.Args != nil {
+		t.Errorf("body = %s, %v", got.body, err)
+	}
+	if auth := got.header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if lease := got.header.Get("X-Lease-Token"); lease != "t1,t2" {
+		t.Errorf("X-Lease-Token = %q", lease)
+	}
+}
+
+// []byte原样发送，不序列化成json
+func TestBytesBody(t *testing.T) {
+	c, got := newServer(t, reply(http.StatusOK, `{"code": 0, "data": {"output": "pong\n"}}`))
+	out, err := c.LinkTimeout(context.Background(), "echo", []byte("ping\n"), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "pong\n" {
+		t.Errorf("output = %q", out)
+	}
+	if got.method != http.MethodPut || got.path != "/app/link/echo" || got.query != "timeout=2s" {
+		t.Errorf("request = %s %s?%s", got.method, got.path, got.query)
+	}
+	if got.body != "ping\n" {
+		t.Errorf("body = %q", got.body)
+	}
+	if ct := got.header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if auth := got.header.Get("Authorization"); auth != "" {
+		t.Errorf("Authorization without a token = %q", auth)
+	}
+}
+
+func TestBinaryPayload(t *testing.T) {
+	data := []byte{0, 1, 0xfe, 0xff}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	c, got := newServer(t, reply(http.StatusOK, `{"code": 0, "data": {"output": "`+encoded+`", "encoding": "base64"}}`))
+	out, err := c.LinkBinary(context.Background(), "dev", data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("payload = %v", out)
+	}
+	if got.query != "encoding=base64" || got.body != encoded {
+		t.Errorf("request query %q body %q", got.query, got.body)
+	}
+}
+
+// data不是output包装时原样返回
+func TestJSONData(t *testing.T) {
+	c, _ := newServer(t, reply(http.StatusOK, `{"code": 0, "data": {"web": "running", "db": "stopped"}}`))
+	list, err := c.List(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || string(list["web"]) != `"running"` {
+		t.Errorf("list = %v", list)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(http.ResponseWriter, *http.Request)
+		check   func(*testing.T, error)
+	}{
+		{"envelope", reply(http.StatusNotFound,
+			`{"code": -1, "data": {"msg": "app not found: web"}, "error": {"code": "APP_NOT_FOUND", "message": "app not found: web", "request_id": "r1"}}`),
+			func(t *testing.T, err error) {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("error %v is not an APIError", err)
+				}
+				if apiErr.Status != http.StatusNotFound || apiErr.Code != "APP_NOT_FOUND" || apiErr.RequestId != "r1" || apiErr.Message != "app not found: web" {
+					t.Errorf("error = %+v", apiErr)
+				}
+				if !strings.Contains(err.Error(), "404 APP_NOT_FOUND") {
+					t.Errorf("Error() = %q", err.Error())
+				}
+			}},
+		{"retry after", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			reply(http.StatusTooManyRequests, `{"code": -1, "error": {"code": "RATE_LIMITED", "message": "too many requests"}}`)(w, r)
+		}, func(t *testing.T, err error) {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests || apiErr.RetryAfter != 3*time.Second {
+				t.Errorf("error = %+v", err)
+			}
+		}},
+		// 没有error字段的旧格式错误
+		{"legacy", reply(http.StatusOK, `{"code": -1, "data": "failed"}`), func(t *testing.T, err error) {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Message != `"failed"` {
+				t.Errorf("error = %+v", err)
+			}
+		}},
+		{"not json", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, "bad gateway")
+		}, func(t *testing.T, err error) {
+			if err == nil || !strings.Contains(err.Error(), "unexpected response 502") {
+				t.Errorf("error = %v", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newServer(t, tt.respond)
+			_, err := c.AppStatus(context.Background(), "web")
+			tt.check(t, err)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hostctl_proxy/client"
+)
+
+// 用client访问真实的router，检查两边对响应格式的理解一致
+func TestClientRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c := client.New(srv.URL)
+	ctx := context.Background()
+
+	var cmd client.CommandConfig
+	err := c.GetConfig(ctx, "command", "roundtrip", &cmd)
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("GetConfig of a missing command = %v, want APIError", err)
+	}
+	if apiErr.Status != http.StatusNotFound || apiErr.Code != ErrCodeConfigNotFound || apiErr.RequestId == "" {
+		t.Errorf("error = %+v", apiErr)
+	}
+
+	want := client.CommandConfig{Cmd: "echo", DefaultArgs: []string{"a b"}}
+	if err := c.AddConfig(ctx, "command", "roundtrip", want); err != nil {
+		t.Fatal(err)
+	}
+	defer c.DeleteConfig(ctx, "command", "roundtrip")
+	if err := c.GetConfig(ctx, "command", "roundtrip", &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Cmd != want.Cmd || len(cmd.DefaultArgs) != 1 || cmd.DefaultArgs[0] != "a b" {
+		t.Errorf("command = %+v", cmd)
+	}
+	if err := c.AddConfig(ctx, "command", "roundtrip", want); !errors.As(err, &apiErr) || apiErr.Code != ErrCodeConfigExists {
+		t.Errorf("adding twice = %v, want %s", err, ErrCodeConfigExists)
+	}
+}
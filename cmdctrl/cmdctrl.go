@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,6 +20,7 @@ import (
 
 type CommandInfo struct {
 	Environ         []string
+	EnvironFunc     func() []string // 每次启动时调用，返回的环境变量追加到Environ之后
 	Args            []string
 	ArgsFunc        func(args ...string) ([]string, error)
 	MaxRetries      int
@@ -26,6 +28,13 @@ type CommandInfo struct {
 	RecoverDuration time.Duration
 	StopSignal      os.Signal
 	Shell           bool
+	Launch          func(*exec.Cmd) error // 自定义启动进程的方式，默认为cmd.Start
+	OpenStdin       bool                  // 启动时创建stdin管道，运行中可以通过WriteStdin写入
+
+	// 依赖的app，启动前会先启动依赖并等待ready
+	DependsOn    []string
+	ReadyCheck   func(*CommandInfo) error
+	ReadyTimeout time.Duration
 
 	OnStart func(*CommandInfo) error
 	OnStop  func(*CommandInfo)
@@ -48,6 +57,8 @@ type ProcessKeeper struct {
 	stopC      chan bool
 	runBeganAt time.Time
 	donewg     *sync.WaitGroup
+	stdin      *os.File   // stdin管道的写端，进程退出后关闭
+	stdinMu    sync.Mutex // 保证每次WriteStdin的数据连续写入
 }
 
 type CommandCtrl struct {
@@ -94,7 +105,7 @@ func (cc *CommandCtrl) Exists(name string) bool {
 
 func (cc *CommandCtrl) Add(name string, c CommandInfo) error {
 	if len(c.Args) == 0 && c.ArgsFunc == nil {
-		return fmt.Errorf("not enough length of Args, must larger than 1")
+		return ErrMsg("AIA", name)
 	}
 
 	if c.MaxRetries == 0 {
@@ -109,12 +120,15 @@ func (cc *CommandCtrl) Add(name string, c CommandInfo) error {
 	if c.StopSignal == nil {
 		c.StopSignal = syscall.SIGTERM
 	}
+	if c.ReadyTimeout == 0 {
+		c.ReadyTimeout = 30 * time.Second
+	}
 
-	cc.rl.RLock()
-	defer cc.rl.RUnlock()
+	cc.rl.Lock()
+	defer cc.rl.Unlock()
 
 	if _, exists := cc.cmds[name]; exists {
-		return fmt.Errorf("app name conflict: %s", name)
+		return ErrMsg("ANC", name)
 	}
 	cc.cmds[name] = &ProcessKeeper{
 		name:    name,
@@ -124,16 +138,16 @@ func (cc *CommandCtrl) Add(name string, c CommandInfo) error {
 }
 
 func (cc *CommandCtrl) Remove(name string) error {
-	cc.rl.RLock()
-	defer cc.rl.RUnlock()
+	cc.rl.Lock()
+	defer cc.rl.Unlock()
 
 	pkeeper, ok := cc.cmds[name]
 	if !ok {
-		return fmt.Errorf("app not found: %s ", name)
+		return ErrMsg("ANF", name)
 	}
 
-	if pkeeper.keeping {
-		return fmt.Errorf("app %s is running, stop first", name)
+	if pkeeper.isKeeping() {
+		return ErrMsg("ARN", name)
 	}
 
 	delete(cc.cmds, name)
@@ -141,12 +155,16 @@ func (cc *CommandCtrl) Remove(name string) error {
 }
 
 func (cc *CommandCtrl) Start(name string, args ...string) error {
-	cc.rl.RLock()
-	defer cc.rl.RUnlock()
-
-	pkeeper, ok := cc.cmds[name]
-	if !ok {
-		return fmt.Errorf("app not found: %s", name)
+	keepers, err := cc.keepers(name)
+	if err != nil {
+		return err
+	}
+	// 先启动依赖，已经运行的依赖只检查ready
+	pkeeper := keepers[len(keepers)-1]
+	for _, dep := range keepers[:len(keepers)-1] {
+		if err := dep.startAndWait(); err != nil {
+			return fmt.Errorf("starting dependency %s of %s: %w", dep.name, name, err)
+		}
 	}
 
 	// fmt.Printf("%v args %v\n", name, pkeeper.cmdInfo.Args)
@@ -166,12 +184,12 @@ func (cc *CommandCtrl) Start(name string, args ...string) error {
 }
 
 func (cc *CommandCtrl) Stop(name string, waits ...bool) error {
+	// 等待进程退出时不持有cc.rl
 	cc.rl.RLock()
-	defer cc.rl.RUnlock()
-
 	pkeeper, ok := cc.cmds[name]
+	cc.rl.RUnlock()
 	if !ok {
-		return fmt.Errorf("app not found: %s", name)
+		return ErrMsg("ANF", name)
 	}
 	wait := false
 	if len(waits) > 0 {
@@ -180,10 +198,49 @@ func (cc *CommandCtrl) Stop(name string, waits ...bool) error {
 	return pkeeper.stop(wait)
 }
 
-func (cc *CommandCtrl) StopAll() {
-	for _, pkeeper := range cc.cmds {
-		pkeeper.stop(true)
+// StopAll 并行停止所有运行中的app，超过timeout还没停止的app会在error中列出
+func (cc *CommandCtrl) StopAll(timeout time.Duration) error {
+	cc.rl.RLock()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		pending = make(map[string]bool)
+	)
+	for name, pkeeper := range cc.cmds {
+		if !pkeeper.isKeeping() {
+			continue
+		}
+		pending[name] = true
+		wg.Add(1)
+		go func(name string, p *ProcessKeeper) {
+			defer wg.Done()
+			p.stop(true)
+			mu.Lock()
+			delete(pending, name)
+			mu.Unlock()
+		}(name, pkeeper)
 	}
+	cc.rl.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("timeout stopping apps: %s", strings.Join(names, ", "))
 }
 
 func (cc *CommandCtrl) Restart(name string) error {
@@ -192,18 +249,20 @@ func (cc *CommandCtrl) Restart(name string) error {
 }
 
 func (cc *CommandCtrl) UpdateArgs(name string, args ...string) error {
-	cc.rl.RLock()
-	defer cc.rl.RUnlock()
-
 	if len(args) <= 0 {
-		return fmt.Errorf("not enough length of args, must larger than 1")
+		return ErrMsg("AIA", name)
 	}
+	cc.rl.RLock()
 	pkeeper, ok := cc.cmds[name]
+	cc.rl.RUnlock()
 	if !ok {
-		return fmt.Errorf("app not found: %s", name)
+		return ErrMsg("ANF", name)
 	}
+	pkeeper.mu.Lock()
 	pkeeper.cmdInfo.Args = args
-	if !pkeeper.keeping {
+	pkeeper.mu.Unlock()
+	// 重启时会等待依赖ready，不能持有cc.rl
+	if !pkeeper.isKeeping() {
 		return nil
 	}
 	return cc.Restart(name)
@@ -216,7 +275,35 @@ func (cc *CommandCtrl) Running(name string) bool {
 	if !ok {
 		return false
 	}
-	return pkeeper.keeping
+	return pkeeper.isKeeping()
+}
+
+// WriteStdin 向运行中的app的stdin写入数据，app需要配置OpenStdin
+// app不读取stdin时管道会写满，超过timeout后返回os.ErrDeadlineExceeded
+func (cc *CommandCtrl) WriteStdin(name string, data []byte, timeout time.Duration) (int, error) {
+	cc.rl.RLock()
+	pkeeper, ok := cc.cmds[name]
+	cc.rl.RUnlock()
+	if !ok {
+		return 0, ErrMsg("ANF", name)
+	}
+	if !pkeeper.cmdInfo.OpenStdin {
+		return 0, ErrMsg("ANI", name)
+	}
+	pkeeper.mu.Lock()
+	stdin := pkeeper.stdin
+	pkeeper.mu.Unlock()
+	if stdin == nil {
+		return 0, ErrMsg("ASP", name)
+	}
+
+	pkeeper.stdinMu.Lock()
+	defer pkeeper.stdinMu.Unlock()
+	if timeout > 0 {
+		// windows的管道不支持deadline，忽略错误
+		stdin.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return stdin.Write(data)
 }
 
 // func (cc *CommandCtrl) Communicate(name string, input []byte) ([]byte, error) {
@@ -268,7 +355,8 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 	if p.keeping {
 		p.mu.Unlock()
 		p.cmdInfo.Logentry.Errorf("[%s] is running\n", p.name)
-		// return ErrMsg("ARN", p.name)
+		chErr <- ErrMsg("ARN", p.name)
+		return chErr
 	}
 	p.keeping = true
 	p.stopC = make(chan bool, 1)
@@ -286,7 +374,9 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 				chErr <- startErr
 				break
 			}
+			p.mu.Lock()
 			cmdArgs := p.cmdInfo.Args
+			p.mu.Unlock()
 			if p.cmdInfo.ArgsFunc != nil {
 				var er error
 				cmdArgs, er = p.cmdInfo.ArgsFunc(args...)
@@ -304,12 +394,36 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 			}
 			p.cmd = exec.Command(cmdArgs[0], cmdArgs[1:]...)
 			p.cmd.Env = append(os.Environ(), p.cmdInfo.Environ...)
+			if p.cmdInfo.EnvironFunc != nil {
+				p.cmd.Env = append(p.cmd.Env, p.cmdInfo.EnvironFunc()...)
+			}
 			p.cmd.Stdin = p.cmdInfo.Stdin
+			var stdinR *os.File
+			if p.cmdInfo.OpenStdin {
+				var err error
+				if stdinR, err = p.openStdin(); err != nil {
+					p.cmdInfo.Logentry.Errorf("[%s] stdin pipe err: %v\n", p.name, err)
+					chErr <- err
+					goto CMD_DONE
+				}
+				p.cmd.Stdin = stdinR
+			}
 			p.cmd.Stdout = p.cmdInfo.Stdout
 			p.cmd.Stderr = p.cmdInfo.Stderr
 			// fmt.Printf("[%s] args: %v, env: %v\n", p.name, cmdArgs, p.cmdInfo.Environ)
 			p.cmdInfo.Logentry.Infof("[%s] args: %v, env: %v\n", p.name, cmdArgs, p.cmdInfo.Environ)
-			if err := p.cmd.Start(); err != nil {
+			launch := p.cmd.Start
+			if p.cmdInfo.Launch != nil {
+				launch = func() error {
+					return p.cmdInfo.Launch(p.cmd)
+				}
+			}
+			launchErr := launch()
+			if stdinR != nil {
+				// 读端已经交给子进程
+				stdinR.Close()
+			}
+			if err := launchErr; err != nil {
 				p.cmdInfo.Logentry.Errorf("[%s] app start err: %v\n", p.name, err)
 				chErr <- err
 				goto CMD_DONE
@@ -317,7 +431,9 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 			// fmt.Printf("[%s] program pid: %d\n", p.name, p.cmd.Process.Pid)
 			p.cmdInfo.Logentry.Infof("[%s] program pid: %d\n", p.name, p.cmd.Process.Pid)
 			p.runBeganAt = time.Now()
+			p.mu.Lock()
 			p.running = true
+			p.mu.Unlock()
 			cmdC := goFunc(p.cmd.Wait)
 			// fmt.Printf("cmdC is %v\n", cmdC)
 			p.cmdInfo.Logentry.Infof("[%s] cmdC is %v\n", p.name, cmdC)
@@ -338,9 +454,12 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 				goto CMD_DONE
 			}
 		CMD_IDLE:
+			p.closeStdin()
 			// fmt.Printf("[%s] idle for %v\n", p.name, p.cmdInfo.NextLaunchWait)
 			p.cmdInfo.Logentry.Infof("[%s] idle for %v\n", p.name, p.cmdInfo.NextLaunchWait)
+			p.mu.Lock()
 			p.running = false
+			p.mu.Unlock()
 			select {
 			case <-p.stopC:
 				goto CMD_DONE
@@ -349,6 +468,7 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 			}
 		}
 	CMD_DONE:
+		p.closeStdin()
 		// fmt.Printf("[%s] program finished\n", p.name)
 		p.cmdInfo.Logentry.Infof("[%s] program finished\n", p.name)
 		if p.cmdInfo.OnStop != nil {
@@ -363,6 +483,34 @@ func (p *ProcessKeeper) start(args ...string) chan error {
 	return chErr
 }
 
+// keeping和running由进程的goroutine修改，读取时需要持有p.mu
+func (p *ProcessKeeper) isKeeping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keeping
+}
+
+// 创建stdin管道，读端交给进程，写端保存在p.stdin
+func (p *ProcessKeeper) openStdin() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.stdin = w
+	p.mu.Unlock()
+	return r, nil
+}
+
+func (p *ProcessKeeper) closeStdin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stdin != nil {
+		p.stdin.Close()
+		p.stdin = nil
+	}
+}
+
 func (p *ProcessKeeper) terminate(cmdC chan error) {
 	if runtime.GOOS == "windows" {
 		if p.cmd.Process != nil {
@@ -390,7 +538,7 @@ func (p *ProcessKeeper) stop(wait bool) error {
 	if !p.keeping {
 		p.mu.Unlock()
 		p.cmdInfo.Logentry.Errorf("[%s] is already stopped", p.name)
-		return fmt.Errorf("[%s] is already stopped", p.name)
+		return ErrMsg("ASP", p.name)
 	}
 	select {
 	case p.stopC <- true:
@@ -0,0 +1,165 @@
+package cmdctrl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const readyPollInterval = 200 * time.Millisecond
+
+// 按依赖关系排序，被依赖的app排在前面
+// 结果包含names的所有依赖，调用前需要持有cc.rl
+func (cc *CommandCtrl) order(names ...string) ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	var (
+		sorted []string
+		state  = make(map[string]int)
+		visit  func(name string, path []string) error
+	)
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("%w: %v", ErrDependencyCycle, append(path, name))
+		}
+		pkeeper, ok := cc.cmds[name]
+		if !ok {
+			return ErrMsg("ANF", name)
+		}
+		state[name] = visiting
+		path = append(append([]string{}, path...), name)
+		for _, dep := range pkeeper.cmdInfo.DependsOn {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// Order 返回names及其依赖的启动顺序
+func (cc *CommandCtrl) Order(names ...string) ([]string, error) {
+	cc.rl.RLock()
+	defer cc.rl.RUnlock()
+	return cc.order(names...)
+}
+
+// 按启动顺序返回names及其依赖的ProcessKeeper
+// 启动和停止时只在这里持有cc.rl，等待ready或进程退出时不阻塞配置的修改
+func (cc *CommandCtrl) keepers(names ...string) ([]*ProcessKeeper, error) {
+	cc.rl.RLock()
+	defer cc.rl.RUnlock()
+	order, err := cc.order(names...)
+	if err != nil {
+		return nil, err
+	}
+	keepers := make([]*ProcessKeeper, len(order))
+	for i, name := range order {
+		keepers[i] = cc.cmds[name]
+	}
+	return keepers, nil
+}
+
+// 启动app并等待ready，已经运行的app只检查ready
+func (p *ProcessKeeper) startAndWait(args ...string) error {
+	var chErr chan error
+	if !p.isKeeping() {
+		if p.cmdInfo.OnStart != nil {
+			if err := p.cmdInfo.OnStart(&p.cmdInfo); err != nil {
+				return err
+			}
+		}
+		chErr = p.start(args...)
+	}
+
+	deadline := time.After(p.cmdInfo.ReadyTimeout)
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-chErr:
+			if errors.Is(err, ErrRunning) {
+				// 同时被其他请求启动，继续等待ready
+				chErr = nil
+				continue
+			}
+			if err == nil {
+				err = ErrMsg("ASP", p.name)
+			}
+			return err
+		case <-deadline:
+			return ErrMsg("ANR", p.name)
+		case <-ticker.C:
+			if p.ready() {
+				p.cmdInfo.Logentry.Infof("[%s] is ready\n", p.name)
+				return nil
+			}
+		}
+	}
+}
+
+// StartGroup 按依赖顺序启动一组app及其依赖，每个app ready后再启动下一个
+func (cc *CommandCtrl) StartGroup(names ...string) error {
+	keepers, err := cc.keepers(names...)
+	if err != nil {
+		return err
+	}
+	for _, p := range keepers {
+		if err := p.startAndWait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopGroup 按依赖的逆序停止一组app，依赖不会被停止
+func (cc *CommandCtrl) StopGroup(names ...string) ([]string, error) {
+	keepers, err := cc.keepers(names...)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool, len(names))
+	for _, name := range names {
+		members[name] = true
+	}
+
+	var stopped []string
+	for i := len(keepers) - 1; i >= 0; i-- {
+		p := keepers[i]
+		if !members[p.name] || !p.isKeeping() {
+			continue
+		}
+		if err := p.stop(true); err != nil {
+			return stopped, err
+		}
+		stopped = append(stopped, p.name)
+	}
+	return stopped, nil
+}
+
+func (p *ProcessKeeper) ready() bool {
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+	if !running {
+		return false
+	}
+	if p.cmdInfo.ReadyCheck == nil {
+		return true
+	}
+	return p.cmdInfo.ReadyCheck(&p.cmdInfo) == nil
+}
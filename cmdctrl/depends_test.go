@@ -0,0 +1,114 @@
+package cmdctrl
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newDepsCtrl(t *testing.T, deps map[string][]string) *CommandCtrl {
+	t.Helper()
+	cc := New(len(deps))
+	for name, dependsOn := range deps {
+		if err := cc.Add(name, CommandInfo{Args: []string{"true"}, DependsOn: dependsOn}); err != nil {
+			t.Fatalf("add %s: %v", name, err)
+		}
+	}
+	return cc
+}
+
+func TestOrder(t *testing.T) {
+	cc := newDepsCtrl(t, map[string][]string{
+		"db":     nil,
+		"cache":  nil,
+		"queue":  {"db"},
+		"api":    {"db", "cache"},
+		"web":    {"api", "queue"},
+		"worker": {"queue", "cache"},
+	})
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"db"}, []string{"db"}},
+		{[]string{"queue"}, []string{"db", "queue"}},
+		// 共同的依赖只出现一次
+		{[]string{"web"}, []string{"db", "cache", "api", "queue", "web"}},
+		{[]string{"worker", "web"}, []string{"db", "queue", "cache", "worker", "api", "web"}},
+		{[]string{"db", "db"}, []string{"db"}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := cc.Order(tt.names...)
+		if err != nil {
+			t.Errorf("Order(%v): %v", tt.names, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Order(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestOrderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		deps map[string][]string
+		err  error
+	}{
+		{"self", map[string][]string{"a": {"a"}}, ErrDependencyCycle},
+		{"cycle", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, ErrDependencyCycle},
+		{"cycle below", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}}, ErrDependencyCycle},
+		{"unknown", map[string][]string{"a": {"b"}, "b": {"missing"}}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, err := newDepsCtrl(t, tt.deps).Order("a")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: Order = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// 等待依赖ready时不能阻塞其他app的增删
+func TestStartWaitUnlocked(t *testing.T) {
+	cc := New(2)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	entry := logrus.NewEntry(log)
+	notReady := func(*CommandInfo) error { return errors.New("not ready") }
+	if err := cc.Add("db", CommandInfo{Args: []string{"sleep", "10"}, ReadyCheck: notReady, ReadyTimeout: 2 * time.Second, Logentry: entry}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Add("web", CommandInfo{Args: []string{"sleep", "10"}, DependsOn: []string{"db"}, Logentry: entry}); err != nil {
+		t.Fatal(err)
+	}
+	defer cc.StopAll(time.Second)
+
+	done := make(chan error, 1)
+	go func() { done <- cc.Start("web") }()
+	time.Sleep(200 * time.Millisecond)
+
+	added := make(chan error, 1)
+	go func() {
+		if err := cc.Add("other", CommandInfo{Args: []string{"true"}, Logentry: entry}); err != nil {
+			added <- err
+			return
+		}
+		added <- cc.Remove("other")
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add/Remove blocked while Start waits for a dependency")
+	}
+	if err := <-done; !errors.Is(err, ErrNotReady) {
+		t.Errorf("Start = %v, want ErrNotReady", err)
+	}
+}
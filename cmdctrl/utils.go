@@ -2,21 +2,42 @@ package cmdctrl
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"runtime"
 )
 
+var (
+	ErrNotFound        = errors.New("app not found")
+	ErrRunning         = errors.New("app is running")
+	ErrAlreadyStopped  = errors.New("app is already stopped")
+	ErrNameConflict    = errors.New("app name conflict")
+	ErrInvalidArgs     = errors.New("invalid app args")
+	ErrNotReady        = errors.New("app is not ready")
+	ErrDependencyCycle = errors.New("app dependency cycle")
+	ErrNoStdin         = errors.New("app stdin is not open")
+)
+
+// ErrMsg 根据错误类型生成带app名称的错误，可用errors.Is判断类型
 func ErrMsg(tp string, cmd string) error {
-	var msgText string
 	switch tp {
+	case "ANF":
+		return fmt.Errorf("%w: %s", ErrNotFound, cmd)
 	case "ARN":
-		msgText = "Cmd: " + cmd + " is running now"
+		return fmt.Errorf("%w: %s", ErrRunning, cmd)
 	case "ASP":
-		msgText = "Cmd: " + cmd + " is already stopped"
+		return fmt.Errorf("%w: %s", ErrAlreadyStopped, cmd)
+	case "ANC":
+		return fmt.Errorf("%w: %s", ErrNameConflict, cmd)
+	case "AIA":
+		return fmt.Errorf("%w: %s", ErrInvalidArgs, cmd)
+	case "ANR":
+		return fmt.Errorf("%w: %s", ErrNotReady, cmd)
+	case "ANI":
+		return fmt.Errorf("%w: %s", ErrNoStdin, cmd)
 	default:
-		msgText = "Unknown error"
+		return errors.New("Unknown error")
 	}
-	return errors.New(msgText)
 }
 
 func shellPath() string {
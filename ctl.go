@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"hostctl_proxy/client"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/gorilla/websocket"
+)
+
+// ctl子命令，作为客户端访问运行中的hostctl_proxy
+var (
+	ctlCmd    = kingpin.Command("ctl", "Control a running hostctl_proxy")
+	ctlServer = ctlCmd.Flag("server", "Service url").Default("http://127.0.0.1:8080").Envar("HOSTCTL_SERVER").String()
+	ctlToken  = ctlCmd.Flag("token", "Service token, same as sys.token").Envar("HOSTCTL_TOKEN").String()
+	ctlOutput = ctlCmd.Flag("output", "Output format, table or json").Short('o').Default("table").Enum("table", "json")
+	ctlLease  = ctlCmd.Flag("lease", "Lease token for apps and commands configured with lock, repeatable").Envar("HOSTCTL_LEASE").Strings()
+
+	ctlApp           = ctlCmd.Command("app", "Manage apps")
+	ctlAppList       = ctlApp.Command("list", "List apps and their status")
+	ctlAppStatus     = ctlApp.Command("status", "Show app status")
+	ctlAppStatusName = ctlAppStatus.Arg("name", "App name").Required().String()
+	ctlAppStart      = ctlApp.Command("start", "Start an app")
+	ctlAppStartName  = ctlAppStart.Arg("name", "App name").Required().String()
+	ctlAppStartArgs  = ctlAppStart.Arg("args", "App args, default_args when empty").Strings()
+	ctlAppStop       = ctlApp.Command("stop", "Stop an app")
+	ctlAppStopName   = ctlAppStop.Arg("name", "App name").Required().String()
+	ctlAppRestart    = ctlApp.Command("restart", "Restart an app")
+	ctlAppRestName   = ctlAppRestart.Arg("name", "App name").Required().String()
+	ctlAppRestArgs   = ctlAppRestart.Arg("args", "App args, default_args when empty").Strings()
+	ctlAppLogs       = ctlApp.Command("logs", "Show the latest app output")
+	ctlAppLogsName   = ctlAppLogs.Arg("name", "App name").Required().String()
+	ctlAppLogsLines  = ctlAppLogs.Flag("lines", "Number of lines, 0 for all").Short('n').Default("100").Int()
+	ctlAppClients    = ctlApp.Command("clients", "List websocket clients attached to an app")
+	ctlAppClientsN   = ctlAppClients.Arg("name", "App name").Required().String()
+	ctlAppPorts      = ctlApp.Command("ports", "List socket ports of running apps")
+	ctlAppTty        = ctlApp.Command("tty", "Attach to the terminal of a pty app, input is sent line by line")
+	ctlAppTtyName    = ctlAppTty.Arg("name", "App name").Required().String()
+	ctlAppTtyWrite   = ctlAppTty.Flag("write", "Attach as the writer, otherwise only print the output").Bool()
+	ctlAppStdin      = ctlApp.Command("stdin", "Write lines to the stdin of a running app")
+	ctlAppStdinName  = ctlAppStdin.Arg("name", "App name").Required().String()
+	ctlAppStdinLines = ctlAppStdin.Arg("lines", "Lines to write, each followed by a newline").Strings()
+	ctlAppStdinExp   = ctlAppStdin.Flag("expect", "Wait for the output to match this regular expression").String()
+	ctlAppStdinWait  = ctlAppStdin.Flag("timeout", "Collect the output for this long, or wait this long for --expect").Duration()
+
+	ctlGroup          = ctlCmd.Command("group", "Manage app groups")
+	ctlGroupStatus    = ctlGroup.Command("status", "Show group members in start order")
+	ctlGroupStatusArg = ctlGroupStatus.Arg("name", "Group name").Required().String()
+	ctlGroupStart     = ctlGroup.Command("start", "Start a group in dependency order")
+	ctlGroupStartArg  = ctlGroupStart.Arg("name", "Group name").Required().String()
+	ctlGroupStop      = ctlGroup.Command("stop", "Stop a group in reverse dependency order")
+	ctlGroupStopArg   = ctlGroupStop.Arg("name", "Group name").Required().String()
+
+	ctlCmdGroup  = ctlCmd.Command("cmd", "Run configured commands")
+	ctlCmdRun    = ctlCmdGroup.Command("run", "Run a named command")
+	ctlCmdName   = ctlCmdRun.Arg("name", "Command name").Required().String()
+	ctlCmdArgs   = ctlCmdRun.Arg("args", "Command args, default_args when empty").Strings()
+	ctlCmdParam  = ctlCmdRun.Flag("param", "Param of a templated command, name=value").StringMap()
+	ctlExec      = ctlCmd.Command("exec", "Run a shell command on the server")
+	ctlExecCmd   = ctlExec.Arg("cmd", "Command").Required().String()
+	ctlExecArgs  = ctlExec.Arg("args", "Command args").Strings()
+	ctlFwd       = ctlCmd.Command("forward", "Manage port forwards of proxies")
+	ctlFwdList   = ctlFwd.Command("list", "List port forwards and their counters")
+	ctlFwdStart  = ctlFwd.Command("start", "Start a port forward")
+	ctlFwdStartN = ctlFwdStart.Arg("name", "Proxy name").Required().String()
+	ctlFwdStop   = ctlFwd.Command("stop", "Stop a port forward")
+	ctlFwdStopN  = ctlFwdStop.Arg("name", "Proxy name").Required().String()
+	ctlSch       = ctlCmd.Command("schedule", "Manage scheduled commands and app actions, add them with config set schedule")
+	ctlSchList   = ctlSch.Command("list", "List schedules with their next and last run")
+	ctlSchStatus = ctlSch.Command("status", "Show the run history of a schedule")
+	ctlSchStatN  = ctlSchStatus.Arg("name", "Schedule name").Required().String()
+	ctlSchRun    = ctlSch.Command("run", "Run a schedule now and wait for the result")
+	ctlSchRunN   = ctlSchRun.Arg("name", "Schedule name").Required().String()
+	ctlSchDel    = ctlSch.Command("delete", "Delete a schedule")
+	ctlSchDelN   = ctlSchDel.Arg("name", "Schedule name").Required().String()
+	ctlWf        = ctlCmd.Command("workflow", "Run workflows, add them with config set workflow")
+	ctlWfList    = ctlWf.Command("list", "List configured workflows")
+	ctlWfRun     = ctlWf.Command("run", "Start a workflow job")
+	ctlWfRunN    = ctlWfRun.Arg("name", "Workflow name").Required().String()
+	ctlWfRunVar  = ctlWfRun.Flag("var", "Variable overriding the workflow default, name=value").StringMap()
+	ctlWfRunWait = ctlWfRun.Flag("wait", "Wait for the job to finish and print the step report").Bool()
+	ctlWfJobs    = ctlWf.Command("jobs", "List recent workflow jobs")
+	ctlWfJobsN   = ctlWfJobs.Flag("workflow", "Only list jobs of this workflow").String()
+	ctlWfJob     = ctlWf.Command("job", "Show the step report of a job")
+	ctlWfJobID   = ctlWfJob.Arg("id", "Job id").Required().String()
+	ctlWfCancel  = ctlWf.Command("cancel", "Cancel a running job")
+	ctlWfCancelI = ctlWfCancel.Arg("id", "Job id").Required().String()
+	ctlLimits    = ctlCmd.Command("limits", "Show concurrency limits of commands and links")
+	ctlMetrics   = ctlCmd.Command("metrics", "Show limiter and rate limit metrics in Prometheus text format")
+	ctlLock      = ctlCmd.Command("lock", "Manage exclusive leases of resources")
+	ctlLockList  = ctlLock.Command("list", "List locked resources")
+	ctlLockStat  = ctlLock.Command("status", "Show the holder and waiters of a resource")
+	ctlLockStatR = ctlLockStat.Arg("resource", "Resource name").Required().String()
+	ctlLockAcq   = ctlLock.Command("acquire", "Acquire a lease and print its token")
+	ctlLockAcqR  = ctlLockAcq.Arg("resource", "Resource name").Required().String()
+	ctlLockOwner = ctlLockAcq.Flag("owner", "Owner shown to other users, default user@host").String()
+	ctlLockTTL   = ctlLockAcq.Flag("ttl", "Lease time, renew before it expires").Default("60s").Duration()
+	ctlLockWait  = ctlLockAcq.Flag("wait", "Wait in the queue this long when the resource is locked").Duration()
+	ctlLockRenew = ctlLock.Command("renew", "Renew a lease")
+	ctlLockRenR  = ctlLockRenew.Arg("resource", "Resource name").Required().String()
+	ctlLockRenT  = ctlLockRenew.Arg("token", "Lease token").Required().String()
+	ctlLockRenL  = ctlLockRenew.Flag("ttl", "New lease time, default the acquired one").Duration()
+	ctlLockRel   = ctlLock.Command("release", "Release a lease")
+	ctlLockRelR  = ctlLockRel.Arg("resource", "Resource name").Required().String()
+	ctlLockRelT  = ctlLockRel.Arg("token", "Lease token").String()
+	ctlLockForce = ctlLockRel.Flag("force", "Release whoever holds the lease").Bool()
+	ctlRec       = ctlCmd.Command("recording", "Manage link recordings")
+	ctlRecList   = ctlRec.Command("list", "List link recordings")
+	ctlRecApp    = ctlRecList.Flag("app", "Only list recordings of this app").String()
+	ctlRecGet    = ctlRec.Command("get", "Download a link recording")
+	ctlRecGetN   = ctlRecGet.Arg("name", "Recording name").Required().String()
+	ctlRecGetF   = ctlRecGet.Flag("file", "Output file, default stdout").Short('f').String()
+	ctlRecDel    = ctlRec.Command("delete", "Delete a link recording")
+	ctlRecDelN   = ctlRecDel.Arg("name", "Recording name").Required().String()
+	ctlExpect    = ctlCmd.Command("expect", "Run a send/expect script against an app or a socket proxy")
+	ctlExpectS   = ctlExpect.Arg("script", "JSON script with steps, @file to read from a file, - for stdin").Required().String()
+	ctlExpectApp = ctlExpect.Flag("app", "App or serial port name").String()
+	ctlExpectPxy = ctlExpect.Flag("proxy", "Socket proxy name").String()
+	ctlExpectVar = ctlExpect.Flag("var", "Variable used as ${name} in send, name=value").StringMap()
+	ctlCfg       = ctlCmd.Command("config", "Manage configuration")
+	ctlCfgGet    = ctlCfg.Command("get", "Show a configuration entry")
+	ctlCfgGetF   = ctlCfgGet.Arg("field", "app, command, proxy, serial, schedule or workflow").Required().Enum("app", "command", "proxy", "serial", "schedule", "workflow")
+	ctlCfgGetN   = ctlCfgGet.Arg("name", "Entry name").Required().String()
+	ctlCfgSet    = ctlCfg.Command("set", "Add or modify a configuration entry")
+	ctlCfgSetF   = ctlCfgSet.Arg("field", "app, command, proxy, serial, schedule or workflow").Required().Enum("app", "command", "proxy", "serial", "schedule", "workflow")
+	ctlCfgSetN   = ctlCfgSet.Arg("name", "Entry name").Required().String()
+	ctlCfgSetV   = ctlCfgSet.Arg("value", "JSON value, @file to read from a file, - for stdin").Required().String()
+	ctlCfgDel    = ctlCfg.Command("delete", "Delete a configuration entry")
+	ctlCfgDelF   = ctlCfgDel.Arg("field", "app, command, proxy, serial, schedule or workflow").Required().Enum("app", "command", "proxy", "serial", "schedule", "workflow")
+	ctlCfgDelN   = ctlCfgDel.Arg("name", "Entry name").Required().String()
+	ctlCfgDump   = ctlCfg.Command("dump", "Write the running configuration to config.json")
+	ctlLink      = ctlCmd.Command("link", "Open an interactive session with an app's socket")
+	ctlLinkName  = ctlLink.Arg("name", "App name").Required().String()
+	ctlLinkByPut = ctlLink.Flag("put", "Send each input line with PUT /app/link instead of a websocket").Bool()
+	ctlLinkFrame = ctlLink.Flag("framing", "Send each input line as one message framed by the app's codec").Bool()
+	ctlLinkWatch = ctlLink.Flag("observe", "Join read-only and only print the app's output").Bool()
+)
+
+var ctlInput io.Reader = os.Stdin
+
+// runCtl 执行ctl子命令，command为kingpin解析出的完整命令
+func runCtl(command string) error {
+	c := client.New(*ctlServer)
+	c.Token = *ctlToken
+	c.LeaseTokens = *ctlLease
+	ctx := context.Background()
+
+	switch command {
+	case ctlAppList.FullCommand():
+		return ctlListApps(ctx, c)
+	case ctlAppStatus.FullCommand():
+		status, err := c.AppStatus(ctx, *ctlAppStatusName)
+		if err != nil {
+			return err
+		}
+		return ctlPrint(map[string]string{"name": *ctlAppStatusName, "status": status}, [][]string{{*ctlAppStatusName, status}}, "NAME", "STATUS")
+	case ctlAppStart.FullCommand():
+		if err := c.StartApp(ctx, *ctlAppStartName, *ctlAppStartArgs...); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("app %s is started", *ctlAppStartName))
+	case ctlAppStop.FullCommand():
+		if err := c.StopApp(ctx, *ctlAppStopName); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("app %s is stopped", *ctlAppStopName))
+	case ctlAppRestart.FullCommand():
+		// 没运行的app也可以restart
+		var apiErr *client.APIError
+		if err := c.StopApp(ctx, *ctlAppRestName); err != nil && !(errors.As(err, &apiErr) && apiErr.Code == ErrCodeAppStopped) {
+			return err
+		}
+		if err := c.StartApp(ctx, *ctlAppRestName, *ctlAppRestArgs...); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("app %s is restarted", *ctlAppRestName))
+	case ctlAppLogs.FullCommand():
+		logs, err := c.AppLogs(ctx, *ctlAppLogsName, *ctlAppLogsLines)
+		if err != nil {
+			return err
+		}
+		if *ctlOutput == "json" {
+			return ctlPrintJSON(logs)
+		}
+		for _, line := range logs {
+			fmt.Println(line)
+		}
+		return nil
+	case ctlAppClients.FullCommand():
+		status, err := c.AppClients(ctx, *ctlAppClientsN)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(status.Clients))
+		for _, cl := range status.Clients {
+			role := "writer"
+			switch {
+			case cl.Observer:
+				role = "observer"
+			case cl.Id == status.Controller:
+				role = "controller"
+			case status.WriteMode == "controller":
+				role = "standby"
+			}
+			rows = append(rows, []string{fmt.Sprint(cl.Id), cl.Remote, role, cl.Mode, cl.Since.Format(time.RFC3339)})
+		}
+		return ctlPrint(status, rows, "ID", "REMOTE", "ROLE", "MODE", "SINCE")
+	case ctlAppPorts.FullCommand():
+		ports, err := c.Ports(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(ports))
+		for _, p := range ports {
+			addr := fmt.Sprint(p.Port)
+			if p.Path != "" {
+				addr = p.Path
+			}
+			rows = append(rows, []string{p.App, addr, p.Mode, p.Since.Format(time.RFC3339)})
+		}
+		return ctlPrint(ports, rows, "APP", "PORT", "MODE", "SINCE")
+	case ctlGroupStatus.FullCommand():
+		members, err := c.GroupStatus(ctx, *ctlGroupStatusArg)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(members))
+		for _, m := range members {
+			status := "stopped"
+			if m.Running {
+				status = "running"
+			}
+			rows = append(rows, []string{m.Name, status, fmt.Sprint(m.Member)})
+		}
+		return ctlPrint(members, rows, "NAME", "STATUS", "MEMBER")
+	case ctlGroupStart.FullCommand():
+		if err := c.StartGroup(ctx, *ctlGroupStartArg); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("group %s is started", *ctlGroupStartArg))
+	case ctlGroupStop.FullCommand():
+		if err := c.StopGroup(ctx, *ctlGroupStopArg); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("group %s is stopped", *ctlGroupStopArg))
+	case ctlCmdRun.FullCommand():
+		var (
+			out string
+			err error
+		)
+		if len(*ctlCmdParam) > 0 {
+			// 服务端会按参数类型转换字符串
+			params := make(map[string]interface{}, len(*ctlCmdParam))
+			for k, v := range *ctlCmdParam {
+				params[k] = v
+			}
+			out, err = c.RunCommandParams(ctx, *ctlCmdName, params)
+		} else {
+			out, err = c.RunCommand(ctx, *ctlCmdName, *ctlCmdArgs...)
+		}
+		if err != nil {
+			return err
+		}
+		return ctlPrintText(out)
+	case ctlExec.FullCommand():
+		out, err := c.Exec(ctx, *ctlExecCmd, *ctlExecArgs...)
+		if err != nil {
+			return err
+		}
+		return ctlPrintText(out)
+	case ctlExpect.FullCommand():
+		return ctlRunExpect(ctx, c)
+	case ctlFwdList.FullCommand():
+		statuses, err := c.Forwards(ctx)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(statuses))
+		for name := range statuses {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			st := statuses[name]
+			if !st.Running {
+				rows = append(rows, []string{name, "stopped", "-", "-", "-", "-", "-"})
+				continue
+			}
+			rows = append(rows, []string{name, "running", st.Protocol + " " + st.Listen, st.Target,
+				fmt.Sprintf("%d/%d", st.Active, st.Total), fmt.Sprint(st.Rejected), fmt.Sprintf("%d/%d", st.BytesIn, st.BytesOut)})
+		}
+		return ctlPrint(statuses, rows, "NAME", "STATUS", "LISTEN", "TARGET", "CONNS", "REJECTED", "BYTES IN/OUT")
+	case ctlFwdStart.FullCommand():
+		st, err := c.StartForward(ctx, *ctlFwdStartN)
+		if err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("forward %s is started: %s %s -> %s", *ctlFwdStartN, st.Protocol, st.Listen, st.Target))
+	case ctlFwdStop.FullCommand():
+		if err := c.StopForward(ctx, *ctlFwdStopN); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("forward %s is stopped", *ctlFwdStopN))
+	case ctlSchList.FullCommand():
+		statuses, err := c.Schedules(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(statuses))
+		for _, st := range statuses {
+			rows = append(rows, ctlScheduleRow(st))
+		}
+		return ctlPrint(statuses, rows, "NAME", "WHEN", "ACTION", "NEXT", "LAST", "RUNS", "SKIPPED")
+	case ctlSchStatus.FullCommand():
+		st, err := c.ScheduleStatus(ctx, *ctlSchStatN)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(st.History))
+		for _, run := range st.History {
+			rows = append(rows, ctlScheduleRunRow(run))
+		}
+		return ctlPrint(st, rows, "START", "TRIGGER", "DURATION", "RESULT", "OUTPUT")
+	case ctlSchRun.FullCommand():
+		run, err := c.RunSchedule(ctx, *ctlSchRunN)
+		if err != nil {
+			return err
+		}
+		if *ctlOutput == "json" {
+			return ctlPrintJSON(run)
+		}
+		if run.Output != "" {
+			fmt.Println(run.Output)
+		}
+		if !run.Ok {
+			return fmt.Errorf("schedule %s failed: %s", *ctlSchRunN, run.Error)
+		}
+		return nil
+	case ctlSchDel.FullCommand():
+		if err := c.DeleteSchedule(ctx, *ctlSchDelN); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("schedule %s is deleted", *ctlSchDelN))
+	case ctlWfList.FullCommand():
+		list, err := c.List(ctx, "workflow")
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(list))
+		for name := range list {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			var wf client.WorkflowConfig
+			if err := json.Unmarshal(list[name], &wf); err != nil {
+				return err
+			}
+			rows = append(rows, []string{name, fmt.Sprint(len(wf.Steps)), wf.Description})
+		}
+		return ctlPrint(list, rows, "NAME", "STEPS", "DESCRIPTION")
+	case ctlWfRun.FullCommand():
+		job, err := c.RunWorkflow(ctx, *ctlWfRunN, *ctlWfRunVar)
+		if err != nil {
+			return err
+		}
+		if !*ctlWfRunWait {
+			return ctlPrintText(fmt.Sprintf("job %s is started", job.Id))
+		}
+		if job, err = c.WaitJob(ctx, job.Id, 500*time.Millisecond); err != nil {
+			return err
+		}
+		return ctlPrintJob(job)
+	case ctlWfJobs.FullCommand():
+		jobs, err := c.Jobs(ctx, *ctlWfJobsN)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(jobs))
+		for _, job := range jobs {
+			rows = append(rows, []string{job.Id, job.Workflow, job.State, job.Started.Format(time.RFC3339), job.Error})
+		}
+		return ctlPrint(jobs, rows, "ID", "WORKFLOW", "STATE", "STARTED", "ERROR")
+	case ctlWfJob.FullCommand():
+		job, err := c.Job(ctx, *ctlWfJobID)
+		if err != nil {
+			return err
+		}
+		return ctlPrintJob(job)
+	case ctlWfCancel.FullCommand():
+		if err := c.CancelJob(ctx, *ctlWfCancelI); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("job %s is canceled", *ctlWfCancelI))
+	case ctlLimits.FullCommand():
+		status, err := c.Limits(ctx)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{ctlLimiterRow("all", status.Commands)}
+		for _, l := range status.PerCommand {
+			rows = append(rows, ctlLimiterRow("command", l))
+		}
+		for _, l := range status.Links {
+			rows = append(rows, ctlLimiterRow("link", l))
+		}
+		for _, l := range status.RateLimits {
+			rows = append(rows, ctlRateLimitRow(l))
+		}
+		return ctlPrint(status, rows, "KIND", "NAME", "LIMIT", "RUNNING", "WAITING", "TOTAL", "QUEUED", "REJECTED", "TIMEOUTS")
+	case ctlMetrics.FullCommand():
+		metrics, err := c.Metrics(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Print(metrics)
+		return nil
+	case ctlLockList.FullCommand():
+		statuses, err := c.Locks(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(statuses))
+		for _, st := range statuses {
+			rows = append(rows, ctlLockRow(st))
+		}
+		return ctlPrint(statuses, rows, "RESOURCE", "OWNER", "EXPIRES", "WAITERS")
+	case ctlLockStat.FullCommand():
+		st, err := c.LockStatus(ctx, *ctlLockStatR)
+		if err != nil {
+			return err
+		}
+		return ctlPrint(st, [][]string{ctlLockRow(*st)}, "RESOURCE", "OWNER", "EXPIRES", "WAITERS")
+	case ctlLockAcq.FullCommand():
+		owner := *ctlLockOwner
+		if owner == "" {
+			owner = ctlDefaultOwner()
+		}
+		lease, err := c.Lock(ctx, *ctlLockAcqR, client.LockRequest{
+			Owner: owner,
+			TTL:   int(ctlLockTTL.Seconds()),
+			Wait:  int(ctlLockWait.Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+		if *ctlOutput == "json" {
+			return ctlPrintJSON(lease)
+		}
+		// 只输出token，方便export HOSTCTL_LEASE=$(... lock acquire ...)
+		fmt.Println(lease.Token)
+		return nil
+	case ctlLockRenew.FullCommand():
+		lease, err := c.RenewLock(ctx, *ctlLockRenR, *ctlLockRenT, int(ctlLockRenL.Seconds()))
+		if err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("lease of %s expires at %s", lease.Resource, lease.Expires.Format(time.RFC3339)))
+	case ctlLockRel.FullCommand():
+		token := *ctlLockRelT
+		if token == "" && len(*ctlLease) > 0 {
+			token = (*ctlLease)[0]
+		}
+		if err := c.Unlock(ctx, *ctlLockRelR, token, *ctlLockForce); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("lock %s is released", *ctlLockRelR))
+	case ctlRecList.FullCommand():
+		infos, err := c.Recordings(ctx, *ctlRecApp)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(infos))
+		for _, info := range infos {
+			rows = append(rows, []string{info.Name, info.App, info.Kind, fmt.Sprint(info.Size), info.Start.Format(time.RFC3339)})
+		}
+		return ctlPrint(infos, rows, "NAME", "APP", "KIND", "SIZE", "START")
+	case ctlRecGet.FullCommand():
+		return ctlDownloadRecording(ctx, c, *ctlRecGetN, *ctlRecGetF)
+	case ctlRecDel.FullCommand():
+		if err := c.DeleteRecording(ctx, *ctlRecDelN); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("recording %s is deleted", *ctlRecDelN))
+	case ctlCfgGet.FullCommand():
+		var cfg json.RawMessage
+		if err := c.GetConfig(ctx, *ctlCfgGetF, *ctlCfgGetN, &cfg); err != nil {
+			return err
+		}
+		return ctlPrintJSON(cfg)
+	case ctlCfgSet.FullCommand():
+		return ctlSetConfig(ctx, c)
+	case ctlCfgDel.FullCommand():
+		if err := c.DeleteConfig(ctx, *ctlCfgDelF, *ctlCfgDelN); err != nil {
+			return err
+		}
+		return ctlPrintText(fmt.Sprintf("%s %s is deleted", *ctlCfgDelF, *ctlCfgDelN))
+	case ctlCfgDump.FullCommand():
+		if err := c.DumpConfig(ctx); err != nil {
+			return err
+		}
+		return ctlPrintText("config file is updated")
+	case ctlAppStdin.FullCommand():
+		res, err := c.WriteStdin(ctx, *ctlAppStdinName, client.StdinRequest{
+			Lines:   *ctlAppStdinLines,
+			Expect:  *ctlAppStdinExp,
+			Timeout: int(ctlAppStdinWait.Milliseconds()),
+		})
+		if err != nil {
+			return err
+		}
+		if *ctlOutput == "json" {
+			if err := ctlPrintJSON(res); err != nil {
+				return err
+			}
+		} else if res.Output != "" {
+			fmt.Print(res.Output)
+		} else {
+			fmt.Printf("%d bytes written to %s\n", res.Written, *ctlAppStdinName)
+		}
+		if *ctlAppStdinExp != "" && !res.Matched {
+			return fmt.Errorf("output did not match %q", *ctlAppStdinExp)
+		}
+		return nil
+	case ctlAppTty.FullCommand():
+		return ctlAttachTty(ctx, c, *ctlAppTtyName, *ctlAppTtyWrite)
+	case ctlLink.FullCommand():
+		if *ctlLinkByPut {
+			return ctlLinkPut(ctx, c, *ctlLinkName)
+		}
+		return ctlLinkWebsocket(ctx, c, *ctlLinkName, client.LinkOptions{Framing: *ctlLinkFrame, Observe: *ctlLinkWatch})
+	}
+	return fmt.Errorf("unknown command: %s", command)
+}
+
+func ctlListApps(ctx context.Context, c *client.Client) error {
+	apps, err := c.List(ctx, "app")
+	if err != nil {
+		return err
+	}
+	autostart, err := c.Autostart(ctx)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type appRow struct {
+		Name      string                  `json:"name"`
+		Status    string                  `json:"status"`
+		Autostart *client.AutostartResult `json:"autostart,omitempty"`
+		Config    json.RawMessage         `json:"config"`
+	}
+	var (
+		list []appRow
+		rows [][]string
+	)
+	for _, name := range names {
+		status, err := c.AppStatus(ctx, name)
+		if err != nil {
+			status = err.Error()
+		}
+		var cfg struct {
+			Socket    bool   `json:"socket"`
+			Websocket bool   `json:"websocket"`
+			Executor  string `json:"executor"`
+			RootPath  string `json:"root_path"`
+		}
+		json.Unmarshal(apps[name], &cfg)
+		row := appRow{Name: name, Status: status, Config: apps[name]}
+		autostartState := "-"
+		if res, ok := autostart[name]; ok {
+			row.Autostart = &res
+			autostartState = res.State
+			if res.Error != "" {
+				autostartState += ": " + res.Error
+			}
+		}
+		list = append(list, row)
+		rows = append(rows, []string{name, status, fmt.Sprint(cfg.Socket), fmt.Sprint(cfg.Websocket), strings.TrimSpace(cfg.Executor + " " + cfg.RootPath), autostartState})
+	}
+	return ctlPrint(list, rows, "NAME", "STATUS", "SOCKET", "WEBSOCKET", "COMMAND", "AUTOSTART")
+}
+
+// 读取json参数，@file从文件读取，-从标准输入读取
+func ctlReadValue(v string) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case v == "-":
+		data, err = io.ReadAll(ctlInput)
+	case strings.HasPrefix(v, "@"):
+		data, err = os.ReadFile(v[1:])
+	default:
+		data = []byte(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("invalid json value: %s", data)
+	}
+	return data, nil
+}
+
+func ctlSetConfig(ctx context.Context, c *client.Client) error {
+	data, err := ctlReadValue(*ctlCfgSetV)
+	if err != nil {
+		return err
+	}
+
+	// 已存在的修改，不存在的新增
+	var (
+		cfg    json.RawMessage
+		apiErr *client.APIError
+		action = "modified"
+	)
+	err = c.GetConfig(ctx, *ctlCfgSetF, *ctlCfgSetN, &cfg)
+	switch {
+	case err == nil:
+		err = c.ModifyConfig(ctx, *ctlCfgSetF, *ctlCfgSetN, json.RawMessage(data))
+	case errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound:
+		action = "added"
+		err = c.AddConfig(ctx, *ctlCfgSetF, *ctlCfgSetN, json.RawMessage(data))
+	}
+	if err != nil {
+		return err
+	}
+	return ctlPrintText(fmt.Sprintf("%s %s is %s", *ctlCfgSetF, *ctlCfgSetN, action))
+}
+
+// 每行输入通过PUT /app/link发送一次
+func ctlLinkPut(ctx context.Context, c *client.Client, name string) error {
+	scanner := bufio.NewScanner(ctlInput)
+	for scanner.Scan() {
+		out, err := c.Link(ctx, name, scanner.Bytes())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if err := ctlPrintText(out); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// 通过websocket桥接，标准输入的每行作为一条消息发送，收到的消息直接输出
+func ctlLinkWebsocket(ctx context.Context, c *client.Client, name string, opts client.LinkOptions) error {
+	conn, err := c.DialLinkWith(ctx, name, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			os.Stdout.Write(data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				fmt.Println()
+			}
+		}
+	}()
+
+	// 观察者不读取输入，由服务端或Ctrl-C结束
+	lines := make(chan []byte)
+	go func() {
+		if opts.Observe {
+			return
+		}
+		scanner := bufio.NewScanner(ctlInput)
+		for scanner.Scan() {
+			line := append([]byte{}, scanner.Bytes()...)
+			// 分帧模式下由app的codec处理消息边界
+			if !opts.Framing {
+				line = append(line, '\n')
+			}
+			lines <- line
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				return conn.WriteMessage(websocket.CloseMessage, msg)
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 终端的输出原样输出，writer的每行输入以回车结尾发给终端
+func ctlAttachTty(ctx context.Context, c *client.Client, name string, write bool) error {
+	conn, err := c.DialTty(ctx, name, write)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			os.Stdout.Write(data)
+		}
+	}()
+
+	lines := make(chan []byte)
+	go func() {
+		if !write {
+			return
+		}
+		scanner := bufio.NewScanner(ctlInput)
+		for scanner.Scan() {
+			lines <- append(append([]byte{}, scanner.Bytes()...), '\r')
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				return conn.WriteMessage(websocket.CloseMessage, msg)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 脚本可以是完整的请求，也可以只有steps数组，--app、--proxy和--var优先
+func ctlRunExpect(ctx context.Context, c *client.Client) error {
+	data, err := ctlReadValue(*ctlExpectS)
+	if err != nil {
+		return err
+	}
+	var req client.ExpectRequest
+	if err := json.Unmarshal(data, &req.Steps); err != nil {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+	}
+	if *ctlExpectApp != "" || *ctlExpectPxy != "" {
+		req.App, req.Proxy = *ctlExpectApp, *ctlExpectPxy
+	}
+	if len(*ctlExpectVar) > 0 && req.Vars == nil {
+		req.Vars = make(map[string]string, len(*ctlExpectVar))
+	}
+	for k, v := range *ctlExpectVar {
+		req.Vars[k] = v
+	}
+	res, err := c.Expect(ctx, req)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(res.Transcript))
+	for _, st := range res.Transcript {
+		result := "ok"
+		if st.Error != "" {
+			result = st.Error
+		}
+		rows = append(rows, []string{fmt.Sprint(st.Step), strconv.Quote(st.Send), strconv.Quote(st.Match), fmt.Sprintf("%dms", st.Elapsed), result})
+	}
+	if err := ctlPrint(res, rows, "STEP", "SEND", "MATCH", "ELAPSED", "RESULT"); err != nil {
+		return err
+	}
+	if !res.Ok {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+func ctlScheduleRow(st client.ScheduleStatus) []string {
+	when := st.Config.Cron
+	if when == "" {
+		when = fmt.Sprintf("every %ds", st.Config.Interval)
+	}
+	next := "-"
+	if st.Config.Disabled {
+		next = "disabled"
+	} else if st.Next != nil {
+		next = st.Next.Format(time.RFC3339)
+	}
+	last := "-"
+	if st.Running {
+		last = "running"
+	} else if st.Last != nil {
+		last = "ok"
+		if !st.Last.Ok {
+			last = "failed"
+		}
+		last += " " + st.Last.Start.Format(time.RFC3339)
+	}
+	return []string{st.Name, when, st.Config.Action + " " + st.Config.Target, next, last, fmt.Sprint(st.Runs), fmt.Sprint(st.Skipped)}
+}
+
+func ctlLimiterRow(kind string, l client.LimiterStatus) []string {
+	limit := "-"
+	if l.Limit > 0 {
+		limit = fmt.Sprint(l.Limit)
+	}
+	return []string{kind, l.Name, limit, fmt.Sprint(l.Running), fmt.Sprint(l.Waiting),
+		fmt.Sprint(l.Total), fmt.Sprint(l.Queued), fmt.Sprint(l.Rejected), fmt.Sprint(l.Timeouts)}
+}
+
+// 限流规则的limit显示为rate/burst，被拒绝的请求计入REJECTED
+func ctlRateLimitRow(l client.RateLimitStatus) []string {
+	name := l.Route
+	if name == "" {
+		name = "*"
+	}
+	if len(l.Methods) > 0 {
+		name = strings.Join(l.Methods, ",") + " " + name
+	}
+	return []string{"rate/" + l.By, name, fmt.Sprintf("%v/s,%d", l.Rate, l.Burst), "-", "-",
+		fmt.Sprint(l.Allowed + l.Limited), "-", fmt.Sprint(l.Limited), "-"}
+}
+
+func ctlLockRow(st client.LockStatus) []string {
+	owner, expires := "-", "-"
+	if st.Holder != nil {
+		owner = st.Holder.Owner
+		expires = st.Holder.Expires.Format(time.RFC3339)
+	}
+	waiters := make([]string, 0, len(st.Waiters))
+	for _, w := range st.Waiters {
+		waiters = append(waiters, w.Owner)
+	}
+	return []string{st.Resource, owner, expires, strings.Join(waiters, ",")}
+}
+
+// 默认的租约owner，用户名@主机名
+func ctlDefaultOwner() string {
+	host, _ := os.Hostname()
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("USERNAME")
+	}
+	if user == "" {
+		return host
+	}
+	return user + "@" + host
+}
+
+func ctlScheduleRunRow(run client.ScheduleRun) []string {
+	result := "ok"
+	if !run.Ok {
+		result = run.Error
+	}
+	output := run.Output
+	if i := strings.IndexByte(output, '\n'); i >= 0 {
+		output = output[:i] + " ..."
+	}
+	return []string{run.Start.Format(time.RFC3339), run.Trigger, fmt.Sprintf("%.1fs", run.Duration), result, output}
+}
+
+// 输出每一步的结果，job失败时返回错误
+func ctlPrintJob(job *client.WorkflowJob) error {
+	rows := make([][]string, 0, len(job.Steps))
+	for _, st := range job.Steps {
+		name := st.Name
+		if name == "" {
+			name = "-"
+		}
+		result := st.State
+		if st.Error != "" {
+			result += ": " + st.Error
+		}
+		output := st.Output
+		if i := strings.IndexByte(output, '\n'); i >= 0 {
+			output = output[:i] + " ..."
+		}
+		rows = append(rows, []string{fmt.Sprint(st.Step), name, st.Type, fmt.Sprint(st.Attempts), fmt.Sprintf("%.1fs", st.Duration), result, output})
+	}
+	if err := ctlPrint(job, rows, "STEP", "NAME", "TYPE", "ATTEMPTS", "DURATION", "RESULT", "OUTPUT"); err != nil {
+		return err
+	}
+	if job.State == "failed" || job.State == "canceled" {
+		return fmt.Errorf("job %s %s: %s", job.Id, job.State, job.Error)
+	}
+	return nil
+}
+
+func ctlDownloadRecording(ctx context.Context, c *client.Client, name, path string) error {
+	if path == "" {
+		return c.DownloadRecording(ctx, name, os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := c.DownloadRecording(ctx, name, file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+func ctlPrintJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func ctlPrintText(text string) error {
+	if *ctlOutput == "json" {
+		return ctlPrintJSON(map[string]string{"output": text})
+	}
+	fmt.Println(text)
+	return nil
+}
+
+// ctlPrint 按--output输出，json时输出v，table时输出rows
+func ctlPrint(v interface{}, rows [][]string, headers ...string) error {
+	if *ctlOutput == "json" {
+		return ctlPrintJSON(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
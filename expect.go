@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/expect"
+)
+
+// 连接expect脚本的目标，app（包括串口）使用link的地址，proxy只支持socket proxy
+// 返回连接和用于日志的url
+func dialExpect(body *BodyExpect) (net.Conn, string, error) {
+	if (body.App == "") == (body.Proxy == "") {
+		return nil, "", BadRequest(errors.New("exactly one of app and proxy is required"))
+	}
+	if body.App != "" {
+		appCfg, ok := linkConfig(body.App)
+		if !ok {
+			return nil, "", cmdctrl.ErrMsg("ANF", body.App)
+		}
+		if !appCfg.Socket {
+			return nil, "", fmt.Errorf("%w: %s does not support link", config.ErrField, body.App)
+		}
+		url, err := linkUrl(body.App)
+		if err != nil {
+			return nil, "", err
+		}
+		if isSerialUrl(url) {
+			// 串口只能打开一次，先关闭PUT请求的长连接
+			sessionManager.Close(body.App)
+		}
+		conn, err := dialLink(body.App, linkKindExpect, url)
+		return conn, url, err
+	}
+	pxyCfg, ok := serverConfig.GetConfig("proxy", body.Proxy).(*config.ProxyCfg)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: proxy %s", config.ErrNotFound, body.Proxy)
+	}
+	if !pxyCfg.Socket {
+		return nil, "", fmt.Errorf("%w: proxy %s is not a socket proxy", config.ErrField, body.Proxy)
+	}
+	url := proxyAddress(pxyCfg)
+	conn, err := dialSocket(url, dialTimeout)
+	return conn, url, err
+}
+
+// RunExpect 在新的连接上执行脚本，请求取消时关闭连接结束脚本
+func RunExpect(ctx context.Context, body *BodyExpect) (*expect.Result, error) {
+	prog, err := expect.Compile(body.Script)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	conn, url, err := dialExpect(body)
+	if err != nil {
+		return nil, tunnelError(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	res := prog.Run(conn)
+	if res.Ok {
+		logger.SocketLog("info", url, fmt.Sprintf("expect script finished, %d steps", len(res.Transcript)))
+	} else {
+		logger.SocketLog("error", url, fmt.Sprintf("expect script failed, %s", res.Error))
+	}
+	return res, nil
+}
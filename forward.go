@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/forward"
+)
+
+var (
+	ErrForwardRunning = errors.New("forward is running")
+	ErrForwardStopped = errors.New("forward is not running")
+)
+
+type ForwardStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	*forward.Stats
+}
+
+// ForwardManager 管理proxy配置中的端口转发
+// 转发需要通过接口启动，修改配置后重新启动才生效
+type ForwardManager struct {
+	rl       sync.RWMutex
+	forwards map[string]*forward.Forwarder
+}
+
+func NewForwardManager() *ForwardManager {
+	return &ForwardManager{
+		forwards: make(map[string]*forward.Forwarder),
+	}
+}
+
+func forwardConfig(name string) (forward.Config, error) {
+	pxyCfg, ok := serverConfig.GetConfig("proxy", name).(*config.ProxyCfg)
+	if !ok {
+		return forward.Config{}, fmt.Errorf("%w: proxy %s", config.ErrNotFound, name)
+	}
+	if pxyCfg.Forward == nil {
+		return forward.Config{}, fmt.Errorf("%w: proxy %s has no forward", config.ErrField, name)
+	}
+	return forward.Config{
+		Protocol:    pxyCfg.Forward.Protocol,
+		Listen:      pxyCfg.Forward.Listen,
+		Target:      proxyAddress(pxyCfg),
+		Allow:       pxyCfg.Forward.Allow,
+		IdleTimeout: time.Duration(pxyCfg.Forward.IdleTimeout) * time.Second,
+	}, nil
+}
+
+func (m *ForwardManager) Start(name string) error {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if _, ok := m.forwards[name]; ok {
+		return fmt.Errorf("%w: %s", ErrForwardRunning, name)
+	}
+	cfg, err := forwardConfig(name)
+	if err != nil {
+		return err
+	}
+	f, err := forward.New(cfg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", config.ErrField, err)
+	}
+	f.Logf = func(format string, args ...interface{}) {
+		logger.ProxyLog("error", "forwarding", name, fmt.Sprintf(format, args...))
+	}
+	if err := f.Start(); err != nil {
+		return err
+	}
+	m.forwards[name] = f
+	logger.ProxyLog("info", "forwarding", name, fmt.Sprintf("%s %s -> %s", cfg.Protocol, f.Addr(), cfg.Target))
+	return nil
+}
+
+func (m *ForwardManager) Stop(name string) error {
+	m.rl.Lock()
+	f, ok := m.forwards[name]
+	delete(m.forwards, name)
+	m.rl.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrForwardStopped, name)
+	}
+	if err := f.Stop(); err != nil {
+		logger.ProxyLog("error", "stopping forward", name, err.Error())
+	}
+	logger.ProxyLog("info", "stopping forward", name, fmt.Sprintf("%s is stopped", name))
+	return nil
+}
+
+func (m *ForwardManager) Running(name string) bool {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	_, ok := m.forwards[name]
+	return ok
+}
+
+func (m *ForwardManager) Status(name string) ForwardStatus {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	status := ForwardStatus{Name: name}
+	if f, ok := m.forwards[name]; ok {
+		stats := f.Stats()
+		status.Running = true
+		status.Stats = &stats
+	}
+	return status
+}
+
+// List 返回所有配置了forward的proxy的状态
+func (m *ForwardManager) List() map[string]ForwardStatus {
+	statuses := make(map[string]ForwardStatus)
+	for name, cfg := range serverConfig.List("proxy") {
+		if cfg.(*config.ProxyCfg).Forward != nil {
+			statuses[name] = m.Status(name)
+		}
+	}
+	// 配置已经删除但仍在运行的转发
+	m.rl.RLock()
+	var orphans []string
+	for name := range m.forwards {
+		if _, ok := statuses[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+	m.rl.RUnlock()
+	for _, name := range orphans {
+		statuses[name] = m.Status(name)
+	}
+	return statuses
+}
+
+// StopAll 停止所有转发，服务停止时使用
+func (m *ForwardManager) StopAll() {
+	m.rl.RLock()
+	names := make([]string, 0, len(m.forwards))
+	for name := range m.forwards {
+		names = append(names, name)
+	}
+	m.rl.RUnlock()
+	for _, name := range names {
+		m.Stop(name)
+	}
+}
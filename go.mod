@@ -11,6 +11,7 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/yusufpapurcu/wmi v1.2.3
+	golang.org/x/sys v0.5.0
 	golang.org/x/text v0.14.0
 )
 
@@ -20,6 +21,5 @@ require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/serial"
+)
+
+// 错误码，客户端根据code做判断，不要依赖message
+const (
+	ErrCodeBadRequest       = "BAD_REQUEST"
+	ErrCodeUnauthorized     = "UNAUTHORIZED"
+	ErrCodeNotFound         = "NOT_FOUND"
+	ErrCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	ErrCodeInternal         = "INTERNAL_ERROR"
+	ErrCodeAppNotFound      = "APP_NOT_FOUND"
+	ErrCodeAppRunning       = "APP_RUNNING"
+	ErrCodeAppStopped       = "APP_ALREADY_STOPPED"
+	ErrCodeAppConflict      = "APP_NAME_CONFLICT"
+	ErrCodeAppFailure       = "APP_FAILURE"
+	ErrCodeAppNotReady      = "APP_NOT_READY"
+	ErrCodeDependencyCycle  = "DEPENDENCY_CYCLE"
+	ErrCodeInvalidDep       = "INVALID_DEPENDENCY"
+	ErrCodeConfigInUse      = "CONFIG_IN_USE"
+	ErrCodeConfigNotFound   = "CONFIG_NOT_FOUND"
+	ErrCodeConfigExists     = "CONFIG_EXISTS"
+	ErrCodeUpstream         = "UPSTREAM_ERROR"
+	ErrCodeUpstreamTimeout  = "UPSTREAM_TIMEOUT"
+	ErrCodeCommandFailed    = "COMMAND_FAILED"
+	ErrCodeHubConflict      = "LINK_HUB_CONFLICT"
+	ErrCodeForwardRunning   = "FORWARD_RUNNING"
+	ErrCodeForwardStopped   = "FORWARD_STOPPED"
+	ErrCodeSerialBusy       = "SERIAL_BUSY"
+	ErrCodePortUnavailable  = "PORT_UNAVAILABLE"
+	ErrCodeTtyWriterBusy    = "TTY_WRITER_BUSY"
+	ErrCodeScheduleRunning  = "SCHEDULE_RUNNING"
+	ErrCodeWorkflowRunning  = "WORKFLOW_RUNNING"
+	ErrCodeJobFinished      = "JOB_FINISHED"
+	ErrCodeLockHeld         = "LOCK_HELD"
+	ErrCodeLeaseInvalid     = "LEASE_INVALID"
+	ErrCodeLeaseRequired    = "LEASE_REQUIRED"
+	ErrCodeLocksClosed      = "LOCKS_CLOSED"
+	ErrCodeQueueFull        = "QUEUE_FULL"
+	ErrCodeQueueTimeout     = "QUEUE_TIMEOUT"
+	ErrCodeRateLimited      = "RATE_LIMITED"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// app未ready时建议客户端重试的间隔，单位秒
+const notReadyRetryAfter = 5
+
+var requestSeq uint64
+
+// HttpError 携带http状态码和错误码的error
+type HttpError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func NewHttpError(status int, code string, err error) *HttpError {
+	return &HttpError{
+		Status: status,
+		Code:   code,
+		Err:    err,
+	}
+}
+
+func BadRequest(err error) *HttpError {
+	return NewHttpError(http.StatusBadRequest, ErrCodeBadRequest, err)
+}
+
+func NotFound(format string, a ...interface{}) *HttpError {
+	return NewHttpError(http.StatusNotFound, ErrCodeNotFound, fmt.Errorf(format, a...))
+}
+
+func (e *HttpError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HttpError) Unwrap() error {
+	return e.Err
+}
+
+// 把cmdctrl和config的错误映射成http状态码和错误码
+// 无法识别的错误一律按500处理
+func errorStatus(err error) (int, string) {
+	var he *HttpError
+	switch {
+	case errors.As(err, &he):
+		return he.Status, he.Code
+	case errors.Is(err, cmdctrl.ErrNotFound):
+		return http.StatusNotFound, ErrCodeAppNotFound
+	case errors.Is(err, cmdctrl.ErrRunning):
+		return http.StatusConflict, ErrCodeAppRunning
+	case errors.Is(err, cmdctrl.ErrAlreadyStopped):
+		return http.StatusConflict, ErrCodeAppStopped
+	case errors.Is(err, cmdctrl.ErrNameConflict):
+		return http.StatusConflict, ErrCodeAppConflict
+	case errors.Is(err, cmdctrl.ErrInvalidArgs):
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case errors.Is(err, cmdctrl.ErrNoStdin):
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusGatewayTimeout, ErrCodeUpstreamTimeout
+	case errors.Is(err, cmdctrl.ErrNotReady):
+		return http.StatusServiceUnavailable, ErrCodeAppNotReady
+	case errors.Is(err, cmdctrl.ErrDependencyCycle):
+		return http.StatusConflict, ErrCodeDependencyCycle
+	case errors.Is(err, config.ErrNotFound):
+		return http.StatusNotFound, ErrCodeConfigNotFound
+	case errors.Is(err, config.ErrAlreadyExists):
+		return http.StatusConflict, ErrCodeConfigExists
+	case errors.Is(err, config.ErrField):
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case errors.Is(err, config.ErrDependency):
+		return http.StatusBadRequest, ErrCodeInvalidDep
+	case errors.Is(err, config.ErrInUse):
+		return http.StatusConflict, ErrCodeConfigInUse
+	case errors.Is(err, ErrHubConflict):
+		return http.StatusConflict, ErrCodeHubConflict
+	case errors.Is(err, ErrForwardRunning):
+		return http.StatusConflict, ErrCodeForwardRunning
+	case errors.Is(err, ErrForwardStopped):
+		return http.StatusConflict, ErrCodeForwardStopped
+	case errors.Is(err, serial.ErrBusy):
+		return http.StatusConflict, ErrCodeSerialBusy
+	case errors.Is(err, ErrPortUnavailable):
+		return http.StatusConflict, ErrCodePortUnavailable
+	case errors.Is(err, ErrTtyWriterBusy):
+		return http.StatusConflict, ErrCodeTtyWriterBusy
+	case errors.Is(err, ErrScheduleRunning):
+		return http.StatusConflict, ErrCodeScheduleRunning
+	case errors.Is(err, ErrWorkflowRunning):
+		return http.StatusConflict, ErrCodeWorkflowRunning
+	case errors.Is(err, ErrJobFinished):
+		return http.StatusConflict, ErrCodeJobFinished
+	case errors.Is(err, ErrLockHeld):
+		return http.StatusConflict, ErrCodeLockHeld
+	case errors.Is(err, ErrLeaseInvalid):
+		return http.StatusForbidden, ErrCodeLeaseInvalid
+	case errors.Is(err, ErrLeaseRequired):
+		return http.StatusLocked, ErrCodeLeaseRequired
+	case errors.Is(err, ErrLocksClosed):
+		return http.StatusServiceUnavailable, ErrCodeLocksClosed
+	case errors.Is(err, ErrQueueFull):
+		return http.StatusServiceUnavailable, ErrCodeQueueFull
+	case errors.Is(err, ErrQueueTimeout):
+		return http.StatusServiceUnavailable, ErrCodeQueueTimeout
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, ErrCodeRateLimited
+	default:
+		return http.StatusInternalServerError, ErrCodeInternal
+	}
+}
+
+// Authorized 校验请求的token，sys.token为空时不校验
+// token通过Authorization: Bearer <token>传递
+func Authorized(r *http.Request) bool {
+	token := serverConfig.GetSysConfig().Token
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// 生成request id，客户端带了X-Request-Id时沿用客户端的
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(requestIdHeader); id != "" {
+		return id
+	}
+	seq := atomic.AddUint64(&requestSeq, 1)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(seq, 36)
+}
+
+// RenderError 以统一的错误格式返回，状态码由errorStatus决定
+// data.msg保留给旧版本客户端使用
+func RenderError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	reqId := w.Header().Get(requestIdHeader)
+	res := map[string]interface{}{
+		"code": -1,
+		"data": map[string]interface{}{
+			"msg": err.Error(),
+		},
+		"error": map[string]interface{}{
+			"code":       code,
+			"message":    err.Error(),
+			"request_id": reqId,
+		},
+	}
+	js, jerr := json.Marshal(res)
+	if jerr != nil {
+		logger.HttpResponseLog("error", jerr.Error())
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(js)))
+	if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
+		// 并发限制是暂时的，客户端可以稍后重试
+		w.Header().Set("Retry-After", "1")
+	} else if errors.Is(err, cmdctrl.ErrNotReady) {
+		// app或依赖还在启动，等一会再检查ready
+		w.Header().Set("Retry-After", strconv.Itoa(notReadyRetryAfter))
+	}
+	w.WriteHeader(status)
+	if c, err := w.Write(js); err != nil {
+		logger.HttpResponseLog("error", err.Error())
+	} else {
+		logger.HttpResponseLog("info", fmt.Sprintf("sent error, status: %d, size: %v, body: %s", status, c, js))
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hostctl_proxy/cmdctrl"
+)
+
+// app未ready是暂时的，返回503并让客户端稍后重试
+func TestRenderErrorNotReady(t *testing.T) {
+	w := httptest.NewRecorder()
+	RenderError(w, fmt.Errorf("starting dependency db of web: %w", cmdctrl.ErrNotReady))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want 5", got)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
-	"hostctl_proxy/internal/config"
-	"hostctl_proxy/internal/command"
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/codec"
+	"hostctl_proxy/internal/command"
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/expect"
+	"hostctl_proxy/internal/record"
+	"hostctl_proxy/internal/serial"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +23,7 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -34,10 +41,32 @@ type BodyWithArgs struct {
 	Args []string `json:"args"`
 }
 
+// BodyCommand 运行命令的请求，带参数模板的命令使用params
+type BodyCommand struct {
+	Args   []string               `json:"args"`
+	Params map[string]interface{} `json:"params"`
+}
+
 type BodyProxy struct {
-	Host    string `json:"host"`
-	Port    int    `json:"Port"`
-	Content string `json:"content"`
+	Host     string `json:"host"`
+	Port     int    `json:"Port"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"` // text或base64，默认使用proxy framing中的encoding
+}
+
+// expect脚本，app和proxy二选一
+type BodyExpect struct {
+	App   string `json:"app"`
+	Proxy string `json:"proxy"`
+	expect.Script
+}
+
+// RenderData 作为响应的data原样输出
+type RenderData map[string]interface{}
+
+type TunnelResult struct {
+	Output []byte
+	Err    error
 }
 
 // type PutBody struct {
@@ -53,7 +82,9 @@ func RenderJSON(w http.ResponseWriter, flg bool, result interface{}) {
 	}
 
 	jsRes, err := AppoutJsonSerialize(result)
-	if err != nil {
+	if d, ok := result.(RenderData); ok {
+		res["data"] = d
+	} else if err != nil {
 		data := make(map[string]interface{})
 		if flg {
 			data["output"] = result
@@ -83,7 +114,22 @@ func RenderJSON(w http.ResponseWriter, flg bool, result interface{}) {
 
 func RequestPreprocess(handler func(http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		reqId := requestId(r)
+		r.Header.Set(requestIdHeader, reqId)
+		w.Header().Set(requestIdHeader, reqId)
 		logger.HttpRequestLog("info", r, "request received")
+		// 在验证token之前限流，错误token的重复请求也会被限制
+		if wait, err := rateLimiter.Allow(r); err != nil {
+			logger.HttpRequestLog("warning", r, err.Error())
+			setRetryAfter(w, wait)
+			RenderError(w, err)
+			return
+		}
+		if !Authorized(r) {
+			logger.HttpRequestLog("error", r, "unauthorized")
+			RenderError(w, NewHttpError(http.StatusUnauthorized, ErrCodeUnauthorized, errors.New("invalid or missing token")))
+			return
+		}
 		if r.Method == http.MethodPost || r.Method == http.MethodPut {
 			// io.ReadAll会导致request body不能读第二次
 			// 用io.TeeReader解决上述问题
@@ -92,7 +138,7 @@ func RequestPreprocess(handler func(http.ResponseWriter, *http.Request, httprout
 			r.Body = io.NopCloser(&buf)
 			if _, err := io.ReadAll(tee); err != nil {
 				logger.HttpRequestLog("error", r, err.Error())
-				http.Error(w, err.Error(), 400)
+				RenderError(w, BadRequest(err))
 				return
 			}
 		}
@@ -101,58 +147,93 @@ func RequestPreprocess(handler func(http.ResponseWriter, *http.Request, httprout
 	}
 }
 
-func SocketTunnel(url string, data []byte, ch chan string) {
-	conn, err := net.Dial("tcp", url)
+// SocketTunnel 建立一次性的连接，发送一条消息并读取一条响应
+func SocketTunnel(url string, c codec.Codec, data []byte, timeout time.Duration, ch chan TunnelResult) {
+	conn, err := dialSocket(url, dialTimeout)
 	if err != nil {
 		logger.SocketLog("error", url, err.Error())
-		ch <- err.Error()
+		ch <- TunnelResult{Err: NewHttpError(http.StatusBadGateway, ErrCodeUpstream, err)}
 		return
 	}
 
 	defer func() {
 		if err = conn.Close(); err != nil {
 			logger.SocketLog("error", url, err.Error())
-			ch <- err.Error()
 		}
 	}()
-	err = conn.SetDeadline(time.Now().Add(1 * time.Second))
+	deadline := time.Now().Add(timeout)
+	if err = conn.SetWriteDeadline(deadline); err != nil {
+		logger.SocketLog("error", url, err.Error())
+		ch <- TunnelResult{Err: NewHttpError(http.StatusBadGateway, ErrCodeUpstream, err)}
+		return
+	}
+	if err = c.Encode(conn, data); err != nil {
+		logger.SocketLog("error", url, err.Error())
+		ch <- TunnelResult{Err: NewHttpError(http.StatusBadGateway, ErrCodeUpstream, err)}
+		return
+	}
+	reader := codec.NewReader(conn)
+	reader.Deadline = deadline
+	out, err := c.Decode(reader)
 	if err != nil {
 		logger.SocketLog("error", url, err.Error())
-		ch <- err.Error()
+		ch <- TunnelResult{Err: tunnelError(err)}
 		return
 	}
-	conn.Write(data)
-	reader := bufio.NewReader(conn)
-	var out string
-	// buf := make([]byte, 1024)
-	for {
-		//n, err := conn.Read(buf)
-		line, _, err := reader.ReadLine()
-		if errors.Is(err, io.EOF) {
-			break
+	ch <- TunnelResult{Output: out}
+}
+
+// 状态头表示的失败返回500，超时返回504，其他错误返回502
+func tunnelError(err error) error {
+	var statusErr *codec.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return NewHttpError(http.StatusInternalServerError, ErrCodeAppFailure, err)
+	case errors.Is(err, ErrLinkTimeout), errors.Is(err, os.ErrDeadlineExceeded):
+		return NewHttpError(http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, err)
+	case errors.As(err, new(*HttpError)), errors.Is(err, serial.ErrBusy), errors.Is(err, config.ErrField),
+		errors.Is(err, config.ErrNotFound), errors.Is(err, cmdctrl.ErrNotFound):
+		// 目标本身的错误，按errorStatus处理
+		return err
+	default:
+		return NewHttpError(http.StatusBadGateway, ErrCodeUpstream, err)
+	}
+}
+
+func (server *Server) initHttpServer() {
+	router := newRouter()
+	if unregistered, undocumented, err := checkOpenAPI(router.routes); err != nil {
+		logger.SysLog("error", "checking openapi document", err.Error())
+	} else {
+		if len(unregistered) > 0 {
+			logger.SysLog("warning", "checking openapi document", fmt.Sprintf("routes not registered: %s", strings.Join(unregistered, ", ")))
 		}
-		if err != nil {
-			break
+		if len(undocumented) > 0 {
+			logger.SysLog("warning", "checking openapi document", fmt.Sprintf("routes not documented: %s", strings.Join(undocumented, ", ")))
 		}
-		out = out + fmt.Sprintf("\n%s", line)
-		//out = out + string(buf[:n])
 	}
-	out = strings.Trim(out, "\n")
-	fmt.Printf("received all")
-	ch <- out
+
+	server.httpServer = &http.Server{Handler: router}
 }
 
-func (server *Server) initHttpServer() {
-	router := httprouter.New()
+// newRouter 注册所有接口
+func newRouter() *apiRouter {
+	router := &apiRouter{Router: httprouter.New()}
 	router.GET("/", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		RenderJSON(w, true, "OK! service is active")
 	}))
 
+	router.GET("/openapi.json", RequestPreprocess(serveOpenAPI))
+
 	router.Handle(http.MethodGet, "/list/:components", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		components := p.ByName("components")
 		var data interface{}
 		if components == "command" {
 			data = serverConfig.List("command")
+		} else if components == "serial" {
+			data = serverConfig.List("serial")
+		} else if components == "schedule" || components == "workflow" {
+			data = serverConfig.List(components)
 		} else if components == "app" {
 			data = serverConfig.List("app")
 			// status := r.URL.Query().Get("status")
@@ -165,7 +246,7 @@ func (server *Server) initHttpServer() {
 
 	router.Handle(http.MethodPut, "/configure", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		if err := serverConfig.Dump(jsonPath); err != nil {
-			RenderJSON(w, false, err.Error())
+			RenderError(w, err)
 			return
 		}
 
@@ -180,7 +261,7 @@ func (server *Server) initHttpServer() {
 		// 先增加配置
 		if err := serverConfig.Add(field, name, data); err != nil {
 			logger.ConfigLog("error", fmt.Sprintf("adding %s to config", name), err.Error())
-			RenderJSON(w, false, err.Error())
+			RenderError(w, err)
 			return
 		}
 
@@ -190,17 +271,23 @@ func (server *Server) initHttpServer() {
 			cmdInfo, err := ConvertAppConfig(name, appCfg)
 			if err != nil {
 				logger.AppLog("error", "configuring", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
 				return
 			}
 
 			if err = appManager.Add(name, cmdInfo); err != nil {
 				logger.AppLog("error", "adding", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
 				return
 			}
 			logger.AppLog("info", "adding", name, fmt.Sprintf("%s is added", name))
 		}
+		if field == "schedule" {
+			if err := scheduleManager.Set(name); err != nil {
+				RenderError(w, err)
+				return
+			}
+		}
 		RenderJSON(w, true, fmt.Sprintf("OK! %s: %s is added", field, name))
 	}))
 
@@ -209,7 +296,7 @@ func (server *Server) initHttpServer() {
 		name := p.ByName("name")
 		cfg := serverConfig.GetConfig(field, name)
 		if cfg == nil {
-			RenderJSON(w, false, fmt.Errorf("%s not found: %s", field, name).Error())
+			RenderError(w, fmt.Errorf("%w: %s %s", config.ErrNotFound, field, name))
 			return
 		}
 		RenderJSON(w, true, cfg)
@@ -218,19 +305,40 @@ func (server *Server) initHttpServer() {
 	router.Handle(http.MethodDelete, "/configure/:field/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		field := p.ByName("field")
 		name := p.ByName("name")
+		if field == "app" {
+			if deps := serverConfig.Dependents(name); len(deps) > 0 {
+				err := fmt.Errorf("%w: %s is required by %s", config.ErrInUse, name, strings.Join(deps, ", "))
+				logger.ConfigLog("error", fmt.Sprintf("removing %s from config", name), err.Error())
+				RenderError(w, err)
+				return
+			}
+		}
 		if field == "app" && appManager.Exists(name) {
 			if err := appManager.Remove(name); err != nil {
 				logger.AppLog("error", "removing", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
 				return
 			}
 		}
 
 		if err := serverConfig.Delete(field, name); err != nil {
 			logger.ConfigLog("error", fmt.Sprintf("removing %s from config", name), err.Error())
-			RenderJSON(w, false, err.Error())
+			RenderError(w, err)
 			return
 		}
+		// 删除proxy时停止它的端口转发
+		if field == "proxy" && forwardManager.Running(name) {
+			forwardManager.Stop(name)
+		}
+		if field == "serial" {
+			closeSerial(name)
+		}
+		if field == "schedule" {
+			scheduleManager.Remove(name)
+		}
+		if field == "command" || field == "app" || field == "serial" {
+			limitManager.Remove(field, name)
+		}
 		RenderJSON(w, true, fmt.Sprintf("OK! %s: %s is deleted", field, name))
 	}))
 
@@ -242,29 +350,44 @@ func (server *Server) initHttpServer() {
 		if field == "app" && appManager.Exists(name) {
 			if err := appManager.Remove(name); err != nil {
 				logger.AppLog("error", "removing", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
 				return
 			}
 		}
 
-		if err := serverConfig.Modify(field, name, data); err != nil {
-			logger.ConfigLog("error", fmt.Sprintf("editing %s config", name), err.Error())
-			RenderJSON(w, false, err.Error())
-			return
+		modifyErr := serverConfig.Modify(field, name, data)
+		if modifyErr != nil {
+			logger.ConfigLog("error", fmt.Sprintf("editing %s config", name), modifyErr.Error())
 		}
 
-		if field == "app" {
+		// 修改失败时配置没有变化，用原来的配置重新加回app manager
+		if field == "app" && serverConfig.Exists("app", name) {
 			appCfg := serverConfig.GetConfig("app", name).(*config.AppCfg)
 			cmdInfo, err := ConvertAppConfig(name, appCfg)
 			if err != nil {
 				logger.AppLog("error", "configuring", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
 				return
 			}
 
 			if err = appManager.Add(name, cmdInfo); err != nil {
 				logger.AppLog("error", "adding", name, err.Error())
-				RenderJSON(w, false, err.Error())
+				RenderError(w, err)
+				return
+			}
+		}
+		if modifyErr != nil {
+			RenderError(w, modifyErr)
+			return
+		}
+		// 串口参数变化后重新打开
+		if field == "serial" {
+			closeSerial(name)
+		}
+		// 按新的配置重新计时
+		if field == "schedule" {
+			if err := scheduleManager.Set(name); err != nil {
+				RenderError(w, err)
 				return
 			}
 		}
@@ -276,9 +399,17 @@ func (server *Server) initHttpServer() {
 		var rdata BodyExec
 		if err := json.Unmarshal(data, &rdata); err != nil {
 			logger.HttpRequestLog("error", r, err.Error())
-			http.Error(w, err.Error(), 400)
+			RenderError(w, BadRequest(err))
+			return
+		}
+		waited, release, err := limitManager.Command(r.Context(), "")
+		if err != nil {
+			logger.HttpRequestLog("warning", r, err.Error())
+			RenderError(w, err)
 			return
 		}
+		defer release()
+		setQueueTime(w, waited)
 
 		cmd := command.Command{
 			Args:    append([]string{rdata.Cmd}, rdata.Args...),
@@ -290,7 +421,7 @@ func (server *Server) initHttpServer() {
 
 		output, err := cmd.CombinedOutput()
 		if err != nil {
-			RenderJSON(w, false, err.Error())
+			RenderError(w, NewHttpError(http.StatusInternalServerError, ErrCodeCommandFailed, err))
 		} else {
 			RenderJSON(w, true, strings.TrimSpace(string(output)))
 		}
@@ -299,41 +430,34 @@ func (server *Server) initHttpServer() {
 	router.Handle(http.MethodPost, "/command/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		data, _ := io.ReadAll(r.Body)
 		cmdName := p.ByName("name")
-		cmdCfg := serverConfig.GetConfig("command", cmdName).(*config.CmdCfg)
-		var rdata BodyWithArgs
-		if err := json.Unmarshal(data, &rdata); err != nil {
-			logger.HttpRequestLog("error", r, err.Error())
-			http.Error(w, err.Error(), 400)
+		if !serverConfig.Exists("command", cmdName) {
+			RenderError(w, fmt.Errorf("%w: command %s", config.ErrNotFound, cmdName))
 			return
 		}
-
-		var args []string
-		if len(rdata.Args) > 0 {
-			args = rdata.Args
-		} else {
-			args = cmdCfg.DefaultArgs
+		if err := requireLease(r, "command", cmdName); err != nil {
+			RenderError(w, err)
+			return
 		}
-
-		cmd := command.Command{
-			Args:    append([]string{cmdCfg.Cmd}, args...),
-			Shell:   true,
-			Timeout: 10 * time.Minute,
-			Stdout:  os.Stdout,
-			Stderr:  os.Stderr,
+		var rdata BodyCommand
+		if err := json.Unmarshal(data, &rdata); err != nil {
+			logger.HttpRequestLog("error", r, err.Error())
+			RenderError(w, BadRequest(err))
+			return
 		}
 
-		output, err := cmd.CombinedOutput()
+		output, waited, err := RunLimitedCommand(r.Context(), cmdName, rdata.Args, rdata.Params, 10*time.Minute)
+		setQueueTime(w, waited)
 		if err != nil {
-			RenderJSON(w, false, err.Error())
+			RenderError(w, err)
 		} else {
-			RenderJSON(w, true, strings.TrimSpace(string(output)))
+			RenderJSON(w, true, output)
 		}
 	}))
 
 	router.Handle(http.MethodGet, "/app/status", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		name := r.URL.Query().Get("name")
 		if !appManager.Exists(name) {
-			RenderJSON(w, false, fmt.Sprintf("app not found: %s", name))
+			RenderError(w, cmdctrl.ErrMsg("ANF", name))
 			return
 		}
 		var status string
@@ -346,19 +470,89 @@ func (server *Server) initHttpServer() {
 		RenderJSON(w, true, status)
 	}))
 
+	router.Handle(http.MethodGet, "/app/clients", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := r.URL.Query().Get("name")
+		if _, ok := linkConfig(name); !ok {
+			RenderError(w, cmdctrl.ErrMsg("ANF", name))
+			return
+		}
+		status, ok := wsManager.HubStatus(name)
+		if !ok {
+			status = HubStatus{App: name, Clients: []HubClient{}}
+		}
+		RenderJSON(w, true, status)
+	}))
+
+	router.Handle(http.MethodGet, "/ports", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, sockpManager.List())
+	}))
+
+	router.Handle(http.MethodGet, "/app/autostart", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, autostarter.Results())
+	}))
+
+	router.Handle(http.MethodGet, "/app/logs", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := r.URL.Query().Get("name")
+		if !appManager.Exists(name) {
+			RenderError(w, cmdctrl.ErrMsg("ANF", name))
+			return
+		}
+		lines := 0
+		if l := r.URL.Query().Get("lines"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil {
+				RenderError(w, BadRequest(fmt.Errorf("invalid lines: %s", l)))
+				return
+			}
+			lines = n
+		}
+		RenderJSON(w, true, outputManager.Get(name).Tail(lines))
+	}))
+
+	router.Handle(http.MethodPost, "/app/stdin", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		name := r.URL.Query().Get("name")
+		appCfg, ok := serverConfig.GetConfig("app", name).(*config.AppCfg)
+		if !ok {
+			RenderError(w, cmdctrl.ErrMsg("ANF", name))
+			return
+		}
+		if err := requireLease(r, "app", name); err != nil {
+			RenderError(w, err)
+			return
+		}
+		var rdata BodyStdin
+		if err := json.Unmarshal(data, &rdata); err != nil {
+			logger.HttpRequestLog("error", r, err.Error())
+			RenderError(w, BadRequest(err))
+			return
+		}
+		res, err := WriteStdin(r.Context(), name, appCfg, &rdata)
+		if err != nil {
+			logger.AppLog("error", "writing stdin", name, err.Error())
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, res)
+	}))
+
 	router.Handle(http.MethodPost, "/app/control", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		data, _ := io.ReadAll(r.Body)
 		name := r.URL.Query().Get("name")
 		var rdata BodyWithArgs
 		if err := json.Unmarshal(data, &rdata); err != nil {
 			logger.HttpRequestLog("error", r, err.Error())
-			http.Error(w, err.Error(), 400)
+			RenderError(w, BadRequest(err))
+			return
+		}
+		if err := requireLease(r, "app", name); err != nil {
+			RenderError(w, err)
 			return
 		}
 		if err := appManager.Start(name, rdata.Args...); err != nil {
-			errMsg := fmt.Sprintf("Fail! app %s %s", name, err.Error())
-			logger.AppLog("error", "starting", name, errMsg)
-			RenderJSON(w, false, errMsg)
+			err = fmt.Errorf("Fail! app %s %w", name, err)
+			logger.AppLog("error", "starting", name, err.Error())
+			RenderError(w, err)
 			return
 		}
 		RenderJSON(w, true, fmt.Sprintf("OK! app %s is started", name))
@@ -366,44 +560,150 @@ func (server *Server) initHttpServer() {
 
 	router.Handle(http.MethodDelete, "/app/control", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		name := r.URL.Query().Get("name")
-		if sockpManager.Exists(name) {
-			if err := sockpManager.Deregister(name); err != nil {
-				logger.AppLog("error", "socketport deregistering", name, err.Error())
-				RenderJSON(w, false, err.Error())
-				return
-			}
+		if err := requireLease(r, "app", name); err != nil {
+			RenderError(w, err)
+			return
 		}
-
+		sessionManager.Close(name)
+		// 端口在app停止后释放
 		if err := appManager.Stop(name, true); err != nil {
 			logger.AppLog("error", "stopping", name, err.Error())
-			RenderJSON(w, false, err.Error())
+			RenderError(w, err)
 			return
 		}
 
 		RenderJSON(w, true, fmt.Sprintf("OK! app %s is stopped", name))
 	}))
 
-	router.Handle(http.MethodGet, "/app/link/:appname", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	router.Handle(http.MethodGet, "/group/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		group := p.ByName("name")
+		members := serverConfig.Group(group)
+		if len(members) == 0 {
+			RenderError(w, NotFound("group not found: %s", group))
+			return
+		}
+		order, err := appManager.Order(members...)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		status := make([]map[string]interface{}, 0, len(order))
+		for _, name := range order {
+			status = append(status, map[string]interface{}{
+				"name":    name,
+				"running": appManager.Running(name),
+				"member":  containsString(members, name),
+			})
+		}
+		RenderJSON(w, true, status)
+	}))
+
+	router.Handle(http.MethodPost, "/group/:name/start", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		group := p.ByName("name")
+		members := serverConfig.Group(group)
+		if len(members) == 0 {
+			RenderError(w, NotFound("group not found: %s", group))
+			return
+		}
+		for _, name := range members {
+			if err := requireLease(r, "app", name); err != nil {
+				RenderError(w, err)
+				return
+			}
+		}
+		if err := appManager.StartGroup(members...); err != nil {
+			logger.AppLog("error", "starting group", group, err.Error())
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("OK! group %s is started", group))
+	}))
+
+	router.Handle(http.MethodPost, "/group/:name/stop", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		group := p.ByName("name")
+		members := serverConfig.Group(group)
+		if len(members) == 0 {
+			RenderError(w, NotFound("group not found: %s", group))
+			return
+		}
+		for _, name := range members {
+			if err := requireLease(r, "app", name); err != nil {
+				RenderError(w, err)
+				return
+			}
+		}
+		stopped, err := appManager.StopGroup(members...)
+		for _, name := range stopped {
+			sessionManager.Close(name)
+		}
+		if err != nil {
+			logger.AppLog("error", "stopping group", group, err.Error())
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("OK! group %s is stopped", group))
+	}))
+
+	router.Handle(http.MethodGet, "/app/link/:appname", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		appName := p.ByName("appname")
-		appCfg := serverConfig.GetConfig("app", appName).(*config.AppCfg)
+		appCfg, ok := linkConfig(appName)
+		if !ok {
+			RenderError(w, cmdctrl.ErrMsg("ANF", appName))
+			return
+		}
 		if appCfg.Websocket {
-			wconn, err := upgrader.Upgrade(w, r, nil)
+			// 升级之前先拿到socket url，升级后就不能再返回http错误了
+			socketUrl, err := linkUrl(appName)
 			if err != nil {
-				logger.HttpRequestLog("error", r, "failed to upgrade request")
-				http.Error(w, "Failed to upgrade request", 500)
+				logger.AppLog("error", "getting socketurl", appName, err.Error())
+				RenderError(w, err)
 				return
 			}
-			socketUrl, err := GetSocketUrl(appName)
+			mode, c, err := linkWSOptions(r, appCfg)
 			if err != nil {
-				logger.AppLog("error", "getting socketurl", appName, err.Error())
-				http.Error(w, fmt.Sprintf("Failed to get %s's socketurl", appName), 500)
+				RenderError(w, BadRequest(err))
+				return
+			}
+			// 只读的observer不需要租约
+			if !queryBool(r, "observe") {
+				if err := requireLease(r, "app", appName); err != nil {
+					RenderError(w, err)
+					return
+				}
+			}
+			writeMode, err := linkWriteMode(appCfg.LinkWriteMode)
+			if err != nil {
+				RenderError(w, fmt.Errorf("%w: %v", config.ErrField, err))
+				return
+			}
+			if err := wsManager.CheckHub(appName, socketUrl, c != nil); err != nil {
+				RenderError(w, err)
+				return
+			}
+			wconn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				// Upgrade失败时已经回复了http错误
+				logger.HttpRequestLog("error", r, "failed to upgrade request")
 				return
 			}
 			client := NewWSClient(wconn, wsManager)
+			client.mode = mode
+			client.observer = queryBool(r, "observe")
+			// 二进制和分帧模式下不发送Bye!Bye!，避免破坏socket的协议
+			client.bye = mode == WSModeAuto && c == nil
+			if isSerialUrl(socketUrl) {
+				// 串口只能打开一次，websocket优先，先关闭PUT请求的长连接
+				sessionManager.Close(appName)
+			}
 			wsManager.AddWSClient(client)
-			if err = wsManager.AddSockClient(client, "recv", socketUrl); err != nil {
-				logger.AppLog("error", "adding socketclient", appName, err.Error())
-				http.Error(w, fmt.Sprintf("Failed to add %s's socketclient", appName), 500)
+			if err = wsManager.Join(client, appName, socketUrl, c, writeMode); err != nil {
+				logger.AppLog("error", "joining link hub", appName, err.Error())
+				msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, fmt.Sprintf("Failed to join %s's link hub", appName))
+				if errors.Is(err, serial.ErrBusy) {
+					msg = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+				}
+				wconn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				wsManager.RmWSClient(client)
 				return
 			}
 			go client.ReadMsg()
@@ -411,63 +711,447 @@ func (server *Server) initHttpServer() {
 		} else {
 			err := fmt.Errorf("app %s method not allowed", appName)
 			logger.HttpRequestLog("error", r, err.Error())
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+			RenderError(w, NewHttpError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, err))
 		}
-	})
+	}))
+
+	router.Handle(http.MethodGet, "/app/tty/:appname", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("appname")
+		appCfg, ok := serverConfig.GetConfig("app", appName).(*config.AppCfg)
+		if !ok {
+			RenderError(w, cmdctrl.ErrMsg("ANF", appName))
+			return
+		}
+		if !appCfg.Pty {
+			RenderError(w, fmt.Errorf("%w: %s is not a pty app", config.ErrField, appName))
+			return
+		}
+		// 默认只读，write=true时成为唯一的writer
+		write := queryBool(r, "write")
+		if write {
+			if err := requireLease(r, "app", appName); err != nil {
+				RenderError(w, err)
+				return
+			}
+		}
+		if err := wsManager.CheckTty(appName, write); err != nil {
+			RenderError(w, err)
+			return
+		}
+		wconn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade失败时已经回复了http错误
+			logger.HttpRequestLog("error", r, "failed to upgrade request")
+			return
+		}
+		client := NewWSClient(wconn, wsManager)
+		client.mode = WSModeBinary
+		client.observer = !write
+		client.bye = false
+		wsManager.AddWSClient(client)
+		if err = wsManager.JoinTty(client, appName, write); err != nil {
+			logger.AppLog("error", "joining tty", appName, err.Error())
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+			wconn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			wsManager.RmWSClient(client)
+			return
+		}
+		go client.ReadMsg()
+		go client.WriteMsg()
+	}))
+
+	router.Handle(http.MethodGet, "/app/tty/:appname/status", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("appname")
+		if !appManager.Exists(appName) {
+			RenderError(w, cmdctrl.ErrMsg("ANF", appName))
+			return
+		}
+		status, ok := wsManager.TtyStatus(appName)
+		if !ok {
+			RenderError(w, NewHttpError(http.StatusConflict, ErrCodeAppStopped, fmt.Errorf("tty of %s is not running", appName)))
+			return
+		}
+		RenderJSON(w, true, status)
+	}))
 
 	router.Handle(http.MethodPut, "/app/link/:appname", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		data, _ := io.ReadAll(r.Body)
 		appName := p.ByName("appname")
-		appCfg := serverConfig.GetConfig("app", appName).(*config.AppCfg)
+		appCfg, ok := linkConfig(appName)
+		if !ok {
+			RenderError(w, cmdctrl.ErrMsg("ANF", appName))
+			return
+		}
+		if err := requireLease(r, "app", appName); err != nil {
+			RenderError(w, err)
+			return
+		}
 		logger.AppLog("info", "interacting", appName, fmt.Sprintf("request body: %s", data))
 		if appCfg.Socket {
-			socketUrl, err := GetSocketUrl(appName)
+			socketUrl, err := linkUrl(appName)
 			if err != nil {
 				logger.AppLog("error", "getting socketurl", appName, err.Error())
-				RenderJSON(w, false, err.Error())
-				return
-			}
-			channel := make(chan string)
-			/* 			go func(url string, data []byte, ch chan string) {
-				conn, err := net.Dial("tcp", url)
-				defer func() {
-					if err = conn.Close(); err != nil {
-						logger.SocketLog("error", &conn, err.Error())
-						ch <- err.Error()
-					}
-				}()
+				RenderError(w, err)
+				return
+			}
+			c, err := appCodec(appCfg)
+			if err != nil {
+				RenderError(w, err)
+				return
+			}
+			timeout, err := linkTimeout(r, appCfg)
+			if err != nil {
+				RenderError(w, BadRequest(err))
+				return
+			}
+			encoding, err := payloadEncoding(r.URL.Query().Get("encoding"), appCfg.Framing)
+			if err != nil {
+				RenderError(w, BadRequest(err))
+				return
+			}
+			if data, err = decodePayload(data, encoding); err != nil {
+				RenderError(w, BadRequest(err))
+				return
+			}
+			// 同一个app的请求依次处理，排队超时或队列满时返回503
+			waited, release, err := limitManager.Link(r.Context(), appName, appCfg)
+			if err != nil {
+				logger.AppLog("warning", "interacting", appName, err.Error())
+				RenderError(w, err)
+				return
+			}
+			setQueueTime(w, waited)
+			resp, err := sessionManager.Get(appName).Request(socketUrl, c, data, timeout)
+			release()
+			if err != nil {
+				logger.AppLog("error", "interacting", appName, err.Error())
+				RenderError(w, tunnelError(err))
+				return
+			}
+			renderPayload(w, resp, encoding)
+		} else {
+			err := fmt.Errorf("%s does not support link", appName)
+			RenderError(w, NewHttpError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, err))
+		}
+	}))
+
+	// 脚本执行失败时仍然返回200，结果中ok为false，带上执行到失败为止的记录
+	router.Handle(http.MethodPost, "/expect", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		var rdata BodyExpect
+		if err := json.Unmarshal(data, &rdata); err != nil {
+			logger.HttpRequestLog("error", r, err.Error())
+			RenderError(w, BadRequest(err))
+			return
+		}
+		if rdata.App != "" {
+			if err := requireLease(r, "app", rdata.App); err != nil {
+				RenderError(w, err)
+				return
+			}
+			// 与PUT /app/link一起排队，避免脚本和其他请求交替写入
+			if appCfg, ok := linkConfig(rdata.App); ok {
+				waited, release, err := limitManager.Link(r.Context(), rdata.App, appCfg)
 				if err != nil {
-					logger.SocketLog("error", &conn, err.Error())
-					ch <- err.Error()
+					RenderError(w, err)
+					return
 				}
+				defer release()
+				setQueueTime(w, waited)
+			}
+		}
+		res, err := RunExpect(r.Context(), &rdata)
+		if err != nil {
+			logger.HttpRequestLog("error", r, err.Error())
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, res)
+	}))
 
-				conn.Write(data)
-				reader := bufio.NewReader(conn)
-				var out string
-				for {
-					line, _, err := reader.ReadLine()
-					if err != nil {
-						break
-					}
-					out = out + fmt.Sprintf("\n%s", line)
-				}
-				out = strings.Trim(out, "\n")
-				ch <- out
-			}(socketUrl, data, channel) */
-			go SocketTunnel(socketUrl, data, channel)
-			output := <-channel
-			header := output[0:4]
-			if header == "0000" {
-				RenderJSON(w, false, output[4:])
-			} else {
-				RenderJSON(w, true, output[4:])
+	router.Handle(http.MethodGet, "/forward", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, forwardManager.List())
+	}))
+
+	router.Handle(http.MethodGet, "/forward/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		if !forwardManager.Running(name) {
+			if _, err := forwardConfig(name); err != nil {
+				RenderError(w, err)
+				return
 			}
-		} else {
-			http.Error(w, fmt.Sprintf("%s does not support link", appName), http.StatusMethodNotAllowed)
 		}
+		RenderJSON(w, true, forwardManager.Status(name))
+	}))
+
+	router.Handle(http.MethodPost, "/forward/:name/start", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		if err := forwardManager.Start(name); err != nil {
+			logger.ProxyLog("error", "starting forward", name, err.Error())
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, forwardManager.Status(name))
+	}))
+
+	router.Handle(http.MethodPost, "/forward/:name/stop", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		if err := forwardManager.Stop(name); err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("OK! forward %s is stopped", name))
+	}))
+
+	router.Handle(http.MethodGet, "/schedule", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, scheduleManager.List())
+	}))
+
+	router.Handle(http.MethodGet, "/schedule/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		status, err := scheduleManager.Status(p.ByName("name"))
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, status)
+	}))
+
+	// 与POST /configure/schedule/:name相同，需要PUT /configure保存到配置文件
+	router.Handle(http.MethodPost, "/schedule/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		name := p.ByName("name")
+		if err := serverConfig.Add("schedule", name, data); err != nil {
+			logger.ConfigLog("error", fmt.Sprintf("adding schedule %s to config", name), err.Error())
+			RenderError(w, err)
+			return
+		}
+		if err := scheduleManager.Set(name); err != nil {
+			RenderError(w, err)
+			return
+		}
+		status, _ := scheduleManager.Status(name)
+		RenderJSON(w, true, status)
+	}))
+
+	router.Handle(http.MethodDelete, "/schedule/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		if err := serverConfig.Delete("schedule", name); err != nil {
+			logger.ConfigLog("error", fmt.Sprintf("removing schedule %s from config", name), err.Error())
+			RenderError(w, err)
+			return
+		}
+		scheduleManager.Remove(name)
+		RenderJSON(w, true, fmt.Sprintf("OK! schedule %s is deleted", name))
+	}))
+
+	// 立即运行一次，等待运行结束后返回结果
+	router.Handle(http.MethodPost, "/schedule/:name/run", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		res, err := scheduleManager.Trigger(p.ByName("name"), leaseTokens(r))
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, res)
+	}))
+
+	// 在后台运行工作流，通过GET /jobs/:id查看每一步的结果
+	router.Handle(http.MethodPost, "/workflow/:name/run", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		name := p.ByName("name")
+		var rdata BodyWorkflow
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &rdata); err != nil {
+				logger.HttpRequestLog("error", r, err.Error())
+				RenderError(w, BadRequest(err))
+				return
+			}
+		}
+		job, err := workflowManager.Run(name, rdata.Vars, leaseTokens(r))
+		if err != nil {
+			logger.SysLog("error", "running workflow", fmt.Sprintf("%s: %v", name, err))
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, job)
+	}))
+
+	router.Handle(http.MethodGet, "/jobs", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, workflowManager.Jobs(r.URL.Query().Get("workflow")))
+	}))
+
+	router.Handle(http.MethodGet, "/jobs/:id", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		job, err := workflowManager.Job(p.ByName("id"))
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, job)
+	}))
+
+	router.Handle(http.MethodDelete, "/jobs/:id", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		id := p.ByName("id")
+		if err := workflowManager.Cancel(id); err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("OK! job %s is canceled", id))
+	}))
+
+	router.Handle(http.MethodGet, "/limits", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, limitManager.Status())
+	}))
+
+	router.Handle(http.MethodGet, "/metrics", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		buf := bytes.Buffer{}
+		for _, m := range collectMetrics() {
+			m.write(&buf)
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			logger.HttpResponseLog("error", err.Error())
+		}
+	}))
+
+	router.Handle(http.MethodGet, "/locks", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, lockManager.List())
+	}))
+
+	router.Handle(http.MethodGet, "/locks/:resource", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RenderJSON(w, true, lockManager.Status(p.ByName("resource")))
+	}))
+
+	// 被占用时按wait排队等待，返回的token用于续约、释放和访问需要租约的接口
+	router.Handle(http.MethodPost, "/locks/:resource", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		var rdata BodyLock
+		if err := json.Unmarshal(data, &rdata); err != nil {
+			logger.HttpRequestLog("error", r, err.Error())
+			RenderError(w, BadRequest(err))
+			return
+		}
+		ttl, err := leaseTTL(rdata.TTL)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		if rdata.Wait < 0 {
+			RenderError(w, fmt.Errorf("%w: invalid wait %d", config.ErrField, rdata.Wait))
+			return
+		}
+		lease, err := lockManager.Acquire(r.Context(), p.ByName("resource"), rdata.Owner, ttl, time.Duration(rdata.Wait)*time.Second)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, lease)
+	}))
+
+	router.Handle(http.MethodPut, "/locks/:resource", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		data, _ := io.ReadAll(r.Body)
+		var rdata BodyLease
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &rdata); err != nil {
+				logger.HttpRequestLog("error", r, err.Error())
+				RenderError(w, BadRequest(err))
+				return
+			}
+		}
+		if rdata.TTL < 0 {
+			RenderError(w, fmt.Errorf("%w: invalid ttl %d", config.ErrField, rdata.TTL))
+			return
+		}
+		var ttl time.Duration
+		if rdata.TTL > 0 {
+			var err error
+			if ttl, err = leaseTTL(rdata.TTL); err != nil {
+				RenderError(w, err)
+				return
+			}
+		}
+		if rdata.Token == "" {
+			rdata.Token = r.Header.Get(leaseTokenHeader)
+		}
+		lease, err := lockManager.Renew(p.ByName("resource"), rdata.Token, ttl)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, lease)
+	}))
+
+	// force=true时不检查token，用于清理异常退出的任务留下的租约
+	router.Handle(http.MethodDelete, "/locks/:resource", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		resource := p.ByName("resource")
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = r.Header.Get(leaseTokenHeader)
+		}
+		if err := lockManager.Release(resource, token, queryBool(r, "force")); err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("OK! lock %s is released", resource))
 	}))
 
-	// 临时用，后续用反向代理做转发
+	router.Handle(http.MethodGet, "/recordings", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		infos, err := record.List(serverConfig.GetSysConfig().GetRecordDir(), r.URL.Query().Get("app"))
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, infos)
+	}))
+
+	router.Handle(http.MethodGet, "/recordings/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		path, err := record.Path(serverConfig.GetSysConfig().GetRecordDir(), name)
+		if err != nil {
+			RenderError(w, BadRequest(err))
+			return
+		}
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			RenderError(w, NotFound("recording not found: %s", name))
+			return
+		} else if err != nil {
+			RenderError(w, err)
+			return
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, stat.ModTime(), file)
+	}))
+
+	router.Handle(http.MethodDelete, "/recordings/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		path, err := record.Path(serverConfig.GetSysConfig().GetRecordDir(), name)
+		if err != nil {
+			RenderError(w, BadRequest(err))
+			return
+		}
+		if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+			RenderError(w, NotFound("recording not found: %s", name))
+			return
+		} else if err != nil {
+			RenderError(w, err)
+			return
+		}
+		RenderJSON(w, true, fmt.Sprintf("recording %s is deleted", name))
+	}))
+
+	// http proxy的反向代理
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		router.Handle(method, "/proxy/:name/*path", RequestPreprocess(HttpProxy))
+	}
+
+	// socket proxy的一次性请求
 	router.Handle(http.MethodPut, "/proxy/:name", RequestPreprocess(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		data, _ := io.ReadAll(r.Body)
 		pxyName := p.ByName("name")
@@ -477,7 +1161,7 @@ func (server *Server) initHttpServer() {
 		var rdata BodyProxy
 		if err := json.Unmarshal(data, &rdata); err != nil {
 			logger.HttpRequestLog("error", r, err.Error())
-			http.Error(w, err.Error(), 400)
+			RenderError(w, BadRequest(err))
 			return
 		}
 
@@ -486,26 +1170,74 @@ func (server *Server) initHttpServer() {
 			// 如果没有对应名称，则直接用request body中的host和port作为url发请求
 			if rdata.Host == "" && rdata.Port == 0 {
 				logger.ProxyLog("error", "getting proxy info", pxyName, "host and port are empty")
-				RenderJSON(w, false, "host and port are empty")
+				RenderError(w, BadRequest(errors.New("host and port are empty")))
 				return
 			}
 			url = fmt.Sprintf("%v:%v", rdata.Host, rdata.Port)
 		} else {
 			pxyCfg = _pxyCfg.(*config.ProxyCfg)
-			url = fmt.Sprintf("%v:%v", pxyCfg.Host, pxyCfg.Port)
+			url = proxyAddress(pxyCfg)
+		}
+		c, err := proxyCodec(pxyCfg)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+		var (
+			framing   *config.FramingCfg
+			timeoutMs int
+		)
+		if pxyCfg != nil {
+			framing, timeoutMs = pxyCfg.Framing, pxyCfg.Timeout
+		}
+		timeout, err := requestTimeout(r, timeoutMs)
+		if err != nil {
+			RenderError(w, BadRequest(err))
+			return
+		}
+		encoding, err := payloadEncoding(rdata.Encoding, framing)
+		if err != nil {
+			RenderError(w, BadRequest(err))
+			return
+		}
+		content, err := decodePayload([]byte(rdata.Content), encoding)
+		if err != nil {
+			RenderError(w, BadRequest(err))
+			return
+		}
+		channel := make(chan TunnelResult, 1)
+		go SocketTunnel(url, c, content, timeout, channel)
+		result := <-channel
+		if result.Err != nil {
+			RenderError(w, result.Err)
+			return
 		}
-		channel := make(chan string)
-		go SocketTunnel(url, []byte(rdata.Content), channel)
-		output := <-channel
-		RenderJSON(w, true, output)
+		renderPayload(w, result.Output, encoding)
 	}))
 	// 服务热重启
 	// router.Handle(http.MethodPut, "/restart", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// })
 
-	server.httpServer = &http.Server{Handler: router}
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIdHeader, requestId(r))
+		RenderError(w, NotFound("route not found: %s %s", r.Method, r.URL.Path))
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIdHeader, requestId(r))
+		err := fmt.Errorf("method %s not allowed: %s", r.Method, r.URL.Path)
+		RenderError(w, NewHttpError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, err))
+	})
+	router.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		logger.HttpRequestLog("error", r, fmt.Sprintf("panic: %v", v))
+		RenderError(w, fmt.Errorf("internal error: %v", v))
+	}
+	return router
 }
 
 func (server *Server) Serve(l net.Listener) error {
 	return server.httpServer.Serve(l)
 }
+
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
+}
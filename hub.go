@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"hostctl_proxy/internal/codec"
+
+	"github.com/gorilla/websocket"
+)
+
+// 输入的转发方式
+const (
+	// 所有非观察者客户端的输入都发给app
+	LinkWriteAll = "all"
+	// 只有controller的输入发给app，controller断开后由最早加入的客户端接替
+	LinkWriteController = "controller"
+)
+
+var ErrHubConflict = errors.New("link hub conflict")
+
+// LinkHub 一个socket app的所有websocket客户端共用一个socket连接
+// app的输出广播给所有客户端，字段由WSManager的锁保护
+// 建立连接期间hub已经放入manager，sc为空，ready关闭后sc或err才有值
+// 客户端的输入经input交给hub自己的写协程，app不读取时不影响其他app
+type LinkHub struct {
+	app        string
+	url        string
+	framing    bool
+	sc         *SocketClient
+	err        error
+	ready      chan struct{}
+	input      chan NotifyEvent
+	closed     chan struct{} // hub移除后关闭
+	farewell   []byte        // 关闭socket前最后发给app的消息
+	manager    *WSManager
+	clients    map[*WSClient]bool
+	controller *WSClient
+	writeMode  string
+	created    time.Time
+}
+
+type HubClient struct {
+	Id       int64     `json:"id"`
+	Remote   string    `json:"remote"`
+	Mode     string    `json:"mode"`
+	Observer bool      `json:"observer"`
+	Since    time.Time `json:"since"`
+}
+
+type HubStatus struct {
+	App        string      `json:"app"`
+	Url        string      `json:"url"`
+	Framing    bool        `json:"framing"`
+	WriteMode  string      `json:"write_mode"`
+	Controller int64       `json:"controller,omitempty"`
+	Created    time.Time   `json:"created"`
+	Clients    []HubClient `json:"clients"`
+}
+
+func linkWriteMode(mode string) (string, error) {
+	switch mode {
+	case "", LinkWriteAll:
+		return LinkWriteAll, nil
+	case LinkWriteController:
+		return LinkWriteController, nil
+	}
+	return "", fmt.Errorf("invalid link_write_mode: %s", mode)
+}
+
+// 选出最早加入的非观察者作为controller，调用前需要持有manager的锁
+func (h *LinkHub) elect() {
+	h.controller = nil
+	for c := range h.clients {
+		if c.observer {
+			continue
+		}
+		if h.controller == nil || c.since.Before(h.controller.since) {
+			h.controller = c
+		}
+	}
+}
+
+// 调用前需要持有manager的锁
+func (h *LinkHub) writable(c *WSClient) bool {
+	if c.observer {
+		return false
+	}
+	return h.writeMode == LinkWriteAll || h.controller == c
+}
+
+// 把app的输出发给所有客户端
+// 客户端的写通道满了说明它跟不上输出，断开它以免影响其他客户端
+func (h *LinkHub) broadcast(data []byte) {
+	h.manager.RLock()
+	clients := make([]*WSClient, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.manager.RUnlock()
+
+	for _, c := range clients {
+		if !c.trySend(WSMessage{Type: c.messageType(data), Data: data}) {
+			logger.WebSocketLog("error", c.conn, fmt.Sprintf("Websocket client of %s is too slow, disconnecting", h.app))
+			go c.manager.RmWSClient(c)
+		}
+	}
+}
+
+// 实时接收app的输出并广播
+// socket断开时把关闭原因通过close frame告诉所有客户端
+func (h *LinkHub) pump() {
+	for {
+		output, err := h.sc.ReadPump()
+		if err != nil {
+			h.manager.RLock()
+			removed := h.manager.hubs[h.app] != h
+			h.manager.RUnlock()
+			if removed {
+				// socket是hub移除时关闭的
+				return
+			}
+			code, reason := websocket.CloseInternalServerErr, err.Error()
+			if errors.Is(err, io.EOF) {
+				logger.SocketLog("info", h.sc.url, "Socket closed by server")
+				code, reason = websocket.CloseNormalClosure, "socket closed by app"
+			} else {
+				logger.SocketLog("error", h.sc.url, fmt.Sprintf("Failed to receive message from server: %v", err))
+			}
+			h.manager.closeHub(h, code, reason)
+			return
+		}
+		h.broadcast(output)
+	}
+}
+
+// 把客户端的输入交给写协程，队列满时等待，hub关闭后返回错误
+func (h *LinkHub) enqueue(evt NotifyEvent) error {
+	select {
+	case h.input <- evt:
+		return nil
+	case <-h.closed:
+		return fmt.Errorf("link hub of %s is closed", h.app)
+	}
+}
+
+// 按顺序把客户端的输入发给app，hub移除后发完剩余的输入和farewell再关闭socket
+func (h *LinkHub) writeInput() {
+	for {
+		select {
+		case evt := <-h.input:
+			h.write(evt)
+		case <-h.closed:
+			// 只有这里读取input，先发完客户端离开前的输入
+			for len(h.input) > 0 {
+				h.write(<-h.input)
+			}
+			if h.farewell != nil {
+				h.sc.WritePump(h.farewell)
+			}
+			(*h.sc.conn).Close()
+			logger.SocketLog("info", h.sc.url, fmt.Sprintf("link hub of %s closed", h.app))
+			return
+		}
+	}
+}
+
+func (h *LinkHub) write(evt NotifyEvent) {
+	if err := h.sc.WritePump(evt.message); err != nil {
+		// 发送失败时关闭websocket，避免客户端以为消息已经送达
+		go evt.client.Close(websocket.CloseInternalServerErr, err.Error())
+	}
+}
+
+// 检查分帧方式是否与已有hub一致，调用前需要持有m的锁
+func (m *WSManager) checkHub(app, socketUrl string, framing bool) error {
+	hub, ok := m.hubs[app]
+	if !ok || hub.url != socketUrl {
+		return nil
+	}
+	if hub.framing != framing {
+		return fmt.Errorf("%w: clients of %s are using framing=%v", ErrHubConflict, app, hub.framing)
+	}
+	return nil
+}
+
+// CheckHub 在websocket升级前检查能否加入hub
+func (m *WSManager) CheckHub(app, socketUrl string, framing bool) error {
+	m.RLock()
+	defer m.RUnlock()
+	return m.checkHub(app, socketUrl, framing)
+}
+
+// Join 把客户端加入app的hub，hub不存在时建立socket连接
+// 同一个hub的客户端必须使用相同的分帧方式
+// 连接在m的锁外建立，其他客户端等待同一个连接的结果，不会重复连接
+func (m *WSManager) Join(c *WSClient, app, socketUrl string, cd codec.Codec, writeMode string) error {
+	for {
+		m.Lock()
+		if err := m.checkHub(app, socketUrl, cd != nil); err != nil {
+			m.Unlock()
+			return err
+		}
+		hub, ok := m.hubs[app]
+		if ok && hub.url != socketUrl {
+			// app重启后端口变了，原来的连接已经不可用
+			m.closeHubLocked(hub, websocket.CloseServiceRestart, "app restarted")
+			ok = false
+		}
+		if ok && hub.sc == nil {
+			m.Unlock()
+			<-hub.ready
+			if hub.err != nil {
+				return hub.err
+			}
+			continue
+		}
+		if ok {
+			m.addToHub(c, hub)
+			m.Unlock()
+			return nil
+		}
+		hub = &LinkHub{
+			app:       app,
+			url:       socketUrl,
+			framing:   cd != nil,
+			ready:     make(chan struct{}),
+			input:     make(chan NotifyEvent, inputQueueSize),
+			closed:    make(chan struct{}),
+			manager:   m,
+			clients:   make(map[*WSClient]bool),
+			writeMode: writeMode,
+			created:   time.Now(),
+		}
+		m.hubs[app] = hub
+		m.Unlock()
+
+		sc, err := NewSocket("recv", app, socketUrl, cd)
+
+		m.Lock()
+		defer m.Unlock()
+		hub.sc, hub.err = sc, err
+		close(hub.ready)
+		if err != nil {
+			if m.hubs[app] == hub {
+				delete(m.hubs, app)
+			}
+			return err
+		}
+		if m.hubs[app] != hub {
+			// 建立连接期间hub被关闭，例如app停止或重启
+			(*sc.conn).Close()
+			return fmt.Errorf("link hub of %s was closed while connecting", app)
+		}
+		logger.SocketLog("info", socketUrl, fmt.Sprintf("link hub of %s connected", app))
+		go hub.pump()
+		go hub.writeInput()
+		m.addToHub(c, hub)
+		return nil
+	}
+}
+
+// 调用前需要持有m的锁
+func (m *WSManager) addToHub(c *WSClient, hub *LinkHub) {
+	c.hub = hub
+	hub.clients[c] = true
+	if hub.controller == nil {
+		hub.elect()
+	}
+}
+
+// 客户端离开hub，最后一个客户端离开时关闭socket，调用前需要持有m的锁
+func (m *WSManager) leave(c *WSClient) {
+	if c.tty != nil {
+		m.leaveTty(c)
+		return
+	}
+	hub := c.hub
+	if hub == nil || !hub.clients[c] {
+		return
+	}
+	delete(hub.clients, c)
+	if hub.controller == c {
+		hub.elect()
+	}
+	if len(hub.clients) > 0 {
+		return
+	}
+	var farewell []byte
+	if c.bye {
+		farewell = []byte("Bye!Bye!")
+	}
+	m.removeHub(hub, farewell)
+}
+
+// 移除hub并关闭socket，已经移除的hub不做处理，调用前需要持有m的锁
+// farewell不为空时先发给app再关闭，由hub的写协程进行以免app没有响应时阻塞其他客户端
+func (m *WSManager) removeHub(hub *LinkHub, farewell []byte) {
+	if m.hubs[hub.app] != hub {
+		return
+	}
+	delete(m.hubs, hub.app)
+	if hub.sc == nil {
+		// 还在建立连接，由Join关闭
+		return
+	}
+	hub.farewell = farewell
+	close(hub.closed)
+}
+
+// 移除hub并通知所有客户端，客户端回复close frame后由ReadMsg移除
+func (m *WSManager) closeHub(hub *LinkHub, code int, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	m.closeHubLocked(hub, code, reason)
+}
+
+// 调用前需要持有m的锁
+func (m *WSManager) closeHubLocked(hub *LinkHub, code int, reason string) {
+	m.removeHub(hub, nil)
+	for c := range hub.clients {
+		go c.Close(code, reason)
+	}
+}
+
+// CloseHub 关闭app的hub，没有hub时不做处理
+func (m *WSManager) CloseHub(app string, code int, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	if hub, ok := m.hubs[app]; ok {
+		m.closeHubLocked(hub, code, reason)
+	}
+}
+
+// HubStatus 返回app的hub状态，没有客户端时返回false
+func (m *WSManager) HubStatus(app string) (HubStatus, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	hub, ok := m.hubs[app]
+	if !ok || hub.sc == nil {
+		return HubStatus{}, false
+	}
+	status := HubStatus{
+		App:       app,
+		Url:       hub.url,
+		Framing:   hub.framing,
+		WriteMode: hub.writeMode,
+		Created:   hub.created,
+		Clients:   make([]HubClient, 0, len(hub.clients)),
+	}
+	if hub.controller != nil {
+		status.Controller = hub.controller.id
+	}
+	for c := range hub.clients {
+		status.Clients = append(status.Clients, HubClient{
+			Id:       c.id,
+			Remote:   c.conn.RemoteAddr().String(),
+			Mode:     c.mode,
+			Observer: c.observer,
+			Since:    c.since,
+		})
+	}
+	sort.Slice(status.Clients, func(i, j int) bool {
+		return status.Clients[i].Since.Before(status.Clients[j].Since)
+	})
+	return status, true
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 记录收到的数据的socket app，conn是hub建立的连接
+type hubApp struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	conn net.Conn
+	recv []byte
+}
+
+func newHubApp(t *testing.T) *hubApp {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	app := &hubApp{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			app.mu.Lock()
+			app.conn = conn
+			app.mu.Unlock()
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					app.mu.Lock()
+					app.recv = append(app.recv, buf[:n]...)
+					app.mu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return app
+}
+
+func (a *hubApp) received() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return string(a.recv)
+}
+
+func (a *hubApp) write(t *testing.T, data string) {
+	t.Helper()
+	a.mu.Lock()
+	conn := a.conn
+	a.mu.Unlock()
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 按/app/link的方式把websocket客户端加入app的hub，observe=1时是观察者
+func newHubServer(t *testing.T, m *WSManager, name string, app *hubApp, writeMode string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wconn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewWSClient(wconn, m)
+		client.observer = queryBool(r, "observe")
+		m.AddWSClient(client)
+		if err := m.Join(client, name, app.ln.Addr().String(), nil, writeMode); err != nil {
+			m.RmWSClient(client)
+			return
+		}
+		go client.ReadMsg()
+		go client.WriteMsg()
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialHub(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func hubClients(m *WSManager, name string) int {
+	status, _ := m.HubStatus(name)
+	return len(status.Clients)
+}
+
+// 客户端正常关闭并等待manager移除
+func leaveHub(t *testing.T, m *WSManager, name string, conn *websocket.Conn, remaining int) {
+	t.Helper()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+	waitFor(t, "client to leave the hub", func() bool { return hubClients(m, name) == remaining })
+}
+
+// 只有最后一个客户端离开时才给app发送Bye!Bye!
+func TestHubBye(t *testing.T) {
+	m := NewWebsocketManager()
+	app := newHubApp(t)
+	url := newHubServer(t, m, "echo", app, LinkWriteAll)
+
+	first := dialHub(t, url)
+	waitFor(t, "first client", func() bool { return hubClients(m, "echo") == 1 })
+	second := dialHub(t, url)
+	waitFor(t, "second client", func() bool { return hubClients(m, "echo") == 2 })
+
+	leaveHub(t, m, "echo", first, 1)
+	time.Sleep(100 * time.Millisecond)
+	if got := app.received(); got != "" {
+		t.Errorf("app received %q after one of two clients left", got)
+	}
+
+	leaveHub(t, m, "echo", second, 0)
+	waitFor(t, "Bye!Bye!", func() bool { return app.received() == "Bye!Bye!" })
+}
+
+// 不读取输入的app只阻塞自己hub的客户端
+func TestHubInputIsolation(t *testing.T) {
+	m := NewWebsocketManager()
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	app := newHubApp(t)
+	stuckConn := dialHub(t, newHubServer(t, m, "stuck", &hubApp{ln: stuck}, LinkWriteAll))
+	conn := dialHub(t, newHubServer(t, m, "echo", app, LinkWriteAll))
+	waitFor(t, "both hubs", func() bool { return hubClients(m, "stuck") == 1 && hubClients(m, "echo") == 1 })
+
+	// 写满stuck的socket缓冲区
+	chunk := make([]byte, 64<<10)
+	go func() {
+		for i := 0; i < 256; i++ {
+			if err := stuckConn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "input of the other hub", func() bool { return app.received() == "ping" })
+}
+
+func readHub(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// app的输出广播给所有客户端，包括观察者
+func TestHubFanOut(t *testing.T) {
+	m := NewWebsocketManager()
+	app := newHubApp(t)
+	url := newHubServer(t, m, "echo", app, LinkWriteAll)
+	conns := []*websocket.Conn{dialHub(t, url), dialHub(t, url), dialHub(t, url+"?observe=1")}
+	waitFor(t, "three clients", func() bool { return hubClients(m, "echo") == 3 })
+
+	app.write(t, "hello")
+	for i, conn := range conns {
+		if got := readHub(t, conn); got != "hello" {
+			t.Errorf("client %d received %q", i, got)
+		}
+	}
+
+	// all模式下非观察者的输入都发给app
+	conns[0].WriteMessage(websocket.TextMessage, []byte("a"))
+	waitFor(t, "input of the first client", func() bool { return app.received() == "a" })
+	conns[1].WriteMessage(websocket.TextMessage, []byte("b"))
+	waitFor(t, "input of the second client", func() bool { return app.received() == "ab" })
+	conns[2].WriteMessage(websocket.TextMessage, []byte("c"))
+	time.Sleep(100 * time.Millisecond)
+	if got := app.received(); got != "ab" {
+		t.Errorf("app received %q, input of the observer should be dropped", got)
+	}
+}
+
+// controller模式下只有controller的输入发给app，controller离开后由最早加入的客户端接替
+func TestHubController(t *testing.T) {
+	m := NewWebsocketManager()
+	app := newHubApp(t)
+	url := newHubServer(t, m, "echo", app, LinkWriteController)
+	controller := func() int64 {
+		status, _ := m.HubStatus("echo")
+		return status.Controller
+	}
+
+	// 观察者不能成为controller
+	observer := dialHub(t, url+"?observe=1")
+	waitFor(t, "observer", func() bool { return hubClients(m, "echo") == 1 })
+	if id := controller(); id != 0 {
+		t.Errorf("observer %d was elected", id)
+	}
+	first := dialHub(t, url)
+	waitFor(t, "first client", func() bool { return hubClients(m, "echo") == 2 })
+	firstId := controller()
+	if firstId == 0 {
+		t.Fatal("no controller after a writer joined")
+	}
+	second := dialHub(t, url)
+	waitFor(t, "second client", func() bool { return hubClients(m, "echo") == 3 })
+	if id := controller(); id != firstId {
+		t.Errorf("controller changed to %d when another client joined", id)
+	}
+
+	second.WriteMessage(websocket.TextMessage, []byte("x"))
+	observer.WriteMessage(websocket.TextMessage, []byte("y"))
+	first.WriteMessage(websocket.TextMessage, []byte("a"))
+	waitFor(t, "input of the controller", func() bool { return strings.Contains(app.received(), "a") })
+	if got := app.received(); got != "a" {
+		t.Errorf("app received %q, want only the controller's input", got)
+	}
+
+	leaveHub(t, m, "echo", first, 2)
+	if id := controller(); id == 0 || id == firstId {
+		t.Fatalf("controller after the first client left = %d", id)
+	}
+	second.WriteMessage(websocket.TextMessage, []byte("b"))
+	waitFor(t, "input of the new controller", func() bool { return app.received() == "ab" })
+}
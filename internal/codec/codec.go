@@ -0,0 +1,135 @@
+// Package codec 负责socket消息的分帧
+// 同一个连接上的多次请求需要依靠分帧判断一条响应在哪里结束
+package codec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+)
+
+const (
+	TypeNewline    = "newline"
+	TypeCRLF       = "crlf"
+	TypeTerminator = "terminator"
+	TypeRegex      = "regex"
+	TypeLength     = "length"
+	TypeFixed      = "fixed"
+	TypeIdle       = "idle"
+	TypeLines      = "lines"
+	TypeStatus     = "status"
+
+	// 单条消息的最大长度，防止错误的长度头导致分配过大的内存
+	MaxFrameSize = 16 << 20
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrShortFrame    = errors.New("frame too short")
+)
+
+// Reader 在连接上读取一条完整的消息
+// Deadline是整条消息的截止时间
+type Reader struct {
+	*bufio.Reader
+	conn     net.Conn
+	Deadline time.Time
+}
+
+func NewReader(conn net.Conn) *Reader {
+	return &Reader{
+		Reader: bufio.NewReader(conn),
+		conn:   conn,
+	}
+}
+
+func (r *Reader) SetReadDeadline(t time.Time) error {
+	return r.conn.SetReadDeadline(t)
+}
+
+type Codec interface {
+	// Encode 把一条消息写入w
+	Encode(w io.Writer, msg []byte) error
+	// Decode 读取一条消息，返回的消息不包含分帧信息
+	Decode(r *Reader) ([]byte, error)
+}
+
+type Config struct {
+	Type         string
+	Terminator   string
+	Pattern      string
+	LengthSize   int
+	LittleEndian bool
+	Size         int
+	IdleGap      time.Duration
+	// 在Type的分帧基础上解析4字节状态头
+	StatusHeader bool
+}
+
+func New(cfg Config) (Codec, error) {
+	var (
+		c   Codec
+		err error
+	)
+	switch cfg.Type {
+	case TypeNewline:
+		c = &Terminator{Term: []byte("\n")}
+	case TypeCRLF:
+		c = &Terminator{Term: []byte("\r\n")}
+	case TypeTerminator:
+		if cfg.Terminator == "" {
+			return nil, errors.New("codec terminator is empty")
+		}
+		c = &Terminator{Term: []byte(cfg.Terminator)}
+	case TypeRegex:
+		c, err = NewRegex(cfg.Pattern)
+	case TypeLength:
+		c, err = NewLengthPrefix(cfg.LengthSize, cfg.LittleEndian)
+	case TypeFixed:
+		if cfg.Size <= 0 || cfg.Size > MaxFrameSize {
+			return nil, fmt.Errorf("invalid codec size: %d", cfg.Size)
+		}
+		c = &Fixed{Size: cfg.Size}
+	case TypeIdle, TypeStatus, "":
+		gap := cfg.IdleGap
+		if gap <= 0 {
+			gap = time.Second
+		}
+		c = &Idle{Gap: gap}
+	case TypeLines:
+		gap := cfg.IdleGap
+		if gap <= 0 {
+			gap = time.Second
+		}
+		c = &Lines{Idle{Gap: gap}}
+	default:
+		return nil, fmt.Errorf("unknown codec type: %s", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.StatusHeader || cfg.Type == TypeStatus {
+		c = &StatusHeader{Inner: c}
+	}
+	return c, nil
+}
+
+// 编译前检查正则，供New使用
+func compile(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.New("codec pattern is empty")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid codec pattern: %w", err)
+	}
+	if re.MatchString("") {
+		return nil, fmt.Errorf("codec pattern matches empty string: %s", pattern)
+	}
+	return re, nil
+}
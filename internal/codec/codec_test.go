@@ -0,0 +1,184 @@
+package codec
+
+import (
+	"errors"
+	"net"
+	"regexp/syntax"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 分几次写入的数据，pause为写入前等待的时间，data为空时关闭连接
+type chunk struct {
+	pause time.Duration
+	data  string
+}
+
+// 按chunks写入，解码n条消息
+func decodeN(t *testing.T, c Codec, chunks []chunk, n int) ([]string, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for _, ch := range chunks {
+			time.Sleep(ch.pause)
+			if ch.data == "" {
+				server.Close()
+				return
+			}
+			if _, err := server.Write([]byte(ch.data)); err != nil {
+				return
+			}
+		}
+	}()
+
+	r := NewReader(client)
+	r.Deadline = time.Now().Add(5 * time.Second)
+	var msgs []string
+	for i := 0; i < n; i++ {
+		msg, err := c.Decode(r)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, string(msg))
+	}
+	return msgs, nil
+}
+
+func mustCodec(t *testing.T, cfg Config) Codec {
+	t.Helper()
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New(%+v): %v", cfg, err)
+	}
+	return c
+}
+
+func TestDecode(t *testing.T) {
+	long := strings.Repeat("x", 3*RegexWindow)
+	tests := []struct {
+		name   string
+		cfg    Config
+		chunks []chunk
+		want   []string
+	}{
+		{"newline", Config{Type: TypeNewline}, []chunk{{0, "a\nb\n"}}, []string{"a", "b"}},
+		{"newline split", Config{Type: TypeNewline}, []chunk{{0, "he"}, {5 * time.Millisecond, "llo\nwo"}, {0, "rld\n"}}, []string{"hello", "world"}},
+		{"crlf", Config{Type: TypeCRLF}, []chunk{{0, "a\r\nb\r"}, {0, "\n"}}, []string{"a", "b"}},
+		{"terminator split", Config{Type: TypeTerminator, Terminator: "END"}, []chunk{{0, "xEN"}, {0, "Dy END"}}, []string{"x", "y "}},
+		{"regex", Config{Type: TypeRegex, Pattern: `\$ `}, []chunk{{0, "out\n$ more$ "}}, []string{"out\n", "more"}},
+		{"regex split", Config{Type: TypeRegex, Pattern: `\$ `}, []chunk{{0, "ou"}, {5 * time.Millisecond, "t\n$"}, {5 * time.Millisecond, " next$ "}}, []string{"out\n", "next"}},
+		{"regex trailing greedy", Config{Type: TypeRegex, Pattern: `>\s*`}, []chunk{{0, "a>  \nb> "}}, []string{"a", "b"}},
+		{"regex trailing greedy split", Config{Type: TypeRegex, Pattern: `>\s*`}, []chunk{{0, "a> "}, {10 * time.Millisecond, "  \n"}, {0, "b>"}}, []string{"a", "b"}},
+		// 超过RegexTailGrace才到达的内容属于下一条消息
+		{"regex trailing after grace", Config{Type: TypeRegex, Pattern: `>\s*`}, []chunk{{0, "a> "}, {4 * RegexTailGrace, " b>"}}, []string{"a", " b"}},
+		{"regex line start", Config{Type: TypeRegex, Pattern: `(?m)^# `}, []chunk{{0, "ls\nfile # x\n# "}}, []string{"ls\nfile # x\n"}},
+		{"regex long message", Config{Type: TypeRegex, Pattern: `\n\$ `}, []chunk{{0, long}, {0, "\n"}, {5 * time.Millisecond, "$ "}}, []string{long}},
+		{"length", Config{Type: TypeLength, LengthSize: 2}, []chunk{{0, "\x00"}, {0, "\x03abc\x00\x01d"}}, []string{"abc", "d"}},
+		{"length little endian", Config{Type: TypeLength, LengthSize: 4, LittleEndian: true}, []chunk{{0, "\x02\x00\x00\x00hi"}}, []string{"hi"}},
+		{"fixed", Config{Type: TypeFixed, Size: 3}, []chunk{{0, "ab"}, {0, "cdef"}}, []string{"abc", "def"}},
+		{"idle", Config{Type: TypeIdle, IdleGap: 30 * time.Millisecond}, []chunk{{0, "ab"}, {5 * time.Millisecond, "c"}, {100 * time.Millisecond, "d"}}, []string{"abc", "d"}},
+		{"lines", Config{Type: TypeLines, IdleGap: 30 * time.Millisecond}, []chunk{{0, "\r\nx\r\ny\r\n\r\n"}}, []string{"x\ny"}},
+		{"status", Config{Type: TypeNewline, StatusHeader: true}, []chunk{{0, "0001ok\n"}}, []string{"ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeN(t, mustCodec(t, tt.cfg), tt.chunks, len(tt.want))
+			if err != nil {
+				t.Fatalf("decode: %v, got %q", err, got)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		chunks []chunk
+		check  func(error) bool
+	}{
+		{"status failure", Config{Type: TypeNewline, StatusHeader: true}, []chunk{{0, "0000bad\n"}}, func(err error) bool {
+			var se *StatusError
+			return errors.As(err, &se) && string(se.Msg) == "bad"
+		}},
+		{"status short", Config{Type: TypeNewline, StatusHeader: true}, []chunk{{0, "ok\n"}}, func(err error) bool {
+			return errors.Is(err, ErrShortFrame)
+		}},
+		{"regex eof", Config{Type: TypeRegex, Pattern: `\$ `}, []chunk{{0, "no prompt"}, {5 * time.Millisecond, ""}}, func(err error) bool {
+			return err != nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeN(t, mustCodec(t, tt.cfg), tt.chunks, 1)
+			if !tt.check(err) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+// 没有分隔的大量数据不能反复扫描整个缓冲区
+func TestRegexLargeFrame(t *testing.T) {
+	data := strings.Repeat("y", 4<<20)
+	start := time.Now()
+	got, err := decodeN(t, mustCodec(t, Config{Type: TypeRegex, Pattern: `>\s*`}), []chunk{{0, data}, {0, "> "}}, 1)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got[0]) != len(data) {
+		t.Errorf("got %d bytes, want %d", len(got[0]), len(data))
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("decoding took %v", d)
+	}
+}
+
+func TestOpenTail(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{`\$ `, false},
+		{`>\s*`, true},
+		{`> ?`, true},
+		{`\d+`, true},
+		{`x{2}`, false},
+		{`x{2,3}`, true},
+		{`(?:ok|error)\n`, false},
+		{`ok|okay`, true},
+		{`# $`, true},
+		{`(?m)^# `, false},
+	}
+	for _, tt := range tests {
+		re, err := syntax.Parse(tt.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.pattern, err)
+		}
+		if got := openTail(re.Simplify()); got != tt.want {
+			t.Errorf("openTail(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Type: TypeRegex},
+		{Type: TypeRegex, Pattern: `a*`},
+		{Type: TypeRegex, Pattern: `(`},
+		{Type: TypeTerminator},
+		{Type: TypeLength, LengthSize: 3},
+		{Type: TypeFixed},
+		{Type: "bogus"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) should fail", cfg)
+		}
+	}
+}
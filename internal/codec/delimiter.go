@@ -0,0 +1,176 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"time"
+)
+
+// Terminator 以固定的结束符分隔消息，newline和crlf是它的特例
+type Terminator struct {
+	Term []byte
+}
+
+func (c *Terminator) Encode(w io.Writer, msg []byte) error {
+	if !bytes.HasSuffix(msg, c.Term) {
+		msg = append(msg[:len(msg):len(msg)], c.Term...)
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func (c *Terminator) Decode(r *Reader) ([]byte, error) {
+	if err := r.SetReadDeadline(r.Deadline); err != nil {
+		return nil, err
+	}
+	last := c.Term[len(c.Term)-1]
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice(last)
+		buf = append(buf, chunk...)
+		if len(buf) > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasSuffix(buf, c.Term) {
+			return buf[:len(buf)-len(c.Term)], nil
+		}
+	}
+}
+
+const (
+	// 分隔的最大长度，每次只在最后这么多字节中查找分隔，避免长消息反复扫描
+	RegexWindow = 1024
+	// 匹配到已收到数据的末尾且正则结尾可以匹配更多内容时（比如>\s*），等待这么久确认分隔已经完整
+	RegexTailGrace = 50 * time.Millisecond
+)
+
+// Regex 以匹配正则的内容作为分隔，比如shell的提示符
+// 发送时不添加分隔
+type Regex struct {
+	re *regexp.Regexp
+	// 正则的结尾是否可能匹配更多内容，或者依赖后面的数据（$、\b）
+	tail bool
+}
+
+func NewRegex(pattern string) (*Regex, error) {
+	re, err := compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sre, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid codec pattern: %w", err)
+	}
+	return &Regex{re: re, tail: openTail(sre.Simplify())}, nil
+}
+
+// 正则结尾的部分在收到更多数据后是否可能匹配得更长或者不再匹配
+func openTail(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest,
+		syntax.OpEndLine, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	case syntax.OpRepeat:
+		return re.Max == -1 || re.Max > re.Min || openTail(re.Sub[0])
+	case syntax.OpCapture:
+		return openTail(re.Sub[0])
+	case syntax.OpConcat:
+		return len(re.Sub) > 0 && openTail(re.Sub[len(re.Sub)-1])
+	case syntax.OpAlternate:
+		// 分支之间可能互为前缀，比如a|ab
+		return true
+	}
+	return false
+}
+
+func (c *Regex) Encode(w io.Writer, msg []byte) error {
+	_, err := w.Write(msg)
+	return err
+}
+
+// 只peek已经收到的数据，找到分隔后只消费到分隔结束的位置，分隔之后的数据留给下一条消息
+// 已经确认没有分隔的数据不再整体扫描，只在最后RegexWindow字节中继续查找
+func (c *Regex) Decode(r *Reader) ([]byte, error) {
+	if err := r.SetReadDeadline(r.Deadline); err != nil {
+		return nil, err
+	}
+	// 已经消费、确认不包含分隔的数据
+	var buf []byte
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return nil, err
+		}
+		chunk, _ := r.Peek(r.Buffered())
+		from := windowStart(buf)
+		data := append(buf[from:len(buf):len(buf)], chunk...)
+		loc := c.re.FindIndex(data)
+		if loc == nil {
+			buf = append(buf, chunk...)
+			if _, err := r.Discard(len(chunk)); err != nil {
+				return nil, err
+			}
+			if len(buf) > MaxFrameSize {
+				return nil, ErrFrameTooLarge
+			}
+			continue
+		}
+		if c.tail && loc[1] == len(data) && waitMore(r, len(chunk)) {
+			// 带着新的数据重新查找
+			continue
+		}
+		consumed := from + loc[1] - len(buf)
+		if consumed < 0 {
+			consumed = 0
+		}
+		msg := append(buf, chunk[:consumed]...)[:from+loc[0]]
+		if _, err := r.Discard(consumed); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// 查找分隔的起始位置，至少包含最后RegexWindow字节
+// 尽量往前扩展到换行符，使(?m)^只在真正的行首匹配
+func windowStart(buf []byte) int {
+	from := len(buf) - RegexWindow
+	if from <= 0 {
+		return 0
+	}
+	low := from - RegexWindow
+	if low < 0 {
+		low = 0
+	}
+	if i := bytes.LastIndexByte(buf[low:from], '\n'); i >= 0 {
+		return low + i
+	}
+	return from
+}
+
+// 等待RegexTailGrace，返回是否收到了buffered之后的新数据
+// 已经有完整的消息，缓冲区已满或连接出错时按没有新数据处理，错误留给下一次读取
+func waitMore(r *Reader, buffered int) bool {
+	if buffered >= r.Size() {
+		return false
+	}
+	deadline := time.Now().Add(RegexTailGrace)
+	if !r.Deadline.IsZero() && r.Deadline.Before(deadline) {
+		deadline = r.Deadline
+	}
+	if err := r.SetReadDeadline(deadline); err != nil {
+		return false
+	}
+	_, err := r.Peek(buffered + 1)
+	r.SetReadDeadline(r.Deadline)
+	return err == nil
+}
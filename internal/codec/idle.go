@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Idle 收到数据后超过Gap没有新数据即认为消息结束
+type Idle struct {
+	Gap time.Duration
+}
+
+func (c *Idle) Encode(w io.Writer, msg []byte) error {
+	_, err := w.Write(msg)
+	return err
+}
+
+func (c *Idle) Decode(r *Reader) ([]byte, error) {
+	// 等待第一个字节
+	if err := r.SetReadDeadline(r.Deadline); err != nil {
+		return nil, err
+	}
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+
+	var (
+		msg []byte
+		buf = make([]byte, 4096)
+	)
+	for {
+		deadline := time.Now().Add(c.Gap)
+		if !r.Deadline.IsZero() && r.Deadline.Before(deadline) {
+			deadline = r.Deadline
+		}
+		if err := r.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, err := r.Read(buf)
+		msg = append(msg, buf[:n]...)
+		if len(msg) > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			// 到了整条消息的截止时间时也返回已经收到的数据
+			return msg, nil
+		case errors.Is(err, io.EOF):
+			return msg, nil
+		default:
+			return msg, err
+		}
+	}
+}
+
+// Lines 与Idle分帧相同，响应中的\r\n换成\n并去掉首尾的空行
+// 与原来按行读取socket的输出保持一致
+type Lines struct {
+	Idle
+}
+
+func (c *Lines) Decode(r *Reader) ([]byte, error) {
+	msg, err := c.Idle.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Trim(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")), "\n"), nil
+}
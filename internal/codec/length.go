@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// LengthPrefix 消息前带1、2或4字节的长度头
+type LengthPrefix struct {
+	Size  int
+	Order binary.ByteOrder
+}
+
+// NewLengthPrefix size为0时使用4字节，默认大端
+func NewLengthPrefix(size int, littleEndian bool) (*LengthPrefix, error) {
+	if size == 0 {
+		size = 4
+	}
+	if size != 1 && size != 2 && size != 4 {
+		return nil, fmt.Errorf("invalid codec length size: %d", size)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if littleEndian {
+		order = binary.LittleEndian
+	}
+	return &LengthPrefix{Size: size, Order: order}, nil
+}
+
+func (c *LengthPrefix) max() int {
+	switch c.Size {
+	case 1:
+		return 0xff
+	case 2:
+		return 0xffff
+	default:
+		return MaxFrameSize
+	}
+}
+
+func (c *LengthPrefix) Encode(w io.Writer, msg []byte) error {
+	if len(msg) > c.max() {
+		return fmt.Errorf("%w: %d bytes for %d-byte length", ErrFrameTooLarge, len(msg), c.Size)
+	}
+	header := make([]byte, c.Size)
+	switch c.Size {
+	case 1:
+		header[0] = byte(len(msg))
+	case 2:
+		c.Order.PutUint16(header, uint16(len(msg)))
+	default:
+		c.Order.PutUint32(header, uint32(len(msg)))
+	}
+	_, err := w.Write(append(header, msg...))
+	return err
+}
+
+func (c *LengthPrefix) Decode(r *Reader) ([]byte, error) {
+	if err := r.SetReadDeadline(r.Deadline); err != nil {
+		return nil, err
+	}
+	header := make([]byte, c.Size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var size uint32
+	switch c.Size {
+	case 1:
+		size = uint32(header[0])
+	case 2:
+		size = uint32(c.Order.Uint16(header))
+	default:
+		size = c.Order.Uint32(header)
+	}
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Fixed 每条消息固定Size字节，发送时原样发送
+type Fixed struct {
+	Size int
+}
+
+func (c *Fixed) Encode(w io.Writer, msg []byte) error {
+	_, err := w.Write(msg)
+	return err
+}
+
+func (c *Fixed) Decode(r *Reader) ([]byte, error) {
+	if err := r.SetReadDeadline(r.Deadline); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, c.Size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
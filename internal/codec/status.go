@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	statusSize    = 4
+	statusFailure = "0000"
+)
+
+// StatusError 状态头为0000时返回，Msg为状态头之后的内容
+type StatusError struct {
+	Msg []byte
+}
+
+func (e *StatusError) Error() string {
+	return string(e.Msg)
+}
+
+// StatusHeader 响应的前4字节是状态头，0000表示失败，其他值表示成功
+// 分帧由Inner负责，发送时不添加状态头
+type StatusHeader struct {
+	Inner Codec
+}
+
+func (c *StatusHeader) Encode(w io.Writer, msg []byte) error {
+	return c.Inner.Encode(w, msg)
+}
+
+func (c *StatusHeader) Decode(r *Reader) ([]byte, error) {
+	msg, err := c.Inner.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < statusSize {
+		return nil, fmt.Errorf("%w: %q has no status header", ErrShortFrame, msg)
+	}
+	if string(msg[:statusSize]) == statusFailure {
+		return nil, &StatusError{Msg: msg[statusSize:]}
+	}
+	return msg[statusSize:], nil
+}
@@ -0,0 +1,110 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var ErrTemplate = errors.New("invalid command template")
+
+// SplitArgs 按空白分割命令行，支持单引号和双引号，不做其他shell展开
+// {{ }}中的空白和引号属于模板，不分割
+func SplitArgs(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inWord  bool
+		quote   byte
+		actions int
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case actions > 0:
+			if strings.HasPrefix(line[i:], "}}") {
+				actions--
+				cur.WriteString("}}")
+				i++
+				continue
+			}
+			cur.WriteByte(c)
+		case strings.HasPrefix(line[i:], "{{"):
+			actions++
+			inWord = true
+			cur.WriteString("{{")
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote in %q", ErrTemplate, line)
+	}
+	if actions > 0 {
+		return nil, fmt.Errorf("%w: unterminated {{ in %q", ErrTemplate, line)
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// 模板中的浮点数按普通小数输出，避免1000000变成1e+06
+type floatArg float64
+
+func (f floatArg) String() string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 64)
+}
+
+// Render 先把模板分割成参数，再分别用text/template渲染
+// 参数的值不会被再次分割，也不经过shell
+// 渲染结果为空的参数也会保留，避免后面的参数错位
+func Render(line string, values map[string]interface{}) ([]string, error) {
+	words, err := SplitArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if f, ok := v.(float64); ok {
+			v = floatArg(f)
+		}
+		data[k] = v
+	}
+	args := make([]string, 0, len(words))
+	for _, word := range words {
+		if !strings.Contains(word, "{{") {
+			args = append(args, word)
+			continue
+		}
+		tpl, err := template.New("arg").Option("missingkey=error").Parse(word)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTemplate, err)
+		}
+		var b strings.Builder
+		if err := tpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTemplate, err)
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  a  b\tc\n", []string{"a", "b", "c"}},
+		{`-m "hello world" 'x y'`, []string{"-m", "hello world", "x y"}},
+		{`a"b c"d`, []string{"ab cd"}},
+		{`""`, []string{""}},
+		{`--port {{ .port }}`, []string{"--port", "{{ .port }}"}},
+		{`--name={{printf "%s %s" .a .b}}`, []string{`--name={{printf "%s %s" .a .b}}`}},
+		{`{{if .v}}-v{{end}} x`, []string{"{{if .v}}-v{{end}}", "x"}},
+	}
+	for _, tt := range tests {
+		got, err := SplitArgs(tt.line)
+		if err != nil {
+			t.Errorf("SplitArgs(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	for _, line := range []string{`"abc`, `'abc`, `{{ .x`} {
+		if _, err := SplitArgs(line); !errors.Is(err, ErrTemplate) {
+			t.Errorf("SplitArgs(%q) = %v, want ErrTemplate", line, err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		values map[string]interface{}
+		want   []string
+	}{
+		{"plain", "a b", nil, []string{"a", "b"}},
+		{"value is one argument", "--msg {{.m}}", map[string]interface{}{"m": "a b; rm -rf /"}, []string{"--msg", "a b; rm -rf /"}},
+		{"int", "-n {{.n}}", map[string]interface{}{"n": int64(3)}, []string{"-n", "3"}},
+		{"large float", "{{.f}}", map[string]interface{}{"f": float64(1000000)}, []string{"1000000"}},
+		{"small float", "{{.f}}", map[string]interface{}{"f": 0.000001}, []string{"0.000001"}},
+		{"float compare", "{{if gt .f 1.5}}big{{end}}", map[string]interface{}{"f": 2.0}, []string{"big"}},
+		// 为空的参数保留在原来的位置
+		{"empty keeps position", "{{.a}} {{.b}} {{.c}}", map[string]interface{}{"a": "1", "b": "", "c": "3"}, []string{"1", "", "3"}},
+		{"empty conditional", "{{if .v}}-v{{end}} x", map[string]interface{}{"v": false}, []string{"", "x"}},
+		{"bool", "--flag={{.b}}", map[string]interface{}{"b": true}, []string{"--flag=true"}},
+	}
+	for _, tt := range tests {
+		got, err := Render(tt.line, tt.values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Render(%q) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tests := []struct {
+		line   string
+		values map[string]interface{}
+	}{
+		{"{{.missing}}", map[string]interface{}{}},
+		{"{{.a", nil},
+		{"{{nosuchfunc .a}}", map[string]interface{}{"a": 1}},
+	}
+	for _, tt := range tests {
+		if _, err := Render(tt.line, tt.values); !errors.Is(err, ErrTemplate) {
+			t.Errorf("Render(%q) = %v, want ErrTemplate", tt.line, err)
+		}
+	}
+}
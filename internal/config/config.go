@@ -5,11 +5,27 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"hostctl_proxy/internal/command"
+	"hostctl_proxy/internal/cron"
 
 	"dario.cat/mergo"
 )
 
+var (
+	ErrNotFound      = errors.New("config not found")
+	ErrAlreadyExists = errors.New("config already exists")
+	ErrField         = errors.New("field error")
+	ErrDependency    = errors.New("app dependency error")
+	ErrInUse         = errors.New("app is required by other apps")
+)
+
 type AppCfg struct {
 	Socket      bool     `json:"socket"`
 	Websocket   bool     `json:"websocket"`
@@ -18,18 +34,634 @@ type AppCfg struct {
 	DefaultArgs []string `json:"default_args"`
 	MaxRetries  int      `json:"max_retries"`
 	Shell       bool     `json:"shell"`
+	Pty         bool     `json:"pty"`   // 在伪终端下运行，通过/app/tty连接终端
+	Stdin       bool     `json:"stdin"` // 创建stdin管道，通过/app/stdin写入
 	OnStart     string   `json:"on_start"`
 	OnStop      string   `json:"on_stop"`
+	// 启动前需要先启动的app
+	DependsOn    []string `json:"depends_on"`
+	Groups       []string `json:"groups"`
+	ReadyTimeout int      `json:"ready_timeout"` // 秒，等待依赖ready的时间
+	// 服务启动时自动启动，按autostart_order从小到大启动
+	Autostart      bool `json:"autostart"`
+	AutostartDelay int  `json:"autostart_delay"` // 秒，启动前等待的时间
+	AutostartOrder int  `json:"autostart_order"`
+	// PUT /app/link的分帧方式和超时
+	Framing     *FramingCfg `json:"framing"`
+	LinkTimeout int         `json:"link_timeout"` // 毫秒，默认5000
+	// websocket客户端输入的转发方式，all或controller，默认all
+	LinkWriteMode string `json:"link_write_mode"`
+	// 记录/app/link的socket数据，见GET /recordings
+	Record bool `json:"record"`
+	// socket app的端口，port为固定端口，port_range为"起始-结束"，都没有时随机分配
+	Port      int    `json:"port"`
+	PortRange string `json:"port_range"`
+	// 端口传给app的方式，port_args中的{port}替换为端口，port_env为环境变量名
+	// 都没有配置时为--server localhost {port}
+	PortArgs []string `json:"port_args"`
+	PortEnv  string   `json:"port_env"`
+	// 为unix://时app监听unix socket，路径为空时在runtime_dir下按app名称生成
+	Address string `json:"address"`
+	// 启停、stdin、link和tty写入需要持有该资源的租约，见/locks
+	Lock string `json:"lock"`
+	// PUT /app/link和expect依次处理，排队的请求数，默认16，-1不限制
+	LinkQueue int `json:"link_queue"`
+}
+
+func (c *AppCfg) GetLinkQueue() int {
+	if c.LinkQueue == 0 {
+		return 16
+	}
+	if c.LinkQueue < 0 {
+		return -1
+	}
+	return c.LinkQueue
+}
+
+// ParsePortRange 解析"起始-结束"格式的端口范围
+func ParsePortRange(portRange string) (int, int, error) {
+	from, to, ok := strings.Cut(portRange, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: invalid port_range %s", ErrField, portRange)
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(from))
+	last, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || first <= 0 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("%w: invalid port_range %s", ErrField, portRange)
+	}
+	return first, last, nil
+}
+
+func (c *AppCfg) checkPorts() error {
+	if c.Address != "" {
+		if !strings.HasPrefix(c.Address, "unix://") {
+			return fmt.Errorf("%w: address should be unix:///path", ErrField)
+		}
+		if c.Port > 0 || c.PortRange != "" {
+			return fmt.Errorf("%w: address is exclusive with port and port_range", ErrField)
+		}
+		// unix socket没有端口，{port}只会被替换成0
+		for _, arg := range c.PortArgs {
+			if strings.Contains(arg, "{port}") {
+				return fmt.Errorf("%w: port_args of a unix socket app should use {path} instead of {port}", ErrField)
+			}
+		}
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("%w: invalid port %d", ErrField, c.Port)
+	}
+	if c.Port > 0 && c.PortRange != "" {
+		return fmt.Errorf("%w: port and port_range are exclusive", ErrField)
+	}
+	if c.PortRange != "" {
+		if _, _, err := ParsePortRange(c.PortRange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 消息分帧，type为lines、newline、crlf、terminator、regex、length、fixed、idle或status
+// 没有配置时app按lines加状态头处理，proxy按lines处理
+type FramingCfg struct {
+	Type         string `json:"type"`
+	Terminator   string `json:"terminator"`
+	Pattern      string `json:"pattern"`       // regex的分隔正则
+	LengthSize   int    `json:"length_size"`   // length的长度头字节数，1、2或4，默认4
+	ByteOrder    string `json:"byte_order"`    // big或little，默认big
+	Size         int    `json:"size"`          // fixed的消息长度
+	IdleGap      int    `json:"idle_gap"`      // 毫秒，默认1000
+	StatusHeader bool   `json:"status_header"` // 响应带4字节状态头，0000表示失败
+	Encoding     string `json:"encoding"`      // 请求和响应的编码，text或base64，默认text
 }
 
 type CmdCfg struct {
 	Cmd         string   `json:"cmd"`
 	DefaultArgs []string `json:"default_args"`
+	// 配置template后不经过shell运行，cmd为程序，template为参数行
+	// 参数行中的{{.name}}替换为params中的参数，调用时传params而不是args
+	Template string               `json:"template"`
+	Params   map[string]*ParamCfg `json:"params"`
+	// 运行时需要持有该资源的租约，见/locks
+	Lock string `json:"lock"`
+	// 同时运行的数量，0表示不限制，排队按sys.command_queue
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+// 命令参数的类型
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamFloat  = "float"
+	ParamBool   = "bool"
+	ParamEnum   = "enum"
+)
+
+// 命令的参数，没有default时必须传
+type ParamCfg struct {
+	Type        string      `json:"type"` // string、int、float、bool或enum，默认string
+	Default     interface{} `json:"default"`
+	Enum        []string    `json:"enum"`
+	Pattern     string      `json:"pattern"` // string的值需要完整匹配的正则
+	Min         *float64    `json:"min"`     // int和float的范围
+	Max         *float64    `json:"max"`
+	Description string      `json:"description"`
+	// string的值默认不能以-开头，避免被程序当作选项
+	AllowDash bool `json:"allow_dash"`
+
+	re *regexp.Regexp // check时编译的pattern
+}
+
+// Templated 命令是否使用参数模板
+func (c *CmdCfg) Templated() bool {
+	return c.Template != "" || len(c.Params) > 0
+}
+
+func (c *CmdCfg) check() error {
+	if strings.TrimSpace(c.Cmd) == "" {
+		return fmt.Errorf("%w: command has no cmd", ErrField)
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("%w: invalid max_concurrent %d", ErrField, c.MaxConcurrent)
+	}
+	if !c.Templated() {
+		return nil
+	}
+	if _, err := command.SplitArgs(c.Cmd); err != nil {
+		return fmt.Errorf("%w: %v", ErrField, err)
+	}
+	// 用默认值或零值渲染一次，检查模板只引用了声明的参数
+	values := make(map[string]interface{}, len(c.Params))
+	for name, p := range c.Params {
+		if !namePattern.MatchString(name) {
+			return fmt.Errorf("%w: invalid param name %q", ErrField, name)
+		}
+		if p == nil {
+			return fmt.Errorf("%w: param %s has no definition", ErrField, name)
+		}
+		v, err := p.check(name)
+		if err != nil {
+			return err
+		}
+		values[name] = v
+	}
+	if _, err := command.Render(c.Template, values); err != nil {
+		return fmt.Errorf("%w: %v", ErrField, err)
+	}
+	return nil
+}
+
+// 检查参数的定义，返回默认值，没有默认值时返回类型的零值
+func (p *ParamCfg) check(name string) (interface{}, error) {
+	var zero interface{}
+	switch p.Type {
+	case "", ParamString:
+		zero = ""
+	case ParamInt:
+		zero = int64(0)
+	case ParamFloat:
+		zero = float64(0)
+	case ParamBool:
+		zero = false
+	case ParamEnum:
+		if len(p.Enum) == 0 {
+			return nil, fmt.Errorf("%w: enum param %s has no values", ErrField, name)
+		}
+		zero = p.Enum[0]
+	default:
+		return nil, fmt.Errorf("%w: param %s has invalid type %q", ErrField, name, p.Type)
+	}
+	if p.Pattern != "" && p.re == nil {
+		re, err := p.matcher(name)
+		if err != nil {
+			return nil, err
+		}
+		// 修改配置时沿用的参数已经编译过，不会在这里写入
+		p.re = re
+	}
+	if p.Default == nil {
+		return zero, nil
+	}
+	v, err := p.Convert(name, p.Default)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default: %w", err)
+	}
+	return v, nil
+}
+
+// pattern需要完整匹配，没有经过check的参数在这里编译
+func (p *ParamCfg) matcher(name string) (*regexp.Regexp, error) {
+	if p.re != nil {
+		return p.re, nil
+	}
+	re, err := regexp.Compile(`^(?:` + p.Pattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("%w: param %s pattern: %v", ErrField, name, err)
+	}
+	return re, nil
+}
+
+// Convert 把请求中的值转换成参数的类型并检查范围，数字和bool也可以用字符串传
+func (p *ParamCfg) Convert(name string, raw interface{}) (interface{}, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: param %s %s, got %v", ErrField, name, reason, raw)
+	}
+	switch p.Type {
+	case "", ParamString:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalid("should be a string")
+		}
+		if !p.AllowDash && strings.HasPrefix(s, "-") {
+			return nil, invalid("should not start with -")
+		}
+		if p.Pattern != "" {
+			re, err := p.matcher(name)
+			if err != nil {
+				return nil, err
+			}
+			if !re.MatchString(s) {
+				return nil, invalid(fmt.Sprintf("should match %s", p.Pattern))
+			}
+		}
+		return s, nil
+	case ParamEnum:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalid("should be a string")
+		}
+		for _, e := range p.Enum {
+			if s == e {
+				return s, nil
+			}
+		}
+		return nil, invalid(fmt.Sprintf("should be one of %s", strings.Join(p.Enum, ", ")))
+	case ParamBool:
+		switch v := raw.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, invalid("should be a bool")
+	case ParamInt, ParamFloat:
+		var f float64
+		switch v := raw.(type) {
+		case float64:
+			f = v
+		case json.Number:
+			var err error
+			if f, err = v.Float64(); err != nil {
+				return nil, invalid("should be a number")
+			}
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return nil, invalid("should be a number")
+			}
+		default:
+			return nil, invalid("should be a number")
+		}
+		if p.Min != nil && f < *p.Min {
+			return nil, invalid(fmt.Sprintf("should be >= %v", *p.Min))
+		}
+		if p.Max != nil && f > *p.Max {
+			return nil, invalid(fmt.Sprintf("should be <= %v", *p.Max))
+		}
+		if p.Type == ParamFloat {
+			return f, nil
+		}
+		if f != float64(int64(f)) {
+			return nil, invalid("should be an integer")
+		}
+		return int64(f), nil
+	}
+	return nil, fmt.Errorf("%w: param %s has invalid type %q", ErrField, name, p.Type)
+}
+
+// ResolveParams 检查请求的参数并补上默认值，返回模板使用的值
+func (c *CmdCfg) ResolveParams(params map[string]interface{}) (map[string]interface{}, error) {
+	for name := range params {
+		if _, ok := c.Params[name]; !ok {
+			return nil, fmt.Errorf("%w: unknown param %s", ErrField, name)
+		}
+	}
+	values := make(map[string]interface{}, len(c.Params))
+	for name, p := range c.Params {
+		raw, ok := params[name]
+		if !ok || raw == nil {
+			if p.Default == nil {
+				return nil, fmt.Errorf("%w: param %s is required", ErrField, name)
+			}
+			raw = p.Default
+		}
+		v, err := p.Convert(name, raw)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// 定时任务的动作
+const (
+	ScheduleCommand = "command"
+	ScheduleStart   = "start"
+	ScheduleStop    = "stop"
+	ScheduleRestart = "restart"
+)
+
+// 定时任务，cron和interval二选一
+// action为command时运行名为target的命令，为start、stop或restart时操作名为target的app
+type ScheduleCfg struct {
+	Cron     string   `json:"cron"`     // 分 时 日 月 周，也可以用@daily等
+	Interval int      `json:"interval"` // 秒
+	Action   string   `json:"action"`
+	Target   string   `json:"target"`
+	Args     []string `json:"args"`    // 为空时使用命令或app的default_args
+	Timeout  int      `json:"timeout"` // 秒，命令的超时，默认600
+	Disabled bool     `json:"disabled"`
+	// 带参数模板的命令使用的参数
+	Params map[string]interface{} `json:"params"`
+}
+
+func (c *ScheduleCfg) check() error {
+	if (c.Cron == "") == (c.Interval == 0) {
+		return fmt.Errorf("%w: schedule needs either cron or interval", ErrField)
+	}
+	if c.Cron != "" {
+		if _, err := cron.Parse(c.Cron); err != nil {
+			return fmt.Errorf("%w: %v", ErrField, err)
+		}
+	} else if c.Interval < 0 {
+		return fmt.Errorf("%w: invalid interval %d", ErrField, c.Interval)
+	}
+	switch c.Action {
+	case ScheduleCommand, ScheduleStart, ScheduleStop, ScheduleRestart:
+	default:
+		return fmt.Errorf("%w: invalid schedule action %q", ErrField, c.Action)
+	}
+	if c.Target == "" {
+		return fmt.Errorf("%w: schedule has no target", ErrField)
+	}
+	if len(c.Params) > 0 && c.Action != ScheduleCommand {
+		return fmt.Errorf("%w: params are only for command schedules", ErrField)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("%w: invalid timeout %d", ErrField, c.Timeout)
+	}
+	return nil
+}
+
+func (c *ScheduleCfg) GetTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// 工作流步骤的类型
+const (
+	StepCommand = "command"
+	StepApp     = "app"
+	StepSend    = "send"
+	StepWait    = "wait"
+)
+
+// 步骤的运行条件，success时前面的步骤都成功才运行，failure时有步骤失败才运行
+const (
+	WhenSuccess = "success"
+	WhenFailure = "failure"
+	WhenAlways  = "always"
+)
+
+// 步骤和参数的名字，用作变量名
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// 工作流，按顺序执行steps，args和data中的${name}替换为变量
+type WorkflowCfg struct {
+	Description string            `json:"description"`
+	Vars        map[string]string `json:"vars"` // 变量的默认值，运行时可以覆盖
+	Steps       []WorkflowStep    `json:"steps"`
+}
+
+// 工作流的一步
+// command运行命令，app启停app，send向app、串口或socket proxy发送data并等待expect，
+// wait在配置了app或proxy时等待expect，否则等待duration
+type WorkflowStep struct {
+	Name    string   `json:"name"` // 步骤的输出保存为变量${name}
+	Type    string   `json:"type"`
+	Command string   `json:"command"`
+	App     string   `json:"app"`
+	Action  string   `json:"action"` // app的start、stop或restart
+	Proxy   string   `json:"proxy"`
+	Args    []string `json:"args"` // 为空时使用命令或app的default_args
+	Data    string   `json:"data"`
+	Expect  string   `json:"expect"` // 正则，命名分组保存为变量
+	Fail    string   `json:"fail"`
+	// 毫秒
+	Duration   int `json:"duration"`
+	Timeout    int `json:"timeout"`     // command默认600000，app默认60000，send和wait默认5000
+	Retries    int `json:"retries"`     // 失败后重试的次数
+	RetryDelay int `json:"retry_delay"` // 默认1000
+	// 失败后继续执行，不算作工作流失败
+	ContinueOnError bool   `json:"continue_on_error"`
+	When            string `json:"when"` // success、failure或always，默认success
+	// 带参数模板的命令使用的参数，字符串中的${var}会被替换
+	Params map[string]interface{} `json:"params"`
+}
+
+func (c *WorkflowCfg) check() error {
+	if len(c.Steps) == 0 {
+		return fmt.Errorf("%w: workflow has no steps", ErrField)
+	}
+	names := make(map[string]bool, len(c.Steps))
+	for i := range c.Steps {
+		st := &c.Steps[i]
+		if err := st.check(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if st.Name != "" {
+			if names[st.Name] {
+				return fmt.Errorf("step %d: %w: duplicate name %s", i+1, ErrField, st.Name)
+			}
+			names[st.Name] = true
+		}
+	}
+	return nil
+}
+
+func (st *WorkflowStep) check() error {
+	if st.Name != "" && !namePattern.MatchString(st.Name) {
+		return fmt.Errorf("%w: invalid step name %q", ErrField, st.Name)
+	}
+	if len(st.Params) > 0 && st.Type != StepCommand {
+		return fmt.Errorf("%w: params are only for command steps", ErrField)
+	}
+	switch st.Type {
+	case StepCommand:
+		if st.Command == "" {
+			return fmt.Errorf("%w: command step needs command", ErrField)
+		}
+	case StepApp:
+		if st.App == "" {
+			return fmt.Errorf("%w: app step needs app", ErrField)
+		}
+		switch st.Action {
+		case ScheduleStart, ScheduleStop, ScheduleRestart:
+		default:
+			return fmt.Errorf("%w: invalid app action %q", ErrField, st.Action)
+		}
+	case StepSend, StepWait:
+		if st.App != "" && st.Proxy != "" {
+			return fmt.Errorf("%w: app and proxy are exclusive", ErrField)
+		}
+		target := st.App != "" || st.Proxy != ""
+		if st.Type == StepSend && (!target || st.Data == "") {
+			return fmt.Errorf("%w: send step needs data and app or proxy", ErrField)
+		}
+		if st.Type == StepWait && target == (st.Expect == "") {
+			return fmt.Errorf("%w: wait step needs either expect with app or proxy, or only duration", ErrField)
+		}
+		if st.Type == StepWait && !target && st.Duration <= 0 {
+			return fmt.Errorf("%w: wait step needs duration", ErrField)
+		}
+		if st.Fail != "" && st.Expect == "" {
+			return fmt.Errorf("%w: fail without expect", ErrField)
+		}
+		for _, pattern := range []string{st.Expect, st.Fail} {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%w: %v", ErrField, err)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: invalid step type %q", ErrField, st.Type)
+	}
+	switch st.When {
+	case "", WhenSuccess, WhenFailure, WhenAlways:
+	default:
+		return fmt.Errorf("%w: invalid when %q", ErrField, st.When)
+	}
+	if st.Duration < 0 || st.Timeout < 0 || st.Retries < 0 || st.RetryDelay < 0 {
+		return fmt.Errorf("%w: duration, timeout, retries and retry_delay should not be negative", ErrField)
+	}
+	return nil
 }
 
 type SysCfg struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	Token           string `json:"token"`
+	ShutdownTimeout int    `json:"shutdown_timeout"` // 秒，默认10秒
+	RecordDir       string `json:"record_dir"`       // link记录的目录，默认./recordings
+	RuntimeDir      string `json:"runtime_dir"`      // 生成的unix socket的目录，默认./run
+	// 同时运行的/exec和命令数，0表示不限制
+	MaxCommands int `json:"max_commands"`
+	// 命令达到并发上限时排队的请求数，默认0直接拒绝，-1不限制
+	CommandQueue int `json:"command_queue"`
+	// 毫秒，命令和link排队等待的时间，默认30000
+	QueueTimeout int `json:"queue_timeout"`
+	// 按客户端和路由限制请求频率，请求需要满足所有匹配的规则
+	RateLimits []*RateLimitCfg `json:"rate_limits"`
+}
+
+const (
+	RateByIP    = "ip"
+	RateByToken = "token"
+	RateByRoute = "route"
+)
+
+// RateLimitCfg 令牌桶限流规则
+type RateLimitCfg struct {
+	// 路由，:name匹配一段，*path匹配剩余部分，为空匹配所有请求
+	Route string `json:"route"`
+	// 请求方法，为空匹配所有方法
+	Methods []string `json:"methods"`
+	// ip按客户端地址，token按请求的token（没有token时按地址），route所有客户端共用，默认ip
+	By string `json:"by"`
+	// 每秒补充的请求数
+	Rate float64 `json:"rate"`
+	// 桶的容量，即允许的突发请求数，默认为rate且至少为1
+	Burst int `json:"burst"`
+}
+
+func (c *RateLimitCfg) GetBy() string {
+	if c.By == "" {
+		return RateByIP
+	}
+	return c.By
+}
+
+func (c *RateLimitCfg) GetBurst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	if c.Rate > 1 {
+		return int(c.Rate)
+	}
+	return 1
+}
+
+func (c *RateLimitCfg) check() error {
+	if c.Route != "" {
+		if !strings.HasPrefix(c.Route, "/") {
+			return fmt.Errorf("%w: route %s should start with /", ErrField, c.Route)
+		}
+		segs := strings.Split(strings.Trim(c.Route, "/"), "/")
+		for i, seg := range segs {
+			if (seg == ":" || seg == "*") || (strings.HasPrefix(seg, "*") && i != len(segs)-1) {
+				return fmt.Errorf("%w: invalid route %s", ErrField, c.Route)
+			}
+		}
+	}
+	for _, m := range c.Methods {
+		if m == "" || strings.ToUpper(m) != m {
+			return fmt.Errorf("%w: invalid method %q", ErrField, m)
+		}
+	}
+	switch c.GetBy() {
+	case RateByIP, RateByToken, RateByRoute:
+	default:
+		return fmt.Errorf("%w: invalid by %s", ErrField, c.By)
+	}
+	if c.Rate <= 0 {
+		return fmt.Errorf("%w: rate should be greater than 0", ErrField)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("%w: invalid burst %d", ErrField, c.Burst)
+	}
+	return nil
+}
+
+func (c *SysCfg) GetQueueTimeout() time.Duration {
+	if c.QueueTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.QueueTimeout) * time.Millisecond
+}
+
+func (c *SysCfg) GetShutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c *SysCfg) GetRuntimeDir() string {
+	if c.RuntimeDir == "" {
+		return "./run"
+	}
+	return c.RuntimeDir
+}
+
+func (c *SysCfg) GetRecordDir() string {
+	if c.RecordDir == "" {
+		return "./recordings"
+	}
+	return c.RecordDir
 }
 
 // 暂时留着做http的转发
@@ -39,22 +671,91 @@ type ProxyCfg struct {
 	Port    int                    `json:"port"`
 	Url     string                 `json:"url"`
 	Setting map[string]interface{} `json:"setting"`
+	Framing *FramingCfg            `json:"framing"`
+	Timeout int                    `json:"timeout"` // 毫秒，默认5000
+	Forward *ForwardCfg            `json:"forward"`
+	// http proxy的路径重写，按顺序使用第一条匹配的规则
+	Rewrite []RewriteCfg `json:"rewrite"`
+	// socket proxy的地址，可以是host:port或unix:///path，配置后代替host和port
+	Address string `json:"address"`
+}
+
+type RewriteCfg struct {
+	Match   string `json:"match"`   // 正则
+	Replace string `json:"replace"` // 可以使用$1引用分组
+
+	re *regexp.Regexp // check时编译的match
+}
+
+// 编译rewrite规则，添加和修改proxy时检查
+func (c *ProxyCfg) check() error {
+	for i := range c.Rewrite {
+		re, err := regexp.Compile(c.Rewrite[i].Match)
+		if err != nil {
+			return fmt.Errorf("%w: invalid rewrite %s: %v", ErrField, c.Rewrite[i].Match, err)
+		}
+		c.Rewrite[i].re = re
+	}
+	return nil
+}
+
+// Matcher 返回check时编译的正则，没有经过check的规则在这里编译
+func (r *RewriteCfg) Matcher() (*regexp.Regexp, error) {
+	if r.re != nil {
+		return r.re, nil
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid rewrite %s: %v", ErrField, r.Match, err)
+	}
+	return re, nil
+}
+
+// 端口转发，把listen收到的流量转发到host:port
+type ForwardCfg struct {
+	Listen      string   `json:"listen"`
+	Protocol    string   `json:"protocol"`     // tcp或udp，默认tcp
+	Allow       []string `json:"allow"`        // 允许的来源ip或网段，为空时不限制
+	IdleTimeout int      `json:"idle_timeout"` // 秒，udp会话的空闲时间，默认60
+}
+
+// 串口，与socket app一样通过/app/link使用，名字不能与app相同
+type SerialCfg struct {
+	Device      string `json:"device"`
+	Baud        int    `json:"baud"`         // 默认9600
+	DataBits    int    `json:"data_bits"`    // 5到8，默认8
+	Parity      string `json:"parity"`       // none、odd或even，默认none
+	StopBits    int    `json:"stop_bits"`    // 1或2，默认1
+	FlowControl string `json:"flow_control"` // none、rtscts或xonxoff，默认none
+	// 以下与AppCfg的同名配置相同
+	Framing       *FramingCfg `json:"framing"`
+	LinkTimeout   int         `json:"link_timeout"`
+	LinkWriteMode string      `json:"link_write_mode"`
+	Record        bool        `json:"record"`
+	Lock          string      `json:"lock"`
+	LinkQueue     int         `json:"link_queue"`
 }
 
 type ServerConfig struct {
-	rl      sync.RWMutex
-	sys     *SysCfg
-	proxies map[string]*ProxyCfg
-	cmds    map[string]*CmdCfg
-	apps    map[string]*AppCfg
+	rl        sync.RWMutex
+	sys       *SysCfg
+	proxies   map[string]*ProxyCfg
+	cmds      map[string]*CmdCfg
+	apps      map[string]*AppCfg
+	serials   map[string]*SerialCfg
+	schedules map[string]*ScheduleCfg
+	workflows map[string]*WorkflowCfg
 }
 
 func New() *ServerConfig {
 	return &ServerConfig{
-		sys:     &SysCfg{},
-		proxies: make(map[string]*ProxyCfg),
-		cmds:    make(map[string]*CmdCfg),
-		apps:    make(map[string]*AppCfg),
+		sys:       &SysCfg{},
+		proxies:   make(map[string]*ProxyCfg),
+		cmds:      make(map[string]*CmdCfg),
+		apps:      make(map[string]*AppCfg),
+		serials:   make(map[string]*SerialCfg),
+		schedules: make(map[string]*ScheduleCfg),
+		workflows: make(map[string]*WorkflowCfg),
 	}
 }
 
@@ -75,22 +776,154 @@ func (cfg *ServerConfig) Init(filePath string) error {
 	if err = json.Unmarshal(*marshalData["sys"], cfg.sys); err != nil {
 		return err
 	}
+	for i, rl := range cfg.sys.RateLimits {
+		if rl == nil {
+			return fmt.Errorf("rate_limits[%d]: %w: empty rule", i, ErrField)
+		}
+		if err = rl.check(); err != nil {
+			return fmt.Errorf("rate_limits[%d]: %w", i, err)
+		}
+	}
 
 	if err = json.Unmarshal(*marshalData["proxy"], &(cfg.proxies)); err != nil {
 		return err
 	}
+	for name, pxy := range cfg.proxies {
+		if err = pxy.check(); err != nil {
+			return fmt.Errorf("proxy %s: %w", name, err)
+		}
+	}
 
 	if err = json.Unmarshal(*marshalData["command"], &(cfg.cmds)); err != nil {
 		return err
 	}
+	for name, cmd := range cfg.cmds {
+		if err = cmd.check(); err != nil {
+			return fmt.Errorf("command %s: %w", name, err)
+		}
+	}
 
 	if err = json.Unmarshal(*marshalData["app"], &(cfg.apps)); err != nil {
 		return err
 	}
+	for name, app := range cfg.apps {
+		if err = app.checkPorts(); err != nil {
+			return fmt.Errorf("app %s: %w", name, err)
+		}
+	}
+
+	// 旧的配置文件没有serial
+	if raw, ok := marshalData["serial"]; ok && raw != nil {
+		if err = json.Unmarshal(*raw, &(cfg.serials)); err != nil {
+			return err
+		}
+	}
+
+	if raw, ok := marshalData["schedule"]; ok && raw != nil {
+		if err = json.Unmarshal(*raw, &(cfg.schedules)); err != nil {
+			return err
+		}
+		for name, sc := range cfg.schedules {
+			if err = sc.check(); err != nil {
+				return fmt.Errorf("schedule %s: %w", name, err)
+			}
+		}
+	}
+
+	if raw, ok := marshalData["workflow"]; ok && raw != nil {
+		if err = json.Unmarshal(*raw, &(cfg.workflows)); err != nil {
+			return err
+		}
+		for name, wf := range cfg.workflows {
+			if err = wf.check(); err != nil {
+				return fmt.Errorf("workflow %s: %w", name, err)
+			}
+		}
+	}
+
+	return cfg.checkDependencies()
+}
+
+// 检查depends_on引用的app是否存在，以及是否有循环依赖
+// 调用前需要持有cfg.rl
+func (cfg *ServerConfig) checkDependencies() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(cfg.apps))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("%w: cycle %s", ErrDependency, strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		path = append(append([]string{}, path...), name)
+		for _, dep := range cfg.apps[name].DependsOn {
+			if _, ok := cfg.apps[dep]; !ok {
+				return fmt.Errorf("%w: %s depends on unknown app %s", ErrDependency, name, dep)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
 
+	names := make([]string, 0, len(cfg.apps))
+	for name := range cfg.apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Dependents 返回依赖name的app
+func (cfg *ServerConfig) Dependents(name string) []string {
+	cfg.rl.RLock()
+	defer cfg.rl.RUnlock()
+	return cfg.dependents(name)
+}
+
+// 调用前需要持有cfg.rl
+func (cfg *ServerConfig) dependents(name string) []string {
+	var deps []string
+	for app, appCfg := range cfg.apps {
+		for _, dep := range appCfg.DependsOn {
+			if dep == name {
+				deps = append(deps, app)
+			}
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// Group 返回属于group的所有app
+func (cfg *ServerConfig) Group(group string) []string {
+	cfg.rl.RLock()
+	defer cfg.rl.RUnlock()
+	var names []string
+	for name, appCfg := range cfg.apps {
+		for _, g := range appCfg.Groups {
+			if g == group {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (cfg *ServerConfig) Exists(field string, name string) bool {
 	cfg.rl.RLock()
 	defer cfg.rl.RUnlock()
@@ -100,6 +933,15 @@ func (cfg *ServerConfig) Exists(field string, name string) bool {
 	} else if field == "app" {
 		_, exist := cfg.apps[name]
 		return exist
+	} else if field == "serial" {
+		_, exist := cfg.serials[name]
+		return exist
+	} else if field == "schedule" {
+		_, exist := cfg.schedules[name]
+		return exist
+	} else if field == "workflow" {
+		_, exist := cfg.workflows[name]
+		return exist
 	} else {
 		_, exist := cfg.proxies[name]
 		return exist
@@ -108,32 +950,80 @@ func (cfg *ServerConfig) Exists(field string, name string) bool {
 
 func (cfg *ServerConfig) Add(field string, name string, data []byte) error {
 	if cfg.Exists(field, name) {
-		return fmt.Errorf("%s is already configured", name)
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, name)
 	}
 
 	cfg.rl.RLock()
 	defer cfg.rl.RUnlock()
 
+	// app和串口都通过/app/link使用，名字不能重复
+	if _, ok := cfg.serials[name]; ok && field == "app" {
+		return fmt.Errorf("%w: %s is used by a serial port", ErrAlreadyExists, name)
+	}
+	if _, ok := cfg.apps[name]; ok && field == "serial" {
+		return fmt.Errorf("%w: %s is used by an app", ErrAlreadyExists, name)
+	}
+
 	if field == "command" {
 		var temp CmdCfg
 		if err := json.Unmarshal(data, &temp); err != nil {
 			return err
 		}
+		if err := temp.check(); err != nil {
+			return err
+		}
 		cfg.cmds[name] = &temp
 	} else if field == "app" {
 		var temp AppCfg
 		if err := json.Unmarshal(data, &temp); err != nil {
 			return err
 		}
+		if err := temp.checkPorts(); err != nil {
+			return err
+		}
 		cfg.apps[name] = &temp
+		if err := cfg.checkDependencies(); err != nil {
+			delete(cfg.apps, name)
+			return err
+		}
 	} else if field == "proxy" {
 		var temp ProxyCfg
 		if err := json.Unmarshal(data, &temp); err != nil {
 			return err
 		}
+		if err := temp.check(); err != nil {
+			return err
+		}
 		cfg.proxies[name] = &temp
+	} else if field == "serial" {
+		var temp SerialCfg
+		if err := json.Unmarshal(data, &temp); err != nil {
+			return err
+		}
+		if temp.Device == "" {
+			return fmt.Errorf("%w: serial %s has no device", ErrField, name)
+		}
+		cfg.serials[name] = &temp
+	} else if field == "schedule" {
+		var temp ScheduleCfg
+		if err := json.Unmarshal(data, &temp); err != nil {
+			return err
+		}
+		if err := temp.check(); err != nil {
+			return err
+		}
+		cfg.schedules[name] = &temp
+	} else if field == "workflow" {
+		var temp WorkflowCfg
+		if err := json.Unmarshal(data, &temp); err != nil {
+			return err
+		}
+		if err := temp.check(); err != nil {
+			return err
+		}
+		cfg.workflows[name] = &temp
 	} else {
-		return errors.New("field error")
+		return fmt.Errorf("%w: %s", ErrField, field)
 	}
 
 	return nil
@@ -141,7 +1031,7 @@ func (cfg *ServerConfig) Add(field string, name string, data []byte) error {
 
 func (cfg *ServerConfig) Delete(field string, name string) error {
 	if !cfg.Exists(field, name) {
-		return fmt.Errorf("%s not found", name)
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
 	}
 
 	cfg.rl.RLock()
@@ -150,16 +1040,25 @@ func (cfg *ServerConfig) Delete(field string, name string) error {
 	if field == "command" {
 		delete(cfg.cmds, name)
 	} else if field == "app" {
+		if deps := cfg.dependents(name); len(deps) > 0 {
+			return fmt.Errorf("%w: %s is required by %s", ErrInUse, name, strings.Join(deps, ", "))
+		}
 		delete(cfg.apps, name)
 	} else if field == "proxy" {
 		delete(cfg.proxies, name)
+	} else if field == "serial" {
+		delete(cfg.serials, name)
+	} else if field == "schedule" {
+		delete(cfg.schedules, name)
+	} else if field == "workflow" {
+		delete(cfg.workflows, name)
 	}
 	return nil
 }
 
 func (cfg *ServerConfig) Modify(field string, name string, data []byte) error {
 	if !cfg.Exists(field, name) {
-		return fmt.Errorf("%s not found", name)
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
 	}
 
 	cfg.rl.RLock()
@@ -170,26 +1069,121 @@ func (cfg *ServerConfig) Modify(field string, name string, data []byte) error {
 		if err := json.Unmarshal(data, &md); err != nil {
 			return err
 		}
-		if err := mergo.Merge(cfg.cmds[name], md, mergo.WithOverride); err != nil {
+		// 参数按请求整个替换
+		cmd := *cfg.cmds[name]
+		cmd.Params = nil
+		if err := mergo.Merge(&cmd, md, mergo.WithOverride); err != nil {
 			return err
 		}
+		if md.Params == nil {
+			cmd.Params = cfg.cmds[name].Params
+		}
+		if err := cmd.check(); err != nil {
+			return err
+		}
+		cfg.cmds[name] = &cmd
 	} else if field == "app" {
 		var md AppCfg
 		if err := json.Unmarshal(data, &md); err != nil {
 			return err
 		}
+		backup := *cfg.apps[name]
 		if err := mergo.Merge(cfg.apps[name], md, mergo.WithOverride); err != nil {
 			return err
 		}
 		cfg.apps[name].DefaultArgs = md.DefaultArgs
+		// mergo不会用空列表覆盖，请求中有depends_on时按请求整个替换，null或[]清除依赖
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err == nil {
+			if _, ok := fields["depends_on"]; ok {
+				cfg.apps[name].DependsOn = md.DependsOn
+			}
+		}
+		// mergo不会用零值覆盖，修改port、port_range或address时清除其他的
+		if md.Port > 0 {
+			cfg.apps[name].PortRange = ""
+			cfg.apps[name].Address = ""
+		} else if md.PortRange != "" {
+			cfg.apps[name].Port = 0
+			cfg.apps[name].Address = ""
+		} else if md.Address != "" {
+			cfg.apps[name].Port = 0
+			cfg.apps[name].PortRange = ""
+		}
+		err := cfg.apps[name].checkPorts()
+		if err == nil {
+			err = cfg.checkDependencies()
+		}
+		if err != nil {
+			*cfg.apps[name] = backup
+			return err
+		}
 	} else if field == "proxy" {
 		var md ProxyCfg
 		if err := json.Unmarshal(data, &md); err != nil {
 			return err
 		}
+		backup := *cfg.proxies[name]
 		if err := mergo.Merge(cfg.proxies[name], md, mergo.WithOverride); err != nil {
 			return err
 		}
+		if err := cfg.proxies[name].check(); err != nil {
+			*cfg.proxies[name] = backup
+			return err
+		}
+	} else if field == "serial" {
+		var md SerialCfg
+		if err := json.Unmarshal(data, &md); err != nil {
+			return err
+		}
+		if err := mergo.Merge(cfg.serials[name], md, mergo.WithOverride); err != nil {
+			return err
+		}
+	} else if field == "schedule" {
+		var md ScheduleCfg
+		if err := json.Unmarshal(data, &md); err != nil {
+			return err
+		}
+		backup := *cfg.schedules[name]
+		if err := mergo.Merge(cfg.schedules[name], md, mergo.WithOverride); err != nil {
+			return err
+		}
+		// mergo不会用零值覆盖，修改cron或interval时清除另一个，请求中有disabled时按请求设置
+		if md.Cron != "" {
+			cfg.schedules[name].Interval = 0
+		} else if md.Interval > 0 {
+			cfg.schedules[name].Cron = ""
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err == nil {
+			if _, ok := fields["disabled"]; ok {
+				cfg.schedules[name].Disabled = md.Disabled
+			}
+		}
+		if err := cfg.schedules[name].check(); err != nil {
+			*cfg.schedules[name] = backup
+			return err
+		}
+	} else if field == "workflow" {
+		// 步骤是一个整体，steps和vars按请求整个替换
+		var md WorkflowCfg
+		if err := json.Unmarshal(data, &md); err != nil {
+			return err
+		}
+		wf := *cfg.workflows[name]
+		if md.Description != "" {
+			wf.Description = md.Description
+		}
+		if md.Vars != nil {
+			wf.Vars = md.Vars
+		}
+		if md.Steps != nil {
+			wf.Steps = md.Steps
+		}
+		if err := wf.check(); err != nil {
+			return err
+		}
+		cfg.workflows[name] = &wf
 	}
 
 	return nil
@@ -201,6 +1195,9 @@ func (cfg *ServerConfig) Dump(filePath string) error {
 	dump["command"] = cfg.cmds
 	dump["app"] = cfg.apps
 	dump["proxy"] = cfg.proxies
+	dump["serial"] = cfg.serials
+	dump["schedule"] = cfg.schedules
+	dump["workflow"] = cfg.workflows
 	data, err := json.Marshal(dump)
 	if err != nil {
 		return err
@@ -231,6 +1228,12 @@ func (cfg *ServerConfig) GetConfig(field string, name string) interface{} {
 		return cfg.apps[name]
 	} else if field == "proxy" {
 		return cfg.proxies[name]
+	} else if field == "serial" {
+		return cfg.serials[name]
+	} else if field == "schedule" {
+		return cfg.schedules[name]
+	} else if field == "workflow" {
+		return cfg.workflows[name]
 	}
 
 	return nil
@@ -247,8 +1250,14 @@ func (cfg *ServerConfig) List(field string) map[string]interface{} {
 		length = len(cfg.cmds)
 	} else if field == "proxy" {
 		length = len(cfg.proxies)
+	} else if field == "serial" {
+		length = len(cfg.serials)
+	} else if field == "schedule" {
+		length = len(cfg.schedules)
+	} else if field == "workflow" {
+		length = len(cfg.workflows)
 	} else {
-		length = len(cfg.apps) + len(cfg.cmds) + len(cfg.proxies)
+		length = len(cfg.apps) + len(cfg.cmds) + len(cfg.proxies) + len(cfg.serials)
 	}
 	list := make(map[string]interface{}, length)
 
@@ -269,6 +1278,25 @@ func (cfg *ServerConfig) List(field string) map[string]interface{} {
 			list[k] = v
 		}
 	}
+
+	if field == "serial" || field == "all" {
+		for k, v := range cfg.serials {
+			list[k] = v
+		}
+	}
+
+	// 定时任务和工作流的名字可能与其他配置重复，不放在all里
+	if field == "schedule" {
+		for k, v := range cfg.schedules {
+			list[k] = v
+		}
+	}
+
+	if field == "workflow" {
+		for k, v := range cfg.workflows {
+			list[k] = v
+		}
+	}
 	return list
 }
 
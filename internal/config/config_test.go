@@ -0,0 +1,238 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestParamConvert(t *testing.T) {
+	tests := []struct {
+		name  string
+		param ParamCfg
+		raw   interface{}
+		want  interface{}
+		ok    bool
+	}{
+		{"string", ParamCfg{}, "abc", "abc", true},
+		{"string not string", ParamCfg{}, 3.0, nil, false},
+		{"string leading dash", ParamCfg{}, "-rf", nil, false},
+		{"string allow dash", ParamCfg{AllowDash: true}, "-rf", "-rf", true},
+		{"pattern", ParamCfg{Pattern: `[a-z]+\d`}, "abc1", "abc1", true},
+		// pattern需要完整匹配
+		{"pattern partial", ParamCfg{Pattern: `[a-z]+\d`}, "abc1 x", nil, false},
+		{"pattern alternation", ParamCfg{Pattern: `a|b`}, "ab", nil, false},
+		{"int", ParamCfg{Type: ParamInt}, 3.0, int64(3), true},
+		{"int string", ParamCfg{Type: ParamInt}, " 42 ", int64(42), true},
+		{"int negative", ParamCfg{Type: ParamInt}, "-2", int64(-2), true},
+		{"int fraction", ParamCfg{Type: ParamInt}, 1.5, nil, false},
+		{"int range", ParamCfg{Type: ParamInt, Min: float(1), Max: float(10)}, 11.0, nil, false},
+		{"float", ParamCfg{Type: ParamFloat}, "1e6", float64(1000000), true},
+		{"float min", ParamCfg{Type: ParamFloat, Min: float(0)}, -0.5, nil, false},
+		{"bool", ParamCfg{Type: ParamBool}, "true", true, true},
+		{"bool invalid", ParamCfg{Type: ParamBool}, "yes please", nil, false},
+		{"enum", ParamCfg{Type: ParamEnum, Enum: []string{"fast", "slow"}}, "slow", "slow", true},
+		{"enum invalid", ParamCfg{Type: ParamEnum, Enum: []string{"fast", "slow"}}, "medium", nil, false},
+	}
+	for _, tt := range tests {
+		p := tt.param
+		if _, err := p.check(tt.name); err != nil {
+			t.Fatalf("%s: check: %v", tt.name, err)
+		}
+		got, err := p.Convert(tt.name, tt.raw)
+		if !tt.ok {
+			if !errors.Is(err, ErrField) {
+				t.Errorf("%s: Convert(%v) = %v, %v, want ErrField", tt.name, tt.raw, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Convert(%v) = %#v, %v, want %#v", tt.name, tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestParamCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		param ParamCfg
+	}{
+		{"invalid type", ParamCfg{Type: "date"}},
+		{"empty enum", ParamCfg{Type: ParamEnum}},
+		{"invalid pattern", ParamCfg{Pattern: "("}},
+		{"invalid default", ParamCfg{Type: ParamInt, Default: "x"}},
+		{"default out of range", ParamCfg{Type: ParamInt, Default: 0.0, Min: float(1)}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.param.check("p"); !errors.Is(err, ErrField) {
+			t.Errorf("%s: check = %v, want ErrField", tt.name, err)
+		}
+	}
+}
+
+// 没有经过check的参数也不能panic
+func TestParamConvertUnchecked(t *testing.T) {
+	p := &ParamCfg{Pattern: "("}
+	if _, err := p.Convert("p", "x"); !errors.Is(err, ErrField) {
+		t.Errorf("Convert = %v, want ErrField", err)
+	}
+}
+
+func TestCmdResolveParams(t *testing.T) {
+	cmd := &CmdCfg{
+		Cmd:      "ping",
+		Template: "-c {{.count}} {{.host}}",
+		Params: map[string]*ParamCfg{
+			"count": {Type: ParamInt, Default: 3.0},
+			"host":  {Pattern: `[\w.-]+`},
+		},
+	}
+	if err := cmd.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	values, err := cmd.ResolveParams(map[string]interface{}{"host": "example.com"})
+	if err != nil {
+		t.Fatalf("ResolveParams: %v", err)
+	}
+	want := map[string]interface{}{"count": int64(3), "host": "example.com"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("ResolveParams = %v, want %v", values, want)
+	}
+	for _, params := range []map[string]interface{}{
+		{},
+		{"host": "a", "extra": 1.0},
+		{"host": "a b"},
+	} {
+		if _, err := cmd.ResolveParams(params); !errors.Is(err, ErrField) {
+			t.Errorf("ResolveParams(%v) = %v, want ErrField", params, err)
+		}
+	}
+
+	bad := &CmdCfg{Cmd: "ping", Template: "{{.undeclared}}"}
+	if err := bad.check(); err == nil {
+		t.Error("template with an undeclared param should fail check")
+	}
+}
+
+func TestModifyDependsOn(t *testing.T) {
+	cfg := New()
+	for _, app := range []struct{ name, data string }{
+		{"db", `{"port": 5432}`},
+		{"cache", `{"port": 6379}`},
+		{"web", `{"port": 8080, "depends_on": ["db", "cache"]}`},
+	} {
+		if err := cfg.Add("app", app.name, []byte(app.data)); err != nil {
+			t.Fatalf("add %s: %v", app.name, err)
+		}
+	}
+	dependsOn := func() []string {
+		return cfg.GetConfig("app", "web").(*AppCfg).DependsOn
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want []string
+		err  error
+	}{
+		{"omitted keeps the list", `{"port": 8081}`, []string{"db", "cache"}, nil},
+		{"replace", `{"depends_on": ["db"]}`, []string{"db"}, nil},
+		{"unknown app", `{"depends_on": ["nosuch"]}`, []string{"db"}, ErrDependency},
+		{"self", `{"depends_on": ["web"]}`, []string{"db"}, ErrDependency},
+		{"empty clears", `{"depends_on": []}`, []string{}, nil},
+		{"set again", `{"depends_on": ["cache"]}`, []string{"cache"}, nil},
+		{"null clears", `{"depends_on": null}`, nil, nil},
+	}
+	for _, tt := range tests {
+		err := cfg.Modify("app", "web", []byte(tt.data))
+		if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: Modify = %v, want %v", tt.name, err, tt.err)
+		}
+		if got := dependsOn(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: depends_on = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// 修改依赖后形成循环时恢复原来的配置
+	if err := cfg.Modify("app", "web", []byte(`{"depends_on": ["db"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Modify("app", "db", []byte(`{"depends_on": ["web"]}`)); !errors.Is(err, ErrDependency) {
+		t.Errorf("cycle: Modify = %v, want ErrDependency", err)
+	}
+	if deps := cfg.GetConfig("app", "db").(*AppCfg).DependsOn; len(deps) != 0 {
+		t.Errorf("db depends_on = %q after a rejected cycle", deps)
+	}
+	if err := cfg.Delete("app", "db"); !errors.Is(err, ErrInUse) {
+		t.Errorf("Delete db = %v, want ErrInUse", err)
+	}
+}
+
+func TestProxyRewriteCheck(t *testing.T) {
+	cfg := New()
+	if err := cfg.Add("proxy", "bad", []byte(`{"url": "http://127.0.0.1:80", "rewrite": [{"match": "("}]}`)); !errors.Is(err, ErrField) {
+		t.Errorf("Add with an invalid rewrite = %v, want ErrField", err)
+	}
+	if err := cfg.Add("proxy", "api", []byte(`{"url": "http://127.0.0.1:80", "rewrite": [{"match": "^/v1/(.*)", "replace": "/$1"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	pxy := cfg.GetConfig("proxy", "api").(*ProxyCfg)
+	if pxy.Rewrite[0].re == nil {
+		t.Error("rewrite was not compiled by Add")
+	}
+
+	// 修改失败时恢复原来的规则
+	if err := cfg.Modify("proxy", "api", []byte(`{"rewrite": [{"match": "["}]}`)); !errors.Is(err, ErrField) {
+		t.Errorf("Modify with an invalid rewrite = %v, want ErrField", err)
+	}
+	if got := pxy.Rewrite[0].Match; got != "^/v1/(.*)" {
+		t.Errorf("rewrite after a rejected Modify = %q", got)
+	}
+	if err := cfg.Modify("proxy", "api", []byte(`{"rewrite": [{"match": "^/v2/(.*)", "replace": "/$1"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if pxy.Rewrite[0].re == nil || pxy.Rewrite[0].re.String() != "^/v2/(.*)" {
+		t.Errorf("rewrite was not compiled by Modify: %v", pxy.Rewrite[0].re)
+	}
+}
+
+func TestAppPortsCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		app  string
+		ok   bool
+	}{
+		{"fixed", `{"port": 8080}`, true},
+		{"range", `{"port_range": "10000-10100"}`, true},
+		{"unix", `{"address": "unix://", "port_args": ["--unix", "{path}"]}`, true},
+		{"invalid port", `{"port": 70000}`, false},
+		{"port and range", `{"port": 8080, "port_range": "10000-10100"}`, false},
+		{"invalid range", `{"port_range": "100-10"}`, false},
+		{"unix with port", `{"address": "unix://", "port": 8080}`, false},
+		// unix socket app的{port}只会得到0
+		{"unix port placeholder", `{"address": "unix://", "port_args": ["--port={port}"]}`, false},
+	}
+	for _, tt := range tests {
+		err := New().Add("app", "web", []byte(tt.app))
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, ErrField) {
+			t.Errorf("%s: Add = %v", tt.name, err)
+		}
+
+		// 配置文件中的app同样检查
+		path := filepath.Join(t.TempDir(), "config.json")
+		data := `{"sys": {}, "proxy": {}, "command": {}, "app": {"web": ` + tt.app + `}}`
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err = New().Init(path)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, ErrField) {
+			t.Errorf("%s: Init = %v", tt.name, err)
+		}
+	}
+}
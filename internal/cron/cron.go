@@ -0,0 +1,185 @@
+// Package cron 解析5段cron表达式（分 时 日 月 周）并计算下一次执行时间
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSpec = errors.New("invalid cron expression")
+
+// Schedule 解析后的cron表达式，每段用bit表示允许的值
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// 日和周都不是*时，满足其中一个即可
+	domStar, dowStar bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 0和7都表示周日
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse 解析cron表达式，支持*、a-b、*/n、a-b/n、逗号分隔的列表、月和周的英文缩写，以及@daily等宏
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q should have 5 fields", ErrSpec, spec)
+	}
+	s := &Schedule{
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+	}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		b, err := f.parsePart(part)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func (f field) parsePart(part string) (uint64, error) {
+	rangeExpr, step := part, 1
+	if i := strings.IndexByte(part, '/'); i >= 0 {
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("%w: invalid step in %s %q", ErrSpec, f.name, part)
+		}
+		rangeExpr, step = part[:i], n
+	}
+	first, last := f.min, f.max
+	switch {
+	case rangeExpr == "*" || rangeExpr == "?":
+	case strings.Contains(rangeExpr, "-"):
+		bounds := strings.SplitN(rangeExpr, "-", 2)
+		var err error
+		if first, err = f.value(bounds[0]); err != nil {
+			return 0, err
+		}
+		if last, err = f.value(bounds[1]); err != nil {
+			return 0, err
+		}
+		if first > last {
+			return 0, fmt.Errorf("%w: invalid range in %s %q", ErrSpec, f.name, part)
+		}
+	default:
+		v, err := f.value(rangeExpr)
+		if err != nil {
+			return 0, err
+		}
+		first = v
+		// 单个值带步长时表示从该值开始到最大值
+		if step == 1 {
+			last = v
+		}
+	}
+	var bits uint64
+	for v := first; v <= last; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%w: %s should be %d-%d, got %q", ErrSpec, f.name, f.min, f.max, s)
+	}
+	return v, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domOk := s.dom&(1<<uint(t.Day())) != 0
+	dowOk := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domOk && dowOk
+	}
+	return domOk || dowOk
+}
+
+// Next 返回t之后第一个满足表达式的时间，精确到分钟，5年内没有时返回零值
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
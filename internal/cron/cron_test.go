@@ -0,0 +1,103 @@
+package cron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"* * * * *", "2024-03-10 12:00", "2024-03-10 12:01"},
+		{"*/15 * * * *", "2024-03-10 12:07", "2024-03-10 12:15"},
+		{"*/15 * * * *", "2024-03-10 12:45", "2024-03-10 13:00"},
+		{"0 9-17/4 * * *", "2024-03-10 13:30", "2024-03-10 17:00"},
+		{"5,35 * * * *", "2024-03-10 12:05", "2024-03-10 12:35"},
+		{"30 2 * * *", "2024-03-10 02:30", "2024-03-11 02:30"},
+		{"0 0 1 * *", "2024-01-31 10:00", "2024-02-01 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"0 0 29 feb *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 12 * JAN-MAR *", "2024-03-31 12:00", "2025-01-01 12:00"},
+		// 2024-03-10是周日，7和0都表示周日
+		{"0 8 * * mon-fri", "2024-03-09 08:00", "2024-03-11 08:00"},
+		{"0 8 * * 7", "2024-03-09 08:00", "2024-03-10 08:00"},
+		{"0 8 * * 0", "2024-03-09 08:00", "2024-03-10 08:00"},
+		// 日和周都不是*时满足其中一个即可
+		{"0 0 15 * fri", "2024-03-09 00:00", "2024-03-15 00:00"},
+		{"0 0 13 * fri", "2024-03-09 00:00", "2024-03-13 00:00"},
+		{"0 0 1 * ?", "2024-03-09 00:00", "2024-04-01 00:00"},
+		// 单个值带步长表示从该值开始
+		{"10/20 * * * *", "2024-03-10 12:31", "2024-03-10 12:50"},
+		{"@hourly", "2024-03-10 12:00", "2024-03-10 13:00"},
+		{"@weekly", "2024-03-10 12:00", "2024-03-17 00:00"},
+		{"@YEARLY", "2024-03-10 12:00", "2025-01-01 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(date(tt.from)); !got.Equal(date(tt.want)) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+// 秒和纳秒被截断，结果总是在t之后
+func TestNextTruncates(t *testing.T) {
+	s, err := Parse("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := date("2024-03-10 12:00").Add(59*time.Second + time.Millisecond)
+	if got := s.Next(from); !got.Equal(date("2024-03-10 12:01")) {
+		t.Errorf("Next = %s", got)
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	s, err := Parse("0 0 31 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Next(date("2024-01-01 00:00")); !got.IsZero() {
+		t.Errorf("Next = %s, want zero", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"@often",
+	} {
+		if _, err := Parse(spec); !errors.Is(err, ErrSpec) {
+			t.Errorf("Parse(%q) = %v, want ErrSpec", spec, err)
+		}
+	}
+}
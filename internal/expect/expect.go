@@ -0,0 +1,248 @@
+// Package expect 在socket连接上执行send/expect脚本，返回每一步的记录
+package expect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	// 等待匹配时缓存的数据上限
+	MaxBuffer = 1 << 20
+
+	readSize = 4096
+)
+
+var (
+	ErrScript  = errors.New("invalid expect script")
+	ErrTimeout = errors.New("expect timeout")
+	ErrFail    = errors.New("fail pattern matched")
+	ErrClosed  = errors.New("connection closed")
+	ErrBuffer  = errors.New("expect buffer is full")
+)
+
+// send中的${name}会替换成变量
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Step 先发送send，再等待收到的数据匹配expect
+// expect中的命名分组会保存为变量，供后面的send使用
+type Step struct {
+	Send    string `json:"send,omitempty"`
+	Expect  string `json:"expect,omitempty"`
+	Fail    string `json:"fail,omitempty"`    // 先于expect匹配时脚本失败
+	Timeout int    `json:"timeout,omitempty"` // 毫秒，默认使用脚本的timeout
+}
+
+type Script struct {
+	Steps   []Step            `json:"steps"`
+	Vars    map[string]string `json:"vars,omitempty"`
+	Timeout int               `json:"timeout,omitempty"` // 毫秒，每一步的默认超时，默认5000
+}
+
+type StepResult struct {
+	Step   int    `json:"step"`
+	Send   string `json:"send,omitempty"` // 替换变量后实际发送的内容
+	Expect string `json:"expect,omitempty"`
+	// 本步收到的数据，到匹配结束为止，失败时为已经收到的全部数据
+	Output  string            `json:"output"`
+	Match   string            `json:"match,omitempty"`
+	Groups  []string          `json:"groups,omitempty"`
+	Capture map[string]string `json:"capture,omitempty"`
+	Elapsed int64             `json:"elapsed"` // 毫秒
+	Error   string            `json:"error,omitempty"`
+}
+
+type Result struct {
+	Ok bool `json:"ok"`
+	// 初始变量加上捕获的变量
+	Vars       map[string]string `json:"vars"`
+	Transcript []StepResult      `json:"transcript"`
+	FailedStep int               `json:"failed_step,omitempty"` // 从1开始，成功时为0
+	Error      string            `json:"error,omitempty"`
+}
+
+type step struct {
+	Step
+	expect  *regexp.Regexp
+	fail    *regexp.Regexp
+	timeout time.Duration
+}
+
+// Program 编译后的脚本，可以多次执行
+type Program struct {
+	steps []step
+	vars  map[string]string
+}
+
+// Compile 检查脚本并编译正则
+func Compile(s Script) (*Program, error) {
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%w: no steps", ErrScript)
+	}
+	timeout := DefaultTimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Millisecond
+	}
+	p := &Program{vars: s.Vars}
+	for i, st := range s.Steps {
+		cs := step{Step: st, timeout: timeout}
+		if st.Timeout > 0 {
+			cs.timeout = time.Duration(st.Timeout) * time.Millisecond
+		}
+		if st.Send == "" && st.Expect == "" {
+			return nil, fmt.Errorf("%w: step %d has neither send nor expect", ErrScript, i+1)
+		}
+		if st.Fail != "" && st.Expect == "" {
+			return nil, fmt.Errorf("%w: step %d has fail without expect", ErrScript, i+1)
+		}
+		var err error
+		if st.Expect != "" {
+			if cs.expect, err = regexp.Compile(st.Expect); err != nil {
+				return nil, fmt.Errorf("%w: step %d expect: %v", ErrScript, i+1, err)
+			}
+		}
+		if st.Fail != "" {
+			if cs.fail, err = regexp.Compile(st.Fail); err != nil {
+				return nil, fmt.Errorf("%w: step %d fail: %v", ErrScript, i+1, err)
+			}
+		}
+		p.steps = append(p.steps, cs)
+	}
+	return p, nil
+}
+
+// 一次执行的状态
+type run struct {
+	conn net.Conn
+	buf  []byte
+	vars map[string]string
+}
+
+// Run 在conn上按顺序执行每一步，遇到错误时停止，conn由调用方关闭
+func (p *Program) Run(conn net.Conn) *Result {
+	r := &run{conn: conn, vars: make(map[string]string, len(p.vars))}
+	for k, v := range p.vars {
+		r.vars[k] = v
+	}
+	res := &Result{Vars: r.vars, Transcript: make([]StepResult, 0, len(p.steps))}
+	for i, st := range p.steps {
+		sr := r.step(i+1, st)
+		res.Transcript = append(res.Transcript, sr)
+		if sr.Error != "" {
+			res.FailedStep = i + 1
+			res.Error = fmt.Sprintf("step %d: %s", i+1, sr.Error)
+			return res
+		}
+	}
+	res.Ok = true
+	return res
+}
+
+func (r *run) step(n int, st step) (sr StepResult) {
+	start := time.Now()
+	sr = StepResult{Step: n, Expect: st.Expect}
+	defer func() {
+		sr.Elapsed = time.Since(start).Milliseconds()
+	}()
+	deadline := start.Add(st.timeout)
+	if st.Send != "" {
+		data, err := r.expand(st.Send)
+		if err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+		sr.Send = data
+		r.conn.SetWriteDeadline(deadline)
+		if _, err := r.conn.Write([]byte(data)); err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+	}
+	if st.expect == nil {
+		return sr
+	}
+	loc, err := r.wait(st, deadline)
+	if err != nil {
+		sr.Output = string(r.buf)
+		sr.Error = err.Error()
+		return sr
+	}
+	sr.Output = string(r.buf[:loc[1]])
+	sr.Match = string(r.buf[loc[0]:loc[1]])
+	for g := 1; g*2 < len(loc); g++ {
+		var v string
+		if loc[g*2] >= 0 {
+			v = string(r.buf[loc[g*2]:loc[g*2+1]])
+		}
+		sr.Groups = append(sr.Groups, v)
+		if name := st.expect.SubexpNames()[g]; name != "" {
+			if sr.Capture == nil {
+				sr.Capture = make(map[string]string)
+			}
+			sr.Capture[name] = v
+			r.vars[name] = v
+		}
+	}
+	// 匹配之后的数据留给下一步
+	r.buf = append(r.buf[:0], r.buf[loc[1]:]...)
+	return sr
+}
+
+// 读取数据直到expect匹配，fail先于expect匹配时返回ErrFail
+func (r *run) wait(st step, deadline time.Time) ([]int, error) {
+	chunk := make([]byte, readSize)
+	for {
+		loc := st.expect.FindSubmatchIndex(r.buf)
+		if st.fail != nil {
+			if f := st.fail.FindIndex(r.buf); f != nil && (loc == nil || f[0] < loc[1]) {
+				return nil, fmt.Errorf("%w: %q", ErrFail, r.buf[f[0]:f[1]])
+			}
+		}
+		if loc != nil {
+			return loc, nil
+		}
+		if len(r.buf) >= MaxBuffer {
+			return nil, ErrBuffer
+		}
+		r.conn.SetReadDeadline(deadline)
+		n, err := r.conn.Read(chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+		if err != nil && n == 0 {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				return nil, fmt.Errorf("%w: %q not matched in %v", ErrTimeout, st.Expect, st.timeout)
+			case errors.Is(err, io.EOF):
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+	}
+}
+
+// 替换send中的${name}，变量不存在时返回错误
+func (r *run) expand(s string) (string, error) {
+	return Expand(s, r.vars)
+}
+
+// Expand 把s中的${name}替换成vars中的变量，变量不存在时返回错误
+func Expand(s string, vars map[string]string) (string, error) {
+	var missing string
+	out := varPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := varPattern.FindStringSubmatch(m)[1]
+		v, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %s", missing)
+	}
+	return out, nil
+}
@@ -0,0 +1,132 @@
+package expect
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		script Script
+	}{
+		{"no steps", Script{}},
+		{"empty step", Script{Steps: []Step{{}}}},
+		{"fail without expect", Script{Steps: []Step{{Send: "a", Fail: "b"}}}},
+		{"invalid expect", Script{Steps: []Step{{Expect: "("}}}},
+		{"invalid fail", Script{Steps: []Step{{Expect: "a", Fail: "["}}}},
+	}
+	for _, tt := range tests {
+		if _, err := Compile(tt.script); !errors.Is(err, ErrScript) {
+			t.Errorf("%s: Compile = %v, want ErrScript", tt.name, err)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"user": "admin", "id": "7"}
+	got, err := Expand("login ${user} #${id} $user ${}", vars)
+	if err != nil || got != "login admin #7 $user ${}" {
+		t.Errorf("Expand = %q, %v", got, err)
+	}
+	if _, err := Expand("${user} ${missing}", vars); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("undefined variable: %v", err)
+	}
+}
+
+// 模拟设备：每收到一行按replies回复，没有对应回复时不响应
+func device(t *testing.T, replies map[string]string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			reply, ok := replies[strings.TrimSpace(line)]
+			if !ok {
+				continue
+			}
+			if reply == "" {
+				return
+			}
+			if _, err := server.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+	return client
+}
+
+func runScript(t *testing.T, script Script, conn net.Conn) *Result {
+	t.Helper()
+	p, err := Compile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Run(conn)
+}
+
+func TestRun(t *testing.T) {
+	conn := device(t, map[string]string{
+		"login admin": "welcome admin, session 42\n> ",
+		"show 42":     "status: ok\nextra\n> ",
+	})
+	res := runScript(t, Script{
+		Vars: map[string]string{"user": "admin"},
+		Steps: []Step{
+			{Send: "login ${user}\n", Expect: `session (?P<sid>\d+)`},
+			{Send: "show ${sid}\n", Expect: `status: (\w+)`, Fail: "error"},
+			// 上一步匹配之后的数据留给下一步
+			{Expect: "> "},
+		},
+	}, conn)
+	if !res.Ok || res.FailedStep != 0 {
+		t.Fatalf("result = %+v", res)
+	}
+	if res.Vars["sid"] != "42" || res.Vars["user"] != "admin" {
+		t.Errorf("vars = %v", res.Vars)
+	}
+	first := res.Transcript[0]
+	if first.Send != "login admin\n" || first.Match != "session 42" || first.Capture["sid"] != "42" {
+		t.Errorf("step 1 = %+v", first)
+	}
+	second := res.Transcript[1]
+	if second.Send != "show 42\n" || !reflect.DeepEqual(second.Groups, []string{"ok"}) {
+		t.Errorf("step 2 = %+v", second)
+	}
+	if got := res.Transcript[2].Output; got != "\nextra\n> " {
+		t.Errorf("step 3 output = %q", got)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Step
+		err   string
+	}{
+		{"fail pattern", []Step{{Send: "boot\n", Expect: "ready", Fail: "panic"}}, ErrFail.Error()},
+		{"timeout", []Step{{Send: "silent\n", Expect: "ready", Timeout: 50}}, ErrTimeout.Error()},
+		{"closed", []Step{{Send: "quit\n", Expect: "ready"}}, ErrClosed.Error()},
+		{"undefined variable", []Step{{Send: "${nope}\n"}}, "undefined variable nope"},
+	}
+	for _, tt := range tests {
+		conn := device(t, map[string]string{"boot": "kernel panic, not ready\n", "quit": ""})
+		res := runScript(t, Script{Steps: append([]Step{{Send: "hello\n"}}, tt.steps...)}, conn)
+		if res.Ok || res.FailedStep != 2 || !strings.Contains(res.Error, tt.err) {
+			t.Errorf("%s: result = %+v, want %q at step 2", tt.name, res, tt.err)
+		}
+		if len(res.Transcript) != 2 {
+			t.Errorf("%s: transcript has %d steps", tt.name, len(res.Transcript))
+		}
+	}
+}
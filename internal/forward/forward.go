@@ -0,0 +1,370 @@
+// Package forward 把本地端口的tcp或udp流量转发到目标地址
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+
+	dialTimeout = 5 * time.Second
+	// udp没有连接，超过这个时间没有数据的会话会被关闭
+	defaultIdleTimeout = time.Minute
+	maxDatagramSize    = 65535
+
+	unixScheme = "unix://"
+)
+
+type Config struct {
+	Protocol string
+	Listen   string
+	Target   string // host:port，tcp转发时也可以是unix:///path
+	// 允许的来源ip或网段，为空时不限制
+	Allow       []string
+	IdleTimeout time.Duration
+}
+
+type Stats struct {
+	Protocol string    `json:"protocol"`
+	Listen   string    `json:"listen"`
+	Target   string    `json:"target"`
+	Started  time.Time `json:"started"`
+	// 当前的连接数，udp为会话数
+	Active   int64 `json:"active"`
+	Total    int64 `json:"total"`
+	Rejected int64 `json:"rejected"`
+	Failed   int64 `json:"failed"`
+	// 客户端发给目标的字节数
+	BytesIn int64 `json:"bytes_in"`
+	// 目标发给客户端的字节数
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type Forwarder struct {
+	cfg     Config
+	allow   []*net.IPNet
+	started time.Time
+
+	ln net.Listener
+	pc net.PacketConn
+
+	mu    sync.Mutex
+	conns map[io.Closer]bool
+	wg    sync.WaitGroup
+
+	active, total, rejected, failed atomic.Int64
+	bytesIn, bytesOut               atomic.Int64
+
+	// 连接级别的错误，不影响转发
+	Logf func(format string, args ...interface{})
+}
+
+func New(cfg Config) (*Forwarder, error) {
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = ProtocolTCP
+	case ProtocolTCP, ProtocolUDP:
+	default:
+		return nil, fmt.Errorf("invalid forward protocol: %s", cfg.Protocol)
+	}
+	if cfg.Listen == "" || cfg.Target == "" {
+		return nil, errors.New("forward listen and target are required")
+	}
+	if cfg.Protocol == ProtocolUDP && strings.HasPrefix(cfg.Target, unixScheme) {
+		return nil, errors.New("udp forward does not support unix socket target")
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	allow, err := parseAllow(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return &Forwarder{
+		cfg:   cfg,
+		allow: allow,
+		conns: make(map[io.Closer]bool),
+		Logf:  func(string, ...interface{}) {},
+	}, nil
+}
+
+// ip按单个地址处理，其他按网段处理
+func parseAllow(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid forward allow entry: %s", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward allow entry: %s", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (f *Forwarder) allowed(addr net.Addr) bool {
+	if len(f.allow) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start 开始监听，监听失败时返回错误
+func (f *Forwarder) Start() error {
+	var err error
+	if f.cfg.Protocol == ProtocolUDP {
+		if f.pc, err = net.ListenPacket("udp", f.cfg.Listen); err != nil {
+			return err
+		}
+		f.started = time.Now()
+		f.wg.Add(1)
+		go f.serveUDP()
+		return nil
+	}
+	if f.ln, err = net.Listen("tcp", f.cfg.Listen); err != nil {
+		return err
+	}
+	f.started = time.Now()
+	f.wg.Add(1)
+	go f.serveTCP()
+	return nil
+}
+
+// Stop 停止监听并关闭所有连接
+func (f *Forwarder) Stop() error {
+	var err error
+	if f.ln != nil {
+		err = f.ln.Close()
+	}
+	if f.pc != nil {
+		err = f.pc.Close()
+	}
+	f.mu.Lock()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// Addr 实际监听的地址，listen的端口为0时使用
+func (f *Forwarder) Addr() string {
+	if f.ln != nil {
+		return f.ln.Addr().String()
+	}
+	if f.pc != nil {
+		return f.pc.LocalAddr().String()
+	}
+	return f.cfg.Listen
+}
+
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		Protocol: f.cfg.Protocol,
+		Listen:   f.Addr(),
+		Target:   f.cfg.Target,
+		Started:  f.started,
+		Active:   f.active.Load(),
+		Total:    f.total.Load(),
+		Rejected: f.rejected.Load(),
+		Failed:   f.failed.Load(),
+		BytesIn:  f.bytesIn.Load(),
+		BytesOut: f.bytesOut.Load(),
+	}
+}
+
+func (f *Forwarder) track(c io.Closer) {
+	f.mu.Lock()
+	f.conns[c] = true
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) untrack(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) serveTCP() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.Logf("accept failed: %v", err)
+			}
+			return
+		}
+		if !f.allowed(conn.RemoteAddr()) {
+			f.rejected.Add(1)
+			f.Logf("rejected connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		f.total.Add(1)
+		f.wg.Add(1)
+		go f.handleTCP(conn)
+	}
+}
+
+func (f *Forwarder) handleTCP(conn net.Conn) {
+	defer f.wg.Done()
+	f.track(conn)
+	defer func() {
+		f.untrack(conn)
+		conn.Close()
+	}()
+
+	network, address := "tcp", f.cfg.Target
+	if strings.HasPrefix(address, unixScheme) {
+		network, address = "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	target, err := net.DialTimeout(network, address, dialTimeout)
+	if err != nil {
+		f.failed.Add(1)
+		f.Logf("connecting %s for %s failed: %v", f.cfg.Target, conn.RemoteAddr(), err)
+		return
+	}
+	f.track(target)
+	defer func() {
+		f.untrack(target)
+		target.Close()
+	}()
+
+	f.active.Add(1)
+	defer f.active.Add(-1)
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn, counter *atomic.Int64) {
+		io.Copy(&countWriter{w: dst, n: counter}, src)
+		// 一端关闭后通知另一端，tcp和unix连接支持半关闭，其他连接直接关闭
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(target, conn, &f.bytesIn)
+	go pipe(conn, target, &f.bytesOut)
+	<-done
+	<-done
+}
+
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// 每个客户端地址一个udp会话，会话使用单独的连接与目标通信
+func (f *Forwarder) serveUDP() {
+	defer f.wg.Done()
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]net.Conn)
+		buf      = make([]byte, maxDatagramSize)
+	)
+	for {
+		n, addr, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.Logf("receive failed: %v", err)
+			}
+			return
+		}
+		if !f.allowed(addr) {
+			f.rejected.Add(1)
+			continue
+		}
+		mu.Lock()
+		target, ok := sessions[addr.String()]
+		if !ok {
+			target, err = net.Dial("udp", f.cfg.Target)
+			if err != nil {
+				mu.Unlock()
+				f.failed.Add(1)
+				f.Logf("connecting %s for %s failed: %v", f.cfg.Target, addr, err)
+				continue
+			}
+			sessions[addr.String()] = target
+			f.total.Add(1)
+			f.active.Add(1)
+			f.track(target)
+			f.wg.Add(1)
+			go func(addr net.Addr, target net.Conn) {
+				defer f.wg.Done()
+				f.replyUDP(addr, target)
+				mu.Lock()
+				delete(sessions, addr.String())
+				mu.Unlock()
+				f.untrack(target)
+				target.Close()
+				f.active.Add(-1)
+			}(addr, target)
+		}
+		mu.Unlock()
+		if _, err := target.Write(buf[:n]); err != nil {
+			f.Logf("sending to %s for %s failed: %v", f.cfg.Target, addr, err)
+			continue
+		}
+		f.bytesIn.Add(int64(n))
+		// 客户端有数据时延长会话
+		target.SetReadDeadline(time.Now().Add(f.cfg.IdleTimeout))
+	}
+}
+
+// 把目标的响应发回客户端，会话空闲超时或连接关闭时返回
+func (f *Forwarder) replyUDP(addr net.Addr, target net.Conn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		target.SetReadDeadline(time.Now().Add(f.cfg.IdleTimeout))
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := f.pc.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+		f.bytesOut.Add(int64(n))
+	}
+}
@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 目标读到EOF后才回复，客户端半关闭后应该仍然能收到回复
+func TestHalfClose(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "target.sock")
+	tcpTarget, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpTarget.Close()
+	unixTarget, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixTarget.Close()
+
+	for _, tt := range []struct {
+		name   string
+		ln     net.Listener
+		target string
+	}{
+		{"tcp", tcpTarget, tcpTarget.Addr().String()},
+		{"unix", unixTarget, unixScheme + sock},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			go func() {
+				c, err := tt.ln.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				data, _ := io.ReadAll(c)
+				c.Write(append([]byte("got "), data...))
+			}()
+
+			f, err := New(Config{Listen: "127.0.0.1:0", Target: tt.target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer f.Stop()
+
+			conn, err := net.Dial("tcp", f.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			reply, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != "got ping" {
+				t.Errorf("reply = %q, want %q", reply, "got ping")
+			}
+		})
+	}
+}
@@ -53,6 +53,7 @@ func (sl *ServerLogger) HttpRequestLog(lvl string, r *http.Request, msg string)
 		"field":          "http request",
 		"request_url":    r.URL.String(),
 		"request_method": r.Method,
+		"request_id":     r.Header.Get("X-Request-Id"),
 	}
 	sl.CommonLog(lvl, msg, f)
 }
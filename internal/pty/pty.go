@@ -0,0 +1,11 @@
+// Package pty 在伪终端下启动进程，主设备可以像文件一样读写
+package pty
+
+import "errors"
+
+const (
+	DefaultCols = 80
+	DefaultRows = 24
+)
+
+var ErrUnsupported = errors.New("pty is not supported on this platform")
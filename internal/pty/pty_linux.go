@@ -0,0 +1,93 @@
+package pty
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 打开一对主从设备，从设备给子进程使用
+func open() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("unlockpt: %w", err)
+		}
+		var err error
+		if n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN); err != nil {
+			return fmt.Errorf("ptsname: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// Start 在新的伪终端下启动cmd，返回主设备
+// 子进程是新会话的leader，从设备是它的控制终端
+func Start(cmd *exec.Cmd) (*os.File, error) {
+	master, slave, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	if err := Resize(master, DefaultCols, DefaultRows); err != nil {
+		master.Close()
+		return nil, err
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// Resize 修改终端大小，子进程会收到SIGWINCH
+func Resize(master *os.File, cols, rows int) error {
+	if cols <= 0 || rows <= 0 || cols > 0xffff || rows > 0xffff {
+		return fmt.Errorf("invalid terminal size %dx%d", cols, rows)
+	}
+	ws := &unix.Winsize{Col: uint16(cols), Row: uint16(rows)}
+	return control(master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+	})
+}
+
+// 不用Fd()，否则文件会变成阻塞模式，Close无法中断Read
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
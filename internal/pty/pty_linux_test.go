@@ -0,0 +1,70 @@
+package pty
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 从主设备读取直到输出包含want，返回目前读到的所有输出
+func readUntil(t *testing.T, master *os.File, out *bytes.Buffer, want string) string {
+	t.Helper()
+	master.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for !strings.Contains(out.String(), want) {
+		n, err := master.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			t.Fatalf("waiting for %q: %v, got %q", want, err, out.String())
+		}
+	}
+	return out.String()
+}
+
+func TestStart(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `stty size; read l; stty size; echo "got $l"`)
+	master, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	var out bytes.Buffer
+	readUntil(t, master, &out, "24 80\r\n")
+	// 改变大小后子进程看到新的大小
+	if err := Resize(master, 100, 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	// 终端回显输入，输出的\n转换为\r\n
+	got := readUntil(t, master, &out, "got hello\r\n")
+	if want := "24 80\r\nhello\r\n30 100\r\ngot hello\r\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("wait: %v", err)
+	}
+}
+
+func TestResizeInvalid(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	master, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		master.Close()
+	}()
+	for _, size := range [][2]int{{0, 24}, {80, -1}, {0x10000, 24}} {
+		if err := Resize(master, size[0], size[1]); err == nil {
+			t.Errorf("Resize(%d, %d) succeeded", size[0], size[1])
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package pty
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Start 暂不支持windows的ConPTY
+func Start(cmd *exec.Cmd) (*os.File, error) {
+	return nil, ErrUnsupported
+}
+
+func Resize(master *os.File, cols, rows int) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,221 @@
+// Package record 记录socket连接上收发的数据，用于排查问题和离线回放
+// 每个连接一个文件，第一行是Header，之后每行一个Event
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 发给app的数据
+	DirTx = "tx"
+	// 从app收到的数据
+	DirRx = "rx"
+
+	Ext = ".jsonl"
+)
+
+var ErrInvalidName = errors.New("invalid recording name")
+
+type Header struct {
+	App   string    `json:"app"`
+	Kind  string    `json:"kind"`
+	Url   string    `json:"url"`
+	Start time.Time `json:"start"`
+}
+
+// Event 一次读写，Data在文件中为base64
+type Event struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"`
+	Data []byte    `json:"data"`
+}
+
+type Recorder struct {
+	mu   sync.Mutex
+	name string
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Create 在dir下新建记录文件并写入Header
+func Create(dir string, h Header) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := fmt.Sprintf("%s_%s_%s", h.App, h.Kind, h.Start.Format("20060102-150405.000"))
+	for i := 0; ; i++ {
+		name := base + Ext
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, i, Ext)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r := &Recorder{name: name, file: file, enc: json.NewEncoder(file)}
+		if err := r.enc.Encode(h); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+func (r *Recorder) Name() string {
+	return r.name
+}
+
+// Record 写入一条记录，文件已经关闭时忽略
+func (r *Recorder) Record(dir string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.enc.Encode(Event{Time: time.Now(), Dir: dir, Data: data})
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Conn 记录经过连接的所有数据，关闭连接时关闭记录文件
+type Conn struct {
+	net.Conn
+	rec *Recorder
+}
+
+func NewConn(conn net.Conn, rec *Recorder) *Conn {
+	return &Conn{Conn: conn, rec: rec}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.rec.Record(DirRx, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.rec.Record(DirTx, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Close() error {
+	c.rec.Close()
+	return c.Conn.Close()
+}
+
+type Recording struct {
+	Header Header
+	Events []Event
+}
+
+// Load 读取记录文件
+func Load(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rec Recording
+	dec := json.NewDecoder(bufio.NewReader(file))
+	if err := dec.Decode(&rec.Header); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	for dec.More() {
+		var evt Event
+		if err := dec.Decode(&evt); err != nil {
+			return nil, fmt.Errorf("invalid recording event: %w", err)
+		}
+		rec.Events = append(rec.Events, evt)
+	}
+	return &rec, nil
+}
+
+type Info struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Header
+}
+
+// Path 返回记录文件的路径，name不能包含目录
+func Path(dir, name string) (string, error) {
+	if name == "" || filepath.Base(name) != name || !strings.HasSuffix(name, Ext) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidName, name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// List 列出dir下的记录，app不为空时只返回该app的记录，按开始时间排序
+func List(dir, app string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Info{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), Ext) {
+			continue
+		}
+		info, err := readInfo(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			// 不是记录文件
+			continue
+		}
+		if app != "" && info.App != app {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	return infos, nil
+}
+
+func readInfo(path string) (Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Name: filepath.Base(path), Size: stat.Size()}
+	if err := json.NewDecoder(file).Decode(&info.Header); err != nil {
+		return Info{}, err
+	}
+	return info, nil
+}
@@ -0,0 +1,153 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 经过Conn的读写按顺序记录，Load读回相同的内容
+func TestConnRecord(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	rec, err := Create(dir, Header{App: "echo", Kind: "put", Url: "localhost:9000", Start: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := server.Read(buf)
+		server.Write(append([]byte("re:"), buf[:n]...))
+		server.Close()
+	}()
+	conn := NewConn(client, rec)
+	conn.Write([]byte{0, 1, 'x'})
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(reply) != "re:\x00\x01x" {
+		t.Fatalf("reply = %q", reply)
+	}
+	// 关闭后的记录被忽略
+	if err := rec.Record(DirTx, []byte("late")); err != nil {
+		t.Errorf("Record after Close = %v", err)
+	}
+
+	loaded, err := Load(filepath.Join(dir, rec.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Header.App != "echo" || !loaded.Header.Start.Equal(start) {
+		t.Errorf("header = %+v", loaded.Header)
+	}
+	if len(loaded.Events) != 2 {
+		t.Fatalf("events = %+v", loaded.Events)
+	}
+	if e := loaded.Events[0]; e.Dir != DirTx || string(e.Data) != "\x00\x01x" {
+		t.Errorf("event 0 = %+v", e)
+	}
+	if e := loaded.Events[1]; e.Dir != DirRx || string(e.Data) != "re:\x00\x01x" {
+		t.Errorf("event 1 = %+v", e)
+	}
+}
+
+func TestCreateUniqueName(t *testing.T) {
+	dir := t.TempDir()
+	h := Header{App: "echo", Kind: "ws", Start: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)}
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		rec, err := Create(dir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Close()
+		names[rec.Name()] = true
+	}
+	if !names["echo_ws_20240501-080000.000.jsonl"] || !names["echo_ws_20240501-080000.000-2.jsonl"] || len(names) != 3 {
+		t.Errorf("names = %v", names)
+	}
+}
+
+func TestPath(t *testing.T) {
+	if p, err := Path("/var/rec", "a.jsonl"); err != nil || p != filepath.Join("/var/rec", "a.jsonl") {
+		t.Errorf("Path = %q, %v", p, err)
+	}
+	for _, name := range []string{"", "a.txt", "../a.jsonl", "sub/a.jsonl"} {
+		if _, err := Path("/var/rec", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Path(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	if infos, err := List(filepath.Join(dir, "missing"), ""); err != nil || len(infos) != 0 {
+		t.Errorf("missing dir: %v, %v", infos, err)
+	}
+	base := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	for i, app := range []string{"b", "a", "b"} {
+		rec, err := Create(dir, Header{App: app, Kind: "put", Start: base.Add(time.Duration(2-i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Close()
+	}
+	// 不是记录的文件被忽略
+	os.WriteFile(filepath.Join(dir, "junk.jsonl"), []byte("not json"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("{}"), 0644)
+
+	infos, err := List(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 || infos[0].App != "b" || infos[1].App != "a" || !infos[0].Start.Before(infos[2].Start) {
+		t.Errorf("List = %+v", infos)
+	}
+	if infos[0].Size == 0 {
+		t.Errorf("size of %s is 0", infos[0].Name)
+	}
+	infos, err = List(dir, "b")
+	if err != nil || len(infos) != 2 {
+		t.Errorf("List(b) = %+v, %v", infos, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	now := time.Now()
+	p := &Replayer{Rec: &Recording{Events: []Event{
+		{Time: now, Dir: DirTx, Data: []byte("ping")},
+		{Time: now, Dir: DirRx, Data: []byte("pong")},
+		{Time: now, Dir: DirTx, Data: []byte("quit")},
+		{Time: now, Dir: DirRx, Data: []byte("bye")},
+	}}}
+	var mismatched []int
+	p.Mismatch = func(conn net.Conn, index int, want, got []byte) {
+		mismatched = append(mismatched, index)
+	}
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Replay(server)
+		server.Close()
+	}()
+	go func() {
+		client.Write([]byte("ping"))
+		// 长度相同但内容不同的数据仍然继续回放
+		client.Write([]byte("exit"))
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, _ := io.ReadAll(client)
+	if string(out) != "pongbye" {
+		t.Errorf("replayed %q", out)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Replay = %v", err)
+	}
+	if len(mismatched) != 1 || mismatched[0] != 2 {
+		t.Errorf("mismatched events = %v", mismatched)
+	}
+}
@@ -0,0 +1,68 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Replayer 作为假的socket server回放记录
+// 每个连接从头回放：tx事件等待客户端发送同样长度的数据，rx事件按记录的间隔发给客户端
+type Replayer struct {
+	Rec *Recording
+	// 回放速度，1为原速，0表示不等待
+	Speed float64
+	// 客户端发送的数据与记录不一致时调用
+	Mismatch func(conn net.Conn, index int, want, got []byte)
+	// 回放结束后保持连接直到客户端断开
+	Hold bool
+}
+
+// Serve 接受连接并回放，listener关闭时返回
+func (p *Replayer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			p.Replay(conn)
+		}()
+	}
+}
+
+// Replay 在一个连接上回放记录
+func (p *Replayer) Replay(conn net.Conn) error {
+	var last time.Time
+	for i, evt := range p.Rec.Events {
+		switch evt.Dir {
+		case DirTx:
+			got := make([]byte, len(evt.Data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				return err
+			}
+			if !bytes.Equal(got, evt.Data) && p.Mismatch != nil {
+				p.Mismatch(conn, i, evt.Data, got)
+			}
+		case DirRx:
+			if p.Speed > 0 && !last.IsZero() {
+				time.Sleep(time.Duration(float64(evt.Time.Sub(last)) / p.Speed))
+			}
+			if _, err := conn.Write(evt.Data); err != nil {
+				return err
+			}
+		}
+		last = evt.Time
+	}
+	if p.Hold {
+		_, err := io.Copy(io.Discard, conn)
+		return err
+	}
+	return nil
+}
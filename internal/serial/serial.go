@@ -0,0 +1,100 @@
+// Package serial 打开并配置串口，打开后的串口可以像socket连接一样使用
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	ParityNone = "none"
+	ParityOdd  = "odd"
+	ParityEven = "even"
+
+	FlowNone    = "none"
+	FlowRTSCTS  = "rtscts"
+	FlowXonXoff = "xonxoff"
+
+	defaultBaud = 9600
+)
+
+var (
+	ErrBusy        = errors.New("serial port is in use")
+	ErrConfig      = errors.New("invalid serial config")
+	ErrUnsupported = errors.New("serial ports are not supported on this platform")
+)
+
+type Config struct {
+	Device      string
+	Baud        int    // 默认9600
+	DataBits    int    // 5到8，默认8
+	Parity      string // none、odd或even，默认none
+	StopBits    int    // 1或2，默认1
+	FlowControl string // none、rtscts或xonxoff，默认none
+}
+
+// 补全默认值并检查配置
+func (c *Config) normalize() error {
+	if c.Device == "" {
+		return fmt.Errorf("%w: device is required", ErrConfig)
+	}
+	if c.Baud == 0 {
+		c.Baud = defaultBaud
+	}
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+	if c.DataBits < 5 || c.DataBits > 8 {
+		return fmt.Errorf("%w: data_bits %d", ErrConfig, c.DataBits)
+	}
+	switch c.Parity {
+	case "":
+		c.Parity = ParityNone
+	case ParityNone, ParityOdd, ParityEven:
+	default:
+		return fmt.Errorf("%w: parity %s", ErrConfig, c.Parity)
+	}
+	switch c.StopBits {
+	case 0:
+		c.StopBits = 1
+	case 1, 2:
+	default:
+		return fmt.Errorf("%w: stop_bits %d", ErrConfig, c.StopBits)
+	}
+	switch c.FlowControl {
+	case "":
+		c.FlowControl = FlowNone
+	case FlowNone, FlowRTSCTS, FlowXonXoff:
+	default:
+		return fmt.Errorf("%w: flow_control %s", ErrConfig, c.FlowControl)
+	}
+	return nil
+}
+
+// Port 已打开的串口，实现net.Conn，读写支持deadline
+// 串口以独占方式打开，Close后其他会话才能打开
+type Port struct {
+	*os.File
+	device string
+}
+
+func (p *Port) LocalAddr() net.Addr {
+	return Addr(p.device)
+}
+
+func (p *Port) RemoteAddr() net.Addr {
+	return Addr(p.device)
+}
+
+// Addr 串口的设备路径
+type Addr string
+
+func (a Addr) Network() string {
+	return "serial"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
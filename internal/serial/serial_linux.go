@@ -0,0 +1,132 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var bauds = map[int]uint32{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1152000: unix.B1152000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	2500000: unix.B2500000,
+	3000000: unix.B3000000,
+	3500000: unix.B3500000,
+	4000000: unix.B4000000,
+}
+
+var dataBits = map[int]uint32{
+	5: unix.CS5,
+	6: unix.CS6,
+	7: unix.CS7,
+	8: unix.CS8,
+}
+
+// Open 以raw模式打开串口，也可以是pty的slave端，用于测试
+// 用flock和TIOCEXCL独占串口，已经被占用时返回ErrBusy
+func Open(cfg Config) (*Port, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	speed, ok := bauds[cfg.Baud]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported baud %d", ErrConfig, cfg.Baud)
+	}
+	// 非阻塞打开，os.File才能使用poller和deadline
+	fd, err := unix.Open(cfg.Device, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			// 被其他进程以TIOCEXCL打开
+			return nil, fmt.Errorf("%w: %s", ErrBusy, cfg.Device)
+		}
+		return nil, &os.PathError{Op: "open", Path: cfg.Device, Err: err}
+	}
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		unix.Close(fd)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrBusy, cfg.Device)
+		}
+		return nil, &os.PathError{Op: "flock", Path: cfg.Device, Err: err}
+	}
+	if err := unix.IoctlSetInt(fd, unix.TIOCEXCL, 0); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "ioctl", Path: cfg.Device, Err: err}
+	}
+	if err := setTermios(fd, cfg, speed); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "tcsetattr", Path: cfg.Device, Err: err}
+	}
+	return &Port{File: os.NewFile(uintptr(fd), cfg.Device), device: cfg.Device}, nil
+}
+
+// 设置为raw模式，与cfmakeraw相同，读到1个字节就返回
+func setTermios(fd int, cfg Config, speed uint32) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL |
+		unix.IXON | unix.IXOFF | unix.IXANY | unix.INPCK
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CREAD | unix.CLOCAL | dataBits[cfg.DataBits] | speed
+	switch cfg.Parity {
+	case ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+		t.Iflag |= unix.INPCK
+	case ParityEven:
+		t.Cflag |= unix.PARENB
+		t.Iflag |= unix.INPCK
+	}
+	if cfg.StopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	switch cfg.FlowControl {
+	case FlowRTSCTS:
+		t.Cflag |= unix.CRTSCTS
+	case FlowXonXoff:
+		t.Iflag |= unix.IXON | unix.IXOFF
+	}
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// Close 关闭前清除TIOCEXCL，tty还被其他进程打开时独占标志不会自动清除
+func (p *Port) Close() error {
+	if rc, err := p.File.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			unix.IoctlSetInt(int(fd), unix.TIOCNXCL, 0)
+		})
+	}
+	return p.File.Close()
+}
@@ -0,0 +1,159 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	procGetCommState = kernel32.NewProc("GetCommState")
+	procSetCommState = kernel32.NewProc("SetCommState")
+	procPurgeComm    = kernel32.NewProc("PurgeComm")
+)
+
+// DCB的位域
+const (
+	dcbBinary         = 0x00000001
+	dcbParity         = 0x00000002
+	dcbOutxCtsFlow    = 0x00000004
+	dcbOutxDsrFlow    = 0x00000008
+	dcbDtrControlMask = 0x00000030
+	dcbDtrEnable      = 0x00000010
+	dcbDsrSensitivity = 0x00000040
+	dcbOutX           = 0x00000100
+	dcbInX            = 0x00000200
+	dcbErrorChar      = 0x00000400
+	dcbNull           = 0x00000800
+	dcbRtsControlMask = 0x00003000
+	dcbRtsEnable      = 0x00001000
+	dcbRtsHandshake   = 0x00002000
+	dcbAbortOnError   = 0x00004000
+
+	noParity    = 0
+	oddParity   = 1
+	evenParity  = 2
+	oneStopBit  = 0
+	twoStopBits = 2
+
+	purgeAll = 0x000f // PURGE_TXABORT|PURGE_RXABORT|PURGE_TXCLEAR|PURGE_RXCLEAR
+)
+
+// 与winbase.h中的DCB相同
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+// Open 以overlapped方式打开COM口，os.File才能使用IOCP和deadline
+// 打开时不共享，已经被占用时返回ErrBusy
+func Open(cfg Config) (*Port, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	// COM10以上必须使用\\.\COMx
+	path := cfg.Device
+	if !strings.HasPrefix(path, `\\.\`) {
+		path = `\\.\` + path
+	}
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: device %s", ErrConfig, cfg.Device)
+	}
+	h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_SHARING_VIOLATION) {
+			return nil, fmt.Errorf("%w: %s", ErrBusy, cfg.Device)
+		}
+		return nil, &os.PathError{Op: "open", Path: cfg.Device, Err: err}
+	}
+	if err := setCommState(h, cfg); err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	// 有数据时立即返回，没有数据时等到第一个字节，超时由deadline控制
+	timeouts := windows.CommTimeouts{
+		ReadIntervalTimeout:        0xffffffff,
+		ReadTotalTimeoutMultiplier: 0xffffffff,
+		ReadTotalTimeoutConstant:   0xfffffffe,
+	}
+	if err := windows.SetCommTimeouts(h, &timeouts); err != nil {
+		windows.CloseHandle(h)
+		return nil, &os.PathError{Op: "SetCommTimeouts", Path: cfg.Device, Err: err}
+	}
+	procPurgeComm.Call(uintptr(h), purgeAll)
+
+	f := os.NewFile(uintptr(h), cfg.Device)
+	// 旧版本的Go不会把NewFile得到的overlapped句柄加入IOCP，读写无法使用
+	if err := f.SetDeadline(time.Time{}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnsupported, cfg.Device, err)
+	}
+	return &Port{File: f, device: cfg.Device}, nil
+}
+
+// 设置为二进制模式，不使用DTR/DSR握手和错误替换
+func setCommState(h windows.Handle, cfg Config) error {
+	var d dcb
+	d.DCBlength = uint32(unsafe.Sizeof(d))
+	if r, _, err := procGetCommState.Call(uintptr(h), uintptr(unsafe.Pointer(&d))); r == 0 {
+		return &os.PathError{Op: "GetCommState", Path: cfg.Device, Err: err}
+	}
+	d.BaudRate = uint32(cfg.Baud)
+	d.ByteSize = byte(cfg.DataBits)
+	d.Flags &^= dcbParity | dcbOutxCtsFlow | dcbOutxDsrFlow | dcbDtrControlMask | dcbDsrSensitivity |
+		dcbOutX | dcbInX | dcbErrorChar | dcbNull | dcbRtsControlMask | dcbAbortOnError
+	d.Flags |= dcbBinary | dcbDtrEnable
+	switch cfg.Parity {
+	case ParityOdd:
+		d.Parity = oddParity
+		d.Flags |= dcbParity
+	case ParityEven:
+		d.Parity = evenParity
+		d.Flags |= dcbParity
+	default:
+		d.Parity = noParity
+	}
+	if cfg.StopBits == 2 {
+		d.StopBits = twoStopBits
+	} else {
+		d.StopBits = oneStopBit
+	}
+	switch cfg.FlowControl {
+	case FlowRTSCTS:
+		d.Flags |= dcbOutxCtsFlow | dcbRtsHandshake
+	case FlowXonXoff:
+		d.Flags |= dcbOutX | dcbInX | dcbRtsEnable
+		d.XonChar = 0x11
+		d.XoffChar = 0x13
+	default:
+		d.Flags |= dcbRtsEnable
+	}
+	if r, _, err := procSetCommState.Call(uintptr(h), uintptr(unsafe.Pointer(&d))); r == 0 {
+		if errors.Is(err, windows.ERROR_INVALID_PARAMETER) {
+			return fmt.Errorf("%w: unsupported serial settings for %s: %v", ErrConfig, cfg.Device, err)
+		}
+		return &os.PathError{Op: "SetCommState", Path: cfg.Device, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+// 排队等待的时间放在响应的这个header中，单位毫秒
+const queueTimeHeader = "X-Queue-Time"
+
+var (
+	ErrQueueFull    = errors.New("too many concurrent requests")
+	ErrQueueTimeout = errors.New("queue timeout")
+)
+
+// LimiterStatus 并发限制的当前状态和累计计数
+type LimiterStatus struct {
+	Name     string `json:"name"`
+	Limit    int    `json:"limit"` // 0表示不限制
+	Queue    int    `json:"queue"` // 允许排队的请求数，-1表示不限制
+	Running  int    `json:"running"`
+	Waiting  int    `json:"waiting"`
+	Total    int64  `json:"total"`    // 获得执行机会的请求数
+	Queued   int64  `json:"queued"`   // 其中排过队的请求数
+	Rejected int64  `json:"rejected"` // 队列满时拒绝的请求数
+	Timeouts int64  `json:"timeouts"` // 排队超时的请求数
+}
+
+// Limiter 限制同时运行的请求数，达到上限时按先后顺序排队
+// limit和queue在每次Acquire时传入，配置修改后立即生效
+type Limiter struct {
+	rl      sync.Mutex
+	name    string
+	limit   int
+	queue   int
+	running int
+	waiters []chan struct{}
+	stats   LimiterStatus
+}
+
+func newLimiter(name string) *Limiter {
+	return &Limiter{name: name}
+}
+
+// Acquire 获得执行机会，返回排队的时间，完成后需要调用Release
+// limit为0时不限制，queue为-1时不限制排队数，为0时达到上限直接拒绝
+func (l *Limiter) Acquire(ctx context.Context, limit, queue int, timeout time.Duration) (time.Duration, error) {
+	l.rl.Lock()
+	l.limit, l.queue = limit, queue
+	if limit <= 0 || (l.running < limit && len(l.waiters) == 0) {
+		l.running++
+		l.stats.Total++
+		l.rl.Unlock()
+		return 0, nil
+	}
+	if queue >= 0 && len(l.waiters) >= queue {
+		l.stats.Rejected++
+		running, waiting := l.running, len(l.waiters)
+		l.rl.Unlock()
+		return 0, fmt.Errorf("%w: %s has %d running and %d waiting", ErrQueueFull, l.name, running, waiting)
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.rl.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	select {
+	case <-ch:
+		// Release已经把位置交给了这个请求
+		l.stats.Total++
+		l.stats.Queued++
+		return time.Since(start), nil
+	default:
+	}
+	for i, v := range l.waiters {
+		if v == ch {
+			l.waiters = append(l.waiters[:i:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	l.stats.Timeouts++
+	return 0, fmt.Errorf("%w: %s is still busy after %v", ErrQueueTimeout, l.name, timeout)
+}
+
+// Release 结束运行，把位置交给排在最前面的请求
+func (l *Limiter) Release() {
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	l.running--
+	for len(l.waiters) > 0 && (l.limit <= 0 || l.running < l.limit) {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.running++
+	}
+}
+
+func (l *Limiter) Status() LimiterStatus {
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	status := l.stats
+	status.Name = l.name
+	status.Limit = l.limit
+	status.Queue = l.queue
+	status.Running = l.running
+	status.Waiting = len(l.waiters)
+	return status
+}
+
+// LimitStatus GET /limits的结果
+type LimitStatus struct {
+	Commands     LimiterStatus     `json:"commands"`
+	PerCommand   []LimiterStatus   `json:"per_command"`
+	Links        []LimiterStatus   `json:"links"`
+	QueueTimeout int               `json:"queue_timeout"` // 毫秒
+	RateLimits   []RateLimitStatus `json:"rate_limits"`
+}
+
+// LimitManager 管理命令和link的并发限制
+// 命令先按command.max_concurrent排队，再按sys.max_commands排队；每个app的PUT /app/link依次处理
+type LimitManager struct {
+	rl       sync.RWMutex
+	commands *Limiter
+	perCmd   map[string]*Limiter
+	links    map[string]*Limiter
+}
+
+func NewLimitManager() *LimitManager {
+	return &LimitManager{
+		commands: newLimiter("commands"),
+		perCmd:   make(map[string]*Limiter),
+		links:    make(map[string]*Limiter),
+	}
+}
+
+func (m *LimitManager) limiter(group map[string]*Limiter, name string) *Limiter {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	l, ok := group[name]
+	if !ok {
+		l = newLimiter(name)
+		group[name] = l
+	}
+	return l
+}
+
+// Command 获得运行命令的机会，name为空时只受全局限制（/exec）
+// 返回排队的总时间和结束时调用的release
+func (m *LimitManager) Command(ctx context.Context, name string) (time.Duration, func(), error) {
+	sysCfg := serverConfig.GetSysConfig()
+	timeout := sysCfg.GetQueueTimeout()
+	var (
+		waited time.Duration
+		perCmd *Limiter
+	)
+	if name != "" {
+		if cmdCfg, ok := serverConfig.GetConfig("command", name).(*config.CmdCfg); ok && cmdCfg.MaxConcurrent > 0 {
+			perCmd = m.limiter(m.perCmd, name)
+			w, err := perCmd.Acquire(ctx, cmdCfg.MaxConcurrent, sysCfg.CommandQueue, timeout)
+			if err != nil {
+				return 0, nil, err
+			}
+			waited += w
+		}
+	}
+	w, err := m.commands.Acquire(ctx, sysCfg.MaxCommands, sysCfg.CommandQueue, timeout-waited)
+	if err != nil {
+		if perCmd != nil {
+			perCmd.Release()
+		}
+		return 0, nil, err
+	}
+	waited += w
+	return waited, func() {
+		m.commands.Release()
+		if perCmd != nil {
+			perCmd.Release()
+		}
+	}, nil
+}
+
+// Link 获得向app发送PUT /app/link或expect请求的机会，同一个app同时只处理一个请求
+func (m *LimitManager) Link(ctx context.Context, name string, appCfg *config.AppCfg) (time.Duration, func(), error) {
+	l := m.limiter(m.links, name)
+	waited, err := l.Acquire(ctx, 1, appCfg.GetLinkQueue(), serverConfig.GetSysConfig().GetQueueTimeout())
+	if err != nil {
+		return 0, nil, err
+	}
+	return waited, l.Release, nil
+}
+
+// Remove 删除app或命令的计数，配置删除时使用
+func (m *LimitManager) Remove(field, name string) {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if field == "command" {
+		delete(m.perCmd, name)
+	} else {
+		delete(m.links, name)
+	}
+}
+
+func (m *LimitManager) Status() LimitStatus {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	status := LimitStatus{
+		Commands:     m.commands.Status(),
+		PerCommand:   make([]LimiterStatus, 0, len(m.perCmd)),
+		Links:        make([]LimiterStatus, 0, len(m.links)),
+		QueueTimeout: int(serverConfig.GetSysConfig().GetQueueTimeout() / time.Millisecond),
+		RateLimits:   rateLimiter.Status(),
+	}
+	for _, l := range m.perCmd {
+		status.PerCommand = append(status.PerCommand, l.Status())
+	}
+	for _, l := range m.links {
+		status.Links = append(status.Links, l.Status())
+	}
+	sort.Slice(status.PerCommand, func(i, j int) bool {
+		return status.PerCommand[i].Name < status.PerCommand[j].Name
+	})
+	sort.Slice(status.Links, func(i, j int) bool {
+		return status.Links[i].Name < status.Links[j].Name
+	})
+	return status
+}
+
+// 排过队的请求在响应中带上排队时间
+func setQueueTime(w http.ResponseWriter, waited time.Duration) {
+	if waited > 0 {
+		w.Header().Set(queueTimeHeader, strconv.FormatInt(waited.Milliseconds(), 10))
+	}
+}
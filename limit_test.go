@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 等待limiter的排队数达到n
+func waitLimiterWaiting(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d waiting on %s", n, l.name), func() bool {
+		return l.Status().Waiting == n
+	})
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter("test")
+	for i := 0; i < 5; i++ {
+		if _, err := l.Acquire(context.Background(), 0, 0, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := l.Status(); s.Running != 5 || s.Total != 5 || s.Queued != 0 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestLimiterQueueFull(t *testing.T) {
+	l := newLimiter("test")
+	if _, err := l.Acquire(context.Background(), 1, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// queue为0时达到上限直接拒绝
+	if _, err := l.Acquire(context.Background(), 1, 0, time.Second); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Acquire = %v, want ErrQueueFull", err)
+	}
+	go l.Acquire(context.Background(), 1, 1, time.Minute)
+	waitLimiterWaiting(t, l, 1)
+	if _, err := l.Acquire(context.Background(), 1, 1, time.Second); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Acquire with a full queue = %v, want ErrQueueFull", err)
+	}
+	if s := l.Status(); s.Rejected != 2 || s.Running != 1 || s.Waiting != 1 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+// 释放后按排队的先后顺序获得执行机会
+func TestLimiterOrder(t *testing.T) {
+	l := newLimiter("test")
+	if _, err := l.Acquire(context.Background(), 1, -1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			waited, err := l.Acquire(context.Background(), 1, -1, 5*time.Second)
+			if err != nil || waited <= 0 {
+				t.Errorf("waiter %d: waited %v, %v", i, waited, err)
+			}
+			order <- i
+		}()
+		waitLimiterWaiting(t, l, i+1)
+	}
+	for want := 0; want < 3; want++ {
+		time.Sleep(5 * time.Millisecond)
+		l.Release()
+		if got := <-order; got != want {
+			t.Fatalf("waiter %d ran before %d", got, want)
+		}
+		if s := l.Status(); s.Running != 1 || s.Waiting != 2-want {
+			t.Errorf("after release %d: status = %+v", want, s)
+		}
+	}
+	if s := l.Status(); s.Total != 4 || s.Queued != 3 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := newLimiter("test")
+	if _, err := l.Acquire(context.Background(), 1, -1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := l.Acquire(context.Background(), 1, -1, 30*time.Millisecond); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Acquire = %v, want ErrQueueTimeout", err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("timed out after %v", d)
+	}
+
+	// 超时或取消的请求离开队列，不影响后面的请求
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(ctx, 1, -1, time.Minute)
+		canceled <- err
+	}()
+	waitLimiterWaiting(t, l, 1)
+	next := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), 1, -1, time.Minute)
+		next <- err
+	}()
+	waitLimiterWaiting(t, l, 2)
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled Acquire = %v, want context.Canceled", err)
+	}
+	waitLimiterWaiting(t, l, 1)
+	l.Release()
+	if err := <-next; err != nil {
+		t.Errorf("next Acquire: %v", err)
+	}
+	if s := l.Status(); s.Timeouts != 1 || s.Running != 1 || s.Waiting != 0 {
+		t.Errorf("status = %+v", s)
+	}
+}
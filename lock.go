@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+const (
+	// 请求中携带租约token的header，多个token用逗号分隔
+	leaseTokenHeader = "X-Lease-Token"
+
+	defaultLeaseTTL = 60 * time.Second
+	maxLeaseTTL     = 24 * time.Hour
+)
+
+var (
+	ErrLockHeld      = errors.New("resource is locked")
+	ErrLeaseInvalid  = errors.New("invalid lease")
+	ErrLeaseRequired = errors.New("lease required")
+	ErrLocksClosed   = errors.New("lock manager is closed")
+)
+
+// BodyLock 申请租约，wait大于0时排队等待
+type BodyLock struct {
+	Owner string `json:"owner"`
+	TTL   int    `json:"ttl"`  // 秒，默认60
+	Wait  int    `json:"wait"` // 秒，0表示被占用时立即返回
+}
+
+// BodyLease 续约或释放租约，token也可以放在X-Lease-Token中
+type BodyLease struct {
+	Token string `json:"token"`
+	TTL   int    `json:"ttl"` // 秒，续约时为空则沿用申请时的ttl
+}
+
+// Lease 资源的租约，token只返回给申请者
+type Lease struct {
+	Resource string    `json:"resource"`
+	Owner    string    `json:"owner"`
+	Token    string    `json:"token,omitempty"`
+	TTL      int       `json:"ttl"` // 秒
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+type LockWaiter struct {
+	Owner string    `json:"owner"`
+	Since time.Time `json:"since"`
+}
+
+type LockStatus struct {
+	Resource string       `json:"resource"`
+	Holder   *Lease       `json:"holder,omitempty"`
+	Waiters  []LockWaiter `json:"waiters,omitempty"`
+}
+
+type lockWaiter struct {
+	owner string
+	ttl   time.Duration
+	since time.Time
+	done  chan struct{}
+	lease *Lease // 轮到时由LockManager设置后关闭done
+	err   error
+}
+
+// 一个资源的持有者和排队的waiter，由LockManager的锁保护
+type lockState struct {
+	holder  *Lease
+	ttl     time.Duration
+	timer   *time.Timer
+	waiters []*lockWaiter
+}
+
+// LockManager 管理资源的独占租约，租约到期或释放后按排队顺序交给下一个waiter
+// 资源名称不需要预先配置，app、串口和命令通过lock配置指定需要的资源
+type LockManager struct {
+	rl     sync.RWMutex
+	locks  map[string]*lockState
+	closed bool
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		locks: make(map[string]*lockState),
+	}
+}
+
+func leaseTTL(seconds int) (time.Duration, error) {
+	if seconds < 0 {
+		return 0, fmt.Errorf("%w: invalid ttl %d", config.ErrField, seconds)
+	}
+	if seconds == 0 {
+		return defaultLeaseTTL, nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl > maxLeaseTTL {
+		return 0, fmt.Errorf("%w: ttl should be at most %d", config.ErrField, int(maxLeaseTTL/time.Second))
+	}
+	return ttl, nil
+}
+
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Acquire 申请资源的租约，被占用时最多排队等待wait
+func (m *LockManager) Acquire(ctx context.Context, resource, owner string, ttl, wait time.Duration) (Lease, error) {
+	if owner == "" {
+		return Lease{}, fmt.Errorf("%w: lease needs an owner", config.ErrField)
+	}
+	m.rl.Lock()
+	if m.closed {
+		m.rl.Unlock()
+		return Lease{}, ErrLocksClosed
+	}
+	st, ok := m.locks[resource]
+	if !ok {
+		st = &lockState{}
+		m.locks[resource] = st
+	}
+	if st.holder == nil {
+		lease, err := m.grant(resource, st, owner, ttl)
+		m.rl.Unlock()
+		return lease, err
+	}
+	if wait <= 0 {
+		holder := st.holder.Owner
+		m.rl.Unlock()
+		return Lease{}, fmt.Errorf("%w: %s is held by %s", ErrLockHeld, resource, holder)
+	}
+	w := &lockWaiter{owner: owner, ttl: ttl, since: time.Now(), done: make(chan struct{})}
+	st.waiters = append(st.waiters, w)
+	m.rl.Unlock()
+	logger.SysLog("info", "waiting lock", fmt.Sprintf("%s: %s is waiting", resource, owner))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	select {
+	case <-w.done:
+		if w.err != nil {
+			return Lease{}, w.err
+		}
+		if ctx.Err() != nil {
+			// 请求已经断开，租约交给下一个waiter
+			if st.holder != nil && st.holder.Token == w.lease.Token {
+				m.release(resource, st)
+			}
+			return Lease{}, ctx.Err()
+		}
+		return *w.lease, nil
+	default:
+	}
+	for i, v := range st.waiters {
+		if v == w {
+			st.waiters = append(st.waiters[:i:i], st.waiters[i+1:]...)
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return Lease{}, ctx.Err()
+	}
+	holder := ""
+	if st.holder != nil {
+		holder = st.holder.Owner
+	}
+	return Lease{}, fmt.Errorf("%w: %s is still held by %s after waiting %s", ErrLockHeld, resource, holder, wait)
+}
+
+// 把空闲的资源交给owner，调用前需要持有m的锁
+func (m *LockManager) grant(resource string, st *lockState, owner string, ttl time.Duration) (Lease, error) {
+	token, err := newLeaseToken()
+	if err != nil {
+		return Lease{}, err
+	}
+	now := time.Now()
+	st.holder = &Lease{
+		Resource: resource,
+		Owner:    owner,
+		Token:    token,
+		TTL:      int(ttl / time.Second),
+		Acquired: now,
+		Expires:  now.Add(ttl),
+	}
+	st.ttl = ttl
+	m.expireAfter(resource, st, token, ttl)
+	logger.SysLog("info", "acquiring lock", fmt.Sprintf("%s: held by %s for %s", resource, owner, ttl))
+	return *st.holder, nil
+}
+
+// 调用前需要持有m的锁
+func (m *LockManager) expireAfter(resource string, st *lockState, token string, ttl time.Duration) {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.timer = time.AfterFunc(ttl, func() {
+		m.rl.Lock()
+		defer m.rl.Unlock()
+		if st.holder == nil || st.holder.Token != token || m.locks[resource] != st {
+			return
+		}
+		logger.SysLog("warning", "expiring lock", fmt.Sprintf("%s: lease of %s expired", resource, st.holder.Owner))
+		m.release(resource, st)
+	})
+}
+
+// 释放当前租约并交给第一个waiter，调用前需要持有m的锁
+func (m *LockManager) release(resource string, st *lockState) {
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	st.holder = nil
+	for len(st.waiters) > 0 {
+		w := st.waiters[0]
+		st.waiters = st.waiters[1:]
+		lease, err := m.grant(resource, st, w.owner, w.ttl)
+		if err != nil {
+			w.err = err
+			close(w.done)
+			continue
+		}
+		w.lease = &lease
+		close(w.done)
+		return
+	}
+	delete(m.locks, resource)
+}
+
+// 调用前需要持有m的锁
+func (m *LockManager) held(resource, token string) (*lockState, error) {
+	st, ok := m.locks[resource]
+	if !ok || st.holder == nil || token == "" || st.holder.Token != token {
+		return nil, fmt.Errorf("%w: no lease of %s with this token, it may have expired", ErrLeaseInvalid, resource)
+	}
+	return st, nil
+}
+
+// Renew 续约，ttl为0时沿用申请时的ttl
+func (m *LockManager) Renew(resource, token string, ttl time.Duration) (Lease, error) {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	st, err := m.held(resource, token)
+	if err != nil {
+		return Lease{}, err
+	}
+	if ttl <= 0 {
+		ttl = st.ttl
+	}
+	st.ttl = ttl
+	st.holder.TTL = int(ttl / time.Second)
+	st.holder.Expires = time.Now().Add(ttl)
+	m.expireAfter(resource, st, token, ttl)
+	return *st.holder, nil
+}
+
+// Release 释放租约，force为true时不检查token
+func (m *LockManager) Release(resource, token string, force bool) error {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	st, err := m.held(resource, token)
+	if err != nil {
+		if !force {
+			return err
+		}
+		if st = m.locks[resource]; st == nil || st.holder == nil {
+			return NotFound("%s is not locked", resource)
+		}
+	}
+	logger.SysLog("info", "releasing lock", fmt.Sprintf("%s: released by %s", resource, st.holder.Owner))
+	m.release(resource, st)
+	return nil
+}
+
+// Check 检查tokens中是否有resource当前的租约，resource为空时不需要租约
+func (m *LockManager) Check(resource string, tokens []string) error {
+	if resource == "" {
+		return nil
+	}
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	st, ok := m.locks[resource]
+	if !ok || st.holder == nil {
+		return fmt.Errorf("%w: %s is not locked, acquire it with POST /locks/%s", ErrLeaseRequired, resource, resource)
+	}
+	for _, token := range tokens {
+		if token == st.holder.Token {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is held by %s", ErrLeaseRequired, resource, st.holder.Owner)
+}
+
+// CloseAll 拒绝新的申请并让所有waiter返回，服务停止时使用
+func (m *LockManager) CloseAll() {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	m.closed = true
+	for _, st := range m.locks {
+		for _, w := range st.waiters {
+			w.err = ErrLocksClosed
+			close(w.done)
+		}
+		st.waiters = nil
+	}
+}
+
+// 调用前需要持有m的锁
+func (st *lockState) status(resource string) LockStatus {
+	status := LockStatus{Resource: resource}
+	if st.holder != nil {
+		holder := *st.holder
+		holder.Token = ""
+		status.Holder = &holder
+	}
+	for _, w := range st.waiters {
+		status.Waiters = append(status.Waiters, LockWaiter{Owner: w.owner, Since: w.since})
+	}
+	return status
+}
+
+// Status 返回资源的持有者和排队的waiter，不包含token
+func (m *LockManager) Status(resource string) LockStatus {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	st, ok := m.locks[resource]
+	if !ok {
+		return LockStatus{Resource: resource}
+	}
+	return st.status(resource)
+}
+
+// List 返回所有被占用的资源，按名称排序
+func (m *LockManager) List() []LockStatus {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	list := make([]LockStatus, 0, len(m.locks))
+	for resource, st := range m.locks {
+		list = append(list, st.status(resource))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Resource < list[j].Resource
+	})
+	return list
+}
+
+func leaseTokens(r *http.Request) []string {
+	var tokens []string
+	for _, v := range r.Header.Values(leaseTokenHeader) {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// lockResource 返回app、串口或命令配置的lock资源，没有配置时为空
+func lockResource(field, name string) string {
+	if field == "command" {
+		if cmdCfg, ok := serverConfig.GetConfig("command", name).(*config.CmdCfg); ok {
+			return cmdCfg.Lock
+		}
+	} else if appCfg, ok := linkConfig(name); ok {
+		return appCfg.Lock
+	}
+	return ""
+}
+
+// requireLease 检查请求是否持有app、串口或命令配置的lock资源的租约
+func requireLease(r *http.Request, field, name string) error {
+	return lockManager.Check(lockResource(field, name), leaseTokens(r))
+}
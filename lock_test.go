@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 等待resource上的排队数达到n
+func waitLockWaiters(t *testing.T, m *LockManager, resource string, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d waiters on %s", n, resource), func() bool {
+		return len(m.Status(resource).Waiters) == n
+	})
+}
+
+type acquireResult struct {
+	lease Lease
+	err   error
+}
+
+func acquireAsync(m *LockManager, ctx context.Context, resource, owner string, ttl, wait time.Duration) chan acquireResult {
+	ch := make(chan acquireResult, 1)
+	go func() {
+		lease, err := m.Acquire(ctx, resource, owner, ttl, wait)
+		ch <- acquireResult{lease, err}
+	}()
+	return ch
+}
+
+func TestLeaseGrant(t *testing.T) {
+	m := NewLockManager()
+	ctx := context.Background()
+	lease, err := m.Acquire(ctx, "bench", "ci", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Owner != "ci" || lease.Token == "" || lease.TTL != 60 {
+		t.Errorf("lease = %+v", lease)
+	}
+	if err := m.Check("bench", []string{"other", lease.Token}); err != nil {
+		t.Errorf("Check with token: %v", err)
+	}
+	if err := m.Check("bench", []string{"other"}); !errors.Is(err, ErrLeaseRequired) {
+		t.Errorf("Check without token = %v, want ErrLeaseRequired", err)
+	}
+	if err := m.Check("", nil); err != nil {
+		t.Errorf("Check without resource: %v", err)
+	}
+	if _, err := m.Acquire(ctx, "bench", "dev", time.Minute, 0); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("second Acquire = %v, want ErrLockHeld", err)
+	}
+	if _, err := m.Acquire(ctx, "bench", "", time.Minute, 0); err == nil {
+		t.Error("Acquire without owner should fail")
+	}
+	if status := m.Status("bench"); status.Holder == nil || status.Holder.Token != "" {
+		t.Errorf("status should hide the token: %+v", status.Holder)
+	}
+
+	if err := m.Release("bench", "wrong", false); !errors.Is(err, ErrLeaseInvalid) {
+		t.Errorf("Release with wrong token = %v, want ErrLeaseInvalid", err)
+	}
+	if err := m.Release("bench", lease.Token, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check("bench", []string{lease.Token}); !errors.Is(err, ErrLeaseRequired) {
+		t.Errorf("Check after release = %v, want ErrLeaseRequired", err)
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("released resource still listed: %+v", m.List())
+	}
+
+	if _, err := m.Acquire(ctx, "bench", "ci", time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Release("bench", "", true); err != nil {
+		t.Errorf("force Release: %v", err)
+	}
+	if err := m.Release("bench", "", true); err == nil {
+		t.Error("force Release of a free resource should fail")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	m := NewLockManager()
+	lease, err := m.Acquire(context.Background(), "bench", "ci", 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 续约后按新的ttl计算到期时间
+	time.Sleep(30 * time.Millisecond)
+	if _, err := m.Renew("bench", lease.Token, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := m.Check("bench", []string{lease.Token}); err != nil {
+		t.Errorf("Check after renew: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := m.Check("bench", []string{lease.Token}); !errors.Is(err, ErrLeaseRequired) {
+		t.Errorf("Check after expiry = %v, want ErrLeaseRequired", err)
+	}
+	if _, err := m.Renew("bench", lease.Token, 0); !errors.Is(err, ErrLeaseInvalid) {
+		t.Errorf("Renew after expiry = %v, want ErrLeaseInvalid", err)
+	}
+}
+
+// 释放或到期后按排队顺序交给下一个waiter
+func TestLeaseHandOff(t *testing.T) {
+	m := NewLockManager()
+	ctx := context.Background()
+	first, err := m.Acquire(ctx, "bench", "a", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := acquireAsync(m, ctx, "bench", "b", 50*time.Millisecond, 2*time.Second)
+	waitLockWaiters(t, m, "bench", 1)
+	c := acquireAsync(m, ctx, "bench", "c", time.Minute, 2*time.Second)
+	waitLockWaiters(t, m, "bench", 2)
+
+	if err := m.Release("bench", first.Token, false); err != nil {
+		t.Fatal(err)
+	}
+	rb := <-b
+	if rb.err != nil || rb.lease.Owner != "b" {
+		t.Fatalf("b got %+v, %v", rb.lease, rb.err)
+	}
+	if err := m.Check("bench", []string{first.Token}); err == nil {
+		t.Error("released token should no longer be valid")
+	}
+	// b不释放，到期后交给c
+	select {
+	case rc := <-c:
+		if rc.err != nil || rc.lease.Owner != "c" {
+			t.Fatalf("c got %+v, %v", rc.lease, rc.err)
+		}
+		if err := m.Check("bench", []string{rc.lease.Token}); err != nil {
+			t.Errorf("Check c: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lease was not handed to c after b expired")
+	}
+}
+
+func TestLeaseWaitEnds(t *testing.T) {
+	m := NewLockManager()
+	if _, err := m.Acquire(context.Background(), "bench", "a", time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acquire(context.Background(), "bench", "b", time.Minute, 30*time.Millisecond); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Acquire after wait = %v, want ErrLockHeld", err)
+	}
+	waitLockWaiters(t, m, "bench", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := acquireAsync(m, ctx, "bench", "c", time.Minute, time.Minute)
+	waitLockWaiters(t, m, "bench", 1)
+	cancel()
+	if r := <-res; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("canceled Acquire = %v, want context.Canceled", r.err)
+	}
+	waitLockWaiters(t, m, "bench", 0)
+
+	res = acquireAsync(m, context.Background(), "bench", "d", time.Minute, time.Minute)
+	waitLockWaiters(t, m, "bench", 1)
+	m.CloseAll()
+	if r := <-res; !errors.Is(r.err, ErrLocksClosed) {
+		t.Errorf("Acquire after CloseAll = %v, want ErrLocksClosed", r.err)
+	}
+	if _, err := m.Acquire(context.Background(), "other", "e", time.Minute, 0); !errors.Is(err, ErrLocksClosed) {
+		t.Errorf("new Acquire after CloseAll = %v, want ErrLocksClosed", err)
+	}
+}
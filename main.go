@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"hostctl_proxy/cmdctrl"
 	"hostctl_proxy/internal/config"
 	"hostctl_proxy/internal/logutils"
-	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/gorilla/websocket"
@@ -20,13 +25,22 @@ const (
 
 var (
 	//verFlag = app.Flag("version", "Show version").Bool()
-	appManager   *cmdctrl.CommandCtrl
-	jsonPath     string
-	serverConfig = config.New()
-	upgrader     = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
-	logger       = &logutils.ServerLogger{}
-	wsManager    = NewWebsocketManager()
-	sockpManager = NewPortsManager()
+	appManager      *cmdctrl.CommandCtrl
+	jsonPath        string
+	serverConfig    = config.New()
+	upgrader        = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+	logger          = &logutils.ServerLogger{}
+	wsManager       = NewWebsocketManager()
+	sockpManager    = NewPortsManager()
+	sessionManager  = NewSessionManager()
+	outputManager   = NewOutputManager()
+	autostarter     = NewAutostartManager()
+	forwardManager  = NewForwardManager()
+	scheduleManager = NewScheduleManager()
+	workflowManager = NewWorkflowManager()
+	lockManager     = NewLockManager()
+	limitManager    = NewLimitManager()
+	rateLimiter     = NewRateLimiter()
 )
 
 func NewServer() *Server {
@@ -64,14 +78,27 @@ func main() {
 		lAddr      = ""
 		close      = make(chan os.Signal, 1)
 	)
-	signal.Notify(close, os.Interrupt)
+	signal.Notify(close, os.Interrupt, syscall.SIGTERM)
 	// command line
 	kingpin.Version(version)
 	kingpin.HelpFlag.Short('h')
 
-	switch kingpin.Parse() {
+	switch cmd := kingpin.Parse(); cmd {
 	case serverCmd.FullCommand():
 		// do nothing
+	case replayCmd.FullCommand():
+		if err := runReplay(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	default:
+		// ctl子命令只作为客户端，不启动服务
+		if err := runCtl(cmd); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// set up server log
@@ -102,6 +129,9 @@ func main() {
 		panic(err)
 	}
 
+	scheduleManager.Load()
+	rateLimiter.Load(serverConfig.GetSysConfig().RateLimits)
+
 	// set up http server
 	server := NewServer()
 	sysCfg := serverConfig.GetSysConfig()
@@ -113,29 +143,66 @@ func main() {
 	// listenAddr = serverHost.String() + ":" + strconv.Itoa(*serverPort)
 
 	l, err := net.Listen("tcp", lAddr)
-	defer func() {
-		if err = l.Close(); err != nil {
-			panic(err)
-		}
-	}()
 	if err != nil {
 		logger.SysLog("error", "setting http server", err.Error())
 		panic(err)
 	}
+	defer func() {
+		// Shutdown时listener已经关闭
+		if err = l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			panic(err)
+		}
+	}()
 
 	logger.SysLog("info", "setting http server", fmt.Sprintf("server addr %s", lAddr))
 	// add interrupt signal notification
 	// start websocket manager
 	// start http server
+	shutdownDone := make(chan struct{}, 1)
 	go func() {
 		s := <-close
 		logger.SysLog("info", "stopping autotestagent", fmt.Sprintf("signal received: %s", s))
-		appManager.StopAll()
-		os.Exit(0)
+		go func() {
+			// 再次收到信号时直接退出
+			s := <-close
+			logger.SysLog("warning", "stopping autotestagent", fmt.Sprintf("signal received again: %s, exit now", s))
+			os.Exit(1)
+		}()
+		Shutdown(server, sysCfg.GetShutdownTimeout())
+		shutdownDone <- struct{}{}
 	}()
-	go wsManager.Run()
-	if err := server.Serve(l); err != nil {
+	go autostarter.Run()
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.SysLog("error", "starting http server", err.Error())
 		panic(err)
 	}
+	<-shutdownDone
+}
+
+// Shutdown 依次停止接收请求、等待请求处理完、关闭websocket、停止所有app
+// 全部步骤共用一个超时时间
+func Shutdown(server *Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	autostarter.Stop()
+	scheduleManager.StopAll()
+	workflowManager.CancelAll()
+	lockManager.CloseAll()
+	// 被hijack的websocket连接不受http.Server.Shutdown管理，需要单独关闭
+	wsManager.CloseAll(websocket.CloseGoingAway, "server is shutting down")
+	if err := server.Shutdown(ctx); err != nil {
+		logger.SysLog("error", "stopping http server", err.Error())
+	} else {
+		logger.SysLog("info", "stopping http server", "all requests are drained")
+	}
+
+	sessionManager.CloseAll()
+	forwardManager.StopAll()
+	if err := appManager.StopAll(time.Until(deadline)); err != nil {
+		logger.SysLog("error", "stopping apps", err.Error())
+	} else {
+		logger.SysLog("info", "stopping apps", "all apps are stopped")
+	}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// 测试中的日志写到os.DevNull和标准输出，只在失败或-v时显示
+func TestMain(m *testing.M) {
+	logFile, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	logger.Init(logFile)
+	os.Exit(m.Run())
+}
+
+// 轮询直到cond成立，2秒后仍不成立时失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
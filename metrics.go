@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GET /metrics使用Prometheus的文本格式
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name   string
+	kind   string // counter或gauge
+	help   string
+	values []metricValue
+}
+
+type metricValue struct {
+	labels [][2]string
+	value  float64
+}
+
+func (m *metric) add(value float64, labels ...[2]string) {
+	m.values = append(m.values, metricValue{labels: labels, value: value})
+}
+
+func label(name, value string) [2]string {
+	return [2]string{name, value}
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, v := range m.values {
+		pairs := make([]string, 0, len(v.labels))
+		for _, l := range v.labels {
+			pairs = append(pairs, l[0]+"="+strconv.Quote(l[1]))
+		}
+		labels := ""
+		if len(pairs) > 0 {
+			labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s%s %s\n", m.name, labels, strconv.FormatFloat(v.value, 'g', -1, 64))
+	}
+}
+
+// 并发限制和限流的计数
+func collectMetrics() []*metric {
+	var (
+		running  = &metric{name: "hostctl_limiter_running", kind: "gauge", help: "Requests running under a concurrency limit."}
+		waiting  = &metric{name: "hostctl_limiter_waiting", kind: "gauge", help: "Requests waiting in a concurrency queue."}
+		total    = &metric{name: "hostctl_limiter_requests_total", kind: "counter", help: "Requests admitted by a concurrency limiter."}
+		queued   = &metric{name: "hostctl_limiter_queued_total", kind: "counter", help: "Admitted requests that had to wait in the queue."}
+		rejected = &metric{name: "hostctl_limiter_rejected_total", kind: "counter", help: "Requests rejected because the queue was full."}
+		timeouts = &metric{name: "hostctl_limiter_timeouts_total", kind: "counter", help: "Requests that timed out in the queue."}
+		allowed  = &metric{name: "hostctl_rate_limit_allowed_total", kind: "counter", help: "Requests allowed by a rate limit rule."}
+		limited  = &metric{name: "hostctl_rate_limit_limited_total", kind: "counter", help: "Requests rejected with 429 by a rate limit rule."}
+		clients  = &metric{name: "hostctl_rate_limit_clients", kind: "gauge", help: "Active token buckets of a rate limit rule."}
+	)
+	status := limitManager.Status()
+	addLimiter := func(kind string, s LimiterStatus) {
+		labels := [][2]string{label("kind", kind), label("name", s.Name)}
+		running.add(float64(s.Running), labels...)
+		waiting.add(float64(s.Waiting), labels...)
+		total.add(float64(s.Total), labels...)
+		queued.add(float64(s.Queued), labels...)
+		rejected.add(float64(s.Rejected), labels...)
+		timeouts.add(float64(s.Timeouts), labels...)
+	}
+	addLimiter("commands", status.Commands)
+	for _, s := range status.PerCommand {
+		addLimiter("command", s)
+	}
+	for _, s := range status.Links {
+		addLimiter("link", s)
+	}
+	for _, s := range status.RateLimits {
+		labels := [][2]string{label("route", s.Route), label("methods", strings.Join(s.Methods, ",")), label("by", s.By)}
+		allowed.add(float64(s.Allowed), labels...)
+		limited.add(float64(s.Limited), labels...)
+		clients.add(float64(s.Clients), labels...)
+	}
+	return []*metric{running, waiting, total, queued, rejected, timeouts, allowed, limited, clients}
+}
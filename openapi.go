@@ -0,0 +1,88 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//go:embed openapi.json
+var openapiDoc []byte
+
+var (
+	openapiParam = regexp.MustCompile(`\{[^/]+\}`)
+	routerParam  = regexp.MustCompile(`[:*][^/]+`)
+)
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(openapiDoc)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openapiDoc); err != nil {
+		logger.HttpResponseLog("error", err.Error())
+	}
+}
+
+// apiRouter 记录注册的接口，用于和openapi.json比较
+type apiRouter struct {
+	*httprouter.Router
+	routes []string // "METHOD /path"
+}
+
+func (r *apiRouter) Handle(method, path string, handle httprouter.Handle) {
+	r.routes = append(r.routes, method+" "+path)
+	r.Router.Handle(method, path, handle)
+}
+
+func (r *apiRouter) GET(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodGet, path, handle)
+}
+
+// 把{name}、:name和*path都换成{}，参数名不同的同一个接口视为相同
+func normalizeRoute(route string) string {
+	route = openapiParam.ReplaceAllString(route, "{}")
+	return routerParam.ReplaceAllString(route, "{}")
+}
+
+// 比较openapi.json和router注册的接口，routes的格式为"METHOD /path"
+// 返回文档中有但没有注册的接口，以及注册了但文档中没有的接口
+func checkOpenAPI(routes []string) (unregistered, undocumented []string, err error) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err = json.Unmarshal(openapiDoc, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[normalizeRoute(route)] = true
+	}
+	documented := make(map[string]bool)
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			route := strings.ToUpper(method) + " " + path
+			documented[normalizeRoute(route)] = true
+			if !registered[normalizeRoute(route)] {
+				unregistered = append(unregistered, route)
+			}
+		}
+	}
+	for _, route := range routes {
+		if !documented[normalizeRoute(route)] {
+			undocumented = append(undocumented, route)
+		}
+	}
+	sort.Strings(unregistered)
+	sort.Strings(undocumented)
+	return unregistered, undocumented, nil
+}
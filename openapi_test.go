@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// openapi.json和router注册的接口需要一一对应
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	router := newRouter()
+	unregistered, undocumented, err := checkOpenAPI(router.routes)
+	if err != nil {
+		t.Fatalf("parse openapi.json: %v", err)
+	}
+	if len(unregistered) > 0 {
+		t.Errorf("documented but not registered:\n  %s", strings.Join(unregistered, "\n  "))
+	}
+	if len(undocumented) > 0 {
+		t.Errorf("registered but not documented:\n  %s", strings.Join(undocumented, "\n  "))
+	}
+}
+
+func TestNormalizeRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string
+	}{
+		{"GET /app/status", "GET /app/status"},
+		{"POST /command/:name", "POST /command/{}"},
+		{"POST /command/{name}", "POST /command/{}"},
+		{"GET /proxy/:name/*path", "GET /proxy/{}/{}"},
+		{"GET /proxy/{name}/{path}", "GET /proxy/{}/{}"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRoute(tt.route); got != tt.want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", tt.route, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+)
+
+// 端口的分配方式
+const (
+	PortModeFixed  = "fixed"
+	PortModeRange  = "range"
+	PortModeRandom = "random"
+	PortModeUnix   = "unix"
+
+	// 端口传给app的参数中的占位符
+	portPlaceholder = "{port}"
+	// unix socket的路径传给app的参数中的占位符
+	pathPlaceholder = "{path}"
+	// 随机端口与其他app冲突时重试的次数
+	randomPortAttempts = 10
+)
+
+var ErrPortUnavailable = errors.New("socket port unavailable")
+
+// 没有配置port_args和port_env时，端口按原来的约定传给app
+var defaultPortArgs = []string{"--server", "localhost", portPlaceholder}
+
+// 监听unix socket的app没有配置port_args和port_env时使用
+var defaultUnixArgs = []string{"--unix", pathPlaceholder}
+
+// PortAlloc 一个socket app当前使用的端口
+type PortAlloc struct {
+	App   string    `json:"app"`
+	Port  int       `json:"port"`
+	Path  string    `json:"path,omitempty"` // unix socket的路径
+	Mode  string    `json:"mode"`
+	Since time.Time `json:"since"`
+}
+
+// Url 连接app使用的地址
+func (alloc *PortAlloc) Url() string {
+	if alloc.Mode == PortModeUnix {
+		return unixScheme + alloc.Path
+	}
+	return fmt.Sprintf("localhost:%d", alloc.Port)
+}
+
+// 传给app的端口或unix socket路径
+func (alloc *PortAlloc) value() string {
+	if alloc.Mode == PortModeUnix {
+		return alloc.Path
+	}
+	return strconv.Itoa(alloc.Port)
+}
+
+// PortsManager 管理socket app的端口，app每次启动时分配，停止时释放
+type PortsManager struct {
+	rl   sync.RWMutex
+	pool map[string]*PortAlloc
+	// app上次使用的端口，重启时优先沿用，socket url不变
+	last map[string]int
+}
+
+func NewPortsManager() *PortsManager {
+	return &PortsManager{
+		pool: make(map[string]*PortAlloc),
+		last: make(map[string]int),
+	}
+}
+
+func (manager *PortsManager) Exists(name string) bool {
+	manager.rl.RLock()
+	defer manager.rl.RUnlock()
+	_, ok := manager.pool[name]
+	return ok
+}
+
+// Allocate 按app的配置分配端口，app已有的分配先释放
+// port为固定端口，port_range为"起始-结束"，都没有配置时随机分配
+// address为unix://时不分配端口，改为分配unix socket的路径
+func (manager *PortsManager) Allocate(name string, appCfg *config.AppCfg) (PortAlloc, error) {
+	manager.rl.Lock()
+	defer manager.rl.Unlock()
+	delete(manager.pool, name)
+
+	if path, ok := unixPath(appCfg.Address); ok {
+		path, err := manager.unixSocket(name, path)
+		if err != nil {
+			return PortAlloc{}, err
+		}
+		alloc := &PortAlloc{App: name, Path: path, Mode: PortModeUnix, Since: time.Now()}
+		manager.pool[name] = alloc
+		return *alloc, nil
+	}
+
+	var (
+		port int
+		mode string
+		err  error
+	)
+	switch {
+	case appCfg.Port > 0:
+		mode = PortModeFixed
+		port, err = manager.fixedPort(appCfg.Port)
+	case appCfg.PortRange != "":
+		mode = PortModeRange
+		port, err = manager.rangePort(name, appCfg.PortRange)
+	default:
+		mode = PortModeRandom
+		port, err = manager.randomPort(name)
+	}
+	if err != nil {
+		return PortAlloc{}, err
+	}
+	alloc := &PortAlloc{App: name, Port: port, Mode: mode, Since: time.Now()}
+	manager.pool[name] = alloc
+	manager.last[name] = port
+	return *alloc, nil
+}
+
+// Deregister 释放app的端口，app停止时使用
+// unix socket文件app退出后不一定会删除，这里一并删除
+func (manager *PortsManager) Deregister(name string) {
+	manager.rl.Lock()
+	defer manager.rl.Unlock()
+	if alloc, ok := manager.pool[name]; ok && alloc.Mode == PortModeUnix {
+		if err := removeSocketFile(alloc.Path); err != nil {
+			logger.AppLog("warning", "releasing port", name, fmt.Sprintf("Failed to remove unix socket: %v", err))
+		}
+	}
+	delete(manager.pool, name)
+}
+
+func (manager *PortsManager) get(name string) (PortAlloc, bool) {
+	manager.rl.RLock()
+	defer manager.rl.RUnlock()
+	alloc, ok := manager.pool[name]
+	if !ok {
+		return PortAlloc{}, false
+	}
+	return *alloc, true
+}
+
+// GetSocketUrl 返回连接app使用的地址
+func (manager *PortsManager) GetSocketUrl(name string) (string, error) {
+	alloc, ok := manager.get(name)
+	if !ok {
+		return "", fmt.Errorf("%s not found", name)
+	}
+	return alloc.Url(), nil
+}
+
+// List 返回当前所有的端口分配，按app名称排序
+func (manager *PortsManager) List() []PortAlloc {
+	manager.rl.RLock()
+	defer manager.rl.RUnlock()
+	list := make([]PortAlloc, 0, len(manager.pool))
+	for _, alloc := range manager.pool {
+		list = append(list, *alloc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].App < list[j].App
+	})
+	return list
+}
+
+// 端口分配给了其他app时返回app名称，调用前需要持有manager.rl
+func (manager *PortsManager) owner(port int) (string, bool) {
+	for name, alloc := range manager.pool {
+		if alloc.Mode != PortModeUnix && alloc.Port == port {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// 调用前需要持有manager.rl
+func (manager *PortsManager) fixedPort(port int) (int, error) {
+	if owner, ok := manager.owner(port); ok {
+		return 0, fmt.Errorf("%w: port %d is used by %s", ErrPortUnavailable, port, owner)
+	}
+	if err := portFree(port); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrPortUnavailable, err)
+	}
+	return port, nil
+}
+
+// 优先沿用上次的端口，其次从小到大找第一个空闲的端口，调用前需要持有manager.rl
+func (manager *PortsManager) rangePort(name, portRange string) (int, error) {
+	first, last, err := config.ParsePortRange(portRange)
+	if err != nil {
+		return 0, err
+	}
+	candidates := make([]int, 0, last-first+2)
+	if prev := manager.last[name]; prev >= first && prev <= last {
+		candidates = append(candidates, prev)
+	}
+	for port := first; port <= last; port++ {
+		candidates = append(candidates, port)
+	}
+	for _, port := range candidates {
+		if _, ok := manager.owner(port); ok {
+			continue
+		}
+		if portFree(port) == nil {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no free port in %s", ErrPortUnavailable, portRange)
+}
+
+// 优先沿用上次的端口，否则由系统分配，调用前需要持有manager.rl
+// 检查端口时的listener在app启动前就关闭了，其他进程仍有可能在这之间占用端口
+func (manager *PortsManager) randomPort(name string) (int, error) {
+	if prev, ok := manager.last[name]; ok {
+		if _, used := manager.owner(prev); !used && portFree(prev) == nil {
+			return prev, nil
+		}
+	}
+	for i := 0; i < randomPortAttempts; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if _, used := manager.owner(port); !used {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no free random port", ErrPortUnavailable)
+}
+
+// 路径为空时在runtime_dir下按app名称生成，调用前需要持有manager.rl
+// 上次遗留的socket文件会先删除，否则app无法监听
+func (manager *PortsManager) unixSocket(name, path string) (string, error) {
+	if path == "" {
+		dir := serverConfig.GetSysConfig().GetRuntimeDir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrPortUnavailable, err)
+		}
+		path = filepath.Join(dir, name+".sock")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrPortUnavailable, err)
+	}
+	for other, alloc := range manager.pool {
+		if alloc.Mode == PortModeUnix && alloc.Path == path {
+			return "", fmt.Errorf("%w: %s is used by %s", ErrPortUnavailable, path, other)
+		}
+	}
+	if err := removeSocketFile(path); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrPortUnavailable, err)
+	}
+	return path, nil
+}
+
+// 只删除socket文件，路径上是其他文件时返回错误
+func removeSocketFile(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// 端口能在localhost上监听才算空闲
+func portFree(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// socket app启动时分配端口，返回传给app的参数
+func socketPortArgs(appName string, appCfg *config.AppCfg) ([]string, error) {
+	alloc, err := sockpManager.Allocate(appName, appCfg)
+	if err != nil {
+		return nil, err
+	}
+	portArgs := appCfg.PortArgs
+	if portArgs == nil && appCfg.PortEnv == "" {
+		portArgs = defaultPortArgs
+		if alloc.Mode == PortModeUnix {
+			portArgs = defaultUnixArgs
+		}
+	}
+	replacer := strings.NewReplacer(portPlaceholder, strconv.Itoa(alloc.Port), pathPlaceholder, alloc.Path)
+	args := make([]string, 0, len(portArgs))
+	for _, arg := range portArgs {
+		args = append(args, replacer.Replace(arg))
+	}
+	return args, nil
+}
+
+// app停止（包括重试次数用完后退出）时释放端口
+func releasePortOnStop(appName string, onStop func(*cmdctrl.CommandInfo)) func(*cmdctrl.CommandInfo) {
+	return func(ci *cmdctrl.CommandInfo) {
+		if onStop != nil {
+			onStop(ci)
+		}
+		sockpManager.Deregister(appName)
+	}
+}
+
+// 配置了port_env时通过环境变量把端口传给app，每次启动时调用
+// 监听unix socket的app传的是socket的路径
+func socketPortEnv(appName string, appCfg *config.AppCfg) func() []string {
+	if !appCfg.Socket || appCfg.PortEnv == "" {
+		return nil
+	}
+	return func() []string {
+		alloc, ok := sockpManager.get(appName)
+		if !ok {
+			return nil
+		}
+		return []string{appCfg.PortEnv + "=" + alloc.value()}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"hostctl_proxy/internal/config"
+)
+
+// 返回n个连续的空闲端口中的第一个
+func freePorts(t *testing.T, n int) int {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		free := first+n-1 <= 65535
+		for port := first; free && port < first+n; port++ {
+			free = portFree(port) == nil
+		}
+		if free {
+			return first
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return 0
+}
+
+func TestAllocateFixed(t *testing.T) {
+	m := NewPortsManager()
+	port := freePorts(t, 1)
+	cfg := &config.AppCfg{Port: port}
+	alloc, err := m.Allocate("a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Port != port || alloc.Mode != PortModeFixed {
+		t.Errorf("alloc = %+v", alloc)
+	}
+	if _, err := m.Allocate("b", cfg); !errors.Is(err, ErrPortUnavailable) {
+		t.Errorf("port of another app: %v, want ErrPortUnavailable", err)
+	}
+
+	// 被其他进程占用的端口
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	m.Deregister("a")
+	if _, err := m.Allocate("b", cfg); !errors.Is(err, ErrPortUnavailable) {
+		t.Errorf("port in use: %v, want ErrPortUnavailable", err)
+	}
+}
+
+func TestAllocateRange(t *testing.T) {
+	m := NewPortsManager()
+	first := freePorts(t, 3)
+	cfg := &config.AppCfg{PortRange: fmt.Sprintf("%d-%d", first, first+2)}
+	ports := make(map[string]int)
+	for _, app := range []string{"a", "b", "c"} {
+		alloc, err := m.Allocate(app, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alloc.Mode != PortModeRange || alloc.Port < first || alloc.Port > first+2 {
+			t.Errorf("%s: alloc = %+v", app, alloc)
+		}
+		ports[app] = alloc.Port
+	}
+	if ports["a"] == ports["b"] || ports["b"] == ports["c"] || ports["a"] == ports["c"] {
+		t.Errorf("ports in the range are shared: %v", ports)
+	}
+	if _, err := m.Allocate("d", cfg); !errors.Is(err, ErrPortUnavailable) {
+		t.Errorf("full range: %v, want ErrPortUnavailable", err)
+	}
+
+	// 重启时沿用上次的端口，即使范围内有更小的空闲端口
+	m.Deregister("a")
+	m.Deregister("b")
+	alloc, err := m.Allocate("b", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Port != ports["b"] {
+		t.Errorf("b got port %d after restart, want %d", alloc.Port, ports["b"])
+	}
+	if len(m.List()) != 2 {
+		t.Errorf("List = %v", m.List())
+	}
+}
+
+func TestAllocateRandomReuse(t *testing.T) {
+	m := NewPortsManager()
+	cfg := &config.AppCfg{}
+	alloc, err := m.Allocate("a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Mode != PortModeRandom || alloc.Port == 0 {
+		t.Errorf("alloc = %+v", alloc)
+	}
+	url, err := m.GetSocketUrl("a")
+	if err != nil || url != fmt.Sprintf("localhost:%d", alloc.Port) {
+		t.Errorf("GetSocketUrl = %q, %v", url, err)
+	}
+	m.Deregister("a")
+	if _, err := m.GetSocketUrl("a"); err == nil {
+		t.Error("GetSocketUrl after Deregister should fail")
+	}
+	again, err := m.Allocate("a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Port != alloc.Port {
+		t.Errorf("restart got port %d, want %d", again.Port, alloc.Port)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"hostctl_proxy/internal/config"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// http proxy共用的连接池
+var proxyTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// 按rewrite规则重写路径，使用第一条匹配的规则，规则在配置检查时已经编译
+func rewritePath(rules []config.RewriteCfg, path string) (string, error) {
+	for i := range rules {
+		re, err := rules[i].Matcher()
+		if err != nil {
+			return "", err
+		}
+		if re.MatchString(path) {
+			return re.ReplaceAllString(path, rules[i].Replace), nil
+		}
+	}
+	return path, nil
+}
+
+// setting中的headers会加到转发的请求上
+func settingHeaders(setting map[string]interface{}) (map[string]string, error) {
+	raw, ok := setting["headers"]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: setting.headers should be an object", config.ErrField)
+	}
+	headers := make(map[string]string, len(values))
+	for k, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: setting.headers.%s should be a string", config.ErrField, k)
+		}
+		headers[k] = s
+	}
+	return headers, nil
+}
+
+// HttpProxy 把/proxy/:name/*path的请求转发到proxy的url
+// 响应边收边发，timeout为等待响应头的时间
+func HttpProxy(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("name")
+	pxyCfg, ok := serverConfig.GetConfig("proxy", name).(*config.ProxyCfg)
+	if !ok {
+		RenderError(w, fmt.Errorf("%w: proxy %s", config.ErrNotFound, name))
+		return
+	}
+	if pxyCfg.Socket {
+		err := fmt.Errorf("proxy %s is a socket proxy, use PUT /proxy/%s", name, name)
+		RenderError(w, NewHttpError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, err))
+		return
+	}
+	target, err := url.Parse(pxyCfg.Url)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		RenderError(w, fmt.Errorf("%w: proxy %s has an invalid url: %q", config.ErrField, name, pxyCfg.Url))
+		return
+	}
+	path, err := rewritePath(pxyCfg.Rewrite, p.ByName("path"))
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	headers, err := settingHeaders(pxyCfg.Setting)
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	timeout := defaultLinkTimeout
+	if pxyCfg.Timeout > 0 {
+		timeout = time.Duration(pxyCfg.Timeout) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = path
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			// 服务的token不转发给目标
+			if serverConfig.GetSysConfig().Token != "" {
+				pr.Out.Header.Del("Authorization")
+			}
+			for k, v := range headers {
+				pr.Out.Header.Set(k, v)
+			}
+		},
+		Transport:     proxyTransport,
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			timer.Stop()
+			logger.ProxyLog("info", "proxying", name, fmt.Sprintf("%s %s -> %s", r.Method, resp.Request.URL, resp.Status))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.ProxyLog("error", "proxying", name, fmt.Sprintf("%s %s: %v", r.Method, req.URL, err))
+			if timedOut.Load() {
+				err = fmt.Errorf("%s did not respond in %v", name, timeout)
+				RenderError(w, NewHttpError(http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, err))
+				return
+			}
+			RenderError(w, NewHttpError(http.StatusBadGateway, ErrCodeUpstream, err))
+		},
+	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"hostctl_proxy/internal/config"
+)
+
+func TestRewritePath(t *testing.T) {
+	rules := []config.RewriteCfg{
+		{Match: `^/api/v1/(.*)`, Replace: "/v1/$1"},
+		{Match: `^/api/(.*)`, Replace: "/latest/$1"},
+		{Match: `\.html$`, Replace: ""},
+	}
+	tests := []struct {
+		path, want string
+	}{
+		// 使用第一条匹配的规则
+		{"/api/v1/users", "/v1/users"},
+		{"/api/users", "/latest/users"},
+		{"/index.html", "/index"},
+		{"/static/app.js", "/static/app.js"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := rewritePath(rules, tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("rewritePath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+
+	// 没有经过check的规则也不能panic
+	if _, err := rewritePath([]config.RewriteCfg{{Match: "("}}, "/"); !errors.Is(err, config.ErrField) {
+		t.Errorf("invalid rule = %v, want ErrField", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+// 空闲的令牌桶补满后在清理时删除
+const rateSweepInterval = time.Minute
+
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimitStatus 限流规则的配置和累计计数
+type RateLimitStatus struct {
+	Route   string   `json:"route"`
+	Methods []string `json:"methods,omitempty"`
+	By      string   `json:"by"`
+	Rate    float64  `json:"rate"`
+	Burst   int      `json:"burst"`
+	Clients int      `json:"clients"` // 当前的令牌桶数
+	Allowed int64    `json:"allowed"`
+	Limited int64    `json:"limited"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 一条限流规则，每个客户端（by为route时所有客户端共用）一个令牌桶
+type rateRule struct {
+	cfg     config.RateLimitCfg
+	segs    []string
+	burst   float64
+	buckets map[string]*tokenBucket
+	allowed int64
+	limited int64
+}
+
+// RateLimiter 在RequestPreprocess中按sys.rate_limits限制请求频率
+// 规则只在启动时加载，和sys的其他配置一样不能在运行时修改
+type RateLimiter struct {
+	rl    sync.Mutex
+	rules []*rateRule
+	swept time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{}
+}
+
+func (l *RateLimiter) Load(cfgs []*config.RateLimitCfg) {
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	l.rules = make([]*rateRule, 0, len(cfgs))
+	for _, c := range cfgs {
+		l.rules = append(l.rules, newRateRule(*c))
+		logger.SysLog("info", "loading rate limit", fmt.Sprintf("%s %s: %v/s, burst %d, by %s",
+			strings.Join(c.Methods, ","), c.Route, c.Rate, c.GetBurst(), c.GetBy()))
+	}
+	l.swept = time.Now()
+}
+
+func newRateRule(cfg config.RateLimitCfg) *rateRule {
+	return &rateRule{
+		cfg:     cfg,
+		segs:    routeSegments(cfg.Route),
+		burst:   float64(cfg.GetBurst()),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func routeSegments(route string) []string {
+	if route == "" {
+		return nil
+	}
+	return strings.Split(strings.Trim(route, "/"), "/")
+}
+
+// 按httprouter的规则匹配路径，:name匹配一段，*path匹配剩余部分
+func (rule *rateRule) match(r *http.Request) bool {
+	if len(rule.cfg.Methods) > 0 {
+		found := false
+		for _, m := range rule.cfg.Methods {
+			if m == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.segs == nil {
+		return true
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i, seg := range rule.segs {
+		if strings.HasPrefix(seg, "*") {
+			return true
+		}
+		if i >= len(path) {
+			return false
+		}
+		if strings.HasPrefix(seg, ":") {
+			if path[i] == "" {
+				return false
+			}
+			continue
+		}
+		if seg != path[i] {
+			return false
+		}
+	}
+	return len(path) == len(rule.segs)
+}
+
+// 客户端的标识，token只在通过验证时使用，避免换token绕过限制
+// 没有配置sys.token时任意token都能通过验证，按ip限制
+func (rule *rateRule) clientKey(r *http.Request) string {
+	switch rule.cfg.GetBy() {
+	case config.RateByRoute:
+		return ""
+	case config.RateByToken:
+		if serverConfig.GetSysConfig().Token != "" && Authorized(r) {
+			return "token:" + strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// 从桶中取一个令牌，不够时返回需要等待的时间，调用前需要持有l的锁
+func (rule *rateRule) take(key string, now time.Time) time.Duration {
+	b, ok := rule.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rule.burst, last: now}
+		rule.buckets[key] = b
+	}
+	b.tokens = math.Min(rule.burst, b.tokens+now.Sub(b.last).Seconds()*rule.cfg.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rule.cfg.Rate * float64(time.Second))
+}
+
+// Allow 检查请求是否满足所有匹配的规则，被限制时返回建议的重试等待时间
+// 只有全部规则都允许时才消耗令牌
+func (l *RateLimiter) Allow(r *http.Request) (time.Duration, error) {
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	if len(l.rules) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	if now.Sub(l.swept) > rateSweepInterval {
+		l.sweep(now)
+	}
+
+	type taken struct {
+		rule *rateRule
+		key  string
+	}
+	var matched []taken
+	for _, rule := range l.rules {
+		if !rule.match(r) {
+			continue
+		}
+		key := rule.clientKey(r)
+		if wait := rule.take(key, now); wait > 0 {
+			rule.limited++
+			// 退还之前的规则已经取走的令牌
+			for _, t := range matched {
+				t.rule.buckets[t.key].tokens++
+			}
+			return wait, fmt.Errorf("%w: %s %s is limited to %v/s (burst %d) by %s",
+				ErrRateLimited, r.Method, rule.cfg.Route, rule.cfg.Rate, int(rule.burst), rule.cfg.GetBy())
+		}
+		matched = append(matched, taken{rule: rule, key: key})
+	}
+	for _, t := range matched {
+		t.rule.allowed++
+	}
+	return 0, nil
+}
+
+// 删除已经补满的桶，调用前需要持有l的锁
+func (l *RateLimiter) sweep(now time.Time) {
+	for _, rule := range l.rules {
+		for key, b := range rule.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rule.cfg.Rate >= rule.burst {
+				delete(rule.buckets, key)
+			}
+		}
+	}
+	l.swept = now
+}
+
+func (l *RateLimiter) Status() []RateLimitStatus {
+	l.rl.Lock()
+	defer l.rl.Unlock()
+	list := make([]RateLimitStatus, 0, len(l.rules))
+	for _, rule := range l.rules {
+		list = append(list, RateLimitStatus{
+			Route:   rule.cfg.Route,
+			Methods: rule.cfg.Methods,
+			By:      rule.cfg.GetBy(),
+			Rate:    rule.cfg.Rate,
+			Burst:   int(rule.burst),
+			Clients: len(rule.buckets),
+			Allowed: rule.allowed,
+			Limited: rule.limited,
+		})
+	}
+	return list
+}
+
+// 重试等待时间按秒向上取整，至少1秒
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
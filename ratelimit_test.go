@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rule := newRateRule(config.RateLimitCfg{Rate: 2, Burst: 3})
+	now := time.Now()
+	// 开始时桶是满的，可以突发burst个请求
+	for i := 0; i < 3; i++ {
+		if wait := rule.take("a", now); wait != 0 {
+			t.Fatalf("request %d waits %v", i, wait)
+		}
+	}
+	if wait := rule.take("a", now); wait != 500*time.Millisecond {
+		t.Errorf("empty bucket waits %v, want 500ms", wait)
+	}
+	// 被拒绝的请求不消耗令牌，每秒补充rate个
+	if wait := rule.take("a", now.Add(250*time.Millisecond)); wait != 250*time.Millisecond {
+		t.Errorf("half refilled bucket waits %v, want 250ms", wait)
+	}
+	if wait := rule.take("a", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Errorf("refilled bucket waits %v", wait)
+	}
+	// 每个客户端一个桶
+	if wait := rule.take("b", now); wait != 0 {
+		t.Errorf("other client waits %v", wait)
+	}
+	// 补充不超过burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if wait := rule.take("a", later); wait != 0 {
+			t.Fatalf("request %d after an hour waits %v", i, wait)
+		}
+	}
+	if wait := rule.take("a", later); wait == 0 {
+		t.Error("bucket refilled beyond burst")
+	}
+}
+
+func TestRateRuleMatch(t *testing.T) {
+	tests := []struct {
+		route   string
+		methods []string
+		method  string
+		path    string
+		want    bool
+	}{
+		{"", nil, "GET", "/anything", true},
+		{"/app/status", nil, "GET", "/app/status", true},
+		{"/app/status", nil, "GET", "/app/status/", true},
+		{"/app/status", nil, "GET", "/app/status/x", false},
+		{"/app/status", nil, "GET", "/app", false},
+		{"/command/:name", nil, "POST", "/command/ping", true},
+		{"/command/:name", nil, "POST", "/command/", false},
+		{"/command/:name", nil, "POST", "/command/ping/x", false},
+		{"/files/*path", nil, "GET", "/files/a/b/c", true},
+		{"/files/*path", nil, "GET", "/file", false},
+		{"/exec", []string{"POST"}, "POST", "/exec", true},
+		{"/exec", []string{"POST"}, "GET", "/exec", false},
+		{"", []string{"PUT", "DELETE"}, "DELETE", "/x", true},
+	}
+	for _, tt := range tests {
+		rule := newRateRule(config.RateLimitCfg{Route: tt.route, Methods: tt.methods, Rate: 1})
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := rule.match(r); got != tt.want {
+			t.Errorf("%v %q match %s %s = %v, want %v", tt.methods, tt.route, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter()
+	l.Load([]*config.RateLimitCfg{
+		{Route: "/exec", Methods: []string{"POST"}, Rate: 0.001, Burst: 2},
+		{Route: "/exec", By: config.RateByRoute, Rate: 0.001, Burst: 3},
+	})
+	request := func(addr string) error {
+		r := httptest.NewRequest("POST", "/exec", nil)
+		r.RemoteAddr = addr
+		wait, err := l.Allow(r)
+		if err != nil && wait <= 0 {
+			t.Errorf("limited request has no retry wait")
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := request("10.0.0.1:1000"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	// 同一个地址的不同端口共用一个桶
+	if err := request("10.0.0.1:2000"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("third request = %v, want ErrRateLimited", err)
+	}
+	// 被第一条规则拒绝时退还已经取走的令牌，route规则还剩1个
+	if err := request("10.0.0.2:1000"); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+	if err := request("10.0.0.3:1000"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("request over the route limit = %v, want ErrRateLimited", err)
+	}
+	// 不匹配的请求不受限制
+	if wait, err := l.Allow(httptest.NewRequest("GET", "/app/status", nil)); err != nil || wait != 0 {
+		t.Errorf("unmatched request: %v, %v", wait, err)
+	}
+
+	status := l.Status()
+	if len(status) != 2 {
+		t.Fatalf("status = %+v", status)
+	}
+	if s := status[0]; s.Allowed != 3 || s.Limited != 1 || s.Clients != 3 {
+		t.Errorf("ip rule status = %+v", s)
+	}
+	if s := status[1]; s.Allowed != 3 || s.Limited != 1 || s.Clients != 1 {
+		t.Errorf("route rule status = %+v", s)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := NewRateLimiter()
+	l.Load([]*config.RateLimitCfg{{Rate: 10, Burst: 1}})
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := l.Allow(r); err != nil {
+		t.Fatal(err)
+	}
+	// 补满的桶在清理时删除
+	l.sweep(time.Now().Add(time.Second))
+	if s := l.Status()[0]; s.Clients != 0 {
+		t.Errorf("%d buckets left after sweep", s.Clients)
+	}
+}
+
+// 换token不能绕过by为token的限制
+func TestRateLimitByToken(t *testing.T) {
+	sys := serverConfig.GetSysConfig()
+	defer func(token string) { sys.Token = token }(sys.Token)
+	request := func(l *RateLimiter, token string) error {
+		r := httptest.NewRequest("GET", "/app/status", nil)
+		r.RemoteAddr = "10.0.0.1:1000"
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := l.Allow(r)
+		return err
+	}
+	cfgs := []*config.RateLimitCfg{{By: config.RateByToken, Rate: 0.001, Burst: 2}}
+
+	for _, token := range []string{"", "secret"} {
+		sys.Token = token
+		l := NewRateLimiter()
+		l.Load(cfgs)
+		var limited int
+		for i := 0; i < 10; i++ {
+			if err := request(l, fmt.Sprintf("made-up-%d", i)); errors.Is(err, ErrRateLimited) {
+				limited++
+			}
+		}
+		// 没有配置token时按ip限制，配置了token时未通过验证的请求按ip限制
+		if limited != 8 {
+			t.Errorf("sys.token %q: %d of 10 rotating tokens limited, want 8", token, limited)
+		}
+		if s := l.Status()[0]; s.Clients != 1 {
+			t.Errorf("sys.token %q: %d buckets, want 1", token, s.Clients)
+		}
+	}
+
+	// 通过验证的token有自己的桶
+	sys.Token = "secret"
+	l := NewRateLimiter()
+	l.Load(cfgs)
+	for i := 0; i < 2; i++ {
+		if err := request(l, "made-up"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := request(l, "secret"); err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"hostctl_proxy/internal/record"
+)
+
+// link的连接类型，记录在文件名和Header中
+const (
+	linkKindPut       = "put"
+	linkKindWebsocket = "websocket"
+	linkKindExpect    = "expect"
+)
+
+// 连接app的socket或串口，开启record时记录连接上的所有数据
+// 记录失败不影响连接
+func dialLink(app, kind, url string) (net.Conn, error) {
+	conn, err := dialTarget(app, url)
+	if err != nil {
+		return nil, err
+	}
+	appCfg, ok := linkConfig(app)
+	if !ok || !appCfg.Record {
+		return conn, nil
+	}
+	rec, err := record.Create(serverConfig.GetSysConfig().GetRecordDir(), record.Header{
+		App:   app,
+		Kind:  kind,
+		Url:   url,
+		Start: time.Now(),
+	})
+	if err != nil {
+		logger.AppLog("error", "recording", app, err.Error())
+		return conn, nil
+	}
+	logger.AppLog("info", "recording", app, fmt.Sprintf("%s session is recorded to %s", kind, rec.Name()))
+	return record.NewConn(conn, rec), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"hostctl_proxy/internal/record"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// replay子命令，把link记录作为假的socket server回放，不启动服务
+// 作为socket app运行时参数为 --server localhost PORT FILE
+var (
+	replayCmd    = kingpin.Command("replay", "Replay a link recording as a fake socket server")
+	replayListen = replayCmd.Flag("listen", "Listen address").Default("127.0.0.1:9000").String()
+	replayServer = replayCmd.Flag("server", "Listen host, the port is taken from the first argument, as socket apps are started").String()
+	replaySpeed  = replayCmd.Flag("speed", "Replay speed, 0 replies without delay").Default("1").Float64()
+	replayHold   = replayCmd.Flag("hold", "Keep connections open after the recording ends").Bool()
+	replayArgs   = replayCmd.Arg("args", "[PORT] FILE").Required().Strings()
+)
+
+func runReplay() error {
+	addr, args := *replayListen, *replayArgs
+	if *replayServer != "" {
+		if len(args) < 2 {
+			return fmt.Errorf("port and recording file are required with --server")
+		}
+		addr, args = net.JoinHostPort(*replayServer, args[0]), args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("expected one recording file, got %d", len(args))
+	}
+
+	rec, err := record.Load(args[0])
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "replaying %s (%s of %s, %d events) on %s\n", args[0], rec.Header.Kind, rec.Header.App, len(rec.Events), l.Addr())
+
+	replayer := &record.Replayer{
+		Rec:   rec,
+		Speed: *replaySpeed,
+		Hold:  *replayHold,
+		Mismatch: func(conn net.Conn, index int, want, got []byte) {
+			fmt.Fprintf(os.Stderr, "%s: event %d expected %q, got %q\n", conn.RemoteAddr(), index, want, got)
+		},
+	}
+	return replayer.Serve(l)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/cron"
+)
+
+const (
+	// 每个定时任务保留的运行记录数
+	scheduleHistorySize = 20
+	// 运行记录中保留的输出长度
+	scheduleOutputSize = 4096
+)
+
+const (
+	ScheduleTriggerTimer  = "schedule"
+	ScheduleTriggerManual = "manual"
+)
+
+var ErrScheduleRunning = errors.New("schedule is running")
+
+// ScheduleRun 定时任务的一次运行
+type ScheduleRun struct {
+	Trigger  string    `json:"trigger"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // 秒
+	Ok       bool      `json:"ok"`
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type ScheduleStatus struct {
+	Name    string             `json:"name"`
+	Config  config.ScheduleCfg `json:"config"`
+	Running bool               `json:"running"`
+	Next    *time.Time         `json:"next,omitempty"` // 禁用时没有
+	Runs    int                `json:"runs"`
+	Skipped int                `json:"skipped"` // 上一次还没结束或资源被占用而跳过的次数
+	Last    *ScheduleRun       `json:"last,omitempty"`
+	History []ScheduleRun      `json:"history,omitempty"`
+}
+
+// 定时任务的状态，由ScheduleManager的锁保护
+type scheduleEntry struct {
+	name    string
+	cfg     config.ScheduleCfg
+	spec    *cron.Schedule
+	timer   *time.Timer
+	gen     int // 每次重新计时加1，用于忽略已经失效的timer
+	next    time.Time
+	running bool
+	runs    int
+	skipped int
+	history []ScheduleRun
+}
+
+// ScheduleManager 按schedule配置定时运行命令或启停app
+// 同一个任务上一次还没结束时跳过本次，不会重叠运行
+type ScheduleManager struct {
+	rl      sync.RWMutex
+	entries map[string]*scheduleEntry
+	stopped bool
+}
+
+func NewScheduleManager() *ScheduleManager {
+	return &ScheduleManager{
+		entries: make(map[string]*scheduleEntry),
+	}
+}
+
+// Load 服务启动时加载配置中的所有定时任务
+func (m *ScheduleManager) Load() {
+	for name := range serverConfig.List("schedule") {
+		if err := m.Set(name); err != nil {
+			logger.SysLog("error", "loading schedule", fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+}
+
+// Set 按配置新建或更新定时任务，保留原来的运行记录
+func (m *ScheduleManager) Set(name string) error {
+	schCfg, ok := serverConfig.GetConfig("schedule", name).(*config.ScheduleCfg)
+	if !ok {
+		return fmt.Errorf("%w: schedule %s", config.ErrNotFound, name)
+	}
+	var spec *cron.Schedule
+	if schCfg.Cron != "" {
+		var err error
+		if spec, err = cron.Parse(schCfg.Cron); err != nil {
+			return fmt.Errorf("%w: %v", config.ErrField, err)
+		}
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	e, ok := m.entries[name]
+	if !ok {
+		e = &scheduleEntry{name: name}
+		m.entries[name] = e
+	}
+	e.cfg = *schCfg
+	e.spec = spec
+	m.arm(e)
+	if e.next.IsZero() {
+		logger.SysLog("info", "setting schedule", fmt.Sprintf("%s: %s %s, not scheduled", name, e.cfg.Action, e.cfg.Target))
+	} else {
+		logger.SysLog("info", "setting schedule", fmt.Sprintf("%s: %s %s, next %s", name, e.cfg.Action, e.cfg.Target, e.next.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// Remove 删除定时任务，正在运行的不会中断
+func (m *ScheduleManager) Remove(name string) {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if e, ok := m.entries[name]; ok {
+		m.disarm(e)
+		delete(m.entries, name)
+	}
+}
+
+// StopAll 停止所有计时，服务停止时使用
+func (m *ScheduleManager) StopAll() {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	m.stopped = true
+	for _, e := range m.entries {
+		m.disarm(e)
+	}
+}
+
+// 调用前需要持有m的锁
+func (m *ScheduleManager) disarm(e *scheduleEntry) {
+	e.gen++
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.next = time.Time{}
+}
+
+// 计算下一次运行的时间并计时，调用前需要持有m的锁
+func (m *ScheduleManager) arm(e *scheduleEntry) {
+	m.disarm(e)
+	if m.stopped || e.cfg.Disabled {
+		return
+	}
+	now := time.Now()
+	if e.spec != nil {
+		e.next = e.spec.Next(now)
+		if e.next.IsZero() {
+			return
+		}
+	} else {
+		e.next = now.Add(time.Duration(e.cfg.Interval) * time.Second)
+	}
+	gen := e.gen
+	e.timer = time.AfterFunc(e.next.Sub(now), func() {
+		m.fire(e, gen)
+	})
+}
+
+func (m *ScheduleManager) fire(e *scheduleEntry, gen int) {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if e.gen != gen || m.entries[e.name] != e {
+		return
+	}
+	if e.running {
+		e.skipped++
+		logger.SysLog("warning", "running schedule", fmt.Sprintf("%s: previous run is not finished, skipped", e.name))
+	} else {
+		e.running = true
+		go m.run(e, ScheduleTriggerTimer)
+	}
+	m.arm(e)
+}
+
+// Trigger 立即运行一次定时任务并返回结果，禁用的任务也可以运行
+// 目标配置了lock时tokens中需要有该资源的租约
+func (m *ScheduleManager) Trigger(name string, tokens []string) (ScheduleRun, error) {
+	m.rl.Lock()
+	e, ok := m.entries[name]
+	if !ok {
+		m.rl.Unlock()
+		return ScheduleRun{}, fmt.Errorf("%w: schedule %s", config.ErrNotFound, name)
+	}
+	if e.running {
+		m.rl.Unlock()
+		return ScheduleRun{}, fmt.Errorf("%w: %s", ErrScheduleRunning, name)
+	}
+	if err := lockManager.Check(lockResource(scheduleLockTarget(&e.cfg)), tokens); err != nil {
+		m.rl.Unlock()
+		return ScheduleRun{}, err
+	}
+	e.running = true
+	m.rl.Unlock()
+	return m.run(e, ScheduleTriggerManual), nil
+}
+
+// 运行任务并记录结果，调用前需要把e.running设为true
+func (m *ScheduleManager) run(e *scheduleEntry, trigger string) ScheduleRun {
+	m.rl.RLock()
+	schCfg := e.cfg
+	m.rl.RUnlock()
+
+	if resource := lockResource(scheduleLockTarget(&schCfg)); resource != "" && trigger == ScheduleTriggerTimer {
+		// 定时运行时由任务自己持有租约，资源被占用时跳过这次运行
+		lease, err := lockManager.Acquire(context.Background(), resource, "schedule "+e.name, schCfg.GetTimeout()+defaultLeaseTTL, 0)
+		if err != nil {
+			logger.SysLog("warning", "running schedule", fmt.Sprintf("%s: %v, skipped", e.name, err))
+			m.rl.Lock()
+			e.running = false
+			e.skipped++
+			m.rl.Unlock()
+			return ScheduleRun{Trigger: trigger, Start: time.Now(), Error: err.Error()}
+		}
+		defer lockManager.Release(resource, lease.Token, false)
+	}
+
+	logger.SysLog("info", "running schedule", fmt.Sprintf("%s: %s %s (%s)", e.name, schCfg.Action, schCfg.Target, trigger))
+	res := ScheduleRun{Trigger: trigger, Start: time.Now()}
+	output, err := runScheduleAction(&schCfg)
+	res.Duration = time.Since(res.Start).Seconds()
+	if len(output) > scheduleOutputSize {
+		output = output[len(output)-scheduleOutputSize:]
+	}
+	res.Output = output
+	if err != nil {
+		res.Error = err.Error()
+		logger.SysLog("error", "running schedule", fmt.Sprintf("%s: %v", e.name, err))
+	} else {
+		res.Ok = true
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	e.running = false
+	e.runs++
+	e.history = append(e.history, res)
+	if len(e.history) > scheduleHistorySize {
+		e.history = append([]ScheduleRun(nil), e.history[len(e.history)-scheduleHistorySize:]...)
+	}
+	return res
+}
+
+// 定时任务的目标，用于查找需要的lock资源
+func scheduleLockTarget(schCfg *config.ScheduleCfg) (string, string) {
+	if schCfg.Action == config.ScheduleCommand {
+		return "command", schCfg.Target
+	}
+	return "app", schCfg.Target
+}
+
+func runScheduleAction(schCfg *config.ScheduleCfg) (string, error) {
+	if schCfg.Action == config.ScheduleCommand {
+		output, _, err := RunLimitedCommand(context.Background(), schCfg.Target, schCfg.Args, schCfg.Params, schCfg.GetTimeout())
+		return output, err
+	}
+	return "", RunAppAction(schCfg.Action, schCfg.Target, schCfg.Args)
+}
+
+// 调用前需要持有m的锁
+func (e *scheduleEntry) status(history bool) ScheduleStatus {
+	status := ScheduleStatus{
+		Name:    e.name,
+		Config:  e.cfg,
+		Running: e.running,
+		Runs:    e.runs,
+		Skipped: e.skipped,
+	}
+	if !e.next.IsZero() {
+		next := e.next
+		status.Next = &next
+	}
+	if n := len(e.history); n > 0 {
+		last := e.history[n-1]
+		status.Last = &last
+	}
+	if history {
+		// 最近的在前
+		status.History = make([]ScheduleRun, 0, len(e.history))
+		for i := len(e.history) - 1; i >= 0; i-- {
+			status.History = append(status.History, e.history[i])
+		}
+	}
+	return status
+}
+
+// Status 返回定时任务的状态和运行记录
+func (m *ScheduleManager) Status(name string) (ScheduleStatus, error) {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	e, ok := m.entries[name]
+	if !ok {
+		return ScheduleStatus{}, fmt.Errorf("%w: schedule %s", config.ErrNotFound, name)
+	}
+	return e.status(true), nil
+}
+
+// List 返回所有定时任务的状态，按名称排序，不包含运行记录
+func (m *ScheduleManager) List() []ScheduleStatus {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	list := make([]ScheduleStatus, 0, len(m.entries))
+	for _, e := range m.entries {
+		list = append(list, e.status(false))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
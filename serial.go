@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/codec"
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/serial"
+
+	"github.com/gorilla/websocket"
+)
+
+// 串口link的url，serial://后面是设备路径
+const serialScheme = "serial://"
+
+// link使用的配置，串口转换成等价的socket app配置
+func linkConfig(name string) (*config.AppCfg, bool) {
+	if appCfg, ok := serverConfig.GetConfig("app", name).(*config.AppCfg); ok {
+		return appCfg, true
+	}
+	if serialCfg, ok := serverConfig.GetConfig("serial", name).(*config.SerialCfg); ok {
+		// 串口设备一般没有状态头，默认按行分帧
+		framing := serialCfg.Framing
+		if framing == nil {
+			framing = &config.FramingCfg{Type: codec.TypeLines}
+		}
+		return &config.AppCfg{
+			Socket:        true,
+			Websocket:     true,
+			Framing:       framing,
+			LinkTimeout:   serialCfg.LinkTimeout,
+			LinkWriteMode: serialCfg.LinkWriteMode,
+			Record:        serialCfg.Record,
+			Lock:          serialCfg.Lock,
+			LinkQueue:     serialCfg.LinkQueue,
+		}, true
+	}
+	return nil, false
+}
+
+// link连接的地址，socket app为localhost:port或unix:///path，串口为serial://设备路径
+func linkUrl(name string) (string, error) {
+	if serialCfg, ok := serverConfig.GetConfig("serial", name).(*config.SerialCfg); ok {
+		return serialScheme + serialCfg.Device, nil
+	}
+	socketUrl, err := GetSocketUrl(name)
+	if err != nil {
+		return "", NewHttpError(http.StatusConflict, ErrCodeAppStopped, fmt.Errorf("Failed to get %s's socketurl: %w", name, err))
+	}
+	return socketUrl, nil
+}
+
+func isSerialUrl(url string) bool {
+	return strings.HasPrefix(url, serialScheme)
+}
+
+// 按url连接socket或打开串口
+func dialTarget(name, url string) (net.Conn, error) {
+	if !isSerialUrl(url) {
+		return dialSocket(url, dialTimeout)
+	}
+	serialCfg, ok := serverConfig.GetConfig("serial", name).(*config.SerialCfg)
+	if !ok {
+		return nil, cmdctrl.ErrMsg("ANF", name)
+	}
+	port, err := serial.Open(serial.Config{
+		Device:      serialCfg.Device,
+		Baud:        serialCfg.Baud,
+		DataBits:    serialCfg.DataBits,
+		Parity:      serialCfg.Parity,
+		StopBits:    serialCfg.StopBits,
+		FlowControl: serialCfg.FlowControl,
+	})
+	if errors.Is(err, serial.ErrConfig) {
+		return nil, fmt.Errorf("%w: %v", config.ErrField, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.SocketLog("info", url, fmt.Sprintf("serial port of %s opened", name))
+	return port, nil
+}
+
+// 串口配置变化或删除后，关闭已经打开的串口
+func closeSerial(name string) {
+	sessionManager.Close(name)
+	wsManager.CloseHub(name, websocket.CloseServiceRestart, "serial config changed")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"hostctl_proxy/internal/codec"
+	"hostctl_proxy/internal/config"
+)
+
+const (
+	defaultLinkTimeout = 5 * time.Second
+	dialTimeout        = 3 * time.Second
+	probeTimeout       = time.Millisecond
+)
+
+const (
+	encodingText   = "text"
+	encodingBase64 = "base64"
+)
+
+var ErrLinkTimeout = errors.New("link request timeout")
+
+// SocketSession 与socket app之间的长连接
+// 同一时间只处理一个请求，请求之间复用连接
+type SocketSession struct {
+	name   string
+	mu     sync.Mutex
+	url    string
+	conn   net.Conn
+	reader *codec.Reader
+}
+
+func (s *SocketSession) dial(url string) error {
+	conn, err := dialLink(s.name, linkKindPut, url)
+	if err != nil {
+		return err
+	}
+	s.url = url
+	s.conn = conn
+	s.reader = codec.NewReader(conn)
+	logger.SocketLog("info", url, fmt.Sprintf("session of %s connected", s.name))
+	return nil
+}
+
+// 调用前需要持有s.mu
+func (s *SocketSession) close() {
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Close(); err != nil {
+		logger.SocketLog("error", s.url, err.Error())
+	}
+	logger.SocketLog("info", s.url, fmt.Sprintf("session of %s closed", s.name))
+	s.conn = nil
+	s.reader = nil
+}
+
+// Request 发送一条消息并读取一条响应
+// url变化（app重启后端口变了）或复用的连接已经被对端关闭时重新连接
+// 请求已经发出后不再重试，避免app收到重复的请求
+func (s *SocketSession) Request(url string, c codec.Codec, data []byte, timeout time.Duration) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		reused := s.conn != nil && s.url == url
+		if reused {
+			if err := s.probe(); err != nil {
+				logger.SocketLog("info", url, fmt.Sprintf("session of %s is stale, reconnecting: %v", s.name, err))
+				reused = false
+			}
+		}
+		if !reused {
+			s.close()
+			if err := s.dial(url); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, sent, err := s.roundTrip(c, data, deadline)
+		var statusErr *codec.StatusError
+		if err == nil || errors.As(err, &statusErr) {
+			// 状态头表示的失败是完整的响应，连接仍然可用
+			return resp, err
+		}
+		s.close()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %s after %v", ErrLinkTimeout, s.name, timeout)
+		}
+		// 探测之后对端才关闭的连接，只有一个字节都没有写出时才能安全地重试
+		if !reused || attempt > 0 || sent || !staleConnError(err) {
+			return nil, err
+		}
+		logger.SocketLog("info", url, fmt.Sprintf("session of %s is stale, reconnecting: %v", s.name, err))
+	}
+}
+
+// 复用连接前用很短超时的读检查连接是否还可用
+// 读超时说明连接正常；上一个请求残留的数据丢弃，避免被当成这次的响应
+func (s *SocketSession) probe() error {
+	if n := s.reader.Buffered(); n > 0 {
+		s.reader.Discard(n)
+		logger.SocketLog("info", s.url, fmt.Sprintf("session of %s discarded %d stale bytes", s.name, n))
+	}
+	// 已经过期的deadline不会真正读连接，读不到EOF
+	if err := s.conn.SetReadDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return err
+	}
+	for {
+		_, err := s.reader.Peek(1)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := s.reader.Buffered()
+		s.reader.Discard(n)
+		logger.SocketLog("info", s.url, fmt.Sprintf("session of %s discarded %d stale bytes", s.name, n))
+	}
+}
+
+// sent表示是否已经有数据写到了连接上
+func (s *SocketSession) roundTrip(c codec.Codec, data []byte, deadline time.Time) ([]byte, bool, error) {
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return nil, false, err
+	}
+	w := &countWriter{w: s.conn}
+	if err := c.Encode(w, data); err != nil {
+		return nil, w.n > 0, err
+	}
+	s.reader.Deadline = deadline
+	resp, err := c.Decode(s.reader)
+	return resp, true, err
+}
+
+// 记录写出的字节数
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+func (s *SocketSession) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+}
+
+// 对端已经关闭的连接，重连后可以重试
+func staleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// SessionManager 管理每个socket app的长连接，与PortsManager一起维护
+type SessionManager struct {
+	rl       sync.RWMutex
+	sessions map[string]*SocketSession
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*SocketSession),
+	}
+}
+
+// Get 获取app的session，不存在时新建，连接在第一次请求时建立
+func (m *SessionManager) Get(name string) *SocketSession {
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	s, ok := m.sessions[name]
+	if !ok {
+		s = &SocketSession{name: name}
+		m.sessions[name] = s
+	}
+	return s
+}
+
+// Close 关闭app的session，app停止时使用
+func (m *SessionManager) Close(name string) {
+	m.rl.Lock()
+	s, ok := m.sessions[name]
+	delete(m.sessions, name)
+	m.rl.Unlock()
+	if ok {
+		s.Close()
+	}
+}
+
+func (m *SessionManager) CloseAll() {
+	m.rl.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*SocketSession)
+	m.rl.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+func appCodec(appCfg *config.AppCfg) (codec.Codec, error) {
+	if appCfg.Framing == nil {
+		return codec.New(codec.Config{Type: codec.TypeLines, StatusHeader: true})
+	}
+	return framingCodec(appCfg.Framing)
+}
+
+func proxyCodec(pxyCfg *config.ProxyCfg) (codec.Codec, error) {
+	if pxyCfg == nil || pxyCfg.Framing == nil {
+		return codec.New(codec.Config{Type: codec.TypeLines})
+	}
+	return framingCodec(pxyCfg.Framing)
+}
+
+func framingCodec(f *config.FramingCfg) (codec.Codec, error) {
+	if f.ByteOrder != "" && f.ByteOrder != "big" && f.ByteOrder != "little" {
+		return nil, fmt.Errorf("%w: framing byte_order %s", config.ErrField, f.ByteOrder)
+	}
+	c, err := codec.New(codec.Config{
+		Type:         f.Type,
+		Terminator:   f.Terminator,
+		Pattern:      f.Pattern,
+		LengthSize:   f.LengthSize,
+		LittleEndian: f.ByteOrder == "little",
+		Size:         f.Size,
+		IdleGap:      time.Duration(f.IdleGap) * time.Millisecond,
+		StatusHeader: f.StatusHeader,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: framing %v", config.ErrField, err)
+	}
+	return c, nil
+}
+
+// websocket桥接的选项，mode为auto、text或binary
+// framing为true时按app的分帧收发消息，状态头原样转发
+func linkWSOptions(r *http.Request, appCfg *config.AppCfg) (string, codec.Codec, error) {
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	switch mode {
+	case "":
+		mode = WSModeAuto
+	case WSModeAuto, WSModeText, WSModeBinary:
+	default:
+		return "", nil, fmt.Errorf("invalid websocket mode: %s", mode)
+	}
+	if !queryBool(r, "framing") {
+		return mode, nil, nil
+	}
+	if appCfg.Framing == nil {
+		c, err := codec.New(codec.Config{Type: codec.TypeLines})
+		return mode, c, err
+	}
+	framing := *appCfg.Framing
+	framing.StatusHeader = false
+	if framing.Type == codec.TypeStatus {
+		framing.Type = codec.TypeIdle
+	}
+	c, err := framingCodec(&framing)
+	return mode, c, err
+}
+
+// 参数为空、false或0时返回false
+func queryBool(r *http.Request, key string) bool {
+	v := r.URL.Query().Get(key)
+	return v != "" && v != "false" && v != "0"
+}
+
+// 请求的encoding参数优先，其次是framing中的encoding
+func payloadEncoding(query string, f *config.FramingCfg) (string, error) {
+	encoding := query
+	if encoding == "" && f != nil {
+		encoding = f.Encoding
+	}
+	switch encoding {
+	case "", encodingText:
+		return encodingText, nil
+	case encodingBase64:
+		return encodingBase64, nil
+	}
+	return "", fmt.Errorf("invalid encoding: %s", encoding)
+}
+
+// 解码请求内容，base64用于传输二进制数据
+func decodePayload(data []byte, encoding string) ([]byte, error) {
+	if encoding != encodingBase64 {
+		return data, nil
+	}
+	out, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 payload: %w", err)
+	}
+	return out, nil
+}
+
+// 按编码输出响应，base64时data中带上encoding
+func renderPayload(w http.ResponseWriter, data []byte, encoding string) {
+	if encoding != encodingBase64 {
+		RenderJSON(w, true, string(data))
+		return
+	}
+	RenderJSON(w, true, RenderData{
+		"output":   base64.StdEncoding.EncodeToString(data),
+		"encoding": encodingBase64,
+	})
+}
+
+// app的link_timeout作为默认超时
+func linkTimeout(r *http.Request, appCfg *config.AppCfg) (time.Duration, error) {
+	return requestTimeout(r, appCfg.LinkTimeout)
+}
+
+// 请求的timeout参数优先，纯数字按毫秒处理，其次是配置的毫秒数
+func requestTimeout(r *http.Request, ms int) (time.Duration, error) {
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		if ms, err := strconv.Atoi(t); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond, nil
+		}
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid timeout: %s", t)
+		}
+		return d, nil
+	}
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return defaultLinkTimeout, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"hostctl_proxy/internal/codec"
+)
+
+// 按行收发的测试app，回复handle返回的内容，keep为false时随后关闭连接
+type lineApp struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	requests []string
+}
+
+func newLineApp(t *testing.T, handle func(req string) (resp string, keep bool)) *lineApp {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	app := &lineApp{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					app.mu.Lock()
+					app.requests = append(app.requests, line)
+					app.mu.Unlock()
+					resp, keep := handle(line)
+					conn.Write([]byte(resp))
+					if !keep {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return app
+}
+
+func (a *lineApp) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.requests)
+}
+
+func TestSessionReconnect(t *testing.T) {
+	c, err := codec.New(codec.Config{Type: codec.TypeNewline})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("closed after reply", func(t *testing.T) {
+		// app回复后关闭连接，下一个请求探测到后重新连接
+		app := newLineApp(t, func(req string) (string, bool) { return "ok\n", false })
+		s := &SocketSession{name: "echo"}
+		defer s.Close()
+		url := app.ln.Addr().String()
+		for i := 0; i < 2; i++ {
+			if i > 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			resp, err := s.Request(url, c, []byte("ping"), time.Second)
+			if err != nil || string(resp) != "ok" {
+				t.Fatalf("request %d = %q, %v", i, resp, err)
+			}
+		}
+		if n := app.count(); n != 2 {
+			t.Errorf("app received %d requests, want 2", n)
+		}
+	})
+
+	t.Run("closed before reply", func(t *testing.T) {
+		// 请求已经发出，app没有回复就关闭了连接，不能重发
+		app := newLineApp(t, func(req string) (string, bool) {
+			if req != "first\n" {
+				return "", false
+			}
+			return "ok\n", true
+		})
+		s := &SocketSession{name: "echo"}
+		defer s.Close()
+		url := app.ln.Addr().String()
+		if _, err := s.Request(url, c, []byte("first"), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Request(url, c, []byte("second"), time.Second); err == nil {
+			t.Error("request without a reply should fail")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := app.count(); n != 2 {
+			t.Errorf("app received %d requests, want 2", n)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"time"
+
+	"hostctl_proxy/internal/config"
+)
+
+const (
+	// 配置了expect但没有timeout时等待输出的时间
+	defaultStdinTimeout = 5 * time.Second
+	// 写入stdin的超时，app不读取stdin时管道会写满
+	stdinWriteTimeout = 5 * time.Second
+)
+
+// BodyStdin 写入app stdin的数据，data在前，lines每行追加\n
+// 配置expect或timeout时写入后收集app的输出，直到匹配expect或超时
+type BodyStdin struct {
+	Data     string   `json:"data"`
+	Lines    []string `json:"lines"`
+	Encoding string   `json:"encoding"` // text或base64，同时用于data和output
+	Expect   string   `json:"expect"`
+	Timeout  int      `json:"timeout"` // 毫秒
+}
+
+type StdinResult struct {
+	Written int               `json:"written"`
+	Output  string            `json:"output,omitempty"`
+	Matched bool              `json:"matched,omitempty"`
+	Match   string            `json:"match,omitempty"`
+	Groups  map[string]string `json:"groups,omitempty"`
+}
+
+func (body *BodyStdin) payload() ([]byte, error) {
+	var data []byte
+	switch body.Encoding {
+	case "", "text":
+		data = []byte(body.Data)
+	case "base64":
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(body.Data); err != nil {
+			return nil, fmt.Errorf("invalid base64 data: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid encoding: %s", body.Encoding)
+	}
+	for _, line := range body.Lines {
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// WriteStdin 向app的stdin写入数据，pty app写入终端
+// 收集输出时先开始收集再写入，避免漏掉app的响应
+func WriteStdin(ctx context.Context, name string, appCfg *config.AppCfg, body *BodyStdin) (*StdinResult, error) {
+	data, err := body.payload()
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	var re *regexp.Regexp
+	if body.Expect != "" {
+		if re, err = regexp.Compile(body.Expect); err != nil {
+			return nil, BadRequest(fmt.Errorf("invalid expect: %v", err))
+		}
+	}
+	timeout := time.Duration(body.Timeout) * time.Millisecond
+	if timeout <= 0 && re != nil {
+		timeout = defaultStdinTimeout
+	}
+
+	var watcher *OutputWatcher
+	if timeout > 0 {
+		output := outputManager.Get(name)
+		watcher = output.Watch()
+		defer output.Unwatch(watcher)
+	}
+	res := &StdinResult{}
+	if appCfg.Pty {
+		res.Written, err = wsManager.WriteTty(name, data, stdinWriteTimeout)
+	} else {
+		res.Written, err = appManager.WriteStdin(name, data, stdinWriteTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if watcher == nil {
+		return res, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-watcher.Notify():
+			output := watcher.Bytes()
+			if re == nil {
+				continue
+			}
+			loc := re.FindSubmatchIndex(output)
+			if loc == nil {
+				continue
+			}
+			res.Matched = true
+			res.Match = string(output[loc[0]:loc[1]])
+			for i, group := range re.SubexpNames() {
+				if group == "" || loc[2*i] < 0 {
+					continue
+				}
+				if res.Groups == nil {
+					res.Groups = make(map[string]string)
+				}
+				res.Groups[group] = string(output[loc[2*i]:loc[2*i+1]])
+			}
+			res.Output = encodeOutput(output[:loc[1]], body.Encoding)
+			return res, nil
+		case <-timer.C:
+			res.Output = encodeOutput(watcher.Bytes(), body.Encoding)
+			return res, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func encodeOutput(output []byte, encoding string) string {
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(output)
+	}
+	return string(output)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 启动一个回显stdin的app，测试结束后停止并恢复appManager
+func startEchoApp(t *testing.T, name string) {
+	t.Helper()
+	saved := appManager
+	appManager = cmdctrl.New(1)
+	entry := logrus.New()
+	entry.SetOutput(io.Discard)
+	err := appManager.Add(name, cmdctrl.CommandInfo{
+		Args:      []string{"sh", "-c", `while read l; do echo "got $l"; done`},
+		OpenStdin: true,
+		Stdout:    outputManager.Get(name),
+		Logentry:  logrus.NewEntry(entry),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 进程一直运行时Start要等几秒才返回
+	go appManager.Start(name)
+	waitFor(t, "app running", func() bool { return appManager.Running(name) })
+	t.Cleanup(func() {
+		appManager.Stop(name, true)
+		appManager = saved
+	})
+}
+
+func TestWriteStdin(t *testing.T) {
+	const name = "stdin-echo"
+	startEchoApp(t, name)
+	appCfg := &config.AppCfg{Stdin: true}
+	ctx := context.Background()
+
+	res, err := WriteStdin(ctx, name, appCfg, &BodyStdin{Lines: []string{"hello 42"}, Expect: `got (?P<word>\w+) (?P<num>\d+)\n`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Written != 9 || !res.Matched || res.Match != "got hello 42\n" || res.Output != "got hello 42\n" {
+		t.Errorf("expect: %+v", res)
+	}
+	if res.Groups["word"] != "hello" || res.Groups["num"] != "42" {
+		t.Errorf("groups: %v", res.Groups)
+	}
+
+	// 没有匹配时超时返回收集到的输出
+	res, err = WriteStdin(ctx, name, appCfg, &BodyStdin{Data: "a\n", Lines: []string{"b"}, Expect: "never", Timeout: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Matched || res.Match != "" || res.Output != "got a\ngot b\n" {
+		t.Errorf("timeout: %+v", res)
+	}
+
+	// 只有timeout时收集输出，按encoding编码
+	res, err = WriteStdin(ctx, name, appCfg, &BodyStdin{Data: base64.StdEncoding.EncodeToString([]byte("c\n")), Encoding: "base64", Timeout: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("got c\n")); res.Written != 2 || res.Output != want {
+		t.Errorf("base64: %+v", res)
+	}
+
+	// 不等待输出时只返回写入的字节数
+	if res, err = WriteStdin(ctx, name, appCfg, &BodyStdin{Data: "d\n"}); err != nil || res.Written != 2 || res.Output != "" {
+		t.Errorf("no wait: %+v, %v", res, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := WriteStdin(cancelled, name, appCfg, &BodyStdin{Data: "e\n", Expect: "never"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: %v", err)
+	}
+}
+
+func TestWriteStdinErrors(t *testing.T) {
+	appCfg := &config.AppCfg{Stdin: true}
+	for _, body := range []*BodyStdin{
+		{Data: "x", Expect: "("},
+		{Data: "!", Encoding: "base64"},
+		{Data: "x", Encoding: "hex"},
+	} {
+		var he *HttpError
+		if _, err := WriteStdin(context.Background(), "stdin-none", appCfg, body); !errors.As(err, &he) || he.Status != http.StatusBadRequest {
+			t.Errorf("%+v: %v", body, err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/pty"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 新客户端连接时先发送最近的输出，便于看到当前的屏幕
+	ttyBacklogSize = 64 * 1024
+	ttyReadSize    = 4096
+)
+
+// 客户端用text frame发送的控制消息类型
+const (
+	TtyMsgInput  = "input"
+	TtyMsgResize = "resize"
+)
+
+var ErrTtyWriterBusy = errors.New("tty writer is taken")
+
+// TtyMessage 终端的控制消息，binary frame直接作为输入
+type TtyMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// TtySession pty app的终端，app每次启动时创建，进程退出后关闭
+// 所有客户端都能看到输出，只有writer的输入和resize会发给终端
+// clients、writer和backlog由WSManager的锁保护
+// 输入由终端自己的写协程带超时写入，app不读取时不影响其他终端
+type TtySession struct {
+	app       string
+	master    *os.File
+	out       io.Writer
+	manager   *WSManager
+	clients   map[*WSClient]bool
+	writer    *WSClient
+	backlog   []byte
+	cols      int
+	rows      int
+	created   time.Time
+	input     chan *ttyWrite
+	closed    chan struct{} // 终端关闭后关闭
+	closeOnce sync.Once
+}
+
+// 一次写入终端的输入，client为空时是WriteTty的写入，写完后关闭done
+type ttyWrite struct {
+	client  *WSClient
+	data    []byte
+	timeout time.Duration
+	n       int
+	err     error
+	done    chan struct{}
+}
+
+type TtyStatus struct {
+	App     string      `json:"app"`
+	Cols    int         `json:"cols"`
+	Rows    int         `json:"rows"`
+	Writer  int64       `json:"writer,omitempty"`
+	Created time.Time   `json:"created"`
+	Clients []HubClient `json:"clients"`
+}
+
+// pty app的启动方式，终端的输出写到out并转发给websocket客户端
+func ptyLauncher(appName string, out io.Writer) func(*exec.Cmd) error {
+	return func(cmd *exec.Cmd) error {
+		master, err := pty.Start(cmd)
+		if err != nil {
+			return err
+		}
+		wsManager.openTty(appName, master, out)
+		return nil
+	}
+}
+
+// 实时读取终端的输出并广播，进程退出后读取出错，关闭终端
+func (s *TtySession) pump() {
+	buf := make([]byte, ttyReadSize)
+	for {
+		n, err := s.master.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			if s.out != nil {
+				s.out.Write(data)
+			}
+			s.broadcast(data)
+		}
+		if err != nil {
+			logger.AppLog("info", "tty", s.app, fmt.Sprintf("tty closed: %v", err))
+			s.manager.closeTty(s, websocket.CloseNormalClosure, "app exited")
+			return
+		}
+	}
+}
+
+// 按顺序把输入写给终端，每次写入都带deadline
+func (s *TtySession) writeInput() {
+	for {
+		select {
+		case w := <-s.input:
+			if err := s.master.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+				w.err = err
+			} else {
+				w.n, w.err = s.master.Write(w.data)
+			}
+			if w.done != nil {
+				close(w.done)
+			} else if w.err != nil {
+				logger.WebSocketLog("error", w.client.conn, fmt.Sprintf("Failed to write to tty of %s: %v", s.app, w.err))
+				go w.client.Close(websocket.CloseInternalServerErr, w.err.Error())
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// 把输入交给写协程，终端关闭后返回错误
+func (s *TtySession) enqueue(w *ttyWrite) error {
+	select {
+	case s.input <- w:
+		return nil
+	case <-s.closed:
+		return fmt.Errorf("tty of %s is closed", s.app)
+	}
+}
+
+// 客户端的写通道满了说明它跟不上输出，断开它以免影响其他客户端
+func (s *TtySession) broadcast(data []byte) {
+	s.manager.Lock()
+	s.backlog = append(s.backlog, data...)
+	if len(s.backlog) > ttyBacklogSize {
+		s.backlog = append([]byte(nil), s.backlog[len(s.backlog)-ttyBacklogSize:]...)
+	}
+	clients := make([]*WSClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.manager.Unlock()
+
+	for _, c := range clients {
+		if !c.trySend(WSMessage{Type: websocket.BinaryMessage, Data: data}) {
+			logger.WebSocketLog("error", c.conn, fmt.Sprintf("Tty client of %s is too slow, disconnecting", s.app))
+			go c.manager.RmWSClient(c)
+		}
+	}
+}
+
+// app重新启动时原来的终端已经不可用，关闭后再创建新的
+func (m *WSManager) openTty(app string, master *os.File, out io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	if old, ok := m.ttys[app]; ok {
+		m.closeTtyLocked(old, websocket.CloseServiceRestart, "app restarted")
+	}
+	s := &TtySession{
+		app:     app,
+		master:  master,
+		out:     out,
+		manager: m,
+		clients: make(map[*WSClient]bool),
+		cols:    pty.DefaultCols,
+		rows:    pty.DefaultRows,
+		created: time.Now(),
+		input:   make(chan *ttyWrite, inputQueueSize),
+		closed:  make(chan struct{}),
+	}
+	m.ttys[app] = s
+	go s.pump()
+	go s.writeInput()
+}
+
+func (m *WSManager) closeTty(s *TtySession, code int, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	m.closeTtyLocked(s, code, reason)
+}
+
+// 调用前需要持有m的锁
+func (m *WSManager) closeTtyLocked(s *TtySession, code int, reason string) {
+	if m.ttys[s.app] == s {
+		delete(m.ttys, s.app)
+	}
+	s.master.Close()
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	for c := range s.clients {
+		go c.Close(code, reason)
+	}
+}
+
+// 调用前需要持有m的锁
+func (m *WSManager) checkTty(app string, write bool) (*TtySession, error) {
+	s, ok := m.ttys[app]
+	if !ok {
+		return nil, NewHttpError(http.StatusConflict, ErrCodeAppStopped, fmt.Errorf("tty of %s is not running", app))
+	}
+	if write && s.writer != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTtyWriterBusy, app)
+	}
+	return s, nil
+}
+
+// CheckTty 在websocket升级前检查能否连接终端
+func (m *WSManager) CheckTty(app string, write bool) error {
+	m.RLock()
+	defer m.RUnlock()
+	_, err := m.checkTty(app, write)
+	return err
+}
+
+// JoinTty 客户端连接app的终端，write为true时成为writer
+func (m *WSManager) JoinTty(c *WSClient, app string, write bool) error {
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.checkTty(app, write)
+	if err != nil {
+		return err
+	}
+	c.tty = s
+	s.clients[c] = true
+	if write {
+		s.writer = c
+	}
+	if len(s.backlog) > 0 {
+		c.trySend(WSMessage{Type: websocket.BinaryMessage, Data: append([]byte(nil), s.backlog...)})
+	}
+	return nil
+}
+
+// 客户端断开终端，调用前需要持有m的锁
+func (m *WSManager) leaveTty(c *WSClient) {
+	s := c.tty
+	delete(s.clients, c)
+	if s.writer == c {
+		s.writer = nil
+	}
+}
+
+// 处理客户端发给终端的消息，只接受writer的消息
+func (m *WSManager) notifyTty(evt NotifyEvent) error {
+	client := evt.client
+	m.RLock()
+	s := client.tty
+	writable := s.writer == client
+	m.RUnlock()
+	if !writable {
+		logger.WebSocketLog("warning", client.conn, fmt.Sprintf("Input dropped, client is not the tty writer of %s", s.app))
+		return nil
+	}
+	if evt.mtype == websocket.BinaryMessage {
+		return s.enqueue(&ttyWrite{client: client, data: evt.message, timeout: writeWait})
+	}
+	var msg TtyMessage
+	if err := json.Unmarshal(evt.message, &msg); err != nil {
+		logger.WebSocketLog("warning", client.conn, fmt.Sprintf("Invalid tty message: %v", err))
+		return nil
+	}
+	switch msg.Type {
+	case TtyMsgInput:
+		return s.enqueue(&ttyWrite{client: client, data: []byte(msg.Data), timeout: writeWait})
+	case TtyMsgResize:
+		if err := pty.Resize(s.master, msg.Cols, msg.Rows); err != nil {
+			logger.WebSocketLog("warning", client.conn, fmt.Sprintf("Failed to resize tty of %s: %v", s.app, err))
+			return nil
+		}
+		m.Lock()
+		s.cols, s.rows = msg.Cols, msg.Rows
+		m.Unlock()
+	default:
+		logger.WebSocketLog("warning", client.conn, fmt.Sprintf("Unknown tty message type: %s", msg.Type))
+	}
+	return nil
+}
+
+// WriteTty 向app的终端写入数据，与writer的输入一样
+// app不读取输入时终端会写满，超过timeout后返回os.ErrDeadlineExceeded
+func (m *WSManager) WriteTty(app string, data []byte, timeout time.Duration) (int, error) {
+	m.RLock()
+	s, err := m.checkTty(app, false)
+	m.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	w := &ttyWrite{data: data, timeout: timeout, done: make(chan struct{})}
+	if err := s.enqueue(w); err != nil {
+		return 0, err
+	}
+	select {
+	case <-w.done:
+		return w.n, w.err
+	case <-s.closed:
+		return 0, fmt.Errorf("tty of %s is closed", s.app)
+	}
+}
+
+// TtyStatus 返回app终端的状态，终端没有运行时返回false
+func (m *WSManager) TtyStatus(app string) (TtyStatus, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	s, ok := m.ttys[app]
+	if !ok {
+		return TtyStatus{}, false
+	}
+	status := TtyStatus{
+		App:     app,
+		Cols:    s.cols,
+		Rows:    s.rows,
+		Created: s.created,
+		Clients: make([]HubClient, 0, len(s.clients)),
+	}
+	if s.writer != nil {
+		status.Writer = s.writer.id
+	}
+	for c := range s.clients {
+		status.Clients = append(status.Clients, HubClient{
+			Id:       c.id,
+			Remote:   c.conn.RemoteAddr().String(),
+			Mode:     c.mode,
+			Observer: c != s.writer,
+			Since:    c.since,
+		})
+	}
+	sort.Slice(status.Clients, func(i, j int) bool {
+		return status.Clients[i].Since.Before(status.Clients[j].Since)
+	})
+	return status, true
+}
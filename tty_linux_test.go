@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"hostctl_proxy/internal/pty"
+)
+
+// 终端的输出，pump和测试在不同的goroutine中访问
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// 在pty中启动命令并交给m管理，测试结束时结束进程
+func startTty(t *testing.T, m *WSManager, app string, out io.Writer, args ...string) {
+	t.Helper()
+	cmd := exec.Command(args[0], args[1:]...)
+	master, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	m.openTty(app, master, out)
+}
+
+// 不读取输入的app写满终端后超时，不影响其他终端
+func TestWriteTtyTimeout(t *testing.T) {
+	m := NewWebsocketManager()
+	out := &lockedBuffer{}
+	startTty(t, m, "stuck", nil, "sleep", "10")
+	startTty(t, m, "cat", out, "cat")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.WriteTty("stuck", bytes.Repeat([]byte("xxxxxxx\n"), 1<<17), 300*time.Millisecond)
+		done <- err
+	}()
+	if _, err := m.WriteTty("cat", []byte("ping\n"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "output of cat", func() bool { return bytes.Contains(out.Bytes(), []byte("ping")) })
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("WriteTty = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WriteTty to a tty that is not read did not time out")
+	}
+}
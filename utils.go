@@ -4,87 +4,26 @@ import (
 	//"fmt"
 
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 
+	"hostctl_proxy/cmdctrl"
 	"hostctl_proxy/internal/command"
+	"hostctl_proxy/internal/config"
 )
 
-type PortsManager struct {
-	rl   sync.RWMutex
-	pool map[string]int
-}
-
-func NewPortsManager() *PortsManager {
-	return &PortsManager{
-		pool: make(map[string]int),
-	}
-}
-
-func (manager *PortsManager) Exists(name string) bool {
-	manager.rl.RLock()
-	defer manager.rl.RUnlock()
-	_, ok := manager.pool[name]
-	return ok
-}
-
-func (manager *PortsManager) Register(name string, port int) error {
-	if manager.Exists(name) {
-		return fmt.Errorf("%s is already existed", name)
-	}
-	manager.rl.RLock()
-	defer manager.rl.RUnlock()
-
-	manager.pool[name] = port
-	return nil
-}
-
-func (manager *PortsManager) Deregister(name string) error {
-	if !manager.Exists(name) {
-		return fmt.Errorf("%s not found", name)
-	}
-
-	manager.rl.RLock()
-	defer manager.rl.RUnlock()
-	delete(manager.pool, name)
-	return nil
-}
-
-func (manager *PortsManager) GetRamPort() (*net.TCPListener, error) {
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", 0))
-	if err != nil {
-		return nil, err
-	}
-
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	return l, nil
-}
-
-func (manager *PortsManager) GetSocketPort(name string) (int, error) {
-	if !manager.Exists(name) {
-		return 0, fmt.Errorf("%s not found", name)
-	}
-
-	manager.rl.RLock()
-	defer manager.rl.RUnlock()
-	return manager.pool[name], nil
-}
-
 func CmdKill(pid uint32, force bool) error {
 	var c command.Command
 	var args []string
@@ -153,12 +92,106 @@ func GetLogFile() (*os.File, error) {
 }
 
 func GetSocketUrl(name string) (string, error) {
-	port, err := sockpManager.GetSocketPort(name)
+	return sockpManager.GetSocketUrl(name)
+}
+
+// socket app的端口或unix socket能连接上才算ready，其他app运行即ready
+func appReadyCheck(appName string, appCfg *config.AppCfg) func(*cmdctrl.CommandInfo) error {
+	if !appCfg.Socket {
+		return nil
+	}
+	return func(*cmdctrl.CommandInfo) error {
+		socketUrl, err := GetSocketUrl(appName)
+		if err != nil {
+			return err
+		}
+		conn, err := dialSocket(socketUrl, 500*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// RunCommand 运行command配置中的命令并返回输出，args为空时使用default_args
+// 配置了模板的命令只接受params，渲染后不经过shell直接运行
+func RunCommand(name string, args []string, params map[string]interface{}, timeout time.Duration) (string, error) {
+	cmdCfg, ok := serverConfig.GetConfig("command", name).(*config.CmdCfg)
+	if !ok {
+		return "", fmt.Errorf("%w: command %s", config.ErrNotFound, name)
+	}
+	cmd := command.Command{Timeout: timeout}
+	if cmdCfg.Templated() {
+		if len(args) > 0 {
+			return "", fmt.Errorf("%w: command %s takes params instead of args", config.ErrField, name)
+		}
+		values, err := cmdCfg.ResolveParams(params)
+		if err != nil {
+			return "", err
+		}
+		program, err := command.SplitArgs(cmdCfg.Cmd)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", config.ErrField, err)
+		}
+		rendered, err := command.Render(cmdCfg.Template, values)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", config.ErrField, err)
+		}
+		cmd.Args = append(program, rendered...)
+	} else {
+		if len(params) > 0 {
+			return "", fmt.Errorf("%w: command %s has no params", config.ErrField, name)
+		}
+		if len(args) == 0 {
+			args = cmdCfg.DefaultArgs
+		}
+		cmd.Args = append([]string{cmdCfg.Cmd}, args...)
+		cmd.Shell = true
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return strings.TrimSpace(string(output)), NewHttpError(http.StatusInternalServerError, ErrCodeCommandFailed, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// RunLimitedCommand 按并发限制排队后运行命令，返回排队的时间
+func RunLimitedCommand(ctx context.Context, name string, args []string, params map[string]interface{}, timeout time.Duration) (string, time.Duration, error) {
+	waited, release, err := limitManager.Command(ctx, name)
 	if err != nil {
-		return "", err
+		return "", 0, err
+	}
+	defer release()
+	output, err := RunCommand(name, args, params, timeout)
+	return output, waited, err
+}
+
+// RunAppAction 启动、停止或重启app，重启时没有运行的app直接启动
+func RunAppAction(action, name string, args []string) error {
+	switch action {
+	case config.ScheduleStart:
+		return appManager.Start(name, args...)
+	case config.ScheduleStop:
+		sessionManager.Close(name)
+		return appManager.Stop(name, true)
+	case config.ScheduleRestart:
+		sessionManager.Close(name)
+		if err := appManager.Stop(name, true); err != nil && !errors.Is(err, cmdctrl.ErrAlreadyStopped) {
+			return err
+		}
+		return appManager.Start(name, args...)
+	default:
+		return fmt.Errorf("%w: invalid app action %q", config.ErrField, action)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	socketUrl := fmt.Sprintf("localhost:%v", port)
-	return socketUrl, nil
+	return false
 }
 
 func AppoutJsonSerialize(data interface{}) (interface{}, error) {
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"hostctl_proxy/cmdctrl"
-	"hostctl_proxy/internal/config"
 	"errors"
 	"fmt"
-	"net"
+	"hostctl_proxy/cmdctrl"
+	"hostctl_proxy/internal/config"
+	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/yusufpapurcu/wmi"
@@ -52,19 +53,19 @@ func SearchProcess(kw string, v interface{}) ([]uint32, error) {
 
 func ConvertAppConfig(appName string, appCfg *config.AppCfg) (cmdctrl.CommandInfo, error) {
 	cmdInfo := cmdctrl.CommandInfo{
-		MaxRetries: appCfg.MaxRetries,
-		Shell:      appCfg.Shell,
+		MaxRetries:   appCfg.MaxRetries,
+		Shell:        appCfg.Shell,
+		DependsOn:    appCfg.DependsOn,
+		ReadyCheck:   appReadyCheck(appName, appCfg),
+		ReadyTimeout: time.Duration(appCfg.ReadyTimeout) * time.Second,
 		ArgsFunc: func(args ...string) ([]string, error) {
 			var cmdArgs []string
 			if appCfg.Socket {
-				l, err := sockpManager.GetRamPort()
+				portArgs, err := socketPortArgs(appName, appCfg)
 				if err != nil {
 					return nil, err
 				}
-				defer l.Close()
-				port := l.Addr().(*net.TCPAddr).Port
-				sockpManager.Register(appName, port)
-				cmdArgs = []string{appCfg.Executor, appCfg.RootPath, "--server", "localhost", fmt.Sprintf("%v", port)}
+				cmdArgs = append([]string{appCfg.Executor, appCfg.RootPath}, portArgs...)
 			} else {
 				cmdArgs = []string{appCfg.Executor, appCfg.RootPath}
 			}
@@ -75,8 +76,10 @@ func ConvertAppConfig(appName string, appCfg *config.AppCfg) (cmdctrl.CommandInf
 				return append(cmdArgs, args...), nil
 			}
 		},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		EnvironFunc: socketPortEnv(appName, appCfg),
+		OpenStdin:   appCfg.Stdin && !appCfg.Pty,
+		Stdout:      io.MultiWriter(os.Stdout, outputManager.Get(appName)),
+		Stderr:      io.MultiWriter(os.Stderr, outputManager.Get(appName)),
 		OnStart: func(ci *cmdctrl.CommandInfo) error {
 			logger.AppLog("info", "starting", appName, strings.Join(ci.Args, ", "))
 			logger.AppLog("info", "starting", appName, "Start app successfully")
@@ -109,6 +112,10 @@ func ConvertAppConfig(appName string, appCfg *config.AppCfg) (cmdctrl.CommandInf
 			}
 		}
 	}
+	cmdInfo.OnStop = releasePortOnStop(appName, cmdInfo.OnStop)
+	if appCfg.Pty {
+		cmdInfo.Launch = ptyLauncher(appName, cmdInfo.Stdout)
+	}
 	return cmdInfo, nil
 }
 
@@ -1,26 +1,68 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"hostctl_proxy/internal/codec"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// 等待客户端pong的时间，超过后认为连接已断开
+	pongWait = 60 * time.Second
+	// 发送ping的周期，需要小于pongWait
+	pingPeriod = pongWait * 9 / 10
+	writeWait  = 10 * time.Second
+	// 关闭时等待客户端回复close frame的时间
+	closeWait = time.Second
+
+	readBufferSize = 4096
+	// 每个客户端待发送消息的数量上限
+	writeQueueSize = 256
+	// 每个hub待发给app的输入的数量上限，满了之后客户端的读取等待
+	inputQueueSize = 64
+)
+
+// websocket的消息类型，auto时合法的utf-8文本用text frame，其他用binary frame
+const (
+	WSModeAuto   = "auto"
+	WSModeText   = "text"
+	WSModeBinary = "binary"
+)
+
 type NotifyEvent struct {
 	client  *WSClient
+	mtype   int // websocket消息类型，Bye!Bye!为0
 	message []byte
 }
 
+type WSMessage struct {
+	Type int
+	Data []byte
+}
+
 // 一个WSClient对应一次websocket connection
 type WSClient struct {
 	id      int64           // id暂时没用
 	conn    *websocket.Conn // 连接指针
 	manager *WSManager      // manager
-	wch     chan []byte     // 写通道
+	wch     chan WSMessage  // 写通道
+	done    chan struct{}   // 连接移除后关闭
+	once    sync.Once
+	mode    string // 发给客户端的消息类型
+	// 最后一个客户端断开时给socket发送Bye!Bye!，只在原来的文本模式下使用
+	bye      bool
+	hub      *LinkHub
+	tty      *TtySession // 连接的是pty app的终端时不加入hub
+	observer bool        // 只读客户端，输入不会发给app
+	since    time.Time
 }
 
 func NewWSClient(wconn *websocket.Conn, manager *WSManager) *WSClient {
@@ -29,8 +71,56 @@ func NewWSClient(wconn *websocket.Conn, manager *WSManager) *WSClient {
 		id:      now.UnixNano() + int64(rand.Int()),
 		conn:    wconn,
 		manager: manager,
-		wch:     make(chan []byte),
+		wch:     make(chan WSMessage, writeQueueSize),
+		done:    make(chan struct{}),
+		mode:    WSModeAuto,
+		bye:     true,
+		since:   now,
+	}
+}
+
+// 把消息交给WriteMsg发送，连接已经移除时丢弃
+func (c *WSClient) send(msg WSMessage) bool {
+	select {
+	case c.wch <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// 写通道满时不等待，广播时使用
+func (c *WSClient) trySend(msg WSMessage) bool {
+	select {
+	case c.wch <- msg:
+		return true
+	case <-c.done:
+		return false
+	default:
+		return false
+	}
+}
+
+// Close 向客户端发送close frame，之后连接由ReadMsg移除
+func (c *WSClient) Close(code int, reason string) {
+	// close frame的reason不能超过123字节
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.send(WSMessage{Type: websocket.CloseMessage, Data: websocket.FormatCloseMessage(code, reason)})
+}
+
+func (c *WSClient) messageType(data []byte) int {
+	switch c.mode {
+	case WSModeText:
+		return websocket.TextMessage
+	case WSModeBinary:
+		return websocket.BinaryMessage
+	}
+	if utf8.Valid(data) {
+		return websocket.TextMessage
 	}
+	return websocket.BinaryMessage
 }
 
 // 读取客户端的信息
@@ -39,38 +129,59 @@ func (c *WSClient) ReadMsg() {
 		logger.WebSocketLog("info", c.conn, "Websocket disconnect")
 		c.manager.RmWSClient(c)
 	}()
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		_, data, err := c.conn.ReadMessage()
+		// text和binary frame都原样转发给socket
+		mtype, data, err := c.conn.ReadMessage()
 		if err != nil {
-			c.manager.notifyChan <- NotifyEvent{client: c, message: []byte("Bye!Bye!")}
-			logger.WebSocketLog("error", c.conn, fmt.Sprintf("Failed to read from connection, %v", err))
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				logger.WebSocketLog("info", c.conn, fmt.Sprintf("Websocket closed by client, code: %d, reason: %s", closeErr.Code, closeErr.Text))
+			} else {
+				logger.WebSocketLog("error", c.conn, fmt.Sprintf("Failed to read from connection, %v", err))
+			}
+			// Bye!Bye!由最后一个客户端离开hub时发送
 			break
 		}
-		c.manager.notifyChan <- NotifyEvent{client: c, message: data}
+		if err := c.manager.NotifySock(NotifyEvent{client: c, mtype: mtype, message: data}); err != nil {
+			// 发送失败时关闭websocket，避免客户端以为消息已经送达
+			go c.Close(websocket.CloseInternalServerErr, err.Error())
+		}
 	}
 }
 
 // 给客户端发信息
 func (c *WSClient) WriteMsg() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		logger.WebSocketLog("info", c.conn, "Websocket disconnect")
 		c.manager.RmWSClient(c)
 	}()
-	// 如果绑定了socket client则需要使用RealtimeReadPump
-	if sc, ok := c.manager.sclients[c]; ok {
-		go sc.RealtimeReadPump(c)
-	}
-
 	for {
 		select {
-		case data, ok := <-c.wch:
-			if !ok {
-				logger.WebSocketLog("error", c.conn, "Message channel closed, exiting handler")
-			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		case msg := <-c.wch:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(msg.Type, msg.Data); err != nil {
 				logger.WebSocketLog("error", c.conn, fmt.Sprintf("Failed to send to connection, %v", err))
 				return
 			}
+			if msg.Type == websocket.CloseMessage {
+				// 等待客户端回复close frame，ReadMsg收到后移除连接
+				c.conn.SetReadDeadline(time.Now().Add(closeWait))
+				<-c.done
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				logger.WebSocketLog("error", c.conn, fmt.Sprintf("Failed to ping connection, %v", err))
+				return
+			}
+		case <-c.done:
+			return
 		}
 	}
 }
@@ -82,69 +193,74 @@ type SocketClient struct {
 	conn  *net.Conn
 	url   string
 	ctype string // 暂时用不着
+	// 设置codec时按分帧收发消息，否则原样转发读到的数据
+	codec  codec.Codec
+	reader *codec.Reader
 }
 
-func NewSocket(tp, socketUrl string) (*SocketClient, error) {
-	conn, err := net.Dial("tcp", socketUrl)
+func NewSocket(tp, app, socketUrl string, c codec.Codec) (*SocketClient, error) {
+	conn, err := dialLink(app, linkKindWebsocket, socketUrl)
 	if err != nil {
 		return nil, err
 	}
-	return &SocketClient{
+	sc := &SocketClient{
 		conn:  &conn,
 		url:   socketUrl,
 		ctype: tp,
-	}, nil
+		codec: c,
+	}
+	if c != nil {
+		sc.reader = codec.NewReader(conn)
+	}
+	return sc, nil
 }
 
-// 向server发送消息
+// 向server发送消息，app没有读取时最多等待writeWait
 func (sc *SocketClient) WritePump(input []byte) error {
-	if _, err := (*sc.conn).Write(input); err != nil {
+	if err := (*sc.conn).SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		logger.SocketLog("error", sc.url, fmt.Sprintf("Failed to set write deadline: %v", err))
+		return err
+	}
+	var err error
+	if sc.codec != nil {
+		err = sc.codec.Encode(*sc.conn, input)
+	} else {
+		_, err = (*sc.conn).Write(input)
+	}
+	if err != nil {
 		logger.SocketLog("error", sc.url, fmt.Sprintf("Failed to send message to server: %v", err))
 		return err
 	}
 	return nil
 }
 
-// 接收server的消息
+// 接收server的消息，只返回实际读到的数据
 func (sc *SocketClient) ReadPump() ([]byte, error) {
-	output := make([]byte, 1024)
-	if _, err := (*sc.conn).Read(output); err != nil {
-		return nil, err
+	if sc.codec != nil {
+		return sc.codec.Decode(sc.reader)
 	}
-	return output, nil
-}
-
-// 实时接收server的消息
-func (sc *SocketClient) RealtimeReadPump(c *WSClient) {
-	defer func() {
-		logger.SocketLog("info", sc.url, "Socket disconnected")
-		(*sc.conn).Close()
-	}()
-
-	for {
-		output, err := sc.ReadPump()
-		if err != nil {
-			logger.SocketLog("error", sc.url, fmt.Sprintf("Failed to receive message from server: %v", err))
-			c.wch <- nil
-			break
-		}
-		c.wch <- output
+	output := make([]byte, readBufferSize)
+	n, err := (*sc.conn).Read(output)
+	if n > 0 {
+		// 出错前读到的数据先返回，错误在下一次读取时返回
+		return output[:n], nil
 	}
+	return nil, err
 }
 
 // 用于管理websocket连接
 type WSManager struct {
-	wsclients    map[*WSClient]bool          // 已注册的websocket connection
-	sclients     map[*WSClient]*SocketClient // websocket对应的socket client，如果有的话
-	sync.RWMutex                             // 互斥锁
-	notifyChan   chan NotifyEvent            // 通知channel
+	wsclients    map[*WSClient]bool     // 已注册的websocket connection
+	hubs         map[string]*LinkHub    // 每个socket app的hub
+	ttys         map[string]*TtySession // 每个pty app的终端
+	sync.RWMutex                        // 互斥锁
 }
 
 func NewWebsocketManager() *WSManager {
 	return &WSManager{
-		wsclients:  make(map[*WSClient]bool),
-		sclients:   make(map[*WSClient]*SocketClient),
-		notifyChan: make(chan NotifyEvent),
+		wsclients: make(map[*WSClient]bool),
+		hubs:      make(map[string]*LinkHub),
+		ttys:      make(map[string]*TtySession),
 	}
 }
 
@@ -152,71 +268,63 @@ func NewWebsocketManager() *WSManager {
 // 一般在客户端断开连接后使用
 // 使用时需要加互斥锁，防止goroutine之间竞争
 func (m *WSManager) RmWSClient(client *WSClient) {
-	m.RLock()
-	defer m.RUnlock()
+	m.Lock()
+	defer m.Unlock()
 	if _, ok := m.wsclients[client]; ok {
-		// 如果该websocket connection有socket client时，需要先关闭socket client
-		if sc, ok := m.sclients[client]; ok {
-			(*sc.conn).Close()
-			delete(m.sclients, client)
-		}
+		// 离开hub，最后一个客户端离开时关闭socket client
+		m.leave(client)
 		client.conn.Close()
+		client.once.Do(func() {
+			close(client.done)
+		})
 		delete(m.wsclients, client)
 	}
 }
 
-// 注册新的websocket connection
-func (m *WSManager) AddWSClient(client *WSClient) {
+// 向所有websocket connection发送close frame后断开
+// 服务停止时使用
+func (m *WSManager) CloseAll(code int, reason string) {
 	m.RLock()
-	defer m.RUnlock()
-	m.wsclients[client] = true
-}
+	clients := make([]*WSClient, 0, len(m.wsclients))
+	for client := range m.wsclients {
+		clients = append(clients, client)
+	}
+	m.RUnlock()
 
-// 移除websocket connection对应的socket client
-// 至于为什么不把socket conn直接放WSClient结构体中
-// 为了降低结构体之间的耦合程度
-func (m *WSManager) RmSockClient(c *WSClient) {
-	m.RLock()
-	defer m.RUnlock()
-	if sc, ok := m.sclients[c]; ok {
-		(*sc.conn).Close()
-		delete(m.sclients, c)
+	msg := websocket.FormatCloseMessage(code, reason)
+	for _, client := range clients {
+		if err := client.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+			logger.WebSocketLog("error", client.conn, fmt.Sprintf("Failed to send close frame, %v", err))
+		}
+		m.RmWSClient(client)
 	}
 }
 
-// 为websocket connection注册新的socket client
-func (m *WSManager) AddSockClient(c *WSClient, tp, socketUrl string) error {
-	m.RLock()
-	defer m.RUnlock()
-	sc, err := NewSocket(tp, socketUrl)
-	if err != nil {
-		return err
-	}
-	m.sclients[c] = sc
-	return nil
+// 注册新的websocket connection
+func (m *WSManager) AddWSClient(client *WSClient) {
+	m.Lock()
+	defer m.Unlock()
+	m.wsclients[client] = true
 }
 
-// websocket connection和socket client建立绑定关系后
-// websocket 的消息通过此方法发给socket client
+// websocket connection加入hub后
+// websocket 的消息通过此方法交给hub的写协程，由它发给socket client
+// 观察者和非controller的输入会被丢弃
 func (m *WSManager) NotifySock(evt NotifyEvent) error {
 	client := evt.client
-	msg := evt.message
-	if sc, ok := m.sclients[client]; ok {
-		if err := sc.WritePump(msg); err != nil {
-			return err
-		}
-		return nil
-	} else {
-		return fmt.Errorf("%#v has not bind any socket client", client)
+	if client.tty != nil {
+		return m.notifyTty(evt)
 	}
-}
-
-// manager的通信线程
-func (m *WSManager) Run() {
-	for {
-		select {
-		case e := <-m.notifyChan:
-			m.NotifySock(e)
-		}
+	m.RLock()
+	hub := client.hub
+	writable := hub != nil && hub.writable(client)
+	m.RUnlock()
+	if hub == nil {
+		return fmt.Errorf("%#v has not joined any link hub", client)
+	}
+	if !writable {
+		logger.WebSocketLog("warning", client.conn, fmt.Sprintf("Input dropped, client is not allowed to write to %s", hub.app))
+		return nil
 	}
+	return hub.enqueue(evt)
 }
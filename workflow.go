@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"hostctl_proxy/internal/config"
+	"hostctl_proxy/internal/expect"
+)
+
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+const (
+	StepPending = "pending"
+	StepRunning = "running"
+	StepOk      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+const (
+	// 保留的job数，超过时删除最早结束的
+	maxWorkflowJobs = 50
+	// 步骤结果中保留的输出长度
+	stepOutputSize = 4096
+
+	defaultCommandStepTimeout = 10 * time.Minute
+	defaultAppStepTimeout     = time.Minute
+	defaultStepRetryDelay     = time.Second
+)
+
+var (
+	ErrWorkflowRunning = errors.New("workflow is running")
+	ErrJobFinished     = errors.New("job is finished")
+	ErrStepTimeout     = errors.New("step timeout")
+)
+
+// BodyWorkflow 运行工作流的请求，vars覆盖工作流配置中的默认值
+type BodyWorkflow struct {
+	Vars map[string]string `json:"vars"`
+}
+
+type WorkflowStepResult struct {
+	Step     int        `json:"step"`
+	Name     string     `json:"name,omitempty"`
+	Type     string     `json:"type"`
+	State    string     `json:"state"`
+	Attempts int        `json:"attempts,omitempty"`
+	Start    *time.Time `json:"start,omitempty"`
+	Duration float64    `json:"duration"` // 秒
+	Output   string     `json:"output,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// WorkflowJob 工作流的一次运行，steps与配置中的步骤一一对应
+type WorkflowJob struct {
+	Id       string               `json:"id"`
+	Workflow string               `json:"workflow"`
+	State    string               `json:"state"`
+	Started  time.Time            `json:"started"`
+	Finished *time.Time           `json:"finished,omitempty"`
+	Vars     map[string]string    `json:"vars"`
+	Steps    []WorkflowStepResult `json:"steps"`
+	Error    string               `json:"error,omitempty"` // 第一个导致失败的步骤的错误
+}
+
+// WorkflowJob的字段由WorkflowManager的锁保护
+type workflowJob struct {
+	WorkflowJob
+	cfg    config.WorkflowCfg
+	cancel context.CancelFunc
+	tokens []string // 调用者的租约，每一步运行前检查
+}
+
+// WorkflowManager 在后台运行工作流，同一个工作流同时只能有一个job
+type WorkflowManager struct {
+	rl      sync.RWMutex
+	jobs    map[string]*workflowJob
+	order   []string          // 按创建顺序的job id
+	running map[string]string // 工作流名称到运行中的job id
+	seq     uint64
+}
+
+func NewWorkflowManager() *WorkflowManager {
+	return &WorkflowManager{
+		jobs:    make(map[string]*workflowJob),
+		running: make(map[string]string),
+	}
+}
+
+// Run 创建job并在后台运行，返回job的初始状态
+// 步骤用到的app、串口和命令配置了lock时，tokens中需要有这些资源的租约
+func (m *WorkflowManager) Run(name string, vars map[string]string, tokens []string) (WorkflowJob, error) {
+	wfCfg, ok := serverConfig.GetConfig("workflow", name).(*config.WorkflowCfg)
+	if !ok {
+		return WorkflowJob{}, fmt.Errorf("%w: workflow %s", config.ErrNotFound, name)
+	}
+	for i, st := range wfCfg.Steps {
+		if err := lockManager.Check(lockResource(stepLockTarget(st)), tokens); err != nil {
+			return WorkflowJob{}, fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	if id, ok := m.running[name]; ok {
+		return WorkflowJob{}, fmt.Errorf("%w: %s, job %s", ErrWorkflowRunning, name, id)
+	}
+	m.seq++
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &workflowJob{
+		WorkflowJob: WorkflowJob{
+			Id:       fmt.Sprintf("%s-%d", name, m.seq),
+			Workflow: name,
+			State:    JobRunning,
+			Started:  time.Now(),
+			Vars:     make(map[string]string, len(wfCfg.Vars)+len(vars)),
+			Steps:    make([]WorkflowStepResult, len(wfCfg.Steps)),
+		},
+		cfg:    *wfCfg,
+		cancel: cancel,
+		tokens: tokens,
+	}
+	for k, v := range wfCfg.Vars {
+		job.Vars[k] = v
+	}
+	for k, v := range vars {
+		job.Vars[k] = v
+	}
+	for i, st := range wfCfg.Steps {
+		job.Steps[i] = WorkflowStepResult{Step: i + 1, Name: st.Name, Type: st.Type, State: StepPending}
+	}
+	m.jobs[job.Id] = job
+	m.order = append(m.order, job.Id)
+	m.running[name] = job.Id
+	m.trim()
+	logger.SysLog("info", "running workflow", fmt.Sprintf("%s: job %s started", name, job.Id))
+	go m.execute(ctx, job)
+	return job.snapshot(), nil
+}
+
+// 删除超出数量的已经结束的job，调用前需要持有m的锁
+func (m *WorkflowManager) trim() {
+	excess := len(m.order) - maxWorkflowJobs
+	if excess <= 0 {
+		return
+	}
+	kept := m.order[:0]
+	for _, id := range m.order {
+		if excess > 0 && m.jobs[id].State != JobRunning {
+			delete(m.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+// 调用前需要持有m的锁
+func (job *workflowJob) snapshot() WorkflowJob {
+	s := job.WorkflowJob
+	s.Vars = make(map[string]string, len(job.Vars))
+	for k, v := range job.Vars {
+		s.Vars[k] = v
+	}
+	s.Steps = append([]WorkflowStepResult(nil), job.Steps...)
+	return s
+}
+
+// 按顺序执行步骤，失败后只执行when为failure或always的步骤，取消后跳过剩下的步骤
+func (m *WorkflowManager) execute(ctx context.Context, job *workflowJob) {
+	failed := false
+	for i, st := range job.cfg.Steps {
+		run := ctx.Err() == nil
+		switch st.When {
+		case "", config.WhenSuccess:
+			run = run && !failed
+		case config.WhenFailure:
+			run = run && failed
+		}
+		if !run {
+			m.rl.Lock()
+			job.Steps[i].State = StepSkipped
+			m.rl.Unlock()
+			continue
+		}
+
+		start := time.Now()
+		m.rl.Lock()
+		job.Steps[i].State = StepRunning
+		job.Steps[i].Start = &start
+		vars := make(map[string]string, len(job.Vars))
+		for k, v := range job.Vars {
+			vars[k] = v
+		}
+		m.rl.Unlock()
+
+		output, captures, err := m.runStep(ctx, job, i, st, vars)
+		if err != nil {
+			logger.SysLog("error", "running workflow", fmt.Sprintf("job %s step %d: %v", job.Id, i+1, err))
+		}
+
+		m.rl.Lock()
+		sr := &job.Steps[i]
+		sr.Duration = time.Since(start).Seconds()
+		sr.Output = output
+		if len(output) > stepOutputSize {
+			sr.Output = output[len(output)-stepOutputSize:]
+		}
+		if err != nil {
+			sr.State = StepFailed
+			sr.Error = err.Error()
+			if !st.ContinueOnError && !failed {
+				failed = true
+				job.Error = fmt.Sprintf("step %d: %v", i+1, err)
+			}
+		} else {
+			sr.State = StepOk
+			if st.Name != "" {
+				job.Vars[st.Name] = output
+			}
+			for k, v := range captures {
+				job.Vars[k] = v
+			}
+		}
+		m.rl.Unlock()
+	}
+
+	m.rl.Lock()
+	defer m.rl.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		job.State = JobCanceled
+	case failed:
+		job.State = JobFailed
+	default:
+		job.State = JobSucceeded
+	}
+	finished := time.Now()
+	job.Finished = &finished
+	job.cancel()
+	delete(m.running, job.Workflow)
+	logger.SysLog("info", "running workflow", fmt.Sprintf("%s: job %s %s", job.Workflow, job.Id, job.State))
+}
+
+// 执行一个步骤，失败时按retries重试
+func (m *WorkflowManager) runStep(ctx context.Context, job *workflowJob, i int, st config.WorkflowStep, vars map[string]string) (string, map[string]string, error) {
+	delay := defaultStepRetryDelay
+	if st.RetryDelay > 0 {
+		delay = time.Duration(st.RetryDelay) * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		m.rl.Lock()
+		job.Steps[i].Attempts = attempt
+		m.rl.Unlock()
+		// 租约可能在job运行期间到期或被释放
+		if err := lockManager.Check(lockResource(stepLockTarget(st)), job.tokens); err != nil {
+			return "", nil, err
+		}
+		output, captures, err := runWorkflowStep(ctx, st, vars)
+		if err == nil || attempt > st.Retries || ctx.Err() != nil {
+			return output, captures, err
+		}
+		logger.SysLog("warning", "running workflow", fmt.Sprintf("job %s step %d attempt %d: %v, retrying", job.Id, i+1, attempt, err))
+		select {
+		case <-ctx.Done():
+			return output, captures, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// 步骤操作的app、串口或命令，用于查找需要的lock资源
+func stepLockTarget(st config.WorkflowStep) (string, string) {
+	switch {
+	case st.Type == config.StepCommand:
+		return "command", st.Command
+	case st.App != "":
+		return "app", st.App
+	}
+	return "", ""
+}
+
+func runWorkflowStep(ctx context.Context, st config.WorkflowStep, vars map[string]string) (string, map[string]string, error) {
+	timeout := time.Duration(st.Timeout) * time.Millisecond
+	args := make([]string, 0, len(st.Args))
+	for _, arg := range st.Args {
+		v, err := expect.Expand(arg, vars)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, v)
+	}
+	params := make(map[string]interface{}, len(st.Params))
+	for k, raw := range st.Params {
+		if s, ok := raw.(string); ok {
+			v, err := expect.Expand(s, vars)
+			if err != nil {
+				return "", nil, err
+			}
+			raw = v
+		}
+		params[k] = raw
+	}
+
+	switch st.Type {
+	case config.StepCommand:
+		if timeout <= 0 {
+			timeout = defaultCommandStepTimeout
+		}
+		output, err := runWithContext(ctx, timeout, func() (string, error) {
+			output, _, err := RunLimitedCommand(ctx, st.Command, args, params, timeout)
+			return output, err
+		})
+		return output, nil, err
+	case config.StepApp:
+		if timeout <= 0 {
+			timeout = defaultAppStepTimeout
+		}
+		_, err := runWithContext(ctx, timeout, func() (string, error) {
+			return "", RunAppAction(st.Action, st.App, args)
+		})
+		return "", nil, err
+	case config.StepWait:
+		if st.App == "" && st.Proxy == "" {
+			select {
+			case <-ctx.Done():
+				return "", nil, ctx.Err()
+			case <-time.After(time.Duration(st.Duration) * time.Millisecond):
+				return "", nil, nil
+			}
+		}
+		fallthrough
+	case config.StepSend:
+		body := &BodyExpect{
+			App:   st.App,
+			Proxy: st.Proxy,
+			Script: expect.Script{
+				Steps: []expect.Step{{Send: st.Data, Expect: st.Expect, Fail: st.Fail}},
+				Vars:  vars,
+				// Script.Timeout为0时使用expect的默认超时
+				Timeout: st.Timeout,
+			},
+		}
+		res, err := RunExpect(ctx, body)
+		if err != nil {
+			return "", nil, err
+		}
+		sr := res.Transcript[0]
+		if !res.Ok {
+			return sr.Output, nil, errors.New(sr.Error)
+		}
+		return strings.TrimSpace(sr.Output), sr.Capture, nil
+	default:
+		return "", nil, fmt.Errorf("%w: invalid step type %q", config.ErrField, st.Type)
+	}
+}
+
+// 在后台执行fn，超时或取消时不再等待，fn自己的超时由调用方控制
+func runWithContext(ctx context.Context, timeout time.Duration, fn func() (string, error)) (string, error) {
+	type result struct {
+		output string
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		output, err := fn()
+		ch <- result{output, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.output, res.err
+	case <-timer.C:
+		return "", fmt.Errorf("%w: not finished in %v", ErrStepTimeout, timeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Job 返回job的状态和每一步的结果
+func (m *WorkflowManager) Job(id string) (WorkflowJob, error) {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return WorkflowJob{}, NotFound("job not found: %s", id)
+	}
+	return job.snapshot(), nil
+}
+
+// Jobs 返回保留的job，最近的在前，workflow不为空时只返回该工作流的
+func (m *WorkflowManager) Jobs(workflow string) []WorkflowJob {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	jobs := make([]WorkflowJob, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		job := m.jobs[m.order[i]]
+		if workflow == "" || job.Workflow == workflow {
+			jobs = append(jobs, job.snapshot())
+		}
+	}
+	return jobs
+}
+
+// Cancel 取消运行中的job，正在执行的命令不会被中断，但不再等待它的结果
+func (m *WorkflowManager) Cancel(id string) error {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return NotFound("job not found: %s", id)
+	}
+	if job.State != JobRunning {
+		return fmt.Errorf("%w: %s is %s", ErrJobFinished, id, job.State)
+	}
+	job.cancel()
+	logger.SysLog("info", "canceling workflow", fmt.Sprintf("%s: job %s is canceled", job.Workflow, id))
+	return nil
+}
+
+// CancelAll 取消所有运行中的job，服务停止时使用
+func (m *WorkflowManager) CancelAll() {
+	m.rl.RLock()
+	defer m.rl.RUnlock()
+	for _, id := range m.running {
+		m.jobs[id].cancel()
+	}
+}
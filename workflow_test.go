@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"hostctl_proxy/internal/config"
+)
+
+// 与Run一样创建job，不读取serverConfig中的工作流配置
+func newTestJob(m *WorkflowManager, name string, steps ...config.WorkflowStep) (*workflowJob, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &workflowJob{
+		WorkflowJob: WorkflowJob{
+			Id:       name + "-1",
+			Workflow: name,
+			State:    JobRunning,
+			Vars:     map[string]string{},
+			Steps:    make([]WorkflowStepResult, len(steps)),
+		},
+		cfg:    config.WorkflowCfg{Steps: steps},
+		cancel: cancel,
+	}
+	for i, st := range steps {
+		job.Steps[i] = WorkflowStepResult{Step: i + 1, Name: st.Name, Type: st.Type, State: StepPending}
+	}
+	m.rl.Lock()
+	m.jobs[job.Id] = job
+	m.order = append(m.order, job.Id)
+	m.running[name] = job.Id
+	m.rl.Unlock()
+	return job, ctx
+}
+
+func TestWorkflowExecute(t *testing.T) {
+	m := NewWorkflowManager()
+	job, ctx := newTestJob(m, "steps",
+		config.WorkflowStep{Name: "first", Type: config.StepWait, Duration: 1},
+		// 重试后仍然失败，但不影响后面的步骤
+		config.WorkflowStep{Type: "nope", Retries: 2, RetryDelay: 1, ContinueOnError: true},
+		config.WorkflowStep{Type: config.StepWait, Args: []string{"${missing}"}},
+		config.WorkflowStep{Type: config.StepWait, Duration: 1},
+		config.WorkflowStep{Type: config.StepWait, Duration: 1, When: config.WhenFailure},
+		config.WorkflowStep{Type: config.StepWait, Duration: 1, When: config.WhenAlways},
+	)
+	m.execute(ctx, job)
+
+	got, err := m.Job(job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		state    string
+		attempts int
+	}{
+		{StepOk, 1},
+		{StepFailed, 3},
+		{StepFailed, 1},
+		{StepSkipped, 0},
+		{StepOk, 1},
+		{StepOk, 1},
+	}
+	for i, w := range want {
+		if sr := got.Steps[i]; sr.State != w.state || sr.Attempts != w.attempts {
+			t.Errorf("step %d: %s after %d attempts, want %s after %d", i+1, sr.State, sr.Attempts, w.state, w.attempts)
+		}
+	}
+	if !strings.Contains(got.Steps[1].Error, "invalid step type") {
+		t.Errorf("step 2 error: %q", got.Steps[1].Error)
+	}
+	if got.State != JobFailed || got.Error != "step 3: undefined variable missing" {
+		t.Errorf("job %s: %q", got.State, got.Error)
+	}
+	if v, ok := got.Vars["first"]; !ok || v != "" {
+		t.Errorf("vars: %v", got.Vars)
+	}
+	if got.Finished == nil || len(m.running) != 0 {
+		t.Errorf("job still running: %v", m.running)
+	}
+}
+
+// 取消后正在执行的步骤失败，剩下的步骤包括always都跳过
+func TestWorkflowCancel(t *testing.T) {
+	m := NewWorkflowManager()
+	job, ctx := newTestJob(m, "cancel",
+		config.WorkflowStep{Type: config.StepWait, Duration: 60000},
+		config.WorkflowStep{Type: config.StepWait, Duration: 1, When: config.WhenAlways},
+	)
+	done := make(chan struct{})
+	go func() {
+		m.execute(ctx, job)
+		close(done)
+	}()
+	waitFor(t, "step running", func() bool {
+		got, _ := m.Job(job.Id)
+		return got.Steps[0].State == StepRunning
+	})
+	if err := m.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	got, _ := m.Job(job.Id)
+	if got.State != JobCanceled || got.Steps[0].State != StepFailed || got.Steps[1].State != StepSkipped {
+		t.Errorf("job %s, steps %+v", got.State, got.Steps)
+	}
+	if err := m.Cancel(job.Id); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("cancel finished job: %v", err)
+	}
+}